@@ -7,6 +7,7 @@ import (
 	"path/filepath"
 	"sync"
 	"syscall"
+	"time"
 
 	"github.com/BurntSushi/toml"
 	"github.com/judwhite/go-svc/svc"
@@ -48,6 +49,7 @@ func nsqadminFlagSet(opts *nsqadmin.Options) *flag.FlagSet {
 	flagSet.String("http-client-tls-root-ca-file", "", "path to CA file for the HTTP client")
 	flagSet.String("http-client-tls-cert", "", "path to certificate file for the HTTP client")
 	flagSet.String("http-client-tls-key", "", "path to key file for the HTTP client")
+	flagSet.Duration("http-client-tls-reload-interval", time.Minute, "how often to check the HTTP client TLS files for changes to reload them (0 to disable)")
 
 	flagSet.String("allow-config-from-cidr", opts.AllowConfigFromCIDR, "A CIDR from which to allow HTTP requests to the /config endpoint")
 	flagSet.String("acl-http-header", opts.AclHttpHeader, "HTTP header to check for authenticated admin users")
@@ -56,6 +58,7 @@ func nsqadminFlagSet(opts *nsqadmin.Options) *flag.FlagSet {
 	flagSet.Var(&nsqlookupdHTTPAddresses, "lookupd-http-address", "lookupd HTTP address (may be given multiple times)")
 	nsqdHTTPAddresses := app.StringArray{}
 	flagSet.Var(&nsqdHTTPAddresses, "nsqd-http-address", "nsqd HTTP address (may be given multiple times)")
+	flagSet.String("nsqd-auth-secret", "", "secret sent to nsqd with the topic and channel actions, needed when nsqd has auth enabled")
 	adminUsers := app.StringArray{}
 	flagSet.Var(&adminUsers, "admin-user", "admin user (may be given multiple times; if specified, only these users will be able to perform privileged actions; acl-http-header is used to determine the authenticated user)")
 
@@ -5,6 +5,7 @@ import (
 	"fmt"
 	"math/rand"
 	"os"
+	"os/signal"
 	"path/filepath"
 	"sync"
 	"syscall"
@@ -79,6 +80,7 @@ func (p *program) Start() error {
 		logFatal("failed to instantiate nsqd - %s", err)
 	}
 	p.nsqd = nsqd
+	p.nsqd.SetConfigLoader(configLoader(configFile))
 
 	//读取元数据 nsqd.dat
 	err = p.nsqd.LoadMetadata()
@@ -91,6 +93,16 @@ func (p *program) Start() error {
 		logFatal("failed to persist metadata - %s", err)
 	}
 
+	// SIGHUP reloads the config, like POST /config/reload
+	hupChan := make(chan os.Signal, 1)
+	signal.Notify(hupChan, syscall.SIGHUP)
+	go func() {
+		for range hupChan {
+			// the outcome is logged by nsqd
+			p.nsqd.Reload()
+		}
+	}()
+
 	go func() {
 		//主逻辑,阻塞
 		err := p.nsqd.Main()
@@ -111,6 +123,32 @@ func (p *program) Stop() error {
 	return nil
 }
 
+// configLoader returns the function that resolves the options again from
+// the command line flags and the config file, for reloads
+func configLoader(configFile string) func() (*nsqd.Options, error) {
+	return func() (*nsqd.Options, error) {
+		opts := nsqd.NewOptions()
+
+		flagSet := nsqdFlagSet(opts)
+		flagSet.Parse(os.Args[1:])
+
+		var cfg config
+		if configFile != "" {
+			_, err := toml.DecodeFile(configFile, &cfg)
+			if err != nil {
+				return nil, fmt.Errorf("failed to load config file %s - %s", configFile, err)
+			}
+		}
+		err := cfg.validate()
+		if err != nil {
+			return nil, err
+		}
+
+		options.Resolve(opts, flagSet, cfg)
+		return opts, nil
+	}
+}
+
 func logFatal(f string, args ...interface{}) {
 	lg.LogFatal("[nsqd] ", f, args...)
 }
@@ -67,6 +67,13 @@ type config map[string]interface{}
 
 // Validate settings in the config file, and fatal on errors
 func (cfg config) Validate() {
+	err := cfg.validate()
+	if err != nil {
+		logFatal("%s", err)
+	}
+}
+
+func (cfg config) validate() error {
 	// special validation/translation
 	if v, exists := cfg["tls_required"]; exists {
 		var t tlsRequiredOption
@@ -74,7 +81,7 @@ func (cfg config) Validate() {
 		if err == nil {
 			cfg["tls_required"] = t.String()
 		} else {
-			logFatal("failed parsing tls_required %+v", v)
+			return fmt.Errorf("failed parsing tls_required %+v", v)
 		}
 	}
 	if v, exists := cfg["tls_min_version"]; exists {
@@ -88,9 +95,10 @@ func (cfg config) Validate() {
 				delete(cfg, "tls_min_version")
 			}
 		} else {
-			logFatal("failed parsing tls_min_version %+v", v)
+			return fmt.Errorf("failed parsing tls_min_version %+v", v)
 		}
 	}
+	return nil
 }
 
 func nsqdFlagSet(opts *nsqd.Options) *flag.FlagSet {
@@ -113,6 +121,7 @@ func nsqdFlagSet(opts *nsqd.Options) *flag.FlagSet {
 	flagSet.String("tcp-address", opts.TCPAddress, "<addr>:<port> to listen on for TCP clients")
 	authHTTPAddresses := app.StringArray{}
 	flagSet.Var(&authHTTPAddresses, "auth-http-address", "<addr>:<port> to query auth server (may be given multiple times)")
+	flagSet.String("auth-file", opts.AuthFile, "path to a JSON file of secrets and their authorizations (instead of --auth-http-address)")
 	flagSet.String("broadcast-address", opts.BroadcastAddress, "address that will be registered with lookupd (defaults to the OS hostname)")
 	lookupdTCPAddrs := app.StringArray{}
 	flagSet.Var(&lookupdTCPAddrs, "lookupd-tcp-address", "lookupd TCP address (may be given multiple times)")
@@ -125,6 +134,16 @@ func nsqdFlagSet(opts *nsqd.Options) *flag.FlagSet {
 	flagSet.Int64("max-bytes-per-file", opts.MaxBytesPerFile, "number of bytes per diskqueue file before rolling")
 	flagSet.Int64("sync-every", opts.SyncEvery, "number of messages per diskqueue fsync")
 	flagSet.Duration("sync-timeout", opts.SyncTimeout, "duration of time per diskqueue fsync")
+	flagSet.Int64("priority-mem-queue-size", opts.PriorityMemQueueSize, "number of messages of each priority (1-3) to keep in memory (per channel)")
+	flagSet.Int64("max-purged-msgs", opts.MaxPurgedMsgs, "number of messages deleted from the disk queue of a channel that are skipped once read (per channel)")
+	flagSet.String("inflight-durability", opts.InFlightDurability, "journaling of in-flight and deferred messages so they survive nsqd being killed ('none', 'interval', 'write' or 'sync')")
+	flagSet.Duration("inflight-flush-interval", opts.InFlightFlushInterval, "duration of time per in-flight journal write (with --inflight-durability=interval)")
+
+	// backend queue options
+	flagSet.String("backend-queue", opts.BackendQueue, "default backend queue for messages that overflow the memory queue ('diskqueue' or 'memory')")
+	backendQueueSuffixes := app.StringArray{}
+	flagSet.Var(&backendQueueSuffixes, "backend-queue-suffix", "<suffix>=<backend queue> to use for topics (and their channels) whose name ends in <suffix> (may be given multiple times)")
+	flagSet.Int64("mem-backend-queue-size", opts.MemBackendQueueSize, "number of messages kept by the 'memory' backend queue (per topic/channel) before dropping the oldest")
 
 	flagSet.Int("queue-scan-worker-pool-max", opts.QueueScanWorkerPoolMax, "max concurrency for checking in-flight and deferred message timeouts")
 	flagSet.Int("queue-scan-selection-count", opts.QueueScanSelectionCount, "number of channels to check per cycle (every 100ms) for in-flight and deferred timeouts")
@@ -134,7 +153,12 @@ func nsqdFlagSet(opts *nsqd.Options) *flag.FlagSet {
 	flagSet.Duration("max-msg-timeout", opts.MaxMsgTimeout, "maximum duration before a message will timeout")
 	flagSet.Int64("max-msg-size", opts.MaxMsgSize, "maximum size of a single message in bytes")
 	flagSet.Duration("max-req-timeout", opts.MaxReqTimeout, "maximum requeuing timeout for a message")
+	flagSet.Duration("max-schedule-ahead", opts.MaxScheduleAhead, "maximum time ahead a message can be scheduled for delivery (deliver_at)")
 	flagSet.Int64("max-body-size", opts.MaxBodySize, "maximum size of a single command body")
+	flagSet.Int64("max-headers-size", opts.MaxHeadersSize, "maximum size of the headers of a single message in bytes")
+	flagSet.Uint("max-attempts", uint(opts.MaxAttempts), "default number of delivery attempts before a message is moved to the <topic>.dead_letter topic (0 = unlimited)")
+	flagSet.Duration("dedup-window", opts.DedupWindow, "default duration a topic remembers publish idempotency keys (0 = disabled)")
+	flagSet.Int("max-dedup-keys", opts.MaxDedupKeys, "maximum number of idempotency keys remembered per topic (oldest are forgotten first)")
 
 	// client overridable configuration options
 	flagSet.Duration("max-heartbeat-interval", opts.MaxHeartbeatInterval, "maximum client configurable duration of time between client heartbeats")
@@ -145,6 +169,12 @@ func nsqdFlagSet(opts *nsqd.Options) *flag.FlagSet {
 	flagSet.Duration("output-buffer-timeout", opts.OutputBufferTimeout, "default duration of time between flushing data to clients")
 	flagSet.Int("max-channel-consumers", opts.MaxChannelConsumers, "maximum channel consumer connection count per nsqd instance (default 0, i.e., unlimited)")
 
+	// publish rate limits
+	flagSet.Int64("pub-rate-limit", opts.PubRateLimit, "maximum messages/sec published to this nsqd (0 = unlimited)")
+	flagSet.Int64("pub-byte-rate-limit", opts.PubByteRateLimit, "maximum bytes/sec published to this nsqd (0 = unlimited)")
+	flagSet.Int64("client-pub-rate-limit", opts.ClientPubRateLimit, "maximum messages/sec published by each client identity (auth identity, or IP) (0 = unlimited)")
+	flagSet.Int64("client-pub-byte-rate-limit", opts.ClientPubByteRateLimit, "maximum bytes/sec published by each client identity (auth identity, or IP) (0 = unlimited)")
+
 	// statsd integration options
 	flagSet.String("statsd-address", opts.StatsdAddress, "UDP <addr>:<port> of a statsd daemon for pushing stats")
 	flagSet.Duration("statsd-interval", opts.StatsdInterval, "duration between pushing to statsd")
@@ -166,11 +196,15 @@ func nsqdFlagSet(opts *nsqd.Options) *flag.FlagSet {
 	tlsMinVersion := tlsMinVersionOption(opts.TLSMinVersion)
 	flagSet.Var(&tlsRequired, "tls-required", "require TLS for client connections (true, false, tcp-https)")
 	flagSet.Var(&tlsMinVersion, "tls-min-version", "minimum SSL/TLS version acceptable ('ssl3.0', 'tls1.0', 'tls1.1', or 'tls1.2')")
+	flagSet.Duration("tls-reload-interval", opts.TLSReloadInterval, "how often to check the TLS cert, key and root CA files for changes to reload them (0 to disable)")
 
 	// compression
 	flagSet.Bool("deflate", opts.DeflateEnabled, "enable deflate feature negotiation (client compression)")
 	flagSet.Int("max-deflate-level", opts.MaxDeflateLevel, "max deflate compression level a client can negotiate (> values == > nsqd CPU usage)")
 	flagSet.Bool("snappy", opts.SnappyEnabled, "enable snappy feature negotiation (client compression)")
 
+	// message headers
+	flagSet.Bool("headers", opts.HeadersEnabled, "enable message headers feature negotiation")
+
 	return flagSet
 }
@@ -11,6 +11,7 @@ import (
 	"github.com/BurntSushi/toml"
 	"github.com/judwhite/go-svc/svc"
 	"github.com/mreiferson/go-options"
+	"github.com/nsqio/nsq/internal/app"
 	"github.com/nsqio/nsq/internal/lg"
 	"github.com/nsqio/nsq/internal/version"
 	"github.com/nsqio/nsq/nsqlookupd"
@@ -42,6 +43,13 @@ func nsqlookupdFlagSet(opts *nsqlookupd.Options) *flag.FlagSet {
 
 	flagSet.Duration("inactive-producer-timeout", opts.InactiveProducerTimeout, "duration of time a producer will remain in the active list since its last ping")
 	flagSet.Duration("tombstone-lifetime", opts.TombstoneLifetime, "duration of time a producer will remain tombstoned if registration remains")
+	flagSet.Int("consumer-subset-size", opts.ConsumerSubsetSize, "default number of producers returned by /lookup for a consumer (see the consumer param)")
+
+	flagSet.String("data-path", opts.DataPath, "path to persist created topics/channels and tombstones across restarts (disabled if empty)")
+	peerHTTPAddrs := app.StringArray{}
+	flagSet.Var(&peerHTTPAddrs, "peer-http-address", "peer nsqlookupd HTTP address to sync state with (may be given multiple times)")
+	flagSet.Duration("sync-interval", opts.SyncInterval, "duration of time between syncs of state with peers")
+	flagSet.Duration("deletion-lifetime", opts.DeletionLifetime, "duration of time a deleted topic/channel is remembered, to be synced to peers")
 
 	return flagSet
 }
@@ -37,13 +37,16 @@ func (a *Authorization) HasPermission(permission string) bool {
 
 func (a *Authorization) IsAllowed(topic, channel string) bool {
 	if channel != "" {
-		if !a.HasPermission("subscribe") {
-			return false
-		}
-	} else {
-		if !a.HasPermission("publish") {
-			return false
-		}
+		return a.IsAllowedTo("subscribe", topic, channel)
+	}
+	return a.IsAllowedTo("publish", topic, channel)
+}
+
+// IsAllowedTo checks permission on topic and channel, an "admin" permission
+// on a topic (i.e. with an empty channel) doesn't depend on the channels
+func (a *Authorization) IsAllowedTo(permission, topic, channel string) bool {
+	if !a.HasPermission(permission) {
+		return false
 	}
 
 	topicRegex := regexp.MustCompile(a.Topic)
@@ -52,6 +55,10 @@ func (a *Authorization) IsAllowed(topic, channel string) bool {
 		return false
 	}
 
+	if permission == "admin" && channel == "" {
+		return true
+	}
+
 	for _, c := range a.Channels {
 		channelRegex := regexp.MustCompile(c)
 		if channelRegex.MatchString(channel) {
@@ -70,6 +77,15 @@ func (a *State) IsAllowed(topic, channel string) bool {
 	return false
 }
 
+func (a *State) IsAllowedTo(permission, topic, channel string) bool {
+	for _, aa := range a.Authorizations {
+		if aa.IsAllowedTo(permission, topic, channel) {
+			return true
+		}
+	}
+	return false
+}
+
 func (a *State) IsExpired() bool {
 	if a.Expires.Before(time.Now()) {
 		return true
@@ -114,30 +130,39 @@ func QueryAuthd(authd string, remoteIP string, tlsEnabled bool, commonName strin
 	}
 
 	// validation on response
-	for _, auth := range authState.Authorizations {
+	if err := authState.validate(); err != nil {
+		return nil, err
+	}
+
+	authState.Expires = time.Now().Add(time.Duration(authState.TTL) * time.Second)
+	return &authState, nil
+}
+
+// validate checks that the permissions are known and the topic and channel
+// patterns compile
+func (a *State) validate() error {
+	for _, auth := range a.Authorizations {
 		for _, p := range auth.Permissions {
 			switch p {
-			case "subscribe", "publish":
+			case "subscribe", "publish", "admin":
 			default:
-				return nil, fmt.Errorf("unknown permission %s", p)
+				return fmt.Errorf("unknown permission %s", p)
 			}
 		}
 
 		if _, err := regexp.Compile(auth.Topic); err != nil {
-			return nil, fmt.Errorf("unable to compile topic %q %s", auth.Topic, err)
+			return fmt.Errorf("unable to compile topic %q %s", auth.Topic, err)
 		}
 
 		for _, channel := range auth.Channels {
 			if _, err := regexp.Compile(channel); err != nil {
-				return nil, fmt.Errorf("unable to compile channel %q %s", channel, err)
+				return fmt.Errorf("unable to compile channel %q %s", channel, err)
 			}
 		}
 	}
 
-	if authState.TTL <= 0 {
-		return nil, fmt.Errorf("invalid TTL %d (must be >0)", authState.TTL)
+	if a.TTL <= 0 {
+		return fmt.Errorf("invalid TTL %d (must be >0)", a.TTL)
 	}
-
-	authState.Expires = time.Now().Add(time.Duration(authState.TTL) * time.Second)
-	return &authState, nil
+	return nil
 }
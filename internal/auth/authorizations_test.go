@@ -0,0 +1,68 @@
+package auth
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/nsqio/nsq/internal/test"
+)
+
+func TestIsAllowedTo(t *testing.T) {
+	state := &State{Authorizations: []Authorization{
+		{Topic: "^orders$", Channels: []string{".*"}, Permissions: []string{"publish"}},
+		{Topic: "^orders$", Channels: []string{"^archive$"}, Permissions: []string{"subscribe", "admin"}},
+	}}
+
+	test.Equal(t, true, state.IsAllowed("orders", ""))
+	test.Equal(t, true, state.IsAllowed("orders", "archive"))
+	test.Equal(t, false, state.IsAllowed("orders", "other"))
+
+	test.Equal(t, true, state.IsAllowedTo("publish", "orders", ""))
+	test.Equal(t, false, state.IsAllowedTo("publish", "other", ""))
+	test.Equal(t, true, state.IsAllowedTo("admin", "orders", ""))
+	test.Equal(t, true, state.IsAllowedTo("admin", "orders", "archive"))
+	test.Equal(t, false, state.IsAllowedTo("admin", "orders", "other"))
+	test.Equal(t, false, state.IsAllowedTo("admin", "other", ""))
+
+	test.Nil(t, (&State{TTL: 1, Authorizations: state.Authorizations}).validate())
+}
+
+func TestCache(t *testing.T) {
+	c := NewCache()
+	var queries int
+	query := func(ttl time.Duration) func() (*State, error) {
+		return func() (*State, error) {
+			queries++
+			return &State{Expires: time.Now().Add(ttl)}, nil
+		}
+	}
+
+	_, err := c.Query("127.0.0.1", false, "", "secret", query(time.Minute))
+	test.Nil(t, err)
+	_, err = c.Query("127.0.0.1", false, "", "secret", query(time.Minute))
+	test.Nil(t, err)
+	test.Equal(t, 1, queries)
+
+	// the key includes the client properties
+	_, err = c.Query("127.0.0.2", false, "", "secret", query(time.Minute))
+	test.Nil(t, err)
+	_, err = c.Query("127.0.0.1", true, "", "secret", query(time.Minute))
+	test.Nil(t, err)
+	test.Equal(t, 3, queries)
+
+	// expired states and errors aren't reused
+	_, err = c.Query("127.0.0.1", false, "", "other", query(-time.Second))
+	test.Nil(t, err)
+	_, err = c.Query("127.0.0.1", false, "", "other", func() (*State, error) {
+		queries++
+		return nil, errors.New("unavailable")
+	})
+	test.NotNil(t, err)
+	test.Equal(t, 5, queries)
+
+	c.Purge()
+	_, err = c.Query("127.0.0.1", false, "", "secret", query(time.Minute))
+	test.Nil(t, err)
+	test.Equal(t, 6, queries)
+}
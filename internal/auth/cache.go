@@ -0,0 +1,78 @@
+package auth
+
+import (
+	"sync"
+	"time"
+)
+
+// maxCacheEntries bounds the number of states a Cache holds, as its keys
+// come from untrusted clients
+const maxCacheEntries = 10000
+
+// Cache holds the states returned for each secret (and the client
+// properties sent along with it) until they expire, so that requests that
+// don't keep a connection (i.e. HTTP) don't query the auth server each time
+type Cache struct {
+	sync.Mutex
+	states map[cacheKey]*State
+}
+
+type cacheKey struct {
+	remoteIP   string
+	tlsEnabled bool
+	commonName string
+	secret     string
+}
+
+func NewCache() *Cache {
+	return &Cache{
+		states: make(map[cacheKey]*State),
+	}
+}
+
+// Query returns the cached state for the given client and secret, calling
+// query (and caching its result) if there is none or it expired
+func (c *Cache) Query(remoteIP string, tlsEnabled bool, commonName string, secret string,
+	query func() (*State, error)) (*State, error) {
+	k := cacheKey{remoteIP, tlsEnabled, commonName, secret}
+
+	c.Lock()
+	state, ok := c.states[k]
+	c.Unlock()
+	if ok && !state.IsExpired() {
+		return state, nil
+	}
+
+	state, err := query()
+	if err != nil {
+		return nil, err
+	}
+
+	c.Lock()
+	if len(c.states) >= maxCacheEntries {
+		c.purgeExpired()
+	}
+	if len(c.states) >= maxCacheEntries {
+		c.states = make(map[cacheKey]*State)
+	}
+	c.states[k] = state
+	c.Unlock()
+	return state, nil
+}
+
+// Purge drops all the cached states
+func (c *Cache) Purge() {
+	c.Lock()
+	c.states = make(map[cacheKey]*State)
+	c.Unlock()
+}
+
+// this expects the caller to handle locking
+func (c *Cache) purgeExpired() {
+	now := time.Now()
+	for k, state := range c.states {
+		if state.Expires.Before(now) {
+			delete(c.states, k)
+		}
+	}
+}
@@ -0,0 +1,106 @@
+package auth
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"sync"
+	"time"
+)
+
+// defaultFileTTL is the TTL of the states of an auth file that doesn't set
+// one, i.e. how often clients pick up changes to the file
+const defaultFileTTL = 60
+
+// File is an auth backend reading the authorizations of each secret from a
+// local JSON file, instead of querying an auth server:
+//
+//	{
+//	  "ttl": 60,
+//	  "secrets": {
+//	    "<secret>": {
+//	      "identity": "...",
+//	      "identity_url": "...",
+//	      "authorizations": [
+//	        {"topic": "...", "channels": ["..."], "permissions": ["subscribe", "publish"]}
+//	      ]
+//	    }
+//	  }
+//	}
+//
+// the authorizations have the same topic/channel regex and permission
+// model as the responses of an auth server
+type File struct {
+	sync.RWMutex
+
+	path    string
+	secrets map[string]State
+}
+
+type fileDoc struct {
+	TTL     int              `json:"ttl"`
+	Secrets map[string]State `json:"secrets"`
+}
+
+// LoadFile reads the auth file at path
+func LoadFile(path string) (*File, error) {
+	f := &File{path: path}
+	err := f.Reload()
+	if err != nil {
+		return nil, err
+	}
+	return f, nil
+}
+
+// Path returns the path the file was loaded from
+func (f *File) Path() string {
+	return f.path
+}
+
+// Reload re-reads the file, the current secrets are kept if it's invalid
+func (f *File) Reload() error {
+	data, err := ioutil.ReadFile(f.path)
+	if err != nil {
+		return fmt.Errorf("failed to read auth file %s - %s", f.path, err)
+	}
+
+	var doc fileDoc
+	err = json.Unmarshal(data, &doc)
+	if err != nil {
+		return fmt.Errorf("failed to parse auth file %s - %s", f.path, err)
+	}
+	if doc.TTL == 0 {
+		doc.TTL = defaultFileTTL
+	}
+
+	secrets := make(map[string]State, len(doc.Secrets))
+	for secret, state := range doc.Secrets {
+		if secret == "" {
+			return fmt.Errorf("invalid auth file %s - empty secret", f.path)
+		}
+		state.TTL = doc.TTL
+		err := state.validate()
+		if err != nil {
+			return fmt.Errorf("invalid auth file %s - %s", f.path, err)
+		}
+		secrets[secret] = state
+	}
+
+	f.Lock()
+	f.secrets = secrets
+	f.Unlock()
+	return nil
+}
+
+// Query returns the authorizations of secret, like QueryAnyAuthd does
+func (f *File) Query(secret string) (*State, error) {
+	f.RLock()
+	state, ok := f.secrets[secret]
+	f.RUnlock()
+	if !ok {
+		return nil, errors.New("unknown secret")
+	}
+	state.Expires = time.Now().Add(time.Duration(state.TTL) * time.Second)
+	return &state, nil
+}
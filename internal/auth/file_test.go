@@ -0,0 +1,67 @@
+package auth
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/nsqio/nsq/internal/test"
+)
+
+func TestFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "auth-file")
+	test.Nil(t, err)
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "auth.json")
+
+	err = ioutil.WriteFile(path, []byte(`{"secrets":{
+		"pub":{"identity":"publisher","authorizations":[
+			{"topic":"^orders$","channels":[".*"],"permissions":["publish"]}]},
+		"sub":{"identity":"consumer","authorizations":[
+			{"topic":".*","channels":["^archive$"],"permissions":["subscribe"]}]}
+	}}`), 0644)
+	test.Nil(t, err)
+
+	f, err := LoadFile(path)
+	test.Nil(t, err)
+
+	state, err := f.Query("pub")
+	test.Nil(t, err)
+	test.Equal(t, "publisher", state.Identity)
+	test.Equal(t, defaultFileTTL, state.TTL)
+	test.Equal(t, false, state.IsExpired())
+	test.Equal(t, true, state.Expires.Before(time.Now().Add(time.Duration(defaultFileTTL)*time.Second)))
+	test.Equal(t, true, state.IsAllowed("orders", ""))
+	test.Equal(t, false, state.IsAllowed("orders", "archive"))
+	test.Equal(t, false, state.IsAllowed("other", ""))
+
+	state, err = f.Query("sub")
+	test.Nil(t, err)
+	test.Equal(t, true, state.IsAllowed("orders", "archive"))
+	test.Equal(t, false, state.IsAllowed("orders", ""))
+
+	_, err = f.Query("unknown")
+	test.NotNil(t, err)
+
+	// an invalid file is rejected and the current secrets are kept
+	err = ioutil.WriteFile(path, []byte(`{"secrets":{"pub":{"authorizations":[
+		{"topic":"orders","channels":[".*"],"permissions":["delete"]}]}}}`), 0644)
+	test.Nil(t, err)
+	test.NotNil(t, f.Reload())
+	_, err = f.Query("sub")
+	test.Nil(t, err)
+
+	err = ioutil.WriteFile(path, []byte(`{"ttl":5,"secrets":{"new":{"authorizations":[]}}}`), 0644)
+	test.Nil(t, err)
+	test.Nil(t, f.Reload())
+	_, err = f.Query("sub")
+	test.NotNil(t, err)
+	state, err = f.Query("new")
+	test.Nil(t, err)
+	test.Equal(t, 5, state.TTL)
+
+	_, err = LoadFile(filepath.Join(dir, "missing.json"))
+	test.NotNil(t, err)
+}
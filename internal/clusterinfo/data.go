@@ -8,6 +8,7 @@ import (
 	"strconv"
 	"strings"
 	"sync"
+	"time"
 
 	"github.com/blang/semver"
 	"github.com/nsqio/nsq/internal/http_api"
@@ -37,15 +38,24 @@ func (l ErrList) Errors() []error {
 type ClusterInfo struct {
 	log    lg.AppLogFunc
 	client *http_api.Client
+	// the client of the nsqd topic and channel actions, see SetNSQDAuthSecret
+	nsqdClient *http_api.Client
 }
 
 func New(log lg.AppLogFunc, client *http_api.Client) *ClusterInfo {
 	return &ClusterInfo{
-		log:    log,
-		client: client,
+		log:        log,
+		client:     client,
+		nsqdClient: client,
 	}
 }
 
+// SetNSQDAuthSecret sets the secret sent to nsqd with the topic and channel
+// actions (and peeks), which nsqd requires when it has auth enabled
+func (c *ClusterInfo) SetNSQDAuthSecret(secret string) {
+	c.nsqdClient = c.client.WithAuthSecret(secret)
+}
+
 func (c *ClusterInfo) logf(f string, args ...interface{}) {
 	if c.log != nil {
 		c.log(lg.INFO, f, args...)
@@ -627,6 +637,58 @@ func (c *ClusterInfo) GetNSQDStats(producers Producers,
 	return topicStatsList, channelStatsMap, nil
 }
 
+// PeekChannel returns (up to) the next n messages queued in the given
+// channel on each of the given producers, without consuming them
+func (c *ClusterInfo) PeekChannel(producers Producers, topicName string, channelName string, n int) ([]*PeekedMessage, error) {
+	var lock sync.Mutex
+	var wg sync.WaitGroup
+	var msgs []*PeekedMessage
+	var errs []error
+
+	type respType struct {
+		Messages []*PeekedMessage `json:"messages"`
+	}
+
+	for _, p := range producers {
+		wg.Add(1)
+		go func(p *Producer) {
+			defer wg.Done()
+
+			addr := p.HTTPAddress()
+			endpoint := fmt.Sprintf("http://%s/channel/peek?topic=%s&channel=%s&n=%d",
+				addr, url.QueryEscape(topicName), url.QueryEscape(channelName), n)
+			c.logf("CI: querying nsqd %s", endpoint)
+
+			var resp respType
+			err := c.nsqdClient.GETV1(endpoint, &resp)
+			lock.Lock()
+			defer lock.Unlock()
+			if err != nil {
+				errs = append(errs, err)
+				return
+			}
+			for _, m := range resp.Messages {
+				m.Node = addr
+				m.Hostname = p.Hostname
+			}
+			msgs = append(msgs, resp.Messages...)
+		}(p)
+	}
+	wg.Wait()
+
+	if len(errs) > 0 && len(errs) == len(producers) {
+		return nil, fmt.Errorf("Failed to query any nsqd: %s", ErrList(errs))
+	}
+
+	// by node, keeping the order of each
+	sort.SliceStable(msgs, func(i, j int) bool { return msgs[i].Hostname < msgs[j].Hostname })
+
+	if len(errs) > 0 {
+		return msgs, ErrList(errs)
+	}
+	return msgs, nil
+}
+
 // TombstoneNodeForTopic tombstones the given node for the given topic on all the given nsqlookupd
 // and deletes the topic from the node
 func (c *ClusterInfo) TombstoneNodeForTopic(topic string, node string, lookupdHTTPAddrs []string) error {
@@ -802,8 +864,10 @@ func (c *ClusterInfo) DeleteChannel(topicName string, channelName string, lookup
 	return nil
 }
 
-func (c *ClusterInfo) PauseTopic(topicName string, lookupdHTTPAddrs []string, nsqdHTTPAddrs []string) error {
-	qs := fmt.Sprintf("topic=%s", url.QueryEscape(topicName))
+// PauseTopic pauses the given topic until resumeAt, or indefinitely if it's
+// zero
+func (c *ClusterInfo) PauseTopic(topicName string, resumeAt time.Time, lookupdHTTPAddrs []string, nsqdHTTPAddrs []string) error {
+	qs := fmt.Sprintf("topic=%s", url.QueryEscape(topicName)) + resumeAtQuery(resumeAt)
 	return c.actionHelper(topicName, lookupdHTTPAddrs, nsqdHTTPAddrs, "topic/pause", qs)
 }
 
@@ -812,11 +876,22 @@ func (c *ClusterInfo) UnPauseTopic(topicName string, lookupdHTTPAddrs []string,
 	return c.actionHelper(topicName, lookupdHTTPAddrs, nsqdHTTPAddrs, "topic/unpause", qs)
 }
 
-func (c *ClusterInfo) PauseChannel(topicName string, channelName string, lookupdHTTPAddrs []string, nsqdHTTPAddrs []string) error {
-	qs := fmt.Sprintf("topic=%s&channel=%s", url.QueryEscape(topicName), url.QueryEscape(channelName))
+// PauseChannel pauses the given channel until resumeAt, or indefinitely if
+// it's zero
+func (c *ClusterInfo) PauseChannel(topicName string, channelName string, resumeAt time.Time, lookupdHTTPAddrs []string, nsqdHTTPAddrs []string) error {
+	qs := fmt.Sprintf("topic=%s&channel=%s", url.QueryEscape(topicName), url.QueryEscape(channelName)) + resumeAtQuery(resumeAt)
 	return c.actionHelper(topicName, lookupdHTTPAddrs, nsqdHTTPAddrs, "channel/pause", qs)
 }
 
+// resumeAtQuery returns the resume_at query param of a pause, the same on
+// every node, empty for an indefinite pause
+func resumeAtQuery(resumeAt time.Time) string {
+	if resumeAt.IsZero() {
+		return ""
+	}
+	return "&resume_at=" + url.QueryEscape(resumeAt.UTC().Format(time.RFC3339Nano))
+}
+
 func (c *ClusterInfo) UnPauseChannel(topicName string, channelName string, lookupdHTTPAddrs []string, nsqdHTTPAddrs []string) error {
 	qs := fmt.Sprintf("topic=%s&channel=%s", url.QueryEscape(topicName), url.QueryEscape(channelName))
 	return c.actionHelper(topicName, lookupdHTTPAddrs, nsqdHTTPAddrs, "channel/unpause", qs)
@@ -832,6 +907,16 @@ func (c *ClusterInfo) EmptyChannel(topicName string, channelName string, lookupd
 	return c.actionHelper(topicName, lookupdHTTPAddrs, nsqdHTTPAddrs, "channel/empty", qs)
 }
 
+// TransferChannel moves (action "move") or copies (action "copy") the
+// backlog of the given channel to toChannel of toTopic, or to toTopic if
+// toChannel is empty, on each node
+func (c *ClusterInfo) TransferChannel(action string, topicName string, channelName string, toTopic string, toChannel string,
+	lookupdHTTPAddrs []string, nsqdHTTPAddrs []string) error {
+	qs := fmt.Sprintf("topic=%s&channel=%s&to_topic=%s&to_channel=%s", url.QueryEscape(topicName), url.QueryEscape(channelName),
+		url.QueryEscape(toTopic), url.QueryEscape(toChannel))
+	return c.actionHelper(topicName, lookupdHTTPAddrs, nsqdHTTPAddrs, "channel/"+action, qs)
+}
+
 func (c *ClusterInfo) actionHelper(topicName string, lookupdHTTPAddrs []string, nsqdHTTPAddrs []string, uri string, qs string) error {
 	var errs []error
 
@@ -894,7 +979,7 @@ func (c *ClusterInfo) producersPOST(pl Producers, uri string, qs string) error {
 	for _, p := range pl {
 		endpoint := fmt.Sprintf("http://%s/%s?%s", p.HTTPAddress(), uri, qs)
 		c.logf("CI: querying nsqd %s", endpoint)
-		err := c.client.POSTV1(endpoint)
+		err := c.nsqdClient.POSTV1(endpoint)
 		if err != nil {
 			errs = append(errs, err)
 		}
@@ -102,6 +102,8 @@ type TopicStats struct {
 	NodeStats    []*TopicStats   `json:"nodes"`
 	Channels     []*ChannelStats `json:"channels"`
 	Paused       bool            `json:"paused"`
+	// unix seconds, the latest of the nodes when aggregated
+	ResumeAt int64 `json:"resume_at"`
 
 	E2eProcessingLatency *quantile.E2eProcessingLatencyAggregate `json:"e2e_processing_latency"`
 }
@@ -115,6 +117,9 @@ func (t *TopicStats) Add(a *TopicStats) {
 	if a.Paused {
 		t.Paused = a.Paused
 	}
+	if a.ResumeAt > t.ResumeAt {
+		t.ResumeAt = a.ResumeAt
+	}
 	for _, aChannelStats := range a.Channels {
 		found := false
 		for _, channelStats := range t.Channels {
@@ -156,10 +161,27 @@ type ChannelStats struct {
 	NodeStats     []*ChannelStats `json:"nodes"`
 	Clients       []*ClientStats  `json:"clients"`
 	Paused        bool            `json:"paused"`
+	// unix seconds, the latest of the nodes when aggregated
+	ResumeAt int64 `json:"resume_at"`
+
+	DeadLetterCount int64 `json:"dead_letter_count"`
+	FilteredCount   int64 `json:"filtered_count"`
+
+	// the running (or last) backlog move/copy, per node
+	Transfer *TransferStats `json:"transfer,omitempty"`
 
 	E2eProcessingLatency *quantile.E2eProcessingLatencyAggregate `json:"e2e_processing_latency"`
 }
 
+type TransferStats struct {
+	Kind  string `json:"kind"`
+	To    string `json:"to"`
+	Done  int64  `json:"done"`
+	Total int64  `json:"total"`
+	State string `json:"state"`
+	Error string `json:"error,omitempty"`
+}
+
 func (c *ChannelStats) Add(a *ChannelStats) {
 	c.Node = "*"
 	c.Depth += a.Depth
@@ -171,9 +193,14 @@ func (c *ChannelStats) Add(a *ChannelStats) {
 	c.TimeoutCount += a.TimeoutCount
 	c.MessageCount += a.MessageCount
 	c.ClientCount += a.ClientCount
+	c.DeadLetterCount += a.DeadLetterCount
+	c.FilteredCount += a.FilteredCount
 	if a.Paused {
 		c.Paused = a.Paused
 	}
+	if a.ResumeAt > c.ResumeAt {
+		c.ResumeAt = a.ResumeAt
+	}
 	c.NodeStats = append(c.NodeStats, a)
 	sort.Sort(ChannelStatsByHost{c.NodeStats})
 	if c.E2eProcessingLatency == nil {
@@ -188,6 +215,20 @@ func (c *ChannelStats) Add(a *ChannelStats) {
 	sort.Sort(ClientsByHost{c.Clients})
 }
 
+// PeekedMessage is a message queued in a channel on Node, as returned by
+// nsqd's /channel/peek
+type PeekedMessage struct {
+	Node       string            `json:"node"`
+	Hostname   string            `json:"hostname"`
+	ID         string            `json:"id"`
+	Timestamp  int64             `json:"timestamp"`
+	Attempts   uint16            `json:"attempts"`
+	Priority   uint8             `json:"priority,omitempty"`
+	Headers    map[string]string `json:"headers,omitempty"`
+	Body       string            `json:"body,omitempty"`
+	BodyBase64 string            `json:"body_base64,omitempty"`
+}
+
 type ClientStats struct {
 	Node              string        `json:"node"`
 	RemoteAddress     string        `json:"remote_address"`
@@ -205,6 +246,7 @@ type ClientStats struct {
 	SampleRate        int32         `json:"sample_rate"`
 	Deflate           bool          `json:"deflate"`
 	Snappy            bool          `json:"snappy"`
+	Headers           bool          `json:"headers"`
 	Authed            bool          `json:"authed"`
 	AuthIdentity      string        `json:"auth_identity"`
 	AuthIdentityURL   string        `json:"auth_identity_url"`
@@ -31,7 +31,8 @@ func NewDeadlineTransport(connectTimeout time.Duration, requestTimeout time.Dura
 }
 
 type Client struct {
-	c *http.Client
+	c          *http.Client
+	authSecret string
 }
 
 func NewClient(tlsConfig *tls.Config, connectTimeout time.Duration, requestTimeout time.Duration) *Client {
@@ -45,6 +46,15 @@ func NewClient(tlsConfig *tls.Config, connectTimeout time.Duration, requestTimeo
 	}
 }
 
+// WithAuthSecret returns a copy of the client that sends secret (as
+// "Authorization: Bearer <secret>") with its requests
+func (c *Client) WithAuthSecret(secret string) *Client {
+	return &Client{
+		c:          c.c,
+		authSecret: secret,
+	}
+}
+
 // GETV1 is a helper function to perform a V1 HTTP request
 // and parse our NSQ daemon's expected response format, with deadlines.
 func (c *Client) GETV1(endpoint string, v interface{}) error {
@@ -55,6 +65,9 @@ retry:
 	}
 
 	req.Header.Add("Accept", "application/vnd.nsq; version=1.0")
+	if c.authSecret != "" {
+		req.Header.Add("Authorization", "Bearer "+c.authSecret)
+	}
 
 	resp, err := c.c.Do(req)
 	if err != nil {
@@ -94,6 +107,9 @@ retry:
 	}
 
 	req.Header.Add("Accept", "application/vnd.nsq; version=1.0")
+	if c.authSecret != "" {
+		req.Header.Add("Authorization", "Bearer "+c.authSecret)
+	}
 
 	resp, err := c.c.Do(req)
 	if err != nil {
@@ -0,0 +1,149 @@
+// Package metrics renders metrics in the Prometheus text exposition format
+package metrics
+
+import (
+	"bufio"
+	"io"
+	"math"
+	"strconv"
+	"strings"
+)
+
+// ContentType is the Content-Type of the rendered exposition
+const ContentType = "text/plain; version=0.0.4; charset=utf-8"
+
+type sample struct {
+	labels string
+	value  float64
+}
+
+type family struct {
+	name    string
+	help    string
+	typ     string
+	samples []sample
+}
+
+// Set collects samples, grouped by metric name in the order the names
+// were first added, so that callers can add samples while walking their
+// stats in whatever order is natural
+type Set struct {
+	families []*family
+	byName   map[string]*family
+}
+
+func NewSet() *Set {
+	return &Set{byName: make(map[string]*family)}
+}
+
+// Counter adds a sample of a monotonically increasing metric, labels are
+// given as name, value pairs
+func (s *Set) Counter(name string, help string, value float64, labels ...string) {
+	s.add("counter", name, help, value, labels)
+}
+
+// Gauge adds a sample of a metric that can go up and down, labels are
+// given as name, value pairs
+func (s *Set) Gauge(name string, help string, value float64, labels ...string) {
+	s.add("gauge", name, help, value, labels)
+}
+
+func (s *Set) add(typ string, name string, help string, value float64, labels []string) {
+	f, ok := s.byName[name]
+	if !ok {
+		f = &family{name: name, help: help, typ: typ}
+		s.byName[name] = f
+		s.families = append(s.families, f)
+	}
+	f.samples = append(f.samples, sample{formatLabels(labels), value})
+}
+
+// WriteTo writes every collected sample to w
+func (s *Set) WriteTo(w io.Writer) (int64, error) {
+	cw := &countingWriter{w: bufio.NewWriter(w)}
+	for _, f := range s.families {
+		io.WriteString(cw, "# HELP "+f.name+" "+escapeHelp(f.help)+"\n")
+		io.WriteString(cw, "# TYPE "+f.name+" "+f.typ+"\n")
+		for _, smp := range f.samples {
+			io.WriteString(cw, f.name+smp.labels+" "+formatValue(smp.value)+"\n")
+		}
+	}
+	if cw.err != nil {
+		return cw.n, cw.err
+	}
+	return cw.n, cw.w.Flush()
+}
+
+func (s *Set) String() string {
+	var b strings.Builder
+	s.WriteTo(&b)
+	return b.String()
+}
+
+type countingWriter struct {
+	w   *bufio.Writer
+	n   int64
+	err error
+}
+
+func (c *countingWriter) Write(p []byte) (int, error) {
+	if c.err != nil {
+		return 0, c.err
+	}
+	n, err := c.w.Write(p)
+	c.n += int64(n)
+	c.err = err
+	return n, err
+}
+
+func formatLabels(labels []string) string {
+	if len(labels) < 2 {
+		return ""
+	}
+	var b strings.Builder
+	b.WriteByte('{')
+	for i := 0; i+1 < len(labels); i += 2 {
+		if i > 0 {
+			b.WriteByte(',')
+		}
+		b.WriteString(labels[i])
+		b.WriteString(`="`)
+		b.WriteString(escapeLabelValue(labels[i+1]))
+		b.WriteByte('"')
+	}
+	b.WriteByte('}')
+	return b.String()
+}
+
+var (
+	labelValueReplacer = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+	helpReplacer       = strings.NewReplacer(`\`, `\\`, "\n", `\n`)
+)
+
+func escapeLabelValue(v string) string {
+	return labelValueReplacer.Replace(v)
+}
+
+func escapeHelp(v string) string {
+	return helpReplacer.Replace(v)
+}
+
+func formatValue(v float64) string {
+	switch {
+	case math.IsNaN(v):
+		return "NaN"
+	case math.IsInf(v, 1):
+		return "+Inf"
+	case math.IsInf(v, -1):
+		return "-Inf"
+	}
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
+
+// Bool returns 1 for true and 0 for false
+func Bool(b bool) float64 {
+	if b {
+		return 1
+	}
+	return 0
+}
@@ -0,0 +1,29 @@
+package metrics
+
+import (
+	"math"
+	"testing"
+
+	"github.com/nsqio/nsq/internal/test"
+)
+
+func TestSet(t *testing.T) {
+	s := NewSet()
+	s.Gauge("nsq_topic_depth", "Depth of the topic", 1, "topic", "a")
+	s.Counter("nsq_topic_messages_total", "Messages published", 10, "topic", "a")
+	s.Gauge("nsq_topic_depth", "Depth of the topic", 2.5, "topic", `b"\`+"\n")
+	s.Gauge("nsq_up", "Help with\nnewline", math.NaN())
+
+	expected := `# HELP nsq_topic_depth Depth of the topic
+# TYPE nsq_topic_depth gauge
+nsq_topic_depth{topic="a"} 1
+nsq_topic_depth{topic="b\"\\\n"} 2.5
+# HELP nsq_topic_messages_total Messages published
+# TYPE nsq_topic_messages_total counter
+nsq_topic_messages_total{topic="a"} 10
+# HELP nsq_up Help with\nnewline
+# TYPE nsq_up gauge
+nsq_up NaN
+`
+	test.Equal(t, expected, s.String())
+}
@@ -0,0 +1,236 @@
+// Package tlsreload keeps a TLS certificate and root CAs loaded from files
+// current, so that they can be rotated without a restart
+package tlsreload
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/nsqio/nsq/internal/lg"
+)
+
+// Reloader holds a certificate/key pair and a root CA pool loaded from
+// files, either of which is optional
+//
+// it's meant to be plugged into a tls.Config (see ServerConfig and
+// ClientConfig) so that every new connection uses what was last loaded
+type Reloader struct {
+	sync.RWMutex
+
+	certFile string
+	keyFile  string
+	caFile   string
+
+	cert   *tls.Certificate
+	leaf   *x509.Certificate
+	caPool *x509.CertPool
+
+	// the latest modification time of the files when they were loaded
+	modTime time.Time
+
+	logf lg.AppLogFunc
+}
+
+// New returns a Reloader with the given files loaded, certFile and keyFile
+// must both be given or both be empty, caFile can be empty
+func New(certFile string, keyFile string, caFile string, logf lg.AppLogFunc) (*Reloader, error) {
+	r := &Reloader{logf: logf}
+	err := r.Load(certFile, keyFile, caFile)
+	if err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+// Load switches to the given files, nothing changes if they fail to load
+func (r *Reloader) Load(certFile string, keyFile string, caFile string) error {
+	if (certFile == "") != (keyFile == "") {
+		return errors.New("the TLS cert and key must be given together")
+	}
+
+	var cert *tls.Certificate
+	var leaf *x509.Certificate
+	if certFile != "" {
+		c, err := tls.LoadX509KeyPair(certFile, keyFile)
+		if err != nil {
+			return fmt.Errorf("failed to load TLS cert %s, %s - %s", certFile, keyFile, err)
+		}
+		leaf, err = x509.ParseCertificate(c.Certificate[0])
+		if err != nil {
+			return fmt.Errorf("failed to parse TLS cert %s - %s", certFile, err)
+		}
+		cert = &c
+	}
+
+	var caPool *x509.CertPool
+	if caFile != "" {
+		data, err := ioutil.ReadFile(caFile)
+		if err != nil {
+			return fmt.Errorf("failed to read TLS root CA file %s - %s", caFile, err)
+		}
+		caPool = x509.NewCertPool()
+		if !caPool.AppendCertsFromPEM(data) {
+			return fmt.Errorf("failed to append certificates from %s", caFile)
+		}
+	}
+
+	r.Lock()
+	r.certFile = certFile
+	r.keyFile = keyFile
+	r.caFile = caFile
+	r.cert = cert
+	r.leaf = leaf
+	r.caPool = caPool
+	r.modTime = latestModTime(certFile, keyFile, caFile)
+	r.Unlock()
+
+	if leaf != nil {
+		r.logf(lg.INFO, "TLS: loaded cert %s (expires %s)", certFile, leaf.NotAfter.Format(time.RFC3339))
+	}
+	return nil
+}
+
+// Reload re-reads the current files
+func (r *Reloader) Reload() error {
+	r.RLock()
+	certFile, keyFile, caFile := r.certFile, r.keyFile, r.caFile
+	r.RUnlock()
+	return r.Load(certFile, keyFile, caFile)
+}
+
+// Watch reloads the files every interval if any of them was modified,
+// until exitChan is closed
+func (r *Reloader) Watch(interval time.Duration, exitChan <-chan int) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+		case <-exitChan:
+			return
+		}
+
+		r.RLock()
+		modTime := latestModTime(r.certFile, r.keyFile, r.caFile)
+		changed := modTime.After(r.modTime)
+		r.RUnlock()
+		if !changed {
+			continue
+		}
+		err := r.Reload()
+		if err != nil {
+			// the files may be mid-update, keep the current ones
+			r.logf(lg.ERROR, "TLS: failed to reload - %s", err)
+		}
+	}
+}
+
+func latestModTime(files ...string) time.Time {
+	var latest time.Time
+	for _, fn := range files {
+		if fn == "" {
+			continue
+		}
+		fi, err := os.Stat(fn)
+		if err != nil {
+			continue
+		}
+		if fi.ModTime().After(latest) {
+			latest = fi.ModTime()
+		}
+	}
+	return latest
+}
+
+// GetCertificate is a tls.Config.GetCertificate returning the current
+// certificate
+func (r *Reloader) GetCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	r.RLock()
+	defer r.RUnlock()
+	if r.cert == nil {
+		return nil, errors.New("no TLS cert")
+	}
+	return r.cert, nil
+}
+
+// GetClientCertificate is a tls.Config.GetClientCertificate returning the
+// current certificate (or none)
+func (r *Reloader) GetClientCertificate(*tls.CertificateRequestInfo) (*tls.Certificate, error) {
+	r.RLock()
+	defer r.RUnlock()
+	if r.cert == nil {
+		return &tls.Certificate{}, nil
+	}
+	return r.cert, nil
+}
+
+// CertPool returns the current root CAs, nil if there is no CA file
+func (r *Reloader) CertPool() *x509.CertPool {
+	r.RLock()
+	defer r.RUnlock()
+	return r.caPool
+}
+
+// NotAfter returns the expiry of the current certificate, the zero time if
+// there is none
+func (r *Reloader) NotAfter() time.Time {
+	r.RLock()
+	defer r.RUnlock()
+	if r.leaf == nil {
+		return time.Time{}
+	}
+	return r.leaf.NotAfter
+}
+
+// ServerConfig sets up config to serve the current certificate and to
+// verify client certificates against the current root CAs
+func (r *Reloader) ServerConfig(config *tls.Config) *tls.Config {
+	config.GetCertificate = r.GetCertificate
+	config.GetConfigForClient = func(*tls.ClientHelloInfo) (*tls.Config, error) {
+		c := config.Clone()
+		c.GetConfigForClient = nil
+		c.ClientCAs = r.CertPool()
+		return c, nil
+	}
+	return config
+}
+
+// ClientConfig sets up config to present the current certificate and,
+// unless verification is skipped, to verify servers against the current
+// root CAs
+func (r *Reloader) ClientConfig(config *tls.Config) *tls.Config {
+	config.GetClientCertificate = r.GetClientCertificate
+	r.RLock()
+	hasCA := r.caFile != ""
+	r.RUnlock()
+	if hasCA && !config.InsecureSkipVerify {
+		// RootCAs can't be swapped on a live config, so the built-in
+		// verification is replaced by the equivalent one in verifyServer
+		config.InsecureSkipVerify = true
+		config.VerifyConnection = r.verifyServer
+	}
+	return config
+}
+
+func (r *Reloader) verifyServer(cs tls.ConnectionState) error {
+	if len(cs.PeerCertificates) == 0 {
+		return errors.New("no server certificate")
+	}
+	opts := x509.VerifyOptions{
+		DNSName:       cs.ServerName,
+		Roots:         r.CertPool(),
+		Intermediates: x509.NewCertPool(),
+	}
+	for _, cert := range cs.PeerCertificates[1:] {
+		opts.Intermediates.AddCert(cert)
+	}
+	_, err := cs.PeerCertificates[0].Verify(opts)
+	return err
+}
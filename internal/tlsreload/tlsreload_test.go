@@ -0,0 +1,101 @@
+package tlsreload
+
+import (
+	"crypto/tls"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/nsqio/nsq/internal/lg"
+	"github.com/nsqio/nsq/internal/test"
+)
+
+const certsDir = "../../nsqd/test/certs"
+
+func nilLogf(lvl lg.LogLevel, f string, args ...interface{}) {}
+
+func copyFile(t *testing.T, src string, dst string) {
+	data, err := ioutil.ReadFile(src)
+	test.Nil(t, err)
+	err = ioutil.WriteFile(dst, data, 0600)
+	test.Nil(t, err)
+}
+
+func TestReloaderWatch(t *testing.T) {
+	dir, err := ioutil.TempDir("", "tlsreload-test-")
+	test.Nil(t, err)
+	defer os.RemoveAll(dir)
+
+	certFile := filepath.Join(dir, "cert.pem")
+	keyFile := filepath.Join(dir, "key.pem")
+	copyFile(t, filepath.Join(certsDir, "server.pem"), certFile)
+	copyFile(t, filepath.Join(certsDir, "server.key"), keyFile)
+
+	r, err := New(certFile, keyFile, "", nilLogf)
+	test.Nil(t, err)
+	test.Equal(t, 2027, r.NotAfter().Year())
+	test.Nil(t, r.CertPool())
+
+	exitChan := make(chan int)
+	defer close(exitChan)
+	go r.Watch(10*time.Millisecond, exitChan)
+
+	// rotate the files in place
+	copyFile(t, filepath.Join(certsDir, "cert.pem"), certFile)
+	copyFile(t, filepath.Join(certsDir, "key.pem"), keyFile)
+	future := time.Now().Add(time.Minute)
+	os.Chtimes(certFile, future, future)
+	os.Chtimes(keyFile, future, future)
+
+	for i := 0; i < 100 && r.NotAfter().Year() != 2016; i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	test.Equal(t, 2016, r.NotAfter().Year())
+
+	// a failed reload keeps the current cert
+	err = r.Load(certFile, filepath.Join(dir, "missing.key"), "")
+	test.NotNil(t, err)
+	cert, err := r.GetCertificate(nil)
+	test.Nil(t, err)
+	test.NotNil(t, cert)
+	test.Equal(t, 2016, r.NotAfter().Year())
+
+	_, err = New(certFile, "", "", nilLogf)
+	test.NotNil(t, err)
+}
+
+func TestReloaderClientConfig(t *testing.T) {
+	server, err := New(filepath.Join(certsDir, "server.pem"), filepath.Join(certsDir, "server.key"), "", nilLogf)
+	test.Nil(t, err)
+	listener, err := tls.Listen("tcp", "127.0.0.1:0", server.ServerConfig(&tls.Config{}))
+	test.Nil(t, err)
+	defer listener.Close()
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			conn.(*tls.Conn).Handshake()
+			conn.Close()
+		}
+	}()
+
+	dial := func(caFile string) error {
+		client, err := New("", "", caFile, nilLogf)
+		test.Nil(t, err)
+		config := client.ClientConfig(&tls.Config{})
+		conn, err := tls.DialWithDialer(&net.Dialer{Timeout: time.Second}, "tcp", listener.Addr().String(), config)
+		if err != nil {
+			return err
+		}
+		conn.Close()
+		return nil
+	}
+
+	test.Nil(t, dial(filepath.Join(certsDir, "ca.pem")))
+	test.NotNil(t, dial(filepath.Join(certsDir, "cert.pem")))
+}
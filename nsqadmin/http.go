@@ -2,6 +2,7 @@ package nsqadmin
 
 import (
 	"encoding/json"
+	"errors"
 	"fmt"
 	"html/template"
 	"io"
@@ -13,6 +14,8 @@ import (
 	"net/url"
 	"path"
 	"reflect"
+	"sort"
+	"strconv"
 	"strings"
 	"time"
 
@@ -20,6 +23,7 @@ import (
 	"github.com/nsqio/nsq/internal/clusterinfo"
 	"github.com/nsqio/nsq/internal/http_api"
 	"github.com/nsqio/nsq/internal/lg"
+	"github.com/nsqio/nsq/internal/metrics"
 	"github.com/nsqio/nsq/internal/protocol"
 	"github.com/nsqio/nsq/internal/version"
 )
@@ -73,6 +77,9 @@ func NewHTTPServer(ctx *Context) *httpServer {
 		ci:       clusterinfo.New(ctx.nsqadmin.logf, client),
 		basePath: ctx.nsqadmin.getOpts().BasePath,
 	}
+	if secret := ctx.nsqadmin.getOpts().NSQDAuthSecret; secret != "" {
+		s.ci.SetNSQDAuthSecret(secret)
+	}
 
 	bp := func(p string) string {
 		return path.Join(s.basePath, p)
@@ -80,6 +87,7 @@ func NewHTTPServer(ctx *Context) *httpServer {
 
 	router.Handle("GET", bp("/"), http_api.Decorate(s.indexHandler, log))
 	router.Handle("GET", bp("/ping"), http_api.Decorate(s.pingHandler, log, http_api.PlainText))
+	router.Handle("GET", bp("/metrics"), http_api.Decorate(s.metricsHandler, log, http_api.PlainText))
 
 	router.Handle("GET", bp("/topics"), http_api.Decorate(s.indexHandler, log))
 	router.Handle("GET", bp("/topics/:topic"), http_api.Decorate(s.indexHandler, log))
@@ -101,6 +109,7 @@ func NewHTTPServer(ctx *Context) *httpServer {
 	router.Handle("GET", bp("/api/topics"), http_api.Decorate(s.topicsHandler, log, http_api.V1))
 	router.Handle("GET", bp("/api/topics/:topic"), http_api.Decorate(s.topicHandler, log, http_api.V1))
 	router.Handle("GET", bp("/api/topics/:topic/:channel"), http_api.Decorate(s.channelHandler, log, http_api.V1))
+	router.Handle("GET", bp("/api/topics/:topic/:channel/peek"), http_api.Decorate(s.channelPeekHandler, log, http_api.V1))
 	router.Handle("GET", bp("/api/nodes"), http_api.Decorate(s.nodesHandler, log, http_api.V1))
 	router.Handle("GET", bp("/api/nodes/:node"), http_api.Decorate(s.nodeHandler, log, http_api.V1))
 	router.Handle("POST", bp("/api/topics"), http_api.Decorate(s.createTopicChannelHandler, log, http_api.V1))
@@ -320,6 +329,88 @@ func (s *httpServer) channelHandler(w http.ResponseWriter, req *http.Request, ps
 	}{channelStats[channelName], maybeWarnMsg(messages)}, nil
 }
 
+func (s *httpServer) channelPeekHandler(w http.ResponseWriter, req *http.Request, ps httprouter.Params) (interface{}, error) {
+	var messages []string
+
+	// message bodies are as sensitive as the actions on the channel
+	if !s.isAuthorizedAdminRequest(req) {
+		return nil, http_api.Err{403, "FORBIDDEN"}
+	}
+
+	topicName := ps.ByName("topic")
+	channelName := ps.ByName("channel")
+
+	reqParams, err := http_api.NewReqParams(req)
+	if err != nil {
+		return nil, http_api.Err{400, "INVALID_REQUEST"}
+	}
+	n := 10
+	if ns, err := reqParams.Get("n"); err == nil {
+		n, err = strconv.Atoi(ns)
+		if err != nil || n < 1 {
+			return nil, http_api.Err{400, "INVALID_N"}
+		}
+	}
+
+	producers, err := s.ci.GetTopicProducers(topicName,
+		s.ctx.nsqadmin.getOpts().NSQLookupdHTTPAddresses,
+		s.ctx.nsqadmin.getOpts().NSQDHTTPAddresses)
+	if err != nil {
+		pe, ok := err.(clusterinfo.PartialErr)
+		if !ok {
+			s.ctx.nsqadmin.logf(LOG_ERROR, "failed to get topic producers - %s", err)
+			return nil, http_api.Err{502, fmt.Sprintf("UPSTREAM_ERROR: %s", err)}
+		}
+		s.ctx.nsqadmin.logf(LOG_WARN, "%s", err)
+		messages = append(messages, pe.Error())
+	}
+	_, channelStats, err := s.ci.GetNSQDStats(producers, topicName, channelName, false)
+	if err != nil {
+		pe, ok := err.(clusterinfo.PartialErr)
+		if !ok {
+			s.ctx.nsqadmin.logf(LOG_ERROR, "failed to get channel metadata - %s", err)
+			return nil, http_api.Err{502, fmt.Sprintf("UPSTREAM_ERROR: %s", err)}
+		}
+		s.ctx.nsqadmin.logf(LOG_WARN, "%s", err)
+		messages = append(messages, pe.Error())
+	}
+
+	// only the nodes the channel exists on
+	var channelProducers clusterinfo.Producers
+	if cs, ok := channelStats[channelName]; ok {
+		for _, p := range producers {
+			for _, ns := range cs.NodeStats {
+				if ns.Node == p.HTTPAddress() {
+					channelProducers = append(channelProducers, p)
+					break
+				}
+			}
+		}
+	}
+	if len(channelProducers) == 0 {
+		return nil, http_api.Err{404, "CHANNEL_NOT_FOUND"}
+	}
+
+	peeked, err := s.ci.PeekChannel(channelProducers, topicName, channelName, n)
+	if err != nil {
+		pe, ok := err.(clusterinfo.PartialErr)
+		if !ok {
+			s.ctx.nsqadmin.logf(LOG_ERROR, "failed to peek channel - %s", err)
+			return nil, http_api.Err{502, fmt.Sprintf("UPSTREAM_ERROR: %s", err)}
+		}
+		s.ctx.nsqadmin.logf(LOG_WARN, "%s", err)
+		messages = append(messages, pe.Error())
+	}
+	if peeked == nil {
+		peeked = []*clusterinfo.PeekedMessage{}
+	}
+
+	return struct {
+		Messages []*clusterinfo.PeekedMessage `json:"messages"`
+		Message  string                       `json:"message"`
+	}{peeked, maybeWarnMsg(messages)}, nil
+}
+
 func (s *httpServer) nodesHandler(w http.ResponseWriter, req *http.Request, ps httprouter.Params) (interface{}, error) {
 	var messages []string
 
@@ -340,6 +431,92 @@ func (s *httpServer) nodesHandler(w http.ResponseWriter, req *http.Request, ps h
 	}{producers, maybeWarnMsg(messages)}, nil
 }
 
+// metricsHandler exposes the cluster wide view (stats of every nsqd summed
+// per topic and channel) in the Prometheus text format
+func (s *httpServer) metricsHandler(w http.ResponseWriter, req *http.Request, ps httprouter.Params) (interface{}, error) {
+	var errs []error
+
+	producers, err := s.ci.GetProducers(s.ctx.nsqadmin.getOpts().NSQLookupdHTTPAddresses, s.ctx.nsqadmin.getOpts().NSQDHTTPAddresses)
+	if err != nil {
+		pe, ok := err.(clusterinfo.PartialErr)
+		if !ok {
+			s.ctx.nsqadmin.logf(LOG_ERROR, "failed to get nodes - %s", err)
+			return nil, http_api.Err{502, fmt.Sprintf("UPSTREAM_ERROR: %s", err)}
+		}
+		s.ctx.nsqadmin.logf(LOG_WARN, "%s", err)
+		errs = append(errs, pe.Errors()...)
+	}
+	topicStats, channelStats, err := s.ci.GetNSQDStats(producers, "", "", false)
+	if err != nil {
+		pe, ok := err.(clusterinfo.PartialErr)
+		if !ok {
+			s.ctx.nsqadmin.logf(LOG_ERROR, "failed to get nsqd stats - %s", err)
+			return nil, http_api.Err{502, fmt.Sprintf("UPSTREAM_ERROR: %s", err)}
+		}
+		s.ctx.nsqadmin.logf(LOG_WARN, "%s", err)
+		errs = append(errs, pe.Errors()...)
+	}
+
+	type topicTotals struct {
+		nodes        int
+		depth        int64
+		backendDepth int64
+		messageCount int64
+		paused       bool
+	}
+	var topicNames []string
+	topics := make(map[string]*topicTotals)
+	for _, t := range topicStats {
+		tt, ok := topics[t.TopicName]
+		if !ok {
+			tt = &topicTotals{}
+			topics[t.TopicName] = tt
+			topicNames = append(topicNames, t.TopicName)
+		}
+		tt.nodes++
+		tt.depth += t.Depth
+		tt.backendDepth += t.BackendDepth
+		tt.messageCount += t.MessageCount
+		tt.paused = tt.paused || t.Paused
+	}
+	sort.Strings(topicNames)
+
+	set := metrics.NewSet()
+	set.Gauge("nsq_cluster_nodes", "nsqd nodes known to nsqadmin", float64(len(producers)))
+	set.Gauge("nsq_cluster_upstream_errors", "Errors querying nsqlookupd and nsqd for this scrape", float64(len(errs)))
+
+	for _, name := range topicNames {
+		tt := topics[name]
+		set.Gauge("nsq_cluster_topic_nodes", "nsqd nodes hosting the topic", float64(tt.nodes), "topic", name)
+		set.Gauge("nsq_cluster_topic_depth", "Messages queued in the topic across nodes", float64(tt.depth), "topic", name)
+		set.Gauge("nsq_cluster_topic_backend_depth", "Messages queued in the topic backend across nodes", float64(tt.backendDepth), "topic", name)
+		set.Counter("nsq_cluster_topic_messages_total", "Messages published to the topic across nodes", float64(tt.messageCount), "topic", name)
+		set.Gauge("nsq_cluster_topic_paused", "Whether or not the topic is paused on any node", metrics.Bool(tt.paused), "topic", name)
+	}
+
+	channelKeys := make([]string, 0, len(channelStats))
+	for key := range channelStats {
+		channelKeys = append(channelKeys, key)
+	}
+	sort.Strings(channelKeys)
+	for _, key := range channelKeys {
+		c := channelStats[key]
+		labels := []string{"topic", c.TopicName, "channel", c.ChannelName}
+		set.Gauge("nsq_cluster_channel_depth", "Messages queued in the channel across nodes", float64(c.Depth), labels...)
+		set.Gauge("nsq_cluster_channel_backend_depth", "Messages queued in the channel backend across nodes", float64(c.BackendDepth), labels...)
+		set.Gauge("nsq_cluster_channel_in_flight", "Messages in flight in the channel across nodes", float64(c.InFlightCount), labels...)
+		set.Gauge("nsq_cluster_channel_deferred", "Deferred messages in the channel across nodes", float64(c.DeferredCount), labels...)
+		set.Counter("nsq_cluster_channel_messages_total", "Messages received by the channel across nodes", float64(c.MessageCount), labels...)
+		set.Counter("nsq_cluster_channel_requeued_total", "Messages requeued by the channel across nodes", float64(c.RequeueCount), labels...)
+		set.Counter("nsq_cluster_channel_timed_out_total", "Messages timed out in the channel across nodes", float64(c.TimeoutCount), labels...)
+		set.Gauge("nsq_cluster_channel_clients", "Clients subscribed to the channel across nodes", float64(c.ClientCount), labels...)
+		set.Gauge("nsq_cluster_channel_paused", "Whether or not the channel is paused on any node", metrics.Bool(c.Paused), labels...)
+	}
+
+	w.Header().Set("Content-Type", metrics.ContentType)
+	return set.String(), nil
+}
+
 func (s *httpServer) nodeHandler(w http.ResponseWriter, req *http.Request, ps httprouter.Params) (interface{}, error) {
 	var messages []string
 
@@ -549,6 +726,13 @@ func (s *httpServer) topicChannelAction(req *http.Request, topicName string, cha
 
 	var body struct {
 		Action string `json:"action"`
+		// the destination of move and copy
+		ToTopic   string `json:"to_topic"`
+		ToChannel string `json:"to_channel"`
+		// how long to pause for, or until when (unix seconds or RFC3339),
+		// indefinitely if neither is set
+		Duration string `json:"duration"`
+		ResumeAt string `json:"resume_at"`
 	}
 
 	if !s.isAuthorizedAdminRequest(req) {
@@ -562,14 +746,18 @@ func (s *httpServer) topicChannelAction(req *http.Request, topicName string, cha
 
 	switch body.Action {
 	case "pause":
+		resumeAt, perr := parseResumeAt(body.Duration, body.ResumeAt)
+		if perr != nil {
+			return nil, http_api.Err{400, perr.Error()}
+		}
 		if channelName != "" {
-			err = s.ci.PauseChannel(topicName, channelName,
+			err = s.ci.PauseChannel(topicName, channelName, resumeAt,
 				s.ctx.nsqadmin.getOpts().NSQLookupdHTTPAddresses,
 				s.ctx.nsqadmin.getOpts().NSQDHTTPAddresses)
 
 			s.notifyAdminAction("pause_channel", topicName, channelName, "", req)
 		} else {
-			err = s.ci.PauseTopic(topicName,
+			err = s.ci.PauseTopic(topicName, resumeAt,
 				s.ctx.nsqadmin.getOpts().NSQLookupdHTTPAddresses,
 				s.ctx.nsqadmin.getOpts().NSQDHTTPAddresses)
 
@@ -603,6 +791,22 @@ func (s *httpServer) topicChannelAction(req *http.Request, topicName string, cha
 
 			s.notifyAdminAction("empty_topic", topicName, "", "", req)
 		}
+	case "move", "copy":
+		if channelName == "" {
+			return nil, http_api.Err{400, "INVALID_ACTION"}
+		}
+		if !protocol.IsValidTopicName(body.ToTopic) {
+			return nil, http_api.Err{400, "INVALID_TO_TOPIC"}
+		}
+		if body.ToChannel != "" && !protocol.IsValidChannelName(body.ToChannel) {
+			return nil, http_api.Err{400, "INVALID_TO_CHANNEL"}
+		}
+		err = s.ci.TransferChannel(body.Action, topicName, channelName, body.ToTopic, body.ToChannel,
+			s.ctx.nsqadmin.getOpts().NSQLookupdHTTPAddresses,
+			s.ctx.nsqadmin.getOpts().NSQDHTTPAddresses)
+		if err == nil {
+			s.notifyAdminAction(body.Action+"_channel", topicName, channelName, "", req)
+		}
 	default:
 		return nil, http_api.Err{400, "INVALID_ACTION"}
 	}
@@ -629,6 +833,31 @@ type counterStats struct {
 	MessageCount int64  `json:"message_count"`
 }
 
+// parseResumeAt returns when a pause ends, given how long it's for or
+// until when (unix seconds or RFC3339), zero for an indefinite pause
+//
+// it's worked out once so that every node resumes at the same time
+func parseResumeAt(duration string, resumeAt string) (time.Time, error) {
+	if duration != "" {
+		d, err := time.ParseDuration(duration)
+		if err != nil || d <= 0 {
+			return time.Time{}, errors.New("INVALID_DURATION")
+		}
+		return time.Now().Add(d), nil
+	}
+	if resumeAt != "" {
+		if sec, err := strconv.ParseInt(resumeAt, 10, 64); err == nil {
+			resumeAt = time.Unix(sec, 0).Format(time.RFC3339Nano)
+		}
+		at, err := time.Parse(time.RFC3339Nano, resumeAt)
+		if err != nil || !at.After(time.Now()) {
+			return time.Time{}, errors.New("INVALID_RESUME_AT")
+		}
+		return at, nil
+	}
+	return time.Time{}, nil
+}
+
 func (s *httpServer) counterHandler(w http.ResponseWriter, req *http.Request, ps httprouter.Params) (interface{}, error) {
 	var messages []string
 	stats := make(map[string]*counterStats)
@@ -9,6 +9,7 @@ import (
 	"net/http"
 	"os"
 	"strconv"
+	"strings"
 	"testing"
 	"time"
 
@@ -284,6 +285,83 @@ func TestHTTPChannelGET(t *testing.T) {
 	test.Equal(t, 0, len(cs.Clients))
 }
 
+func TestHTTPChannelPeekGET(t *testing.T) {
+	dataPath, nsqds, nsqlookupds, nsqadmin1 := bootstrapNSQCluster(t)
+	defer os.RemoveAll(dataPath)
+	defer nsqds[0].Exit()
+	defer nsqlookupds[0].Exit()
+	defer nsqadmin1.Exit()
+
+	topicName := "test_channel_peek" + strconv.Itoa(int(time.Now().Unix()))
+	topic := nsqds[0].GetTopic(topicName)
+	channel := topic.GetChannel("ch")
+	topic.PutMessage(nsqd.NewMessage(topic.GenerateID(), []byte("test")))
+	for channel.Depth() != 1 {
+		time.Sleep(time.Millisecond)
+	}
+	time.Sleep(100 * time.Millisecond)
+
+	client := http.Client{}
+	url := fmt.Sprintf("http://%s/api/topics/%s/ch/peek?n=5", nsqadmin1.RealHTTPAddr(), topicName)
+	req, _ := http.NewRequest("GET", url, nil)
+	resp, err := client.Do(req)
+	test.Nil(t, err)
+	test.Equal(t, 200, resp.StatusCode)
+	body, _ := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+
+	t.Logf("%s", body)
+	var peeked struct {
+		Messages []*clusterinfo.PeekedMessage `json:"messages"`
+	}
+	err = json.Unmarshal(body, &peeked)
+	test.Nil(t, err)
+	test.Equal(t, 1, len(peeked.Messages))
+	test.Equal(t, "test", peeked.Messages[0].Body)
+	test.Equal(t, nsqds[0].RealHTTPAddr().String(), peeked.Messages[0].Node)
+	test.Equal(t, int64(1), channel.Depth())
+
+	url = fmt.Sprintf("http://%s/api/topics/%s/nope/peek", nsqadmin1.RealHTTPAddr(), topicName)
+	req, _ = http.NewRequest("GET", url, nil)
+	resp, err = client.Do(req)
+	test.Nil(t, err)
+	resp.Body.Close()
+	test.Equal(t, 404, resp.StatusCode)
+}
+
+func TestHTTPMetricsGET(t *testing.T) {
+	dataPath, nsqds, nsqlookupds, nsqadmin1 := bootstrapNSQCluster(t)
+	defer os.RemoveAll(dataPath)
+	defer nsqds[0].Exit()
+	defer nsqlookupds[0].Exit()
+	defer nsqadmin1.Exit()
+
+	topicName := "test_metrics_get" + strconv.Itoa(int(time.Now().Unix()))
+	topic := nsqds[0].GetTopic(topicName)
+	topic.GetChannel("ch")
+	topic.PutMessage(nsqd.NewMessage(topic.GenerateID(), []byte("1234")))
+	time.Sleep(100 * time.Millisecond)
+
+	client := http.Client{}
+	url := fmt.Sprintf("http://%s/metrics", nsqadmin1.RealHTTPAddr())
+	req, _ := http.NewRequest("GET", url, nil)
+	resp, err := client.Do(req)
+	test.Nil(t, err)
+	test.Equal(t, 200, resp.StatusCode)
+	body, _ := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+
+	t.Logf("%s", body)
+	for _, line := range []string{
+		"nsq_cluster_nodes 1",
+		"nsq_cluster_upstream_errors 0",
+		fmt.Sprintf(`nsq_cluster_topic_messages_total{topic="%s"} 1`, topicName),
+		fmt.Sprintf(`nsq_cluster_channel_depth{topic="%s",channel="ch"} 1`, topicName),
+	} {
+		test.Equal(t, true, strings.Contains(string(body), line+"\n"))
+	}
+}
+
 func TestHTTPNodesSingleGET(t *testing.T) {
 	dataPath, nsqds, nsqlookupds, nsqadmin1 := bootstrapNSQCluster(t)
 	defer os.RemoveAll(dataPath)
@@ -501,6 +579,60 @@ func TestHTTPPauseChannelPOST(t *testing.T) {
 	resp.Body.Close()
 }
 
+func TestHTTPPauseUntilPOST(t *testing.T) {
+	dataPath, nsqds, nsqlookupds, nsqadmin1 := bootstrapNSQCluster(t)
+	defer os.RemoveAll(dataPath)
+	defer nsqds[0].Exit()
+	defer nsqlookupds[0].Exit()
+	defer nsqadmin1.Exit()
+
+	topicName := "test_pause_until_post" + strconv.Itoa(int(time.Now().Unix()))
+	topic := nsqds[0].GetTopic(topicName)
+	channel := topic.GetChannel("ch")
+	time.Sleep(100 * time.Millisecond)
+
+	client := http.Client{}
+	url := fmt.Sprintf("http://%s/api/topics/%s/ch", nsqadmin1.RealHTTPAddr(), topicName)
+	body, _ := json.Marshal(map[string]interface{}{
+		"action":   "pause",
+		"duration": "1h",
+	})
+	req, _ := http.NewRequest("POST", url, bytes.NewBuffer(body))
+	resp, err := client.Do(req)
+	test.Nil(t, err)
+	test.Equal(t, 200, resp.StatusCode)
+	resp.Body.Close()
+	test.Equal(t, true, channel.IsPaused())
+	left := channel.ResumeAt().Sub(time.Now())
+	test.Equal(t, true, left > 59*time.Minute && left <= time.Hour)
+
+	resumeAt := time.Now().Add(2 * time.Hour).Truncate(time.Second)
+	url = fmt.Sprintf("http://%s/api/topics/%s", nsqadmin1.RealHTTPAddr(), topicName)
+	body, _ = json.Marshal(map[string]interface{}{
+		"action":    "pause",
+		"resume_at": strconv.FormatInt(resumeAt.Unix(), 10),
+	})
+	req, _ = http.NewRequest("POST", url, bytes.NewBuffer(body))
+	resp, err = client.Do(req)
+	test.Nil(t, err)
+	test.Equal(t, 200, resp.StatusCode)
+	resp.Body.Close()
+	test.Equal(t, true, topic.IsPaused())
+	test.Equal(t, true, topic.ResumeAt().Equal(resumeAt))
+
+	for _, invalid := range []map[string]interface{}{
+		{"action": "pause", "duration": "-1h"},
+		{"action": "pause", "resume_at": "yesterday"},
+	} {
+		body, _ = json.Marshal(invalid)
+		req, _ = http.NewRequest("POST", url, bytes.NewBuffer(body))
+		resp, err = client.Do(req)
+		test.Nil(t, err)
+		test.Equal(t, 400, resp.StatusCode)
+		resp.Body.Close()
+	}
+}
+
 func TestHTTPEmptyTopicPOST(t *testing.T) {
 	dataPath, nsqds, nsqlookupds, nsqadmin1 := bootstrapNSQCluster(t)
 	defer os.RemoveAll(dataPath)
@@ -559,6 +691,43 @@ func TestHTTPEmptyChannelPOST(t *testing.T) {
 	test.Equal(t, int64(0), channel.Depth())
 }
 
+func TestHTTPMoveChannelPOST(t *testing.T) {
+	dataPath, nsqds, nsqlookupds, nsqadmin1 := bootstrapNSQCluster(t)
+	defer os.RemoveAll(dataPath)
+	defer nsqds[0].Exit()
+	defer nsqlookupds[0].Exit()
+	defer nsqadmin1.Exit()
+
+	topicName := "test_move_channel_post" + strconv.Itoa(int(time.Now().Unix()))
+	topic := nsqds[0].GetTopic(topicName)
+	channel := topic.GetChannel("ch")
+	channel.PutMessage(nsqd.NewMessage(nsqd.MessageID{}, []byte("1234")))
+
+	time.Sleep(100 * time.Millisecond)
+	test.Equal(t, int64(1), channel.Depth())
+
+	client := http.Client{}
+	url := fmt.Sprintf("http://%s/api/topics/%s/ch", nsqadmin1.RealHTTPAddr(), topicName)
+	body, _ := json.Marshal(map[string]interface{}{
+		"action":     "move",
+		"to_topic":   topicName,
+		"to_channel": "ch2",
+	})
+	req, _ := http.NewRequest("POST", url, bytes.NewBuffer(body))
+	resp, err := client.Do(req)
+	test.Nil(t, err)
+	body, _ = ioutil.ReadAll(resp.Body)
+	test.Equal(t, 200, resp.StatusCode)
+	resp.Body.Close()
+
+	for channel.Depth() != 0 {
+		time.Sleep(10 * time.Millisecond)
+	}
+	channel2, err := topic.GetExistingChannel("ch2")
+	test.Nil(t, err)
+	test.Equal(t, int64(1), channel2.Depth())
+}
+
 func TestHTTPconfig(t *testing.T) {
 	dataPath, nsqds, nsqlookupds, nsqadmin1 := bootstrapNSQCluster(t)
 	defer os.RemoveAll(dataPath)
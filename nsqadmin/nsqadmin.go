@@ -3,11 +3,9 @@ package nsqadmin
 import (
 	"bytes"
 	"crypto/tls"
-	"crypto/x509"
 	"encoding/json"
 	"errors"
 	"fmt"
-	"io/ioutil"
 	"log"
 	"net"
 	"net/http"
@@ -18,6 +16,7 @@ import (
 	"sync/atomic"
 
 	"github.com/nsqio/nsq/internal/http_api"
+	"github.com/nsqio/nsq/internal/tlsreload"
 	"github.com/nsqio/nsq/internal/util"
 	"github.com/nsqio/nsq/internal/version"
 )
@@ -30,6 +29,8 @@ type NSQAdmin struct {
 	notifications       chan *AdminAction
 	graphiteURL         *url.URL
 	httpClientTLSConfig *tls.Config
+	tlsReloader         *tlsreload.Reloader
+	exitChan            chan int
 }
 
 func New(opts *Options) (*NSQAdmin, error) {
@@ -39,6 +40,7 @@ func New(opts *Options) (*NSQAdmin, error) {
 
 	n := &NSQAdmin{
 		notifications: make(chan *AdminAction),
+		exitChan:      make(chan int),
 	}
 	n.swapOpts(opts)
 
@@ -58,29 +60,17 @@ func New(opts *Options) (*NSQAdmin, error) {
 		return nil, errors.New("--http-client-tls-cert must be specified with --http-client-tls-key")
 	}
 
-	n.httpClientTLSConfig = &tls.Config{
-		InsecureSkipVerify: opts.HTTPClientTLSInsecureSkipVerify,
-	}
-	if opts.HTTPClientTLSCert != "" && opts.HTTPClientTLSKey != "" {
-		cert, err := tls.LoadX509KeyPair(opts.HTTPClientTLSCert, opts.HTTPClientTLSKey)
-		if err != nil {
-			return nil, fmt.Errorf("failed to LoadX509KeyPair %s, %s - %s",
-				opts.HTTPClientTLSCert, opts.HTTPClientTLSKey, err)
-		}
-		n.httpClientTLSConfig.Certificates = []tls.Certificate{cert}
-	}
-	if opts.HTTPClientTLSRootCAFile != "" {
-		tlsCertPool := x509.NewCertPool()
-		caCertFile, err := ioutil.ReadFile(opts.HTTPClientTLSRootCAFile)
-		if err != nil {
-			return nil, fmt.Errorf("failed to read TLS root CA file %s - %s",
-				opts.HTTPClientTLSRootCAFile, err)
-		}
-		if !tlsCertPool.AppendCertsFromPEM(caCertFile) {
-			return nil, fmt.Errorf("failed to AppendCertsFromPEM %s", opts.HTTPClientTLSRootCAFile)
-		}
-		n.httpClientTLSConfig.RootCAs = tlsCertPool
+	// the client cert and root CAs are reloaded when the files change (see
+	// --http-client-tls-reload-interval)
+	tlsReloader, err := tlsreload.New(opts.HTTPClientTLSCert, opts.HTTPClientTLSKey,
+		opts.HTTPClientTLSRootCAFile, n.logf)
+	if err != nil {
+		return nil, err
 	}
+	n.tlsReloader = tlsReloader
+	n.httpClientTLSConfig = tlsReloader.ClientConfig(&tls.Config{
+		InsecureSkipVerify: opts.HTTPClientTLSInsecureSkipVerify,
+	})
 
 	for _, address := range opts.NSQLookupdHTTPAddresses {
 		_, err := net.ResolveTCPAddr("tcp", address)
@@ -116,7 +106,6 @@ func New(opts *Options) (*NSQAdmin, error) {
 
 	n.logf(LOG_INFO, version.String("nsqadmin"))
 
-	var err error
 	n.httpListener, err = net.Listen("tcp", n.getOpts().HTTPAddress)
 	if err != nil {
 		return nil, fmt.Errorf("listen (%s) failed - %s", n.getOpts().HTTPAddress, err)
@@ -184,6 +173,11 @@ func (n *NSQAdmin) Main() error {
 		exitFunc(http_api.Serve(n.httpListener, http_api.CompressHandler(httpServer), "HTTP", n.logf))
 	})
 	n.waitGroup.Wrap(n.handleAdminActions)
+	if n.getOpts().HTTPClientTLSReloadInterval > 0 {
+		n.waitGroup.Wrap(func() {
+			n.tlsReloader.Watch(n.getOpts().HTTPClientTLSReloadInterval, n.exitChan)
+		})
+	}
 
 	err := <-exitCh
 	return err
@@ -194,5 +188,6 @@ func (n *NSQAdmin) Exit() {
 		n.httpListener.Close()
 	}
 	close(n.notifications)
+	close(n.exitChan)
 	n.waitGroup.Wait()
 }
@@ -7,6 +7,8 @@ import (
 	"net/http"
 	"net/url"
 	"os"
+	"path/filepath"
+	"strings"
 	"testing"
 
 	"github.com/nsqio/nsq/internal/lg"
@@ -101,3 +103,47 @@ func mustStartNSQD(opts *nsqd.Options) (*net.TCPAddr, *net.TCPAddr, *nsqd.NSQD)
 	}()
 	return nsqd.RealTCPAddr(), nsqd.RealHTTPAddr(), nsqd
 }
+
+func TestNSQDAuthSecret(t *testing.T) {
+	lgr := test.NewTestLogger(t)
+
+	dataPath, err := ioutil.TempDir("", "nsq-test-")
+	test.Nil(t, err)
+	defer os.RemoveAll(dataPath)
+	nsqdOpts := nsqd.NewOptions()
+	nsqdOpts.DataPath = dataPath
+	nsqdOpts.AuthFile = filepath.Join(dataPath, "auth.json")
+	err = ioutil.WriteFile(nsqdOpts.AuthFile, []byte(`{"secrets":{
+		"nsqadmin": {"authorizations": [{"topic": ".*", "channels": [".*"], "permissions": ["admin"]}]}
+	}}`), 0644)
+	test.Nil(t, err)
+	nsqdOpts.Logger = lgr
+	_, nsqdHTTPAddr, nsqd := mustStartNSQD(nsqdOpts)
+	defer nsqd.Exit()
+	topic := nsqd.GetTopic("test_nsqd_auth_secret")
+
+	for _, secret := range []string{"", "nsqadmin"} {
+		opts := NewOptions()
+		opts.HTTPAddress = "127.0.0.1:0"
+		opts.NSQDHTTPAddresses = []string{nsqdHTTPAddr.String()}
+		opts.NSQDAuthSecret = secret
+		opts.Logger = lgr
+		nsqadmin, err := New(opts)
+		test.Nil(t, err)
+		go func() {
+			err := nsqadmin.Main()
+			if err != nil {
+				panic(err)
+			}
+		}()
+
+		url := fmt.Sprintf("http://%s/api/topics/test_nsqd_auth_secret", nsqadmin.RealHTTPAddr())
+		resp, err := http.Post(url, "application/json", strings.NewReader(`{"action":"pause"}`))
+		test.Nil(t, err)
+		resp.Body.Close()
+		nsqadmin.Exit()
+		test.Equal(t, 200, resp.StatusCode)
+		// without the secret nsqd refuses the action
+		test.Equal(t, secret != "", topic.IsPaused())
+	}
+}
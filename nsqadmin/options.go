@@ -25,14 +25,16 @@ type Options struct {
 
 	NSQLookupdHTTPAddresses []string `flag:"lookupd-http-address" cfg:"nsqlookupd_http_addresses"`
 	NSQDHTTPAddresses       []string `flag:"nsqd-http-address" cfg:"nsqd_http_addresses"`
+	NSQDAuthSecret          string   `flag:"nsqd-auth-secret"`
 
 	HTTPClientConnectTimeout time.Duration `flag:"http-client-connect-timeout"`
 	HTTPClientRequestTimeout time.Duration `flag:"http-client-request-timeout"`
 
-	HTTPClientTLSInsecureSkipVerify bool   `flag:"http-client-tls-insecure-skip-verify"`
-	HTTPClientTLSRootCAFile         string `flag:"http-client-tls-root-ca-file"`
-	HTTPClientTLSCert               string `flag:"http-client-tls-cert"`
-	HTTPClientTLSKey                string `flag:"http-client-tls-key"`
+	HTTPClientTLSInsecureSkipVerify bool          `flag:"http-client-tls-insecure-skip-verify"`
+	HTTPClientTLSRootCAFile         string        `flag:"http-client-tls-root-ca-file"`
+	HTTPClientTLSCert               string        `flag:"http-client-tls-cert"`
+	HTTPClientTLSKey                string        `flag:"http-client-tls-key"`
+	HTTPClientTLSReloadInterval     time.Duration `flag:"http-client-tls-reload-interval"`
 
 	AllowConfigFromCIDR string `flag:"allow-config-from-cidr"`
 
@@ -57,5 +59,7 @@ func NewOptions() *Options {
 		AllowConfigFromCIDR:      "127.0.0.1/8",
 		AclHttpHeader:            "X-Forwarded-User",
 		AdminUsers:               []string{},
+
+		HTTPClientTLSReloadInterval: time.Minute,
 	}
 }
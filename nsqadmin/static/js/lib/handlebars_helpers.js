@@ -196,7 +196,7 @@ function round(num, places) {
     return Math.round(num * multiplier) / multiplier;
 }
 
-Handlebars.registerHelper('nanotohuman', function(n) {
+var nanotohuman = function(n) {
     var s = '';
     var v;
     if (n >= 3600000000000) {
@@ -222,6 +222,14 @@ Handlebars.registerHelper('nanotohuman', function(n) {
         s = n + 'ns';
     }
     return s;
+};
+
+Handlebars.registerHelper('nanotohuman', nanotohuman);
+
+// resumesin formats the time left until a pause ends, given in unix seconds
+Handlebars.registerHelper('resumesin', function(resumeAt) {
+    var left = Math.max(resumeAt - Math.floor(Date.now() / 1000), 0);
+    return nanotohuman(left * 1000000000);
 });
 
 Handlebars.registerHelper('sparkline', function(typ, node, ns1, ns2, key) {
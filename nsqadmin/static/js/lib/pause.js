@@ -0,0 +1,31 @@
+// a duration as accepted by Go's time.ParseDuration (e.g. 1h30m)
+var durationRe = /^([0-9]*\.?[0-9]+(ns|us|\u00b5s|ms|s|m|h))+$/;
+
+// pauseBody returns the body of a pause action, for the duration or until
+// the resume time (RFC3339 or unix seconds) given, indefinitely if it's empty
+function pauseBody(until) {
+    var body = {'action': 'pause'};
+    until = (until || '').trim();
+    if (durationRe.test(until)) {
+        body['duration'] = until;
+    } else if (until !== '') {
+        body['resume_at'] = until;
+    }
+    return body;
+}
+
+// pauseText describes the pause action of pauseBody, for the confirmation
+function pauseText(body) {
+    if (body['duration']) {
+        return ' for <em>' + body['duration'] + '</em>';
+    }
+    if (body['resume_at']) {
+        return ' until <em>' + body['resume_at'] + '</em>';
+    }
+    return '';
+}
+
+module.exports = {
+    'pauseBody': pauseBody,
+    'pauseText': pauseText
+};
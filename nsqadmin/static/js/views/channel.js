@@ -1,3 +1,4 @@
+var _ = require('underscore');
 var $ = require('jquery');
 
 window.jQuery = $;
@@ -6,6 +7,7 @@ var bootbox = require('bootbox');
 
 var Pubsub = require('../lib/pubsub');
 var AppState = require('../app_state');
+var pause = require('../lib/pause');
 
 var BaseView = require('./base');
 
@@ -15,7 +17,8 @@ var ChannelView = BaseView.extend({
     template: require('./spinner.hbs'),
 
     events: {
-        'click .channel-actions button': 'channelAction'
+        'click .channel-actions button': 'channelAction',
+        'click .channel-peek button': 'peekMessages'
     },
 
     initialize: function() {
@@ -31,13 +34,38 @@ var ChannelView = BaseView.extend({
             .always(Pubsub.trigger.bind(Pubsub, 'view:ready'));
     },
 
+    peekMessages: function(e) {
+        e.preventDefault();
+        e.stopPropagation();
+        $.get(this.model.url() + '/peek', {'n': 20})
+            .done(function(data) {
+                var messages = _.map(data['messages'] || [], function(msg) {
+                    msg['time'] = new Date(msg['timestamp'] / 1e6).toISOString();
+                    return msg;
+                });
+                this.$('.channel-peek-messages').html(require('./channel_peek.hbs')({
+                    'messages': messages
+                }));
+            }.bind(this))
+            .fail(this.handleAJAXError.bind(this));
+    },
+
     channelAction: function(e) {
         e.preventDefault();
         e.stopPropagation();
         var action = $(e.currentTarget).data('action');
+        if (action === 'move' || action === 'copy') {
+            this.transferAction(action);
+            return;
+        }
+        var body = {'action': action};
+        if (action === 'pause') {
+            body = pause.pauseBody(this.$('.pause-until').val());
+        }
         var txt = 'Are you sure you want to <strong>' +
             action + '</strong> <em>' + this.model.get('topic') +
-            '/' + this.model.get('name') + '</em>?';
+            '/' + this.model.get('name') + '</em>' +
+            pause.pauseText(body) + '?';
         bootbox.confirm(txt, function(result) {
             if (result !== true) {
                 return;
@@ -51,11 +79,30 @@ var ChannelView = BaseView.extend({
                     })
                     .fail(this.handleAJAXError.bind(this));
             } else {
-                $.post(this.model.url(), JSON.stringify({'action': action}))
+                $.post(this.model.url(), JSON.stringify(body))
                     .done(function() { window.location.reload(true); })
                     .fail(this.handleAJAXError.bind(this));
             }
         }.bind(this));
+    },
+
+    transferAction: function(action) {
+        var txt = 'To <strong>' + action + '</strong> the backlog of <em>' +
+            this.model.get('topic') + '/' + this.model.get('name') +
+            '</em> to (<em>topic</em> or <em>topic/channel</em>):';
+        bootbox.prompt(txt, function(dst) {
+            if (!dst) {
+                return;
+            }
+            var parts = dst.split('/');
+            $.post(this.model.url(), JSON.stringify({
+                'action': action,
+                'to_topic': parts[0],
+                'to_channel': parts[1] || ''
+            }))
+                .done(function() { window.location.reload(true); })
+                .fail(this.handleAJAXError.bind(this));
+        }.bind(this));
     }
 });
 
@@ -6,6 +6,7 @@ var bootbox = require('bootbox');
 
 var Pubsub = require('../lib/pubsub');
 var AppState = require('../app_state');
+var pause = require('../lib/pause');
 
 var BaseView = require('./base');
 
@@ -35,8 +36,13 @@ var TopicView = BaseView.extend({
         e.preventDefault();
         e.stopPropagation();
         var action = $(e.currentTarget).data('action');
+        var body = {'action': action};
+        if (action === 'pause') {
+            body = pause.pauseBody(this.$('.pause-until').val());
+        }
         var txt = 'Are you sure you want to <strong>' +
-            action + '</strong> <em>' + this.model.get('name') + '</em>?';
+            action + '</strong> <em>' + this.model.get('name') + '</em>' +
+            pause.pauseText(body) + '?';
         bootbox.confirm(txt, function(result) {
             if (result !== true) {
                 return;
@@ -45,7 +51,7 @@ var TopicView = BaseView.extend({
                 $.ajax(this.model.url(), {'method': 'DELETE'})
                     .done(function() { window.location = AppState.basePath('/'); });
             } else {
-                $.post(this.model.url(), JSON.stringify({'action': action}))
+                $.post(this.model.url(), JSON.stringify(body))
                     .done(function() { window.location.reload(true); })
                     .fail(this.handleAJAXError.bind(this));
             }
@@ -1,5 +1,20 @@
 package nsqd
 
+import (
+	"bufio"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"strings"
+	"sync"
+	"sync/atomic"
+
+	"github.com/nsqio/go-diskqueue"
+	"github.com/nsqio/nsq/internal/lg"
+)
+
 // BackendQueue represents the behavior for the secondary message
 // storage system
 //后台消息队列接口
@@ -11,3 +26,307 @@ type BackendQueue interface {
 	Depth() int64
 	Empty() error
 }
+
+// backendScanner is implemented by the BackendQueues that can go through
+// their messages, in order, without them being read (see Channel.Peek)
+type backendScanner interface {
+	// Scan calls fn with each message until it returns false
+	Scan(fn func(b []byte) bool) error
+}
+
+// BackendQueueFactory creates the BackendQueue of a topic or channel,
+// name is unique across all topics and channels and safe to use in a
+// file name
+type BackendQueueFactory func(name string, opts *Options, logf lg.AppLogFunc) BackendQueue
+
+var backendQueueFactories = struct {
+	sync.RWMutex
+	m map[string]BackendQueueFactory
+}{m: map[string]BackendQueueFactory{
+	"diskqueue": newDiskBackendQueue,
+	"memory":    newMemoryBackendQueue,
+}}
+
+// RegisterBackendQueue makes a BackendQueue implementation available to
+// --backend-queue and --backend-queue-suffix under the given kind
+func RegisterBackendQueue(kind string, factory BackendQueueFactory) {
+	backendQueueFactories.Lock()
+	backendQueueFactories.m[kind] = factory
+	backendQueueFactories.Unlock()
+}
+
+func getBackendQueueFactory(kind string) (BackendQueueFactory, bool) {
+	backendQueueFactories.RLock()
+	defer backendQueueFactories.RUnlock()
+	factory, ok := backendQueueFactories.m[kind]
+	return factory, ok
+}
+
+// parseBackendQueueSuffix parses a --backend-queue-suffix value
+// (<topic name suffix>=<kind>)
+func parseBackendQueueSuffix(s string) (string, string, error) {
+	idx := strings.LastIndex(s, "=")
+	if idx < 1 || idx == len(s)-1 {
+		return "", "", fmt.Errorf("invalid backend queue suffix %q - expected <suffix>=<kind>", s)
+	}
+	suffix, kind := s[:idx], s[idx+1:]
+	if _, ok := getBackendQueueFactory(kind); !ok {
+		return "", "", fmt.Errorf("invalid backend queue suffix %q - unknown kind %q", s, kind)
+	}
+	return suffix, kind, nil
+}
+
+func validateBackendQueueOpts(opts *Options) error {
+	if _, ok := getBackendQueueFactory(opts.BackendQueue); !ok {
+		return fmt.Errorf("unknown --backend-queue %q", opts.BackendQueue)
+	}
+	for _, s := range opts.BackendQueueSuffixes {
+		if _, _, err := parseBackendQueueSuffix(s); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// backendQueueKind returns the kind of BackendQueue used by a topic (and
+// its channels), the longest matching --backend-queue-suffix wins over
+// the --backend-queue default
+func backendQueueKind(opts *Options, topicName string) string {
+	kind := opts.BackendQueue
+	longest := -1
+	for _, s := range opts.BackendQueueSuffixes {
+		suffix, k, err := parseBackendQueueSuffix(s)
+		if err != nil {
+			continue
+		}
+		if strings.HasSuffix(topicName, suffix) && len(suffix) > longest {
+			kind = k
+			longest = len(suffix)
+		}
+	}
+	return kind
+}
+
+func newBackendQueue(ctx *context, topicName string, backendName string) BackendQueue {
+	opts := ctx.nsqd.getOpts()
+	kind := backendQueueKind(opts, topicName)
+	factory, ok := getBackendQueueFactory(kind)
+	if !ok {
+		ctx.nsqd.logf(LOG_ERROR, "unknown backend queue %q for %s, falling back to diskqueue", kind, backendName)
+		kind = "diskqueue"
+		factory = newDiskBackendQueue
+	}
+	bq := factory(backendName, opts, ctx.nsqd.logf)
+	if kind == "diskqueue" {
+		// the size on disk is what backlog quotas limit
+		bq = &sizedBackendQueue{
+			BackendQueue: bq,
+			size:         diskQueueSize(opts.DataPath, backendName),
+			dataPath:     opts.DataPath,
+			name:         backendName,
+		}
+	}
+	return bq
+}
+
+func newDiskBackendQueue(name string, opts *Options, logf lg.AppLogFunc) BackendQueue {
+	dqLogf := func(level diskqueue.LogLevel, f string, args ...interface{}) {
+		logf(lg.LogLevel(level), f, args...)
+	}
+	return diskqueue.New(
+		name,
+		opts.DataPath,
+		opts.MaxBytesPerFile,
+		int32(minValidMsgLength),
+		maxBackendMsgLength(opts),
+		opts.SyncEvery,
+		opts.SyncTimeout,
+		dqLogf,
+	)
+}
+
+// sizedBackendQueue keeps track of the bytes held by a BackendQueue, for
+// the backlog quotas (see backlogQuota)
+//
+// the reads are accounted for by the consumers of ReadChan, with
+// backendRead
+type sizedBackendQueue struct {
+	// 64bit atomic vars need to be first for proper alignment on 32bit platforms
+	size int64
+
+	dataPath string
+	name     string
+
+	BackendQueue
+}
+
+func (q *sizedBackendQueue) Put(b []byte) error {
+	err := q.BackendQueue.Put(b)
+	if err == nil {
+		// diskqueue prefixes each message with its 4 byte size
+		atomic.AddInt64(&q.size, int64(len(b))+4)
+	}
+	return err
+}
+
+func (q *sizedBackendQueue) Empty() error {
+	err := q.BackendQueue.Empty()
+	if err == nil {
+		atomic.StoreInt64(&q.size, 0)
+	}
+	return err
+}
+
+// Scan reads the messages left off the diskqueue files
+func (q *sizedBackendQueue) Scan(fn func(b []byte) bool) error {
+	return diskQueueScan(q.dataPath, q.name, q.Depth(), fn)
+}
+
+func (q *sizedBackendQueue) read(b []byte) {
+	if atomic.AddInt64(&q.size, -int64(len(b))-4) < 0 {
+		// a read racing Empty
+		atomic.StoreInt64(&q.size, 0)
+	}
+}
+
+// backendRead accounts for b having been read from bq.ReadChan()
+func backendRead(bq BackendQueue, b []byte) {
+	if q, ok := bq.(*sizedBackendQueue); ok {
+		q.read(b)
+	}
+}
+
+// backendSize returns the bytes held by bq, 0 unless it's a diskqueue
+func backendSize(bq BackendQueue) int64 {
+	if q, ok := bq.(*sizedBackendQueue); ok {
+		return atomic.LoadInt64(&q.size)
+	}
+	return 0
+}
+
+// diskQueueSize returns the bytes left to read in the diskqueue name, per
+// its metadata file, so that sizedBackendQueue starts off right
+func diskQueueSize(dataPath string, name string) int64 {
+	f, err := os.Open(path.Join(dataPath, name+".diskqueue.meta.dat"))
+	if err != nil {
+		return 0
+	}
+	defer f.Close()
+
+	var depth, readFileNum, readPos, writeFileNum, writePos int64
+	_, err = fmt.Fscanf(f, "%d\n%d,%d\n%d,%d\n",
+		&depth, &readFileNum, &readPos, &writeFileNum, &writePos)
+	if err != nil || depth == 0 {
+		return 0
+	}
+
+	size := writePos - readPos
+	for fileNum := readFileNum; fileNum < writeFileNum; fileNum++ {
+		fi, err := os.Stat(path.Join(dataPath, fmt.Sprintf("%s.diskqueue.%06d.dat", name, fileNum)))
+		if err == nil {
+			size += fi.Size()
+		}
+	}
+	if size < 0 {
+		return 0
+	}
+	return size
+}
+
+// diskQueueScan calls fn with the messages of the diskqueue name, which
+// has depth messages left to read, straight from its files until it
+// returns false
+//
+// its metadata file lags behind the reads (it's only synced every so
+// often) so the messages from the read position in there on are counted,
+// to skip those that have been read since
+func diskQueueScan(dataPath string, name string, depth int64, fn func(b []byte) bool) error {
+	if depth <= 0 {
+		return nil
+	}
+
+	var metaDepth, readFileNum, readPos int64
+	f, err := os.Open(path.Join(dataPath, name+".diskqueue.meta.dat"))
+	if err == nil {
+		_, err = fmt.Fscanf(f, "%d\n%d,%d\n", &metaDepth, &readFileNum, &readPos)
+		f.Close()
+		if err != nil {
+			return fmt.Errorf("failed to read diskqueue metadata of %s - %s", name, err)
+		}
+	} else if !os.IsNotExist(err) {
+		return err
+	}
+
+	var total int64
+	err = walkDiskQueue(dataPath, name, readFileNum, readPos, func(r *bufio.Reader, size int) (bool, error) {
+		_, err := r.Discard(size)
+		if err == nil {
+			total++
+		}
+		return true, err
+	})
+	if err != nil {
+		return err
+	}
+
+	skip := total - depth
+	return walkDiskQueue(dataPath, name, readFileNum, readPos, func(r *bufio.Reader, size int) (bool, error) {
+		if skip > 0 {
+			skip--
+			_, err := r.Discard(size)
+			return true, err
+		}
+		b := make([]byte, size)
+		_, err := io.ReadFull(r, b)
+		if err != nil {
+			return false, err
+		}
+		return fn(b), nil
+	})
+}
+
+// walkDiskQueue calls fn with each message of the diskqueue name from
+// readPos in file readFileNum on, fn reads the size bytes of the message
+// and returns whether to carry on
+//
+// a message cut short (i.e. being written) ends the walk
+func walkDiskQueue(dataPath string, name string, readFileNum int64, readPos int64,
+	fn func(r *bufio.Reader, size int) (bool, error)) error {
+	for fileNum, pos := readFileNum, readPos; ; fileNum, pos = fileNum+1, 0 {
+		f, err := os.Open(path.Join(dataPath, fmt.Sprintf("%s.diskqueue.%06d.dat", name, fileNum)))
+		if err != nil {
+			if os.IsNotExist(err) {
+				return nil
+			}
+			return err
+		}
+		_, err = f.Seek(pos, 0)
+		if err != nil {
+			f.Close()
+			return err
+		}
+
+		r := bufio.NewReader(f)
+		for {
+			var size int32
+			err = binary.Read(r, binary.BigEndian, &size)
+			if err != nil {
+				break
+			}
+			more, err := fn(r, int(size))
+			if err == io.EOF || err == io.ErrUnexpectedEOF {
+				f.Close()
+				return nil
+			}
+			if err != nil || !more {
+				f.Close()
+				return err
+			}
+		}
+		f.Close()
+		if err != io.EOF {
+			// a size cut short
+			return nil
+		}
+	}
+}
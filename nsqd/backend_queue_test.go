@@ -0,0 +1,127 @@
+package nsqd
+
+import (
+	"os"
+	"testing"
+	"time"
+
+	"github.com/nsqio/nsq/internal/lg"
+	"github.com/nsqio/nsq/internal/test"
+)
+
+func TestBackendQueueKind(t *testing.T) {
+	opts := NewOptions()
+	opts.BackendQueueSuffixes = []string{".mem=memory", ".disk.mem=diskqueue"}
+
+	test.Equal(t, "diskqueue", backendQueueKind(opts, "orders"))
+	test.Equal(t, "memory", backendQueueKind(opts, "clicks.mem"))
+	test.Equal(t, "diskqueue", backendQueueKind(opts, "clicks.disk.mem"))
+
+	opts.BackendQueue = "memory"
+	test.Equal(t, "memory", backendQueueKind(opts, "orders"))
+
+	test.Nil(t, validateBackendQueueOpts(opts))
+	opts.BackendQueueSuffixes = []string{".mem=bogus"}
+	test.NotNil(t, validateBackendQueueOpts(opts))
+	opts.BackendQueueSuffixes = []string{"memory"}
+	test.NotNil(t, validateBackendQueueOpts(opts))
+	opts.BackendQueueSuffixes = nil
+	opts.BackendQueue = "bogus"
+	test.NotNil(t, validateBackendQueueOpts(opts))
+}
+
+func TestMemoryBackendQueue(t *testing.T) {
+	opts := NewOptions()
+	opts.Logger = test.NewTestLogger(t)
+	opts.MemBackendQueueSize = 3
+	logf := func(lvl lg.LogLevel, f string, args ...interface{}) {
+		lg.Logf(opts.Logger, opts.LogLevel, lvl, f, args...)
+	}
+	q := newMemoryBackendQueue("test", opts, logf)
+	defer q.Close()
+
+	for _, b := range []string{"a", "b", "c", "d", "e"} {
+		test.Nil(t, q.Put([]byte(b)))
+	}
+	// the loop may already be offering the oldest message it popped
+	// before the ring was full, the rest is bounded by the ring size
+	var got []string
+	for q.Depth() > 0 {
+		select {
+		case b := <-q.ReadChan():
+			got = append(got, string(b))
+		case <-time.After(time.Second):
+			t.Fatal("timeout reading memory backend queue")
+		}
+	}
+	test.Equal(t, "e", got[len(got)-1])
+	test.Equal(t, true, len(got) <= 4)
+
+	test.Nil(t, q.Put([]byte("f")))
+	test.Nil(t, q.Empty())
+	test.Equal(t, int64(0), q.Depth())
+}
+
+func TestTopicBackendQueueSuffix(t *testing.T) {
+	opts := NewOptions()
+	opts.Logger = test.NewTestLogger(t)
+	opts.MemQueueSize = 0
+	opts.BackendQueueSuffixes = []string{".mem=memory"}
+	_, _, nsqd := mustStartNSQD(opts)
+	defer os.RemoveAll(opts.DataPath)
+	defer nsqd.Exit()
+
+	topic := nsqd.GetTopic("test_backend.mem")
+	channel := topic.GetChannel("ch")
+	_, ok := topic.backend.(*memoryBackendQueue)
+	test.Equal(t, true, ok)
+	_, ok = channel.backend.(*memoryBackendQueue)
+	test.Equal(t, true, ok)
+
+	topic.PutMessage(NewMessage(topic.GenerateID(), []byte("test")))
+	select {
+	case b := <-channel.backend.ReadChan():
+		msg, err := decodeMessage(b)
+		test.Nil(t, err)
+		test.Equal(t, []byte("test"), msg.Body)
+	case <-time.After(time.Second):
+		t.Fatal("timeout reading channel backend")
+	}
+
+	_, ok = nsqd.GetTopic("test_backend").backend.(*memoryBackendQueue)
+	test.Equal(t, false, ok)
+}
+
+func TestMemoryBackendQueueScan(t *testing.T) {
+	opts := NewOptions()
+	opts.Logger = test.NewTestLogger(t)
+	logf := func(lvl lg.LogLevel, f string, args ...interface{}) {
+		lg.Logf(opts.Logger, opts.LogLevel, lvl, f, args...)
+	}
+	q := newMemoryBackendQueue("test", opts, logf).(*memoryBackendQueue)
+	defer q.Close()
+
+	for _, b := range []string{"a", "b", "c"} {
+		test.Nil(t, q.Put([]byte(b)))
+	}
+	var msgs [][]byte
+	err := q.Scan(func(b []byte) bool {
+		msgs = append(msgs, b)
+		return len(msgs) < 2
+	})
+	test.Nil(t, err)
+	test.Equal(t, [][]byte{[]byte("a"), []byte("b")}, msgs)
+	test.Equal(t, int64(3), q.Depth())
+
+	test.Equal(t, []byte("a"), <-q.ReadChan())
+	for q.Depth() != 2 {
+		time.Sleep(time.Millisecond)
+	}
+	msgs = nil
+	err = q.Scan(func(b []byte) bool {
+		msgs = append(msgs, b)
+		return true
+	})
+	test.Nil(t, err)
+	test.Equal(t, [][]byte{[]byte("b"), []byte("c")}, msgs)
+}
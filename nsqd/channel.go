@@ -3,16 +3,19 @@ package nsqd
 import (
 	"bytes"
 	"container/heap"
+	"encoding/json"
 	"errors"
+	"fmt"
 	"math"
+	"os"
+	"path"
 	"strings"
 	"sync"
 	"sync/atomic"
 	"time"
 
-	"github.com/nsqio/go-diskqueue"
-	"github.com/nsqio/nsq/internal/lg"
 	"github.com/nsqio/nsq/internal/pqueue"
+	"github.com/nsqio/nsq/internal/protocol"
 	"github.com/nsqio/nsq/internal/quantile"
 )
 
@@ -25,6 +28,41 @@ type Consumer interface {
 	Empty()
 }
 
+// deadLetterTopicSuffix is appended to a topic name to form the name of the
+// topic that receives messages which exceeded a channel's MaxAttempts
+const deadLetterTopicSuffix = ".dead_letter"
+
+func deadLetterTopicName(topicName string) string {
+	return strings.TrimSuffix(topicName, "#ephemeral") + deadLetterTopicSuffix
+}
+
+// isDeadLetterTopic returns whether topicName is a dead-letter topic, whose
+// messages are never dead-lettered again (which would go on forever)
+func isDeadLetterTopic(topicName string) bool {
+	return strings.HasSuffix(strings.TrimSuffix(topicName, "#ephemeral"), deadLetterTopicSuffix)
+}
+
+// deadLetterMessage is the body of a message published to a dead-letter topic
+type deadLetterMessage struct {
+	Topic         string `json:"topic"`
+	Channel       string `json:"channel"`
+	ID            string `json:"id"`
+	Timestamp     int64  `json:"timestamp"`
+	Attempts      uint16 `json:"attempts"`
+	ClientID      string `json:"client_id"`
+	Hostname      string `json:"hostname"`
+	RemoteAddress string `json:"remote_address"`
+	Body          []byte `json:"body"`
+	// why the message was dead-lettered, max_attempts or expired
+	Reason string `json:"reason"`
+}
+
+// the reasons of a deadLetterMessage
+const (
+	deadLetterMaxAttempts = "max_attempts"
+	deadLetterExpired     = "expired"
+)
+
 // Channel represents the concrete type for a NSQ channel (and also
 // implements the Queue interface)
 //
@@ -35,9 +73,16 @@ type Consumer interface {
 // messages, timeouts, requeuing, etc.
 type Channel struct {
 	// 64bit atomic vars need to be first for proper alignment on 32bit platforms
-	requeueCount uint64
-	messageCount uint64
-	timeoutCount uint64
+	requeueCount    uint64
+	messageCount    uint64
+	timeoutCount    uint64
+	deadLetterCount uint64
+	filteredCount   uint64
+	expiredCount    uint64
+
+	// messages dropped or rejected by the backlog quota, see SetBacklogQuota
+	overflowDropped  uint64
+	overflowRejected uint64
 
 	sync.RWMutex
 
@@ -48,16 +93,62 @@ type Channel struct {
 	backend BackendQueue
 
 	memoryMsgChan chan *Message
-	exitFlag      int32
+	// in-memory lanes for messages with priority 1..MaxMsgPriority (index
+	// priority-1), drained before memoryMsgChan by protocolV2.messagePump
+	priorityMsgChans [MaxMsgPriority]chan *Message
+	// signalled when a message is put in a priority lane, to wake up a
+	// messagePump that then takes it with nextPriorityMessage
+	priorityReady chan struct{}
+	// held (for reading) to put to the memory queues, filterMemory holds it
+	// to drain and refill them with no puts in between
+	memoryMutex sync.RWMutex
+	// nil unless the topic is partitioned, in which case it replaces the
+	// memory queues (see enablePartitions)
+	partitions *partitionQueue
+	exitFlag   int32
 	exitMutex     sync.RWMutex
 
 	// state tracking
 	clients        map[int64]Consumer
 	paused         int32
+	resume         resumeTimer // set when paused until a given time, see PauseUntil
 	ephemeral      bool
 	deleteCallback func(*Channel)
 	deleter        sync.Once
 
+	// 0 means fall back to the nsqd-wide --max-attempts
+	maxAttempts int32
+
+	// nanoseconds, the TTL of messages published without one (0 = none)
+	messageTTL int64
+	// 1 if expired messages go to the dead-letter topic
+	deadLetterExpired int32
+
+	// the maximum messages per second delivered to all the clients (0 =
+	// unlimited), see SetMaxDeliveryRate
+	maxDeliveryRate int64
+	deliveryLimiter deliveryLimiter
+
+	// *msgFilter, nil when every message is accepted
+	filter atomic.Value
+
+	// *backlogQuota, nil when the backlog is unbounded
+	quota atomic.Value
+
+	// *backlogTransfer, the running (or last) one, see StartTransfer
+	transfer atomic.Value
+
+	// nil unless --inflight-durability is set, see openJournal
+	journal *inFlightJournal
+
+	// the IDs of queued messages that were deleted, which are dropped as
+	// they come up (see dropPurged), purgedCount is their number, and
+	// purgedFile where they're persisted (see persistPurged)
+	purgeMutex  sync.Mutex
+	purged      map[MessageID]struct{}
+	purgedCount int32
+	purgedFile  string
+
 	// Stats tracking
 	e2eProcessingLatencyStream *quantile.Quantile
 
@@ -78,15 +169,26 @@ func NewChannel(topicName string, channelName string, ctx *context,
 		topicName:      topicName,
 		name:           channelName,
 		memoryMsgChan:  nil, //内存消息通道
+		priorityReady:  make(chan struct{}, 1),
 		clients:        make(map[int64]Consumer), //关联消费者客户端
 		deleteCallback: deleteCallback, //删除回调方法
 		ctx:            ctx, //上下文，nsqd指针
 	}
+	c.filter.Store((*msgFilter)(nil))
+	c.quota.Store((*backlogQuota)(nil))
+	c.transfer.Store((*backlogTransfer)(nil))
 	// create mem-queue only if size > 0 (do not use unbuffered chan)
 	//MemQueueSize默认是10000
 	if ctx.nsqd.getOpts().MemQueueSize > 0 {
 		//开启内存消息通道
 		c.memoryMsgChan = make(chan *Message, ctx.nsqd.getOpts().MemQueueSize)
+		// with no room for them, the priority lanes stay nil and their
+		// messages go to the backend
+		if ctx.nsqd.getOpts().PriorityMemQueueSize > 0 {
+			for i := range c.priorityMsgChans {
+				c.priorityMsgChans[i] = make(chan *Message, ctx.nsqd.getOpts().PriorityMemQueueSize)
+			}
+		}
 	}
 	if len(ctx.nsqd.getOpts().E2EProcessingLatencyPercentiles) > 0 {
 		c.e2eProcessingLatencyStream = quantile.New(
@@ -102,10 +204,6 @@ func NewChannel(topicName string, channelName string, ctx *context,
 		//伪后台队列
 		c.backend = newDummyBackendQueue()
 	} else {
-		dqLogf := func(level diskqueue.LogLevel, f string, args ...interface{}) {
-			opts := ctx.nsqd.getOpts()
-			lg.Logf(opts.Logger, opts.LogLevel, lg.LogLevel(level), f, args...)
-		}
 		// backend names, for uniqueness, automatically include the topic...
 		backendName := getBackendName(topicName, channelName)
 		/**
@@ -122,16 +220,12 @@ func NewChannel(topicName string, channelName string, ctx *context,
 				所以还是写入1文件，然后写文件编号+1，读点重置,后续会写入2文件
 			如果读消息，读了以后，发现读点超过了MaxBytesPerFile，则读文件编号+1，读点重置, 后续从读文件读取
 		 */
-		c.backend = diskqueue.New(
-			backendName, //名称
-			ctx.nsqd.getOpts().DataPath,
-			ctx.nsqd.getOpts().MaxBytesPerFile,//默认100*1024*1024 100M
-			int32(minValidMsgLength), //消息最小长度,空消息
-			int32(ctx.nsqd.getOpts().MaxMsgSize)+minValidMsgLength, //消息最大长度
-			ctx.nsqd.getOpts().SyncEvery, //2500
-			ctx.nsqd.getOpts().SyncTimeout, //2s
-			dqLogf, //日志方法
-		)
+		c.backend = newBackendQueue(ctx, topicName, backendName)
+		c.openJournal(backendName)
+		c.purgedFile = path.Join(ctx.nsqd.getOpts().DataPath, backendName+".purged")
+		if err := c.loadPurged(); err != nil {
+			c.ctx.nsqd.logf(LOG_ERROR, "CHANNEL(%s): failed to load deleted messages - %s", c.name, err)
+		}
 	}
 
 	c.ctx.nsqd.Notify(c) //异步通知，更新元数据 nsqd.dat
@@ -197,15 +291,25 @@ func (c *Channel) exit(deleted bool) error {
 	}
 	c.RUnlock()
 
+	if c.partitions != nil {
+		c.partitions.close()
+	}
+
 	//置空各种队列，包括后台消息队列,inflight,deferer
 	if deleted {
 		// empty the queue (deletes the backend files, too)
 		c.Empty()
+		c.deleteJournal()
 		return c.backend.Delete()
 	}
 
 	// write anything leftover to disk
 	c.flush()
+	// which makes the journal redundant
+	c.deleteJournal()
+	if err := c.persistPurged(); err != nil {
+		c.ctx.nsqd.logf(LOG_ERROR, "CHANNEL(%s): failed to persist deleted messages - %s", c.name, err)
+	}
 	return c.backend.Close()
 }
 
@@ -218,15 +322,24 @@ func (c *Channel) Empty() error {
 		client.Empty()
 	}
 	//置空内存消息队列
-	for {
-		select {
-		case <-c.memoryMsgChan:
-		default:
-			goto finish
+	for _, msgChan := range c.msgChans() {
+	drain:
+		for {
+			select {
+			case <-msgChan:
+			default:
+				break drain
+			}
 		}
 	}
+	if c.partitions != nil {
+		c.partitions.empty()
+	}
+	if c.journal != nil {
+		c.journal.Compact()
+	}
+	c.clearPurged()
 
-finish:
 	return c.backend.Empty()
 }
 
@@ -235,24 +348,37 @@ finish:
 func (c *Channel) flush() error {
 	var msgBuf bytes.Buffer
 
-	if len(c.memoryMsgChan) > 0 || len(c.inFlightMessages) > 0 || len(c.deferredMessages) > 0 {
+	memDepth := c.memoryDepth()
+	if memDepth > 0 || len(c.inFlightMessages) > 0 || len(c.deferredMessages) > 0 {
 		c.ctx.nsqd.logf(LOG_INFO, "CHANNEL(%s): flushing %d memory %d in-flight %d deferred messages to backend",
-			c.name, len(c.memoryMsgChan), len(c.inFlightMessages), len(c.deferredMessages))
+			c.name, memDepth, len(c.inFlightMessages), len(c.deferredMessages))
 	}
 
-	for {
-		select {
-		case msg := <-c.memoryMsgChan:
+	// highest priority first so that those are read back first
+	msgChans := c.msgChans()
+	for i := len(msgChans) - 1; i >= 0; i-- {
+	drain:
+		for {
+			select {
+			case msg := <-msgChans[i]:
+				err := writeMessageToBackend(&msgBuf, msg, c.backend)
+				if err != nil {
+					c.ctx.nsqd.logf(LOG_ERROR, "failed to write message to backend - %s", err)
+				}
+			default:
+				break drain
+			}
+		}
+	}
+	if c.partitions != nil {
+		for _, msg := range c.partitions.messages() {
 			err := writeMessageToBackend(&msgBuf, msg, c.backend)
 			if err != nil {
 				c.ctx.nsqd.logf(LOG_ERROR, "failed to write message to backend - %s", err)
 			}
-		default:
-			goto finish
 		}
 	}
 
-finish:
 	c.inFlightMutex.Lock()
 	for _, msg := range c.inFlightMessages {
 		err := writeMessageToBackend(&msgBuf, msg, c.backend)
@@ -275,18 +401,224 @@ finish:
 	return nil
 }
 
+// Peek returns (up to) the next n messages queued in the channel, i.e.
+// not in flight nor deferred, without consuming them
+//
+// a Go channel can't be peeked, so the memory queues are drained and
+// refilled as they were (see filterMemory, clients only wait for them
+// meanwhile) and the backend is read as is
+func (c *Channel) Peek(n int) ([]*Message, error) {
+	c.exitMutex.RLock()
+	defer c.exitMutex.RUnlock()
+	if c.Exiting() {
+		return nil, errors.New("exiting")
+	}
+
+	var msgs []*Message
+	if c.partitions != nil {
+		for _, msg := range c.partitions.messages() {
+			if !c.isPurged(msg.ID) {
+				msgs = append(msgs, msg)
+			}
+		}
+	} else {
+		c.filterMemory(func(msg *Message) bool {
+			// copied while it can't be in flight
+			peeked := *msg
+			msgs = append(msgs, &peeked)
+			return true
+		})
+	}
+	if len(msgs) >= n {
+		return msgs[:n], nil
+	}
+
+	err := c.scanBackend(func(msg *Message) bool {
+		msgs = append(msgs, msg)
+		return len(msgs) < n
+	})
+	if err != nil {
+		return nil, err
+	}
+	return msgs, nil
+}
+
+// filterMemory drains the memory queues, highest priority first as
+// they're delivered, and puts back the messages fn keeps in their order
+//
+// puts are held off meanwhile, so the messages kept always fit back
+//
+// this expects the caller to hold exitMutex
+func (c *Channel) filterMemory(fn func(msg *Message) bool) {
+	c.memoryMutex.Lock()
+	defer c.memoryMutex.Unlock()
+	msgChans := c.msgChans()
+	for i := len(msgChans) - 1; i >= 0; i-- {
+		var drained []*Message
+	drain:
+		for {
+			select {
+			case msg := <-msgChans[i]:
+				drained = append(drained, msg)
+			default:
+				break drain
+			}
+		}
+		for _, msg := range drained {
+			if fn(msg) {
+				msgChans[i] <- msg
+			}
+		}
+	}
+	// for the messages put back in the priority lanes
+	c.signalPriority()
+}
+
+// scanBackend calls fn with the messages in the backend, in order and
+// skipping the purged ones, until it returns false
+func (c *Channel) scanBackend(fn func(msg *Message) bool) error {
+	bs, ok := c.backend.(backendScanner)
+	if !ok {
+		return nil
+	}
+	var err error
+	scanErr := bs.Scan(func(b []byte) bool {
+		var msg *Message
+		msg, err = decodeMessage(b)
+		if err != nil {
+			return false
+		}
+		if c.isPurged(msg.ID) {
+			return true
+		}
+		return fn(msg)
+	})
+	if scanErr != nil {
+		return scanErr
+	}
+	return err
+}
+
 func (c *Channel) Depth() int64 {
-	return int64(len(c.memoryMsgChan)) + c.backend.Depth()
+	return c.memoryDepth() + c.backend.Depth()
+}
+
+// msgChans returns the in-memory queues ordered by priority (lowest first)
+func (c *Channel) msgChans() []chan *Message {
+	msgChans := make([]chan *Message, 0, len(c.priorityMsgChans)+1)
+	msgChans = append(msgChans, c.memoryMsgChan)
+	return append(msgChans, c.priorityMsgChans[:]...)
+}
+
+func (c *Channel) memoryDepth() int64 {
+	depth := int64(len(c.memoryMsgChan))
+	for _, msgChan := range c.priorityMsgChans {
+		depth += int64(len(msgChan))
+	}
+	if c.partitions != nil {
+		depth += c.partitions.Depth()
+	}
+	return depth
+}
+
+// enablePartitions switches the channel to ordered delivery of n partitions
+// (see partitionQueue), it's expected to be called before the channel is
+// used at all
+func (c *Channel) enablePartitions(n int) {
+	if n > 0 {
+		c.partitions = newPartitionQueue(c, n)
+	}
+}
+
+// partitionMsgChan returns the channel delivering the messages of a
+// partitioned channel, nil otherwise
+func (c *Channel) partitionMsgChan() chan *Message {
+	if c.partitions == nil {
+		return nil
+	}
+	return c.partitions.msgChan
+}
+
+// releasePartition unblocks the partition of msg (if partitioned) once msg
+// is done with, other than by being requeued
+func (c *Channel) releasePartition(msg *Message) {
+	if c.partitions != nil {
+		c.partitions.release(msg)
+	}
+}
+
+// signalPriority wakes up a messagePump waiting on the priority lanes, if
+// none is already about to check them
+func (c *Channel) signalPriority() {
+	select {
+	case c.priorityReady <- struct{}{}:
+	default:
+	}
+}
+
+// nextPriorityMessage returns a message from the highest priority non-empty
+// lane without blocking, or nil if they're all empty
+//
+// a single messagePump is woken up per signalPriority, so it passes the
+// signal on when it leaves messages behind
+func (c *Channel) nextPriorityMessage() *Message {
+	for i := len(c.priorityMsgChans) - 1; i >= 0; i-- {
+		select {
+		case msg := <-c.priorityMsgChans[i]:
+			for _, msgChan := range c.priorityMsgChans {
+				if len(msgChan) > 0 {
+					c.signalPriority()
+					break
+				}
+			}
+			return msg
+		default:
+		}
+	}
+	return nil
+}
+
+// PriorityDepths returns the number of in-memory messages at each priority
+func (c *Channel) PriorityDepths() []int64 {
+	depths := make([]int64, 0, len(c.priorityMsgChans)+1)
+	for _, msgChan := range c.msgChans() {
+		depths = append(depths, int64(len(msgChan)))
+	}
+	return depths
 }
 
 func (c *Channel) Pause() error {
+	return c.PauseUntil(time.Time{})
+}
+
+// PauseUntil pauses the channel until resumeAt, or indefinitely if it's
+// zero
+func (c *Channel) PauseUntil(resumeAt time.Time) error {
+	c.resume.set(resumeAt, c.autoResume)
 	return c.doPause(true)
 }
 
 func (c *Channel) UnPause() error {
+	c.resume.set(time.Time{}, nil)
 	return c.doPause(false)
 }
 
+// ResumeAt returns when the paused channel resumes, zero if it doesn't
+func (c *Channel) ResumeAt() time.Time {
+	return c.resume.get()
+}
+
+func (c *Channel) autoResume() {
+	if c.Exiting() {
+		return
+	}
+	c.ctx.nsqd.logf(LOG_INFO, "CHANNEL(%s): resuming as scheduled", c.name)
+	c.doPause(false)
+	c.ctx.nsqd.Lock()
+	c.ctx.nsqd.PersistMetadata()
+	c.ctx.nsqd.Unlock()
+}
+
 func (c *Channel) doPause(pause bool) error {
 	if pause {
 		atomic.StoreInt32(&c.paused, 1)
@@ -317,6 +649,9 @@ func (c *Channel) PutMessage(m *Message) error {
 	if c.Exiting() {
 		return errors.New("exiting")
 	}
+	if !c.makeRoom() {
+		return nil
+	}
 	err := c.put(m) //
 	if err != nil {
 		return err
@@ -326,8 +661,20 @@ func (c *Channel) PutMessage(m *Message) error {
 }
 
 func (c *Channel) put(m *Message) error {
+	if c.partitions != nil {
+		return c.partitions.put(m)
+	}
+	msgChan := c.memoryMsgChan
+	if m.Priority > 0 {
+		msgChan = c.priorityMsgChans[m.Priority-1]
+	}
+	c.memoryMutex.RLock()
+	defer c.memoryMutex.RUnlock()
 	select {
-	case c.memoryMsgChan <- m: //存入channel的内存消息通过
+	case msgChan <- m: //存入channel的内存消息通过
+		if m.Priority > 0 {
+			c.signalPriority()
+		}
 	default:
 		b := bufferPoolGet()
 		err := writeMessageToBackend(b, m, c.backend)
@@ -378,6 +725,8 @@ func (c *Channel) FinishMessage(clientID int64, id MessageID) error {
 		return err
 	}
 	c.removeFromInFlightPQ(msg)
+	c.releasePartition(msg)
+	c.journalClear(id)
 	if c.e2eProcessingLatencyStream != nil {
 		c.e2eProcessingLatencyStream.Insert(msg.Timestamp)
 	}
@@ -399,6 +748,12 @@ func (c *Channel) RequeueMessage(clientID int64, id MessageID, timeout time.Dura
 	c.removeFromInFlightPQ(msg)
 	atomic.AddUint64(&c.requeueCount, 1)
 
+	if c.exceedsMaxAttempts(msg) && c.deadLetter(msg, deadLetterMaxAttempts) == nil {
+		c.releasePartition(msg)
+		c.journalClear(id)
+		return nil
+	}
+
 	if timeout == 0 {
 		c.exitMutex.RLock()
 		if c.Exiting() {
@@ -407,6 +762,9 @@ func (c *Channel) RequeueMessage(clientID int64, id MessageID, timeout time.Dura
 		}
 		err := c.put(msg)
 		c.exitMutex.RUnlock()
+		if err == nil {
+			c.journalClear(id)
+		}
 		return err
 	}
 
@@ -414,6 +772,296 @@ func (c *Channel) RequeueMessage(clientID int64, id MessageID, timeout time.Dura
 	return c.StartDeferredTimeout(msg, timeout)
 }
 
+// SetMaxAttempts sets the number of delivery attempts after which a message
+// is moved to the dead-letter topic (0 uses the nsqd-wide default)
+func (c *Channel) SetMaxAttempts(maxAttempts uint16) {
+	atomic.StoreInt32(&c.maxAttempts, int32(maxAttempts))
+}
+
+// MaxAttempts returns the effective max attempts for this channel,
+// 0 meaning messages are requeued forever
+func (c *Channel) MaxAttempts() uint16 {
+	maxAttempts := uint16(atomic.LoadInt32(&c.maxAttempts))
+	if maxAttempts == 0 {
+		maxAttempts = c.ctx.nsqd.getOpts().MaxAttempts
+	}
+	return maxAttempts
+}
+
+// SetFilter sets the filter expression messages must match to be copied
+// into this channel (see msgFilter), an empty expression clears it
+func (c *Channel) SetFilter(expr string) error {
+	var f *msgFilter
+	if expr != "" {
+		var err error
+		f, err = parseFilter(expr)
+		if err != nil {
+			return err
+		}
+	}
+	c.Lock()
+	c.filter.Store(f)
+	c.Unlock()
+	return nil
+}
+
+// Filter returns the filter expression of this channel
+func (c *Channel) Filter() string {
+	f := c.filter.Load().(*msgFilter)
+	if f == nil {
+		return ""
+	}
+	return f.String()
+}
+
+// SetBacklogQuota bounds the backlog of the channel to maxMsgs messages
+// and/or maxBytes bytes on disk (0 is unlimited), policy (reject,
+// drop_oldest or drop_new, reject if empty) is what happens to messages
+// once it's full
+//
+// reject applies to publishes to the topic, so a full channel holds up
+// the others
+func (c *Channel) SetBacklogQuota(maxMsgs int64, maxBytes int64, policy string) error {
+	q, err := newBacklogQuota(maxMsgs, maxBytes, policy)
+	if err != nil {
+		return err
+	}
+	if q != nil && q.policy == overflowDropOldest && c.partitions != nil {
+		// the partitions keep track of what's left in the backend
+		return errors.New("drop_oldest is not supported by partitioned topics")
+	}
+	c.quota.Store(q)
+	return nil
+}
+
+// BacklogQuota returns the backlog limits and overflow policy of the channel
+func (c *Channel) BacklogQuota() (int64, int64, string) {
+	return c.backlogQuota().values()
+}
+
+func (c *Channel) backlogQuota() *backlogQuota {
+	return c.quota.Load().(*backlogQuota)
+}
+
+// BacklogBytes returns the size of the backlog of the channel on disk
+func (c *Channel) BacklogBytes() int64 {
+	return backendSize(c.backend)
+}
+
+// makeRoom applies the overflow policy of the channel ahead of a message
+// being put, it returns false if the message is to be dropped
+//
+// publishes over a reject quota are turned down by the topic (see
+// Topic.checkBacklog), so those that get here anyway are let through
+func (c *Channel) makeRoom() bool {
+	q := c.backlogQuota()
+	depth := c.Depth()
+	if !q.full(depth, c.BacklogBytes()) {
+		return true
+	}
+	switch q.policy {
+	case overflowDropNew:
+		atomic.AddUint64(&c.overflowDropped, 1)
+		return false
+	case overflowDropOldest:
+		// the depth of a diskqueue lags behind its reads
+		for q.full(depth, c.BacklogBytes()) && dropQueued(c.backend, c.msgChans()...) {
+			atomic.AddUint64(&c.overflowDropped, 1)
+			depth--
+		}
+	}
+	return true
+}
+
+// matches returns whether or not msg passes the channel filter
+func (c *Channel) matches(msg *Message) bool {
+	f := c.filter.Load().(*msgFilter)
+	return f == nil || f.Match(msg)
+}
+
+// accepts is matches, counting the messages that are filtered out
+func (c *Channel) accepts(msg *Message) bool {
+	if c.matches(msg) {
+		return true
+	}
+	atomic.AddUint64(&c.filteredCount, 1)
+	return false
+}
+
+// SetMessageTTL sets how long after being published the messages that
+// weren't published with a TTL expire, 0 disables it
+func (c *Channel) SetMessageTTL(ttl time.Duration) {
+	atomic.StoreInt64(&c.messageTTL, int64(ttl))
+}
+
+// MessageTTL returns the default TTL of the messages of this channel
+func (c *Channel) MessageTTL() time.Duration {
+	return time.Duration(atomic.LoadInt64(&c.messageTTL))
+}
+
+// SetDeadLetterExpired sets whether expired messages are moved to the
+// dead-letter topic rather than dropped
+func (c *Channel) SetDeadLetterExpired(enabled bool) {
+	var v int32
+	if enabled {
+		v = 1
+	}
+	atomic.StoreInt32(&c.deadLetterExpired, v)
+}
+
+// DeadLetterExpired returns whether expired messages are dead-lettered
+func (c *Channel) DeadLetterExpired() bool {
+	return atomic.LoadInt32(&c.deadLetterExpired) == 1
+}
+
+// SetMaxDeliveryRate sets the maximum messages per second the channel
+// delivers, across all of its clients, 0 is unlimited
+func (c *Channel) SetMaxDeliveryRate(rate int64) {
+	atomic.StoreInt64(&c.maxDeliveryRate, rate)
+}
+
+// MaxDeliveryRate returns the maximum messages per second the channel
+// delivers
+func (c *Channel) MaxDeliveryRate() int64 {
+	return atomic.LoadInt64(&c.maxDeliveryRate)
+}
+
+// reserveDelivery reserves the delivery of a message to a client, which
+// is then either made (see delivering) or released (see releaseDelivery),
+// returning false and how long to wait if the channel is over its rate
+//
+// nothing is reserved, and there's no wait, if the rate isn't limited
+func (c *Channel) reserveDelivery(now time.Time) (bool, time.Duration) {
+	rate := c.MaxDeliveryRate()
+	if rate <= 0 {
+		return false, 0
+	}
+	delay := c.deliveryLimiter.reserve(rate, now)
+	return delay == 0, delay
+}
+
+// releaseDelivery gives back a delivery reserved with reserveDelivery
+func (c *Channel) releaseDelivery() {
+	c.deliveryLimiter.release()
+}
+
+// delivering accounts for a message about to be sent to a client, which
+// made its delivery reserved (if it was, the message was taken while the
+// rate wasn't limited otherwise)
+func (c *Channel) delivering(now time.Time, reserved bool) {
+	if !reserved {
+		return
+	}
+	c.deliveryLimiter.delivered(now)
+}
+
+// DeliveryRate returns the messages per second the channel delivered over
+// the last second, only measured while its delivery rate is limited
+func (c *Channel) DeliveryRate() float64 {
+	if c.MaxDeliveryRate() <= 0 {
+		return 0
+	}
+	return c.deliveryLimiter.rate(time.Now())
+}
+
+// expired returns whether msg expired at now, per its own TTL or else the
+// channel default
+func (c *Channel) expired(msg *Message, now int64) bool {
+	if msg.Expires > 0 {
+		return now >= msg.Expires
+	}
+	ttl := atomic.LoadInt64(&c.messageTTL)
+	return ttl > 0 && now >= msg.Timestamp+ttl
+}
+
+// dropExpired discards msg, about to be delivered, if it expired, moving it
+// to the dead-letter topic if enabled
+func (c *Channel) dropExpired(msg *Message, now int64) bool {
+	if !c.expired(msg, now) {
+		return false
+	}
+	atomic.AddUint64(&c.expiredCount, 1)
+	if c.DeadLetterExpired() && !isDeadLetterTopic(c.topicName) {
+		// an expired message is of no use, it's dropped even if this fails
+		c.deadLetter(msg, deadLetterExpired)
+	}
+	c.releasePartition(msg)
+	return true
+}
+
+// exceedsMaxAttempts returns whether msg is due to be dead-lettered, which
+// never is on a dead-letter topic, whose messages are requeued as usual
+func (c *Channel) exceedsMaxAttempts(msg *Message) bool {
+	if isDeadLetterTopic(c.topicName) {
+		return false
+	}
+	maxAttempts := c.MaxAttempts()
+	return maxAttempts > 0 && msg.Attempts >= maxAttempts
+}
+
+// deadLetter publishes a message that exceeded MaxAttempts (or expired) to
+// the companion dead-letter topic, wrapped with metadata about where it came
+// from.
+//
+// On error the caller is expected to requeue the message as usual so
+// that it is never silently lost.
+func (c *Channel) deadLetter(msg *Message, reason string) error {
+	var clientID, hostname, remoteAddress string
+	c.RLock()
+	client, ok := c.clients[msg.clientID]
+	c.RUnlock()
+	if ok {
+		stats := client.Stats()
+		clientID = stats.ClientID
+		hostname = stats.Hostname
+		remoteAddress = stats.RemoteAddress
+	}
+
+	err := c.putDeadLetter(msg, &deadLetterMessage{
+		Topic:         c.topicName,
+		Channel:       c.name,
+		ID:            string(msg.ID[:]),
+		Timestamp:     msg.Timestamp,
+		Attempts:      msg.Attempts,
+		ClientID:      clientID,
+		Hostname:      hostname,
+		RemoteAddress: remoteAddress,
+		Body:          msg.Body,
+		Reason:        reason,
+	})
+	if err != nil {
+		c.ctx.nsqd.logf(LOG_ERROR, "CHANNEL(%s): failed to dead-letter msg(%s), requeueing - %s",
+			c.name, msg.ID, err)
+		return err
+	}
+
+	atomic.AddUint64(&c.deadLetterCount, 1)
+	return nil
+}
+
+func (c *Channel) putDeadLetter(msg *Message, dl *deadLetterMessage) error {
+	topicName := deadLetterTopicName(c.topicName)
+	if !protocol.IsValidTopicName(topicName) {
+		return fmt.Errorf("dead-letter topic name %q is not valid", topicName)
+	}
+
+	body, err := json.Marshal(dl)
+	if err != nil {
+		return err
+	}
+	if int64(len(body)) > c.ctx.nsqd.getOpts().MaxMsgSize {
+		return fmt.Errorf("dead-letter message too big %d > %d",
+			len(body), c.ctx.nsqd.getOpts().MaxMsgSize)
+	}
+
+	topic := c.ctx.nsqd.GetTopic(topicName)
+	dlMsg := NewMessage(topic.GenerateID(), body)
+	dlMsg.Headers = msg.Headers
+	dlMsg.Priority = msg.Priority
+	dlMsg.PartitionKey = msg.PartitionKey
+	return topic.PutMessage(dlMsg)
+}
+
 // AddClient adds a client to the Channel's client list
 func (c *Channel) AddClient(clientID int64, client Consumer) error {
 	c.Lock()
@@ -464,6 +1112,7 @@ func (c *Channel) StartInFlightTimeout(msg *Message, clientID int64, timeout tim
 		return err
 	}
 	c.addToInFlightPQ(msg)
+	c.journalSet(msg, 0)
 	return nil
 }
 
@@ -475,6 +1124,7 @@ func (c *Channel) StartDeferredTimeout(msg *Message, timeout time.Duration) erro
 		return err
 	}
 	c.addToDeferredPQ(item)
+	c.journalSet(msg, absTs)
 	return nil
 }
 
@@ -582,7 +1232,13 @@ func (c *Channel) processDeferredQueue(t int64) bool {
 		if err != nil {
 			goto exit
 		}
-		c.put(msg)
+		if c.dropExpired(msg, t) {
+			c.journalClear(msg.ID)
+			continue
+		}
+		if c.put(msg) == nil {
+			c.journalClear(msg.ID)
+		}
 	}
 
 exit:
@@ -619,9 +1275,128 @@ func (c *Channel) processInFlightQueue(t int64) bool {
 		if ok {
 			client.TimedOutMessage()
 		}
-		c.put(msg)
+		if c.exceedsMaxAttempts(msg) && c.deadLetter(msg, deadLetterMaxAttempts) == nil {
+			c.releasePartition(msg)
+			c.journalClear(msg.ID)
+			continue
+		}
+		if c.put(msg) == nil {
+			c.journalClear(msg.ID)
+		}
 	}
 
 exit:
 	return dirty
 }
+
+// openJournal restores the messages that were in flight or deferred when
+// nsqd was last killed, if it was, and keeps a journal of them from now on
+// unless --inflight-durability is none (see inFlightJournal)
+func (c *Channel) openJournal(backendName string) {
+	opts := c.ctx.nsqd.getOpts()
+	fileName := path.Join(opts.DataPath, backendName+".inflight.dat")
+	if opts.InFlightDurability == inFlightDurabilityNone {
+		if _, err := os.Stat(fileName); err != nil {
+			return
+		}
+	}
+
+	j, entries, err := openInFlightJournal(fileName, opts.InFlightDurability)
+	if err != nil {
+		c.ctx.nsqd.logf(LOG_ERROR, "CHANNEL(%s): failed to open in-flight journal - %s", c.name, err)
+		return
+	}
+	if len(entries) > 0 {
+		c.ctx.nsqd.logf(LOG_INFO, "CHANNEL(%s): restoring %d in-flight/deferred messages from journal",
+			c.name, len(entries))
+	}
+
+	// in-flight messages go back to the queue (through the backend, to not
+	// depend on the memory queue) and deferred ones stay deferred, they're
+	// already journaled as such
+	var msgBuf bytes.Buffer
+	now := time.Now().UnixNano()
+	for _, e := range entries {
+		if e.deadline > now {
+			item := &pqueue.Item{Value: e.msg, Priority: e.deadline}
+			if c.pushDeferredMessage(item) == nil {
+				c.addToDeferredPQ(item)
+			}
+			continue
+		}
+		err := writeMessageToBackend(&msgBuf, e.msg, c.backend)
+		if err != nil {
+			c.ctx.nsqd.logf(LOG_ERROR, "CHANNEL(%s): failed to write message to backend - %s", c.name, err)
+			continue
+		}
+		j.clear(e.msg.ID)
+	}
+
+	if opts.InFlightDurability == inFlightDurabilityNone {
+		j.Delete()
+		return
+	}
+	j.entries = c.journalEntries
+	c.journal = j
+}
+
+// journalEntries returns the messages in flight and deferred, see
+// inFlightJournal.compact
+func (c *Channel) journalEntries() []journalEntry {
+	var entries []journalEntry
+	c.inFlightMutex.Lock()
+	for _, msg := range c.inFlightMessages {
+		entries = append(entries, journalEntry{msg, 0})
+	}
+	c.inFlightMutex.Unlock()
+	c.deferredMutex.Lock()
+	for _, item := range c.deferredMessages {
+		entries = append(entries, journalEntry{item.Value.(*Message), item.Priority})
+	}
+	c.deferredMutex.Unlock()
+	return entries
+}
+
+// journalSet journals msg as in flight (deadline 0) or deferred until
+// deadline
+func (c *Channel) journalSet(msg *Message, deadline int64) {
+	if c.journal == nil {
+		return
+	}
+	err := c.journal.set(msg, deadline)
+	if err != nil {
+		c.ctx.nsqd.logf(LOG_ERROR, "CHANNEL(%s): failed to journal msg(%s) - %s", c.name, msg.ID, err)
+	}
+}
+
+// journalClear journals that the message id is done with (finished,
+// requeued or dropped)
+func (c *Channel) journalClear(id MessageID) {
+	if c.journal == nil {
+		return
+	}
+	err := c.journal.clear(id)
+	if err != nil {
+		c.ctx.nsqd.logf(LOG_ERROR, "CHANNEL(%s): failed to journal msg(%s) - %s", c.name, id, err)
+	}
+}
+
+func (c *Channel) flushJournal() {
+	if c.journal == nil {
+		return
+	}
+	err := c.journal.Flush()
+	if err != nil {
+		c.ctx.nsqd.logf(LOG_ERROR, "CHANNEL(%s): failed to write in-flight journal - %s", c.name, err)
+	}
+}
+
+func (c *Channel) deleteJournal() {
+	if c.journal == nil {
+		return
+	}
+	err := c.journal.Delete()
+	if err != nil {
+		c.ctx.nsqd.logf(LOG_ERROR, "CHANNEL(%s): failed to delete in-flight journal - %s", c.name, err)
+	}
+}
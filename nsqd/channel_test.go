@@ -1,11 +1,13 @@
 package nsqd
 
 import (
+	"encoding/json"
 	"fmt"
 	"io/ioutil"
 	"net/http"
 	"os"
 	"strconv"
+	"sync/atomic"
 	"testing"
 	"time"
 
@@ -137,6 +139,137 @@ func TestChannelEmpty(t *testing.T) {
 	test.Equal(t, int64(0), channel.Depth())
 }
 
+func TestChannelDeadLetter(t *testing.T) {
+	opts := NewOptions()
+	opts.Logger = test.NewTestLogger(t)
+	opts.MaxAttempts = 3
+	_, _, nsqd := mustStartNSQD(opts)
+	defer os.RemoveAll(opts.DataPath)
+	defer nsqd.Exit()
+
+	topicName := "test_channel_dead_letter" + strconv.Itoa(int(time.Now().Unix()))
+	topic := nsqd.GetTopic(topicName)
+	channel := topic.GetChannel("channel")
+	test.Equal(t, uint16(3), channel.MaxAttempts())
+
+	msg := NewMessage(topic.GenerateID(), []byte("test"))
+	msg.Attempts = 2
+	channel.StartInFlightTimeout(msg, 0, opts.MsgTimeout)
+	err := channel.RequeueMessage(0, msg.ID, 0)
+	test.Nil(t, err)
+	test.Equal(t, int64(1), channel.Depth())
+
+	msg = <-channel.memoryMsgChan
+	msg.Attempts++
+	channel.StartInFlightTimeout(msg, 0, opts.MsgTimeout)
+	err = channel.RequeueMessage(0, msg.ID, 0)
+	test.Nil(t, err)
+	test.Equal(t, int64(0), channel.Depth())
+	test.Equal(t, uint64(1), atomic.LoadUint64(&channel.deadLetterCount))
+
+	dlTopic, err := nsqd.GetExistingTopic(topicName + ".dead_letter")
+	test.Nil(t, err)
+	dlMsg := <-dlTopic.memoryMsgChan
+
+	var dl deadLetterMessage
+	err = json.Unmarshal(dlMsg.Body, &dl)
+	test.Nil(t, err)
+	test.Equal(t, topicName, dl.Topic)
+	test.Equal(t, "channel", dl.Channel)
+	test.Equal(t, string(msg.ID[:]), dl.ID)
+	test.Equal(t, uint16(3), dl.Attempts)
+	test.Equal(t, []byte("test"), dl.Body)
+	test.Equal(t, "max_attempts", dl.Reason)
+
+	// a per-channel setting overrides the nsqd-wide default
+	channel.SetMaxAttempts(10)
+	test.Equal(t, uint16(10), channel.MaxAttempts())
+	msg = NewMessage(topic.GenerateID(), []byte("test"))
+	msg.Attempts = 3
+	channel.StartInFlightTimeout(msg, 0, opts.MsgTimeout)
+	channel.RequeueMessage(0, msg.ID, 0)
+	test.Equal(t, int64(1), channel.Depth())
+	test.Equal(t, uint64(1), atomic.LoadUint64(&channel.deadLetterCount))
+}
+
+func TestChannelDeadLetterTopicNotDeadLettered(t *testing.T) {
+	opts := NewOptions()
+	opts.Logger = test.NewTestLogger(t)
+	opts.MaxAttempts = 1
+	_, _, nsqd := mustStartNSQD(opts)
+	defer os.RemoveAll(opts.DataPath)
+	defer nsqd.Exit()
+
+	topicName := "test_channel_dead_letter_loop" + strconv.Itoa(int(time.Now().Unix())) + ".dead_letter"
+	topic := nsqd.GetTopic(topicName)
+	channel := topic.GetChannel("channel")
+
+	msg := NewMessage(topic.GenerateID(), []byte("test"))
+	msg.Attempts = 5
+	channel.StartInFlightTimeout(msg, 0, opts.MsgTimeout)
+	err := channel.RequeueMessage(0, msg.ID, 0)
+	test.Nil(t, err)
+	test.Equal(t, int64(1), channel.Depth())
+	test.Equal(t, uint64(0), atomic.LoadUint64(&channel.deadLetterCount))
+
+	// nor are its expired messages
+	channel.SetDeadLetterExpired(true)
+	msg = <-channel.memoryMsgChan
+	msg.Expires = time.Now().UnixNano()
+	test.Equal(t, true, channel.dropExpired(msg, time.Now().UnixNano()))
+	test.Equal(t, uint64(0), atomic.LoadUint64(&channel.deadLetterCount))
+
+	_, err = nsqd.GetExistingTopic(topicName + ".dead_letter")
+	test.NotNil(t, err)
+}
+
+func TestChannelMessageTTL(t *testing.T) {
+	opts := NewOptions()
+	opts.Logger = test.NewTestLogger(t)
+	_, _, nsqd := mustStartNSQD(opts)
+	defer os.RemoveAll(opts.DataPath)
+	defer nsqd.Exit()
+
+	topicName := "test_channel_message_ttl" + strconv.Itoa(int(time.Now().Unix()))
+	topic := nsqd.GetTopic(topicName)
+	channel := topic.GetChannel("channel")
+	now := time.Now().UnixNano()
+
+	msg := NewMessage(topic.GenerateID(), []byte("test"))
+	msg.Timestamp = now - int64(2*time.Hour)
+	test.Equal(t, false, channel.expired(msg, now))
+	channel.SetMessageTTL(time.Hour)
+	test.Equal(t, true, channel.expired(msg, now))
+
+	// the TTL of the message takes precedence
+	msg.Expires = now + int64(time.Minute)
+	test.Equal(t, false, channel.expired(msg, now))
+	msg.Expires = now
+	test.Equal(t, true, channel.expired(msg, now))
+
+	// expired deferred messages are dropped when due
+	channel.PutMessageDeferred(msg, time.Millisecond)
+	channel.processDeferredQueue(time.Now().Add(time.Second).UnixNano())
+	test.Equal(t, int64(0), channel.Depth())
+	test.Equal(t, uint64(1), atomic.LoadUint64(&channel.expiredCount))
+
+	// and can go to the dead-letter topic
+	channel.SetDeadLetterExpired(true)
+	msg = NewMessage(topic.GenerateID(), []byte("test"))
+	msg.Expires = now
+	test.Equal(t, true, channel.dropExpired(msg, now))
+	test.Equal(t, uint64(2), atomic.LoadUint64(&channel.expiredCount))
+
+	dlTopic, err := nsqd.GetExistingTopic(topicName + ".dead_letter")
+	test.Nil(t, err)
+	dlMsg := <-dlTopic.memoryMsgChan
+	var dl deadLetterMessage
+	err = json.Unmarshal(dlMsg.Body, &dl)
+	test.Nil(t, err)
+	test.Equal(t, string(msg.ID[:]), dl.ID)
+	test.Equal(t, "expired", dl.Reason)
+}
+
 func TestChannelEmptyConsumer(t *testing.T) {
 	opts := NewOptions()
 	opts.Logger = test.NewTestLogger(t)
@@ -248,3 +381,158 @@ func TestChannelHealth(t *testing.T) {
 	resp.Body.Close()
 	test.Equal(t, "OK", string(body))
 }
+
+func TestChannelPriorityBackend(t *testing.T) {
+	opts := NewOptions()
+	opts.Logger = test.NewTestLogger(t)
+	opts.MemQueueSize = 0
+	_, _, nsqd := mustStartNSQD(opts)
+	defer os.RemoveAll(opts.DataPath)
+	defer nsqd.Exit()
+
+	topicName := "test_channel_priority" + strconv.Itoa(int(time.Now().Unix()))
+	channel := nsqd.GetTopic(topicName).GetChannel("ch")
+
+	msg := NewMessage(nsqd.GetTopic(topicName).GenerateID(), []byte("test"))
+	msg.Priority = 2
+	err := channel.PutMessage(msg)
+	test.Nil(t, err)
+	test.Equal(t, int64(1), channel.backend.Depth())
+
+	msgOut, err := decodeMessage(<-channel.backend.ReadChan())
+	test.Nil(t, err)
+	test.Equal(t, msg.ID, msgOut.ID)
+	test.Equal(t, uint8(2), msgOut.Priority)
+}
+
+func TestChannelNextPriorityMessage(t *testing.T) {
+	opts := NewOptions()
+	opts.Logger = test.NewTestLogger(t)
+	_, _, nsqd := mustStartNSQD(opts)
+	defer os.RemoveAll(opts.DataPath)
+	defer nsqd.Exit()
+
+	topicName := "test_channel_next_priority" + strconv.Itoa(int(time.Now().Unix()))
+	topic := nsqd.GetTopic(topicName)
+	channel := topic.GetChannel("ch")
+
+	for _, pri := range []uint8{1, MaxMsgPriority} {
+		msg := NewMessage(topic.GenerateID(), []byte("test"))
+		msg.Priority = pri
+		channel.PutMessage(msg)
+	}
+	<-channel.priorityReady
+
+	// the signal is passed on as long as messages are left behind
+	test.Equal(t, uint8(MaxMsgPriority), channel.nextPriorityMessage().Priority)
+	test.Equal(t, 1, len(channel.priorityReady))
+	<-channel.priorityReady
+	test.Equal(t, uint8(1), channel.nextPriorityMessage().Priority)
+	test.Equal(t, 0, len(channel.priorityReady))
+	test.Nil(t, channel.nextPriorityMessage())
+}
+
+func TestChannelPriorityMemQueueSize(t *testing.T) {
+	opts := NewOptions()
+	opts.Logger = test.NewTestLogger(t)
+	opts.MemQueueSize = 100
+	opts.PriorityMemQueueSize = 10
+	_, _, nsqd := mustStartNSQD(opts)
+	defer os.RemoveAll(opts.DataPath)
+	defer nsqd.Exit()
+
+	topicName := "test_channel_priority_mem_queue_size" + strconv.Itoa(int(time.Now().Unix()))
+	channel := nsqd.GetTopic(topicName).GetChannel("ch")
+
+	// the priority lanes don't take from --mem-queue-size
+	test.Equal(t, 100, cap(channel.memoryMsgChan))
+	for _, msgChan := range channel.priorityMsgChans {
+		test.Equal(t, 10, cap(msgChan))
+	}
+}
+
+func TestChannelPeek(t *testing.T) {
+	opts := NewOptions()
+	opts.Logger = test.NewTestLogger(t)
+	opts.MemQueueSize = 2
+	_, _, nsqd := mustStartNSQD(opts)
+	defer os.RemoveAll(opts.DataPath)
+	defer nsqd.Exit()
+
+	topicName := "test_channel_peek" + strconv.Itoa(int(time.Now().Unix()))
+	topic := nsqd.GetTopic(topicName)
+	channel := topic.GetChannel("ch")
+
+	var ids []MessageID
+	for i := 0; i < 5; i++ {
+		msg := NewMessage(topic.GenerateID(), []byte(strconv.Itoa(i)))
+		ids = append(ids, msg.ID)
+		err := channel.PutMessage(msg)
+		test.Nil(t, err)
+	}
+	test.Equal(t, int64(3), channel.backend.Depth())
+
+	msgs, err := channel.Peek(4)
+	test.Nil(t, err)
+	test.Equal(t, 4, len(msgs))
+	msgs, err = channel.Peek(10)
+	test.Nil(t, err)
+	test.Equal(t, 5, len(msgs))
+	// memory first, then the backend in order
+	test.Equal(t, ids[2], msgs[2].ID)
+	test.Equal(t, ids[4], msgs[4].ID)
+	test.Equal(t, int64(5), channel.Depth())
+
+	msgOut, err := decodeMessage(<-channel.backend.ReadChan())
+	test.Nil(t, err)
+	test.Equal(t, ids[2], msgOut.ID)
+	for channel.backend.Depth() != 2 {
+		time.Sleep(time.Millisecond)
+	}
+	msgs, err = channel.Peek(10)
+	test.Nil(t, err)
+	test.Equal(t, 4, len(msgs))
+	test.Equal(t, ids[3], msgs[2].ID)
+}
+
+func TestChannelPeekConcurrentPut(t *testing.T) {
+	opts := NewOptions()
+	opts.Logger = test.NewTestLogger(t)
+	opts.MemQueueSize = 1000
+	_, _, nsqd := mustStartNSQD(opts)
+	defer os.RemoveAll(opts.DataPath)
+	defer nsqd.Exit()
+
+	topicName := "test_channel_peek_concurrent_put" + strconv.Itoa(int(time.Now().Unix()))
+	topic := nsqd.GetTopic(topicName)
+	channel := topic.GetChannel("ch")
+
+	done := make(chan struct{})
+	go func() {
+		for {
+			select {
+			case <-done:
+				return
+			default:
+			}
+			_, err := channel.Peek(10)
+			test.Nil(t, err)
+		}
+	}()
+
+	var ids []MessageID
+	for i := 0; i < cap(channel.memoryMsgChan); i++ {
+		msg := NewMessage(topic.GenerateID(), []byte("test"))
+		ids = append(ids, msg.ID)
+		err := channel.PutMessage(msg)
+		test.Nil(t, err)
+	}
+	close(done)
+
+	// peeking neither reorders the memory queue nor spills it to the backend
+	test.Equal(t, int64(0), channel.backend.Depth())
+	for _, id := range ids {
+		msg := <-channel.memoryMsgChan
+		test.Equal(t, id, msg.ID)
+	}
+}
@@ -35,6 +35,7 @@ type identifyDataV2 struct {
 	Deflate             bool   `json:"deflate"`
 	DeflateLevel        int    `json:"deflate_level"`
 	Snappy              bool   `json:"snappy"`
+	Headers             bool   `json:"headers"`
 	SampleRate          int32  `json:"sample_rate"`
 	UserAgent           string `json:"user_agent"`
 	MsgTimeout          int    `json:"msg_timeout"`
@@ -54,6 +55,8 @@ type clientV2 struct {
 	MessageCount  uint64
 	FinishCount   uint64
 	RequeueCount  uint64
+	// messages rejected by the publish rate limits
+	ThrottledCount uint64
 
 	pubCounts map[string]uint64
 
@@ -99,6 +102,7 @@ type clientV2 struct {
 	TLS     int32
 	Snappy  int32
 	Deflate int32
+	Headers int32
 
 	// re-usable buffer for reading the 4-byte lengths off the wire
 	lenBuf   [4]byte
@@ -236,10 +240,12 @@ func (c *clientV2) Stats() ClientStats {
 		TLS:             atomic.LoadInt32(&c.TLS) == 1,
 		Deflate:         atomic.LoadInt32(&c.Deflate) == 1,
 		Snappy:          atomic.LoadInt32(&c.Snappy) == 1,
+		Headers:         atomic.LoadInt32(&c.Headers) == 1,
 		Authed:          c.HasAuthorizations(),
 		AuthIdentity:    identity,
 		AuthIdentityURL: identityURL,
 		PubCounts:       pubCounts,
+		ThrottledCount:  atomic.LoadUint64(&c.ThrottledCount),
 	}
 	if stats.TLS {
 		p := prettyConnectionState{c.tlsConn.ConnectionState()}
@@ -253,7 +259,7 @@ func (c *clientV2) Stats() ClientStats {
 
 func (c *clientV2) IsProducer() bool {
 	c.metaLock.RLock()
-	retval := len(c.pubCounts) > 0
+	retval := len(c.pubCounts) > 0 || atomic.LoadUint64(&c.ThrottledCount) > 0
 	c.metaLock.RUnlock()
 	return retval
 }
@@ -368,6 +374,10 @@ func (c *clientV2) PublishedMessage(topic string, count uint64) {
 	c.metaLock.Unlock()
 }
 
+func (c *clientV2) ThrottledMessages(count int) {
+	atomic.AddUint64(&c.ThrottledCount, uint64(count))
+}
+
 func (c *clientV2) TimedOutMessage() {
 	atomic.AddInt64(&c.InFlightCount, -1)
 	c.tryUpdateReadyState()
@@ -537,6 +547,14 @@ func (c *clientV2) UpgradeSnappy() error {
 	return nil
 }
 
+func (c *clientV2) EnableHeaders() {
+	atomic.StoreInt32(&c.Headers, 1)
+}
+
+func (c *clientV2) HeadersEnabled() bool {
+	return atomic.LoadInt32(&c.Headers) == 1
+}
+
 func (c *clientV2) Flush() error {
 	var zeroTime time.Time
 	if c.HeartbeatInterval > 0 {
@@ -572,10 +590,7 @@ func (c *clientV2) QueryAuthd() error {
 		}
 	}
 
-	authState, err := auth.QueryAnyAuthd(c.ctx.nsqd.getOpts().AuthHTTPAddresses,
-		remoteIP, tlsEnabled, commonName, c.AuthSecret,
-		c.ctx.nsqd.getOpts().HTTPClientConnectTimeout,
-		c.ctx.nsqd.getOpts().HTTPClientRequestTimeout)
+	authState, err := c.ctx.nsqd.queryAuth(remoteIP, tlsEnabled, commonName, c.AuthSecret)
 	if err != nil {
 		return err
 	}
@@ -0,0 +1,89 @@
+package nsqd
+
+import (
+	"container/list"
+	"sync"
+	"time"
+)
+
+// maxIdempotencyKeyLength bounds the size of a publish idempotency key
+const maxIdempotencyKeyLength = 256
+
+type dedupEntry struct {
+	key string
+	id  MessageID
+	ts  int64
+}
+
+// dedupCache remembers the idempotency keys published to a topic (and the
+// ID of the message each produced) so that retried publishes within the
+// dedup window can be recognized and dropped
+//
+// keys are kept in insertion order, so expiring them is a matter of
+// trimming the front of the list, and at most maxKeys are kept
+type dedupCache struct {
+	sync.Mutex
+
+	maxKeys int
+	keys    map[string]*list.Element
+	order   *list.List
+}
+
+func newDedupCache(maxKeys int) *dedupCache {
+	return &dedupCache{
+		maxKeys: maxKeys,
+		keys:    make(map[string]*list.Element),
+		order:   list.New(),
+	}
+}
+
+// reserve returns the ID recorded for key (and true) if it was published
+// within window, otherwise it records id for key (and returns it and false)
+func (d *dedupCache) reserve(key string, id MessageID, window time.Duration, now time.Time) (MessageID, bool) {
+	d.Lock()
+	defer d.Unlock()
+
+	d.expire(now.Add(-window).UnixNano())
+	if e, ok := d.keys[key]; ok {
+		return e.Value.(*dedupEntry).id, true
+	}
+
+	for d.maxKeys > 0 && d.order.Len() >= d.maxKeys {
+		d.remove(d.order.Front())
+	}
+	d.keys[key] = d.order.PushBack(&dedupEntry{key: key, id: id, ts: now.UnixNano()})
+	return id, false
+}
+
+// release forgets key if it's still recorded for id, i.e. when the publish
+// it was reserved for failed
+func (d *dedupCache) release(key string, id MessageID) {
+	d.Lock()
+	defer d.Unlock()
+
+	if e, ok := d.keys[key]; ok && e.Value.(*dedupEntry).id == id {
+		d.remove(e)
+	}
+}
+
+// expire removes the keys recorded before cutoff
+//
+// this expects the caller to handle locking
+func (d *dedupCache) expire(cutoff int64) {
+	for e := d.order.Front(); e != nil && e.Value.(*dedupEntry).ts < cutoff; e = d.order.Front() {
+		d.remove(e)
+	}
+}
+
+// this expects the caller to handle locking
+func (d *dedupCache) remove(e *list.Element) {
+	delete(d.keys, e.Value.(*dedupEntry).key)
+	d.order.Remove(e)
+}
+
+// Len returns the number of keys currently remembered
+func (d *dedupCache) Len() int {
+	d.Lock()
+	defer d.Unlock()
+	return d.order.Len()
+}
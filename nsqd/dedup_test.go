@@ -0,0 +1,48 @@
+package nsqd
+
+import (
+	"testing"
+	"time"
+
+	"github.com/nsqio/nsq/internal/test"
+)
+
+func TestDedupCache(t *testing.T) {
+	d := newDedupCache(2)
+	now := time.Now()
+	window := time.Minute
+
+	var id1, id2, id3 MessageID
+	copy(id1[:], "1111111111111111")
+	copy(id2[:], "2222222222222222")
+	copy(id3[:], "3333333333333333")
+
+	id, dup := d.reserve("a", id1, window, now)
+	test.Equal(t, false, dup)
+	test.Equal(t, id1, id)
+
+	id, dup = d.reserve("a", id2, window, now.Add(time.Second))
+	test.Equal(t, true, dup)
+	test.Equal(t, id1, id)
+
+	// expired
+	id, dup = d.reserve("a", id2, window, now.Add(2*window))
+	test.Equal(t, false, dup)
+	test.Equal(t, id2, id)
+	test.Equal(t, 1, d.Len())
+
+	// evicted by maxKeys
+	d.reserve("b", id3, window, now.Add(2*window))
+	d.reserve("c", id3, window, now.Add(2*window))
+	test.Equal(t, 2, d.Len())
+	_, dup = d.reserve("a", id1, window, now.Add(2*window))
+	test.Equal(t, false, dup)
+
+	// release only forgets the key if it's still held by the same ID
+	d.release("a", id3)
+	_, dup = d.reserve("a", id3, window, now.Add(2*window))
+	test.Equal(t, true, dup)
+	d.release("a", id1)
+	_, dup = d.reserve("a", id3, window, now.Add(2*window))
+	test.Equal(t, false, dup)
+}
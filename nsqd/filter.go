@@ -0,0 +1,112 @@
+package nsqd
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+const (
+	filterHeader = iota
+	filterJSON
+	filterPrefix
+)
+
+// msgFilter is a channel-level predicate evaluated by Topic.messagePump,
+// messages that don't match are never copied into the channel
+//
+// supported expressions:
+//
+//	header:<key>=<value>  message has header <key> equal to <value>
+//	json:<field>          JSON body (an object) contains <field>
+//	json:<field>=<value>  JSON body field <field> equals <value>
+//	prefix:<bytes>        body starts with <bytes>
+type msgFilter struct {
+	expr  string
+	kind  int
+	key   string
+	value string
+
+	hasValue      bool
+	valueIsNumber bool
+	valueNumber   float64
+}
+
+func parseFilter(expr string) (*msgFilter, error) {
+	idx := strings.Index(expr, ":")
+	if idx == -1 {
+		return nil, fmt.Errorf("invalid filter %q - missing type", expr)
+	}
+
+	f := &msgFilter{expr: expr}
+	kind, arg := expr[:idx], expr[idx+1:]
+	switch kind {
+	case "header":
+		f.kind = filterHeader
+		idx = strings.Index(arg, "=")
+		if idx < 1 {
+			return nil, fmt.Errorf("invalid filter %q - expected header:<key>=<value>", expr)
+		}
+		f.key, f.value, f.hasValue = arg[:idx], arg[idx+1:], true
+	case "json":
+		f.kind = filterJSON
+		f.key = arg
+		if idx = strings.Index(arg, "="); idx != -1 {
+			f.key, f.value, f.hasValue = arg[:idx], arg[idx+1:], true
+			// cache conversion, integers (up to 2^53 or so) can be compared as float64
+			n, err := strconv.ParseFloat(f.value, 64)
+			f.valueNumber, f.valueIsNumber = n, err == nil
+		}
+		if f.key == "" {
+			return nil, fmt.Errorf("invalid filter %q - expected json:<field>[=<value>]", expr)
+		}
+	case "prefix":
+		f.kind = filterPrefix
+		if arg == "" {
+			return nil, errors.New("invalid filter - empty prefix")
+		}
+		f.value = arg
+	default:
+		return nil, fmt.Errorf("invalid filter %q - unknown type %q", expr, kind)
+	}
+
+	return f, nil
+}
+
+func (f *msgFilter) String() string {
+	return f.expr
+}
+
+// Match returns whether or not msg passes the filter
+func (f *msgFilter) Match(msg *Message) bool {
+	switch f.kind {
+	case filterHeader:
+		v, ok := msg.Headers[f.key]
+		return ok && v == f.value
+	case filterPrefix:
+		return bytes.HasPrefix(msg.Body, []byte(f.value))
+	case filterJSON:
+		var js map[string]interface{}
+		if err := json.Unmarshal(msg.Body, &js); err != nil {
+			return false
+		}
+		v, ok := js[f.key]
+		if !ok || !f.hasValue {
+			return ok
+		}
+		switch v := v.(type) {
+		case string:
+			return v == f.value
+		case float64:
+			return f.valueIsNumber && v == f.valueNumber
+		case bool:
+			return strconv.FormatBool(v) == f.value
+		}
+		// give up on comparisons of other types
+		return false
+	}
+	return false
+}
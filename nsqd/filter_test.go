@@ -0,0 +1,57 @@
+package nsqd
+
+import (
+	"testing"
+
+	"github.com/nsqio/nsq/internal/test"
+)
+
+func TestParseFilter(t *testing.T) {
+	for _, expr := range []string{
+		"", "foo", "bogus:a=b", "header:", "header:=b", "header:a", "json:", "json:=1", "prefix:",
+	} {
+		_, err := parseFilter(expr)
+		test.NotNil(t, err)
+	}
+
+	f, err := parseFilter("header:a=b=c")
+	test.Nil(t, err)
+	test.Equal(t, "a", f.key)
+	test.Equal(t, "b=c", f.value)
+	test.Equal(t, "header:a=b=c", f.String())
+}
+
+func TestFilterMatch(t *testing.T) {
+	msg := NewMessage(MessageID{}, []byte(`{"type":"order","n":12,"ok":true,"nested":{"a":1}}`))
+	msg.Headers = map[string]string{"env": "prod"}
+
+	tests := []struct {
+		expr  string
+		match bool
+	}{
+		{"header:env=prod", true},
+		{"header:env=dev", false},
+		{"header:missing=", false},
+		{"json:type", true},
+		{"json:missing", false},
+		{"json:type=order", true},
+		{"json:type=refund", false},
+		{"json:n=12", true},
+		{"json:n=12.0", true},
+		{"json:n=13", false},
+		{"json:ok=true", true},
+		{"json:nested=1", false},
+		{`prefix:{"type"`, true},
+		{"prefix:order", false},
+	}
+	for _, tt := range tests {
+		f, err := parseFilter(tt.expr)
+		test.Nil(t, err)
+		if f.Match(msg) != tt.match {
+			t.Errorf("filter %q - expected match %v", tt.expr, tt.match)
+		}
+	}
+
+	f, _ := parseFilter("json:type")
+	test.Equal(t, false, f.Match(NewMessage(MessageID{}, []byte("not json"))))
+}
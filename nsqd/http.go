@@ -3,10 +3,12 @@ package nsqd
 import (
 	"bufio"
 	"bytes"
+	"encoding/base64"
 	"encoding/json"
 	"fmt"
 	"io"
 	"io/ioutil"
+	"net"
 	"net/http"
 	"net/http/pprof"
 	"net/url"
@@ -16,10 +18,13 @@ import (
 	"strconv"
 	"strings"
 	"time"
+	"unicode/utf8"
 
 	"github.com/julienschmidt/httprouter"
+	"github.com/nsqio/nsq/internal/auth"
 	"github.com/nsqio/nsq/internal/http_api"
 	"github.com/nsqio/nsq/internal/lg"
+	"github.com/nsqio/nsq/internal/metrics"
 	"github.com/nsqio/nsq/internal/protocol"
 	"github.com/nsqio/nsq/internal/version"
 )
@@ -60,6 +65,7 @@ func newHTTPServer(ctx *context, tlsEnabled bool, tlsRequired bool) *httpServer
 	router.Handle("POST", "/pub", http_api.Decorate(s.doPUB, http_api.V1))
 	router.Handle("POST", "/mpub", http_api.Decorate(s.doMPUB, http_api.V1))
 	router.Handle("GET", "/stats", http_api.Decorate(s.doStats, log, http_api.V1))
+	router.Handle("GET", "/metrics", http_api.Decorate(s.doMetrics, log, http_api.PlainText))
 
 	// only v1
 	router.Handle("POST", "/topic/create", http_api.Decorate(s.doCreateTopic, log, http_api.V1))
@@ -70,10 +76,18 @@ func newHTTPServer(ctx *context, tlsEnabled bool, tlsRequired bool) *httpServer
 	router.Handle("POST", "/channel/create", http_api.Decorate(s.doCreateChannel, log, http_api.V1))
 	router.Handle("POST", "/channel/delete", http_api.Decorate(s.doDeleteChannel, log, http_api.V1))
 	router.Handle("POST", "/channel/empty", http_api.Decorate(s.doEmptyChannel, log, http_api.V1))
+	router.Handle("POST", "/channel/rewind", http_api.Decorate(s.doRewindChannel, log, http_api.V1))
+	router.Handle("GET", "/channel/peek", http_api.Decorate(s.doPeekChannel, log, http_api.V1))
+	router.Handle("POST", "/channel/purge", http_api.Decorate(s.doPurgeChannel, log, http_api.V1))
+	router.Handle("POST", "/channel/move", http_api.Decorate(s.doTransferChannel, log, http_api.V1))
+	router.Handle("POST", "/channel/copy", http_api.Decorate(s.doTransferChannel, log, http_api.V1))
+	router.Handle("POST", "/message/delete", http_api.Decorate(s.doMessageAction, log, http_api.V1))
+	router.Handle("POST", "/message/requeue", http_api.Decorate(s.doMessageAction, log, http_api.V1))
 	router.Handle("POST", "/channel/pause", http_api.Decorate(s.doPauseChannel, log, http_api.V1))
 	router.Handle("POST", "/channel/unpause", http_api.Decorate(s.doPauseChannel, log, http_api.V1))
 	router.Handle("GET", "/config/:opt", http_api.Decorate(s.doConfig, log, http_api.V1))
 	router.Handle("PUT", "/config/:opt", http_api.Decorate(s.doConfig, log, http_api.V1))
+	router.Handle("POST", "/config/reload", http_api.Decorate(s.doConfigReload, log, http_api.V1))
 
 	// debug
 	router.HandlerFunc("GET", "/debug/pprof/", pprof.Index)
@@ -132,6 +146,7 @@ func (s *httpServer) doInfo(w http.ResponseWriter, req *http.Request, ps httprou
 		HTTPPort         int    `json:"http_port"`
 		TCPPort          int    `json:"tcp_port"`
 		StartTime        int64  `json:"start_time"`
+		TLSCertExpiry    int64  `json:"tls_cert_expiry,omitempty"`
 	}{
 		Version:          version.Binary,
 		BroadcastAddress: s.ctx.nsqd.getOpts().BroadcastAddress,
@@ -139,9 +154,20 @@ func (s *httpServer) doInfo(w http.ResponseWriter, req *http.Request, ps httprou
 		TCPPort:          s.ctx.nsqd.RealTCPAddr().Port,
 		HTTPPort:         s.ctx.nsqd.RealHTTPAddr().Port,
 		StartTime:        s.ctx.nsqd.GetStartTime().Unix(),
+		TLSCertExpiry:    tlsCertExpiry(s.ctx.nsqd),
 	}, nil
 }
 
+// tlsCertExpiry returns the expiry of the TLS certificate as a unix
+// timestamp, 0 if TLS isn't enabled
+func tlsCertExpiry(n *NSQD) int64 {
+	expiry := n.TLSCertExpiry()
+	if expiry.IsZero() {
+		return 0
+	}
+	return expiry.Unix()
+}
+
 func (s *httpServer) getExistingTopicFromQuery(req *http.Request) (*http_api.ReqParams, *Topic, string, error) {
 	reqParams, err := http_api.NewReqParams(req)
 	if err != nil {
@@ -154,6 +180,11 @@ func (s *httpServer) getExistingTopicFromQuery(req *http.Request) (*http_api.Req
 		return nil, nil, "", http_api.Err{400, err.Error()}
 	}
 
+	err = s.checkAuth(req, reqParams.Values, "admin", topicName, channelName)
+	if err != nil {
+		return nil, nil, "", err
+	}
+
 	topic, err := s.ctx.nsqd.GetExistingTopic(topicName)
 	if err != nil {
 		return nil, nil, "", http_api.Err{404, "TOPIC_NOT_FOUND"}
@@ -162,24 +193,102 @@ func (s *httpServer) getExistingTopicFromQuery(req *http.Request) (*http_api.Req
 	return reqParams, topic, channelName, err
 }
 
-func (s *httpServer) getTopicFromQuery(req *http.Request) (url.Values, *Topic, error) {
+// getPubTopicFromQuery returns the topic to publish to, the request must be
+// authorized to publish to it
+//
+// it also returns the identity of the publisher for checkPubRate
+func (s *httpServer) getPubTopicFromQuery(req *http.Request) (url.Values, *Topic, string, error) {
+	reqParams, topicName, err := s.getTopicNameFromQuery(req)
+	if err != nil {
+		return nil, nil, "", err
+	}
+	authState, err := s.authorize(req, reqParams, "publish", topicName, "")
+	if err != nil {
+		return nil, nil, "", err
+	}
+	authIdentity := ""
+	if authState != nil {
+		authIdentity = authState.Identity
+	}
+	return reqParams, s.ctx.nsqd.GetTopic(topicName), pubIdentity(authIdentity, req.RemoteAddr), nil
+}
+
+// checkPubRate applies the publish rate limits to msgs
+func (s *httpServer) checkPubRate(topic *Topic, identity string, msgs []*Message) error {
+	var bytes int
+	for _, msg := range msgs {
+		bytes += len(msg.Body)
+	}
+	err := s.ctx.nsqd.checkPubRate(topic, identity, len(msgs), bytes)
+	if err != nil {
+		return http_api.Err{429, "THROTTLED"}
+	}
+	return nil
+}
+
+func (s *httpServer) getTopicNameFromQuery(req *http.Request) (url.Values, string, error) {
 	reqParams, err := url.ParseQuery(req.URL.RawQuery)
 	if err != nil {
 		s.ctx.nsqd.logf(LOG_ERROR, "failed to parse request params - %s", err)
-		return nil, nil, http_api.Err{400, "INVALID_REQUEST"}
+		return nil, "", http_api.Err{400, "INVALID_REQUEST"}
 	}
 
 	topicNames, ok := reqParams["topic"]
 	if !ok {
-		return nil, nil, http_api.Err{400, "MISSING_ARG_TOPIC"}
+		return nil, "", http_api.Err{400, "MISSING_ARG_TOPIC"}
 	}
 	topicName := topicNames[0]
 
 	if !protocol.IsValidTopicName(topicName) {
-		return nil, nil, http_api.Err{400, "INVALID_TOPIC"}
+		return nil, "", http_api.Err{400, "INVALID_TOPIC"}
+	}
+
+	return reqParams, topicName, nil
+}
+
+// checkAuth checks that the request is authorized for permission on topic
+// and channel, with the same authorizations as a TCP client that sent the
+// secret in AUTH
+//
+// the secret is given as "Authorization: Bearer <secret>" or in the
+// auth_secret query param
+func (s *httpServer) checkAuth(req *http.Request, reqParams url.Values,
+	permission string, topicName string, channelName string) error {
+	_, err := s.authorize(req, reqParams, permission, topicName, channelName)
+	return err
+}
+
+// authorize is checkAuth returning the authorizations of the request, nil
+// if auth isn't enabled
+func (s *httpServer) authorize(req *http.Request, reqParams url.Values,
+	permission string, topicName string, channelName string) (*auth.State, error) {
+	if !s.ctx.nsqd.IsAuthEnabled() {
+		return nil, nil
 	}
 
-	return reqParams, s.ctx.nsqd.GetTopic(topicName), nil
+	secret := reqParams.Get("auth_secret")
+	if h := req.Header.Get("Authorization"); strings.HasPrefix(h, "Bearer ") {
+		secret = strings.TrimPrefix(h, "Bearer ")
+	}
+	if secret == "" {
+		return nil, http_api.Err{401, "AUTH_REQUIRED"}
+	}
+
+	remoteIP, _, _ := net.SplitHostPort(req.RemoteAddr)
+	commonName := ""
+	if req.TLS != nil && len(req.TLS.PeerCertificates) > 0 {
+		commonName = req.TLS.PeerCertificates[0].Subject.CommonName
+	}
+	authState, err := s.ctx.nsqd.queryCachedAuth(remoteIP, req.TLS != nil, commonName, secret)
+	if err != nil {
+		// don't leak errors contacting the auth server to untrusted clients
+		s.ctx.nsqd.logf(LOG_WARN, "HTTP: [%s] AUTH failed %s", req.RemoteAddr, err)
+		return nil, http_api.Err{401, "AUTH_FAILED"}
+	}
+	if !authState.IsAllowedTo(permission, topicName, channelName) {
+		return nil, http_api.Err{403, "UNAUTHORIZED"}
+	}
+	return authState, nil
 }
 
 func (s *httpServer) doPUB(w http.ResponseWriter, req *http.Request, ps httprouter.Params) (interface{}, error) {
@@ -204,7 +313,7 @@ func (s *httpServer) doPUB(w http.ResponseWriter, req *http.Request, ps httprout
 		return nil, http_api.Err{400, "MSG_EMPTY"}
 	}
 
-	reqParams, topic, err := s.getTopicFromQuery(req)
+	reqParams, topic, identity, err := s.getPubTopicFromQuery(req)
 	if err != nil {
 		return nil, err
 	}
@@ -222,16 +331,97 @@ func (s *httpServer) doPUB(w http.ResponseWriter, req *http.Request, ps httprout
 		}
 	}
 
+	pubOpts, err := s.getPubOptionsFromQuery(reqParams)
+	if err != nil {
+		return nil, err
+	}
+	if deferred > 0 && pubOpts.deliverAt > 0 {
+		return nil, http_api.Err{400, "INVALID_DELIVER_AT"}
+	}
+
+	headers, err := s.getHeadersFromRequest(req)
+	if err != nil {
+		return nil, err
+	}
+
 	msg := NewMessage(topic.GenerateID(), body)
-	msg.deferred = deferred
+	msg.Headers = headers
+	pubOpts.apply(msg)
+	topic.deferMessage(msg, deferred)
+	err = s.checkPubRate(topic, identity, []*Message{msg})
+	if err != nil {
+		return nil, err
+	}
+	if pubOpts.idempotencyKey != "" {
+		return putKeyed(topic, pubOpts.idempotencyKey, []*Message{msg})
+	}
 	err = topic.PutMessage(msg)
 	if err != nil {
-		return nil, http_api.Err{503, "EXITING"}
+		return nil, httpPutErr(err)
 	}
 
 	return "OK", nil
 }
 
+// httpPutErr returns the error for a failed put, a full backlog (see
+// backlogQuota) is told apart from nsqd exiting
+func httpPutErr(err error) error {
+	if _, ok := err.(errBacklogFull); ok {
+		return http_api.Err{507, "BACKLOG_FULL"}
+	}
+	return http_api.Err{503, "EXITING"}
+}
+
+// putKeyed publishes msgs de-duplicated by an idempotency key, responding
+// with the ID of the (first) message of the original publish
+func putKeyed(topic *Topic, key string, msgs []*Message) (interface{}, error) {
+	id, dup, err := topic.PutMessagesKeyed(key, msgs)
+	if err != nil {
+		return nil, httpPutErr(err)
+	}
+	return struct {
+		ID        string `json:"id"`
+		Duplicate bool   `json:"duplicate"`
+	}{string(id[:]), dup}, nil
+}
+
+// httpHeaderPrefix marks the request headers that /pub attaches to the
+// message, i.e. "X-Nsq-Header-Trace-Id: abc" becomes the header "trace-id"
+const httpHeaderPrefix = "X-Nsq-Header-"
+
+func (s *httpServer) getHeadersFromRequest(req *http.Request) (map[string]string, error) {
+	var headers map[string]string
+	for k, v := range req.Header {
+		if !strings.HasPrefix(k, httpHeaderPrefix) || len(k) == len(httpHeaderPrefix) {
+			continue
+		}
+		if headers == nil {
+			headers = make(map[string]string)
+		}
+		headers[strings.ToLower(k[len(httpHeaderPrefix):])] = v[0]
+	}
+	if headers == nil {
+		return nil, nil
+	}
+
+	if !s.ctx.nsqd.getOpts().HeadersEnabled {
+		return nil, http_api.Err{400, "HEADERS_DISABLED"}
+	}
+	if err := validateHeaders(headers, s.ctx.nsqd.getOpts().MaxHeadersSize); err != nil {
+		return nil, http_api.Err{413, "HEADERS_TOO_BIG"}
+	}
+	return headers, nil
+}
+
+func (s *httpServer) getPubOptionsFromQuery(reqParams url.Values) (*pubOptions, error) {
+	pubOpts, name, err := pubOptionsFromQuery(reqParams, s.ctx.nsqd.getOpts().MaxScheduleAhead)
+	if err != nil {
+		s.ctx.nsqd.logf(LOG_DEBUG, "invalid publish option - %s", err)
+		return nil, http_api.Err{400, "INVALID_" + strings.ToUpper(name)}
+	}
+	return pubOpts, nil
+}
+
 func (s *httpServer) doMPUB(w http.ResponseWriter, req *http.Request, ps httprouter.Params) (interface{}, error) {
 	var msgs []*Message
 	var exit bool
@@ -243,7 +433,12 @@ func (s *httpServer) doMPUB(w http.ResponseWriter, req *http.Request, ps httprou
 		return nil, http_api.Err{413, "BODY_TOO_BIG"}
 	}
 
-	reqParams, topic, err := s.getTopicFromQuery(req)
+	reqParams, topic, identity, err := s.getPubTopicFromQuery(req)
+	if err != nil {
+		return nil, err
+	}
+
+	pubOpts, err := s.getPubOptionsFromQuery(reqParams)
 	if err != nil {
 		return nil, err
 	}
@@ -302,17 +497,211 @@ func (s *httpServer) doMPUB(w http.ResponseWriter, req *http.Request, ps httprou
 		}
 	}
 
+	for _, msg := range msgs {
+		pubOpts.apply(msg)
+	}
+	err = s.checkPubRate(topic, identity, msgs)
+	if err != nil {
+		return nil, err
+	}
+	if pubOpts.idempotencyKey != "" && len(msgs) > 0 {
+		return putKeyed(topic, pubOpts.idempotencyKey, msgs)
+	}
+
 	err = topic.PutMessages(msgs)
 	if err != nil {
-		return nil, http_api.Err{503, "EXITING"}
+		return nil, httpPutErr(err)
 	}
 
 	return "OK", nil
 }
 
 func (s *httpServer) doCreateTopic(w http.ResponseWriter, req *http.Request, ps httprouter.Params) (interface{}, error) {
-	_, _, err := s.getTopicFromQuery(req)
-	return nil, err
+	reqParams, err := url.ParseQuery(req.URL.RawQuery)
+	if err != nil {
+		s.ctx.nsqd.logf(LOG_ERROR, "failed to parse request params - %s", err)
+		return nil, http_api.Err{400, "INVALID_REQUEST"}
+	}
+
+	var retentionTime time.Duration
+	_, hasRetentionTime := reqParams["retention_time"]
+	if hasRetentionTime {
+		retentionTime, err = time.ParseDuration(reqParams.Get("retention_time"))
+		if err != nil || retentionTime < 0 {
+			return nil, http_api.Err{400, "INVALID_RETENTION_TIME"}
+		}
+	}
+
+	var retentionBytes int64
+	_, hasRetentionBytes := reqParams["retention_bytes"]
+	if hasRetentionBytes {
+		retentionBytes, err = strconv.ParseInt(reqParams.Get("retention_bytes"), 10, 64)
+		if err != nil || retentionBytes < 0 {
+			return nil, http_api.Err{400, "INVALID_RETENTION_BYTES"}
+		}
+	}
+
+	var dedupWindow time.Duration
+	_, hasDedupWindow := reqParams["dedup_window"]
+	if hasDedupWindow {
+		dedupWindow, err = time.ParseDuration(reqParams.Get("dedup_window"))
+		if err != nil || dedupWindow < 0 {
+			return nil, http_api.Err{400, "INVALID_DEDUP_WINDOW"}
+		}
+	}
+
+	var partitions int
+	_, hasPartitions := reqParams["partitions"]
+	if hasPartitions {
+		partitions, err = strconv.Atoi(reqParams.Get("partitions"))
+		if err != nil || partitions < 0 || partitions > maxPartitions {
+			return nil, http_api.Err{400, "INVALID_PARTITIONS"}
+		}
+	}
+
+	var pubRateLimit, pubByteRateLimit int64
+	_, hasPubRateLimit := reqParams["pub_rate_limit"]
+	if hasPubRateLimit {
+		pubRateLimit, err = strconv.ParseInt(reqParams.Get("pub_rate_limit"), 10, 64)
+		if err != nil || pubRateLimit < 0 {
+			return nil, http_api.Err{400, "INVALID_PUB_RATE_LIMIT"}
+		}
+	}
+	_, hasPubByteRateLimit := reqParams["pub_byte_rate_limit"]
+	if hasPubByteRateLimit {
+		pubByteRateLimit, err = strconv.ParseInt(reqParams.Get("pub_byte_rate_limit"), 10, 64)
+		if err != nil || pubByteRateLimit < 0 {
+			return nil, http_api.Err{400, "INVALID_PUB_BYTE_RATE_LIMIT"}
+		}
+	}
+
+	quota, err := getBacklogQuotaParams(reqParams)
+	if err != nil {
+		return nil, err
+	}
+
+	_, topicName, err := s.getTopicNameFromQuery(req)
+	if err != nil {
+		return nil, err
+	}
+	err = s.checkAuth(req, reqParams, "admin", topicName, "")
+	if err != nil {
+		return nil, err
+	}
+	topic := s.ctx.nsqd.GetTopic(topicName)
+
+	if hasPartitions {
+		err = topic.SetPartitions(partitions)
+		if err != nil {
+			return nil, http_api.Err{400, "PARTITIONS_IN_USE"}
+		}
+	}
+
+	if hasDedupWindow {
+		topic.SetDedupWindow(dedupWindow)
+	}
+
+	if hasRetentionTime || hasRetentionBytes {
+		maxAge, maxBytes := topic.Retention()
+		if hasRetentionTime {
+			maxAge = retentionTime
+		}
+		if hasRetentionBytes {
+			maxBytes = retentionBytes
+		}
+		if topic.ephemeral && (maxAge > 0 || maxBytes > 0) {
+			return nil, http_api.Err{400, "INVALID_RETENTION"}
+		}
+		err = topic.SetRetention(maxAge, maxBytes)
+		if err != nil {
+			s.ctx.nsqd.logf(LOG_ERROR, "failed to set retention of topic (%s) - %s", topic.name, err)
+			return nil, http_api.Err{500, "INTERNAL_ERROR"}
+		}
+
+	}
+
+	if hasPubRateLimit || hasPubByteRateLimit {
+		msgRate, byteRate := topic.PubRateLimit()
+		if hasPubRateLimit {
+			msgRate = pubRateLimit
+		}
+		if hasPubByteRateLimit {
+			byteRate = pubByteRateLimit
+		}
+		topic.SetPubRateLimit(msgRate, byteRate)
+	}
+
+	if quota.isSet() {
+		err = topic.SetBacklogQuota(quota.apply(topic.BacklogQuota()))
+		if err != nil {
+			return nil, http_api.Err{400, "INVALID_OVERFLOW_POLICY"}
+		}
+	}
+
+	if hasPartitions || hasDedupWindow || hasRetentionTime || hasRetentionBytes ||
+		hasPubRateLimit || hasPubByteRateLimit || quota.isSet() {
+		s.ctx.nsqd.Lock()
+		s.ctx.nsqd.PersistMetadata()
+		s.ctx.nsqd.Unlock()
+	}
+	return nil, nil
+}
+
+// backlogQuotaParams are the backlog quota params of /topic/create and
+// /channel/create (see backlogQuota), each of which is optional
+type backlogQuotaParams struct {
+	maxMsgs  int64
+	maxBytes int64
+	policy   string
+
+	hasMaxMsgs  bool
+	hasMaxBytes bool
+	hasPolicy   bool
+}
+
+func getBacklogQuotaParams(reqParams url.Values) (*backlogQuotaParams, error) {
+	var err error
+	p := &backlogQuotaParams{}
+	_, p.hasMaxMsgs = reqParams["max_backlog_msgs"]
+	if p.hasMaxMsgs {
+		p.maxMsgs, err = strconv.ParseInt(reqParams.Get("max_backlog_msgs"), 10, 64)
+		if err != nil || p.maxMsgs < 0 {
+			return nil, http_api.Err{400, "INVALID_MAX_BACKLOG_MSGS"}
+		}
+	}
+	_, p.hasMaxBytes = reqParams["max_backlog_bytes"]
+	if p.hasMaxBytes {
+		p.maxBytes, err = strconv.ParseInt(reqParams.Get("max_backlog_bytes"), 10, 64)
+		if err != nil || p.maxBytes < 0 {
+			return nil, http_api.Err{400, "INVALID_MAX_BACKLOG_BYTES"}
+		}
+	}
+	_, p.hasPolicy = reqParams["overflow_policy"]
+	if p.hasPolicy {
+		p.policy = reqParams.Get("overflow_policy")
+		if _, err := newBacklogQuota(0, 0, p.policy); err != nil {
+			return nil, http_api.Err{400, "INVALID_OVERFLOW_POLICY"}
+		}
+	}
+	return p, nil
+}
+
+func (p *backlogQuotaParams) isSet() bool {
+	return p.hasMaxMsgs || p.hasMaxBytes || p.hasPolicy
+}
+
+// apply returns the given quota updated with the params that were set
+func (p *backlogQuotaParams) apply(maxMsgs int64, maxBytes int64, policy string) (int64, int64, string) {
+	if p.hasMaxMsgs {
+		maxMsgs = p.maxMsgs
+	}
+	if p.hasMaxBytes {
+		maxBytes = p.maxBytes
+	}
+	if p.hasPolicy {
+		policy = p.policy
+	}
+	return maxMsgs, maxBytes, policy
 }
 
 func (s *httpServer) doEmptyTopic(w http.ResponseWriter, req *http.Request, ps httprouter.Params) (interface{}, error) {
@@ -331,6 +720,11 @@ func (s *httpServer) doEmptyTopic(w http.ResponseWriter, req *http.Request, ps h
 		return nil, http_api.Err{400, "INVALID_TOPIC"}
 	}
 
+	err = s.checkAuth(req, reqParams.Values, "admin", topicName, "")
+	if err != nil {
+		return nil, err
+	}
+
 	topic, err := s.ctx.nsqd.GetExistingTopic(topicName)
 	if err != nil {
 		return nil, http_api.Err{404, "TOPIC_NOT_FOUND"}
@@ -356,6 +750,11 @@ func (s *httpServer) doDeleteTopic(w http.ResponseWriter, req *http.Request, ps
 		return nil, http_api.Err{400, "MISSING_ARG_TOPIC"}
 	}
 
+	err = s.checkAuth(req, reqParams.Values, "admin", topicName, "")
+	if err != nil {
+		return nil, err
+	}
+
 	err = s.ctx.nsqd.DeleteExistingTopic(topicName)
 	if err != nil {
 		return nil, http_api.Err{404, "TOPIC_NOT_FOUND"}
@@ -376,6 +775,11 @@ func (s *httpServer) doPauseTopic(w http.ResponseWriter, req *http.Request, ps h
 		return nil, http_api.Err{400, "MISSING_ARG_TOPIC"}
 	}
 
+	err = s.checkAuth(req, reqParams.Values, "admin", topicName, "")
+	if err != nil {
+		return nil, err
+	}
+
 	topic, err := s.ctx.nsqd.GetExistingTopic(topicName)
 	if err != nil {
 		return nil, http_api.Err{404, "TOPIC_NOT_FOUND"}
@@ -384,7 +788,11 @@ func (s *httpServer) doPauseTopic(w http.ResponseWriter, req *http.Request, ps h
 	if strings.Contains(req.URL.Path, "unpause") {
 		err = topic.UnPause()
 	} else {
-		err = topic.Pause()
+		resumeAt, perr := parseResumeAt(reqParams)
+		if perr != nil {
+			return nil, http_api.Err{400, perr.Error()}
+		}
+		err = topic.PauseUntil(resumeAt)
 	}
 	if err != nil {
 		s.ctx.nsqd.logf(LOG_ERROR, "failure in %s - %s", req.URL.Path, err)
@@ -400,14 +808,355 @@ func (s *httpServer) doPauseTopic(w http.ResponseWriter, req *http.Request, ps h
 }
 
 func (s *httpServer) doCreateChannel(w http.ResponseWriter, req *http.Request, ps httprouter.Params) (interface{}, error) {
-	_, topic, channelName, err := s.getExistingTopicFromQuery(req)
+	reqParams, topic, channelName, err := s.getExistingTopicFromQuery(req)
 	if err != nil {
 		return nil, err
 	}
-	topic.GetChannel(channelName)
+
+	var maxAttempts uint64
+	maxAttemptsStr, err := reqParams.Get("max_attempts")
+	hasMaxAttempts := err == nil
+	if hasMaxAttempts {
+		maxAttempts, err = strconv.ParseUint(maxAttemptsStr, 10, 16)
+		if err != nil {
+			return nil, http_api.Err{400, "INVALID_MAX_ATTEMPTS"}
+		}
+	}
+
+	filter, err := reqParams.Get("filter")
+	hasFilter := err == nil
+	if hasFilter && filter != "" {
+		if _, err := parseFilter(filter); err != nil {
+			return nil, http_api.Err{400, "INVALID_FILTER"}
+		}
+	}
+
+	var messageTTL time.Duration
+	messageTTLStr, err := reqParams.Get("message_ttl")
+	hasMessageTTL := err == nil
+	if hasMessageTTL {
+		messageTTL, err = time.ParseDuration(messageTTLStr)
+		if err != nil || messageTTL < 0 {
+			return nil, http_api.Err{400, "INVALID_MESSAGE_TTL"}
+		}
+	}
+
+	var deadLetterExpired bool
+	deadLetterExpiredStr, err := reqParams.Get("dead_letter_expired")
+	hasDeadLetterExpired := err == nil
+	if hasDeadLetterExpired {
+		deadLetterExpired, err = strconv.ParseBool(deadLetterExpiredStr)
+		if err != nil {
+			return nil, http_api.Err{400, "INVALID_DEAD_LETTER_EXPIRED"}
+		}
+	}
+
+	var maxDeliveryRate int64
+	maxDeliveryRateStr, err := reqParams.Get("max_delivery_rate")
+	hasMaxDeliveryRate := err == nil
+	if hasMaxDeliveryRate {
+		maxDeliveryRate, err = strconv.ParseInt(maxDeliveryRateStr, 10, 64)
+		if err != nil || maxDeliveryRate < 0 {
+			return nil, http_api.Err{400, "INVALID_MAX_DELIVERY_RATE"}
+		}
+	}
+
+	quota, err := getBacklogQuotaParams(reqParams.Values)
+	if err != nil {
+		return nil, err
+	}
+
+	channel := topic.GetChannel(channelName)
+	if hasFilter {
+		channel.SetFilter(filter)
+	}
+	if hasMaxAttempts {
+		channel.SetMaxAttempts(uint16(maxAttempts))
+	}
+	if hasMessageTTL {
+		channel.SetMessageTTL(messageTTL)
+	}
+	if hasDeadLetterExpired {
+		channel.SetDeadLetterExpired(deadLetterExpired)
+	}
+	if hasMaxDeliveryRate {
+		channel.SetMaxDeliveryRate(maxDeliveryRate)
+	}
+	if quota.isSet() {
+		err = channel.SetBacklogQuota(quota.apply(channel.BacklogQuota()))
+		if err != nil {
+			return nil, http_api.Err{400, "INVALID_OVERFLOW_POLICY"}
+		}
+	}
+	if hasMaxAttempts || hasFilter || hasMessageTTL || hasDeadLetterExpired || hasMaxDeliveryRate || quota.isSet() {
+		s.ctx.nsqd.Lock()
+		s.ctx.nsqd.PersistMetadata()
+		s.ctx.nsqd.Unlock()
+	}
 	return nil, nil
 }
 
+// doRewindChannel re-delivers the topic's retained messages published at
+// or after since (unix seconds or RFC3339) to the channel
+func (s *httpServer) doRewindChannel(w http.ResponseWriter, req *http.Request, ps httprouter.Params) (interface{}, error) {
+	reqParams, topic, channelName, err := s.getExistingTopicFromQuery(req)
+	if err != nil {
+		return nil, err
+	}
+
+	sinceStr, err := reqParams.Get("since")
+	if err != nil {
+		return nil, http_api.Err{400, "MISSING_ARG_SINCE"}
+	}
+	var since time.Time
+	if sec, err := strconv.ParseInt(sinceStr, 10, 64); err == nil {
+		since = time.Unix(sec, 0)
+	} else if since, err = time.Parse(time.RFC3339Nano, sinceStr); err != nil {
+		return nil, http_api.Err{400, "INVALID_SINCE"}
+	}
+
+	channel, err := topic.GetExistingChannel(channelName)
+	if err != nil {
+		return nil, http_api.Err{404, "CHANNEL_NOT_FOUND"}
+	}
+
+	if maxAge, maxBytes := topic.Retention(); maxAge == 0 && maxBytes == 0 {
+		return nil, http_api.Err{400, "RETENTION_DISABLED"}
+	}
+
+	count, err := topic.Rewind(channel, since)
+	if err != nil {
+		s.ctx.nsqd.logf(LOG_ERROR, "failed to rewind channel (%s/%s) - %s", topic.name, channelName, err)
+		return nil, http_api.Err{500, "INTERNAL_ERROR"}
+	}
+	s.ctx.nsqd.logf(LOG_INFO, "CHANNEL(%s/%s): rewound %d messages since %s",
+		topic.name, channelName, count, since.Format(time.RFC3339))
+
+	return struct {
+		Count int64 `json:"count"`
+	}{count}, nil
+}
+
+// maxPeekCount bounds the n of /channel/peek, defaultPeekCount is its default
+const (
+	maxPeekCount     = 1000
+	defaultPeekCount = 10
+)
+
+// peekedMessage is a message as returned by /channel/peek, its body is
+// base64 encoded (in body_base64) unless it's valid UTF-8
+type peekedMessage struct {
+	ID         string            `json:"id"`
+	Timestamp  int64             `json:"timestamp"`
+	Attempts   uint16            `json:"attempts"`
+	Priority   uint8             `json:"priority,omitempty"`
+	Headers    map[string]string `json:"headers,omitempty"`
+	Body       string            `json:"body,omitempty"`
+	BodyBase64 string            `json:"body_base64,omitempty"`
+}
+
+func (s *httpServer) doPeekChannel(w http.ResponseWriter, req *http.Request, ps httprouter.Params) (interface{}, error) {
+	reqParams, topic, channelName, err := s.getExistingTopicFromQuery(req)
+	if err != nil {
+		return nil, err
+	}
+
+	n := defaultPeekCount
+	if ns, err := reqParams.Get("n"); err == nil {
+		n, err = strconv.Atoi(ns)
+		if err != nil || n < 1 || n > maxPeekCount {
+			return nil, http_api.Err{400, "INVALID_N"}
+		}
+	}
+
+	channel, err := topic.GetExistingChannel(channelName)
+	if err != nil {
+		return nil, http_api.Err{404, "CHANNEL_NOT_FOUND"}
+	}
+
+	msgs, err := channel.Peek(n)
+	if err != nil {
+		s.ctx.nsqd.logf(LOG_ERROR, "failed to peek channel (%s/%s) - %s", topic.name, channelName, err)
+		return nil, http_api.Err{500, "INTERNAL_ERROR"}
+	}
+
+	peeked := make([]peekedMessage, 0, len(msgs))
+	for _, msg := range msgs {
+		p := peekedMessage{
+			ID:        string(msg.ID[:]),
+			Timestamp: msg.Timestamp,
+			Attempts:  msg.Attempts,
+			Priority:  msg.Priority,
+			Headers:   msg.Headers,
+		}
+		if utf8.Valid(msg.Body) {
+			p.Body = string(msg.Body)
+		} else {
+			p.BodyBase64 = base64.StdEncoding.EncodeToString(msg.Body)
+		}
+		peeked = append(peeked, p)
+	}
+	return struct {
+		Messages []peekedMessage `json:"messages"`
+	}{peeked}, nil
+}
+
+// doMessageAction deletes (/message/delete) or requeues right away
+// (/message/requeue) the message id of a channel
+func (s *httpServer) doMessageAction(w http.ResponseWriter, req *http.Request, ps httprouter.Params) (interface{}, error) {
+	reqParams, topic, channelName, err := s.getExistingTopicFromQuery(req)
+	if err != nil {
+		return nil, err
+	}
+
+	idStr, err := reqParams.Get("id")
+	if err != nil {
+		return nil, http_api.Err{400, "MISSING_ARG_ID"}
+	}
+	var id MessageID
+	if len(idStr) != len(id) {
+		return nil, http_api.Err{400, "INVALID_ID"}
+	}
+	copy(id[:], idStr)
+
+	channel, err := topic.GetExistingChannel(channelName)
+	if err != nil {
+		return nil, http_api.Err{404, "CHANNEL_NOT_FOUND"}
+	}
+
+	var state string
+	action := "requeued"
+	deleting := strings.HasSuffix(req.URL.Path, "delete")
+	if deleting {
+		action = "deleted"
+		state, err = channel.DeleteMessage(id)
+	} else {
+		state, err = channel.ForceRequeueMessage(id)
+	}
+	if err == errMessageNotFound {
+		return nil, http_api.Err{404, "MESSAGE_NOT_FOUND"}
+	}
+	if err == errTooManyPurged {
+		return nil, http_api.Err{507, "TOO_MANY_PURGED"}
+	}
+	if err != nil {
+		s.ctx.nsqd.logf(LOG_ERROR, "failure in %s - %s", req.URL.Path, err)
+		return nil, http_api.Err{500, "INTERNAL_ERROR"}
+	}
+	s.ctx.nsqd.logf(LOG_INFO, "CHANNEL(%s/%s): %s message %s (%s)",
+		topic.name, channelName, action, idStr, state)
+
+	if deleting && state == msgStateQueued {
+		// the message is skipped once it comes up, which must survive
+		// a process failure
+		s.persistPurged(channel)
+	}
+
+	return struct {
+		State string `json:"state"`
+	}{state}, nil
+}
+
+// persistPurged persists the deleted messages of channel, see
+// Channel.persistPurged
+func (s *httpServer) persistPurged(channel *Channel) {
+	err := channel.persistPurged()
+	if err != nil {
+		s.ctx.nsqd.logf(LOG_ERROR, "CHANNEL(%s): failed to persist deleted messages - %s", channel.name, err)
+	}
+}
+
+func (s *httpServer) doPurgeChannel(w http.ResponseWriter, req *http.Request, ps httprouter.Params) (interface{}, error) {
+	reqParams, topic, channelName, err := s.getExistingTopicFromQuery(req)
+	if err != nil {
+		return nil, err
+	}
+
+	expr, err := reqParams.Get("filter")
+	if err != nil {
+		return nil, http_api.Err{400, "MISSING_ARG_FILTER"}
+	}
+	f, err := parseFilter(expr)
+	if err != nil {
+		return nil, http_api.Err{400, "INVALID_FILTER"}
+	}
+
+	channel, err := topic.GetExistingChannel(channelName)
+	if err != nil {
+		return nil, http_api.Err{404, "CHANNEL_NOT_FOUND"}
+	}
+
+	count, err := channel.PurgeMessages(f)
+	if count > 0 {
+		s.persistPurged(channel)
+	}
+	if err == errTooManyPurged {
+		s.ctx.nsqd.logf(LOG_WARN, "CHANNEL(%s/%s): purged only %d messages matching %s - %s",
+			topic.name, channelName, count, expr, err)
+		return nil, http_api.Err{507, "TOO_MANY_PURGED"}
+	}
+	if err != nil {
+		s.ctx.nsqd.logf(LOG_ERROR, "failed to purge channel (%s/%s) - %s", topic.name, channelName, err)
+		return nil, http_api.Err{500, "INTERNAL_ERROR"}
+	}
+	s.ctx.nsqd.logf(LOG_INFO, "CHANNEL(%s/%s): purged %d messages matching %s",
+		topic.name, channelName, count, expr)
+
+	return struct {
+		Count int `json:"count"`
+	}{count}, nil
+}
+
+// doTransferChannel starts moving (/channel/move) or copying
+// (/channel/copy) the backlog of a channel to to_channel of to_topic, or
+// to to_topic itself
+func (s *httpServer) doTransferChannel(w http.ResponseWriter, req *http.Request, ps httprouter.Params) (interface{}, error) {
+	reqParams, topic, channelName, err := s.getExistingTopicFromQuery(req)
+	if err != nil {
+		return nil, err
+	}
+
+	toTopic, err := reqParams.Get("to_topic")
+	if err != nil {
+		return nil, http_api.Err{400, "MISSING_ARG_TO_TOPIC"}
+	}
+	if !protocol.IsValidTopicName(toTopic) {
+		return nil, http_api.Err{400, "INVALID_TO_TOPIC"}
+	}
+	toChannel, _ := reqParams.Get("to_channel")
+	if toChannel != "" && !protocol.IsValidChannelName(toChannel) {
+		return nil, http_api.Err{400, "INVALID_TO_CHANNEL"}
+	}
+	err = s.checkAuth(req, reqParams.Values, "admin", toTopic, toChannel)
+	if err != nil {
+		return nil, err
+	}
+
+	channel, err := topic.GetExistingChannel(channelName)
+	if err != nil {
+		return nil, http_api.Err{404, "CHANNEL_NOT_FOUND"}
+	}
+
+	kind := transferCopy
+	if strings.HasSuffix(req.URL.Path, "move") {
+		kind = transferMove
+	}
+	stats, err := channel.StartTransfer(kind, toTopic, toChannel)
+	switch err {
+	case nil:
+	case errTransferToSelf:
+		return nil, http_api.Err{400, "INVALID_DESTINATION"}
+	case errTransferRunning:
+		return nil, http_api.Err{400, "TRANSFER_IN_PROGRESS"}
+	case errMoveNotSupported:
+		return nil, http_api.Err{400, "MOVE_NOT_SUPPORTED"}
+	default:
+		s.ctx.nsqd.logf(LOG_ERROR, "failed to %s channel (%s/%s) - %s", kind, topic.name, channelName, err)
+		return nil, http_api.Err{500, "INTERNAL_ERROR"}
+	}
+	return stats, nil
+}
+
 func (s *httpServer) doEmptyChannel(w http.ResponseWriter, req *http.Request, ps httprouter.Params) (interface{}, error) {
 	_, topic, channelName, err := s.getExistingTopicFromQuery(req)
 	if err != nil {
@@ -442,7 +1191,7 @@ func (s *httpServer) doDeleteChannel(w http.ResponseWriter, req *http.Request, p
 }
 
 func (s *httpServer) doPauseChannel(w http.ResponseWriter, req *http.Request, ps httprouter.Params) (interface{}, error) {
-	_, topic, channelName, err := s.getExistingTopicFromQuery(req)
+	reqParams, topic, channelName, err := s.getExistingTopicFromQuery(req)
 	if err != nil {
 		return nil, err
 	}
@@ -455,7 +1204,11 @@ func (s *httpServer) doPauseChannel(w http.ResponseWriter, req *http.Request, ps
 	if strings.Contains(req.URL.Path, "unpause") {
 		err = channel.UnPause()
 	} else {
-		err = channel.Pause()
+		resumeAt, perr := parseResumeAt(reqParams)
+		if perr != nil {
+			return nil, http_api.Err{400, perr.Error()}
+		}
+		err = channel.PauseUntil(resumeAt)
 	}
 	if err != nil {
 		s.ctx.nsqd.logf(LOG_ERROR, "failure in %s - %s", req.URL.Path, err)
@@ -553,13 +1306,69 @@ func (s *httpServer) doStats(w http.ResponseWriter, req *http.Request, ps httpro
 	}
 
 	return struct {
-		Version   string        `json:"version"`
-		Health    string        `json:"health"`
-		StartTime int64         `json:"start_time"`
-		Topics    []TopicStats  `json:"topics"`
-		Memory    *memStats     `json:"memory,omitempty"`
-		Producers []ClientStats `json:"producers"`
-	}{version.Binary, health, startTime.Unix(), stats, ms, producerStats}, nil
+		Version       string        `json:"version"`
+		Health        string        `json:"health"`
+		StartTime     int64         `json:"start_time"`
+		TLSCertExpiry int64         `json:"tls_cert_expiry,omitempty"`
+		Topics        []TopicStats  `json:"topics"`
+		Memory        *memStats     `json:"memory,omitempty"`
+		Producers     []ClientStats `json:"producers"`
+	}{version.Binary, health, startTime.Unix(), tlsCertExpiry(s.ctx.nsqd), stats, ms, producerStats}, nil
+}
+
+// doMetrics exposes the data of /stats in the Prometheus text format, it
+// accepts the same topic, channel, include_clients and include_mem params
+func (s *httpServer) doMetrics(w http.ResponseWriter, req *http.Request, ps httprouter.Params) (interface{}, error) {
+	reqParams, err := http_api.NewReqParams(req)
+	if err != nil {
+		s.ctx.nsqd.logf(LOG_ERROR, "failed to parse request params - %s", err)
+		return nil, http_api.Err{400, "INVALID_REQUEST"}
+	}
+	topicName, _ := reqParams.Get("topic")
+	channelName, _ := reqParams.Get("channel")
+	includeClientsParam, _ := reqParams.Get("include_clients")
+	includeMemParam, _ := reqParams.Get("include_mem")
+
+	includeClients, ok := boolParams[includeClientsParam]
+	if !ok {
+		includeClients = true
+	}
+	includeMem, ok := boolParams[includeMemParam]
+	if !ok {
+		includeMem = true
+	}
+
+	var producerStats []ClientStats
+	if includeClients {
+		producerStats = s.ctx.nsqd.GetProducerStats()
+	}
+	if len(topicName) > 0 {
+		for i, clientStat := range producerStats {
+			var pubCounts []PubCount
+			for _, v := range clientStat.PubCounts {
+				if v.Topic == topicName {
+					pubCounts = append(pubCounts, v)
+				}
+			}
+			producerStats[i].PubCounts = pubCounts
+		}
+	}
+	stats := s.ctx.nsqd.GetStats(topicName, channelName, includeClients)
+
+	var ms *memStats
+	if includeMem {
+		m := getMemStats()
+		ms = &m
+	}
+
+	set := metrics.NewSet()
+	writeMetrics(set, stats, producerStats, ms, s.ctx.nsqd.IsHealthy(), time.Since(s.ctx.nsqd.GetStartTime()))
+	if expiry := tlsCertExpiry(s.ctx.nsqd); expiry != 0 {
+		set.Gauge("nsq_nsqd_tls_cert_expiry_timestamp_seconds", "When the TLS certificate expires", float64(expiry))
+	}
+
+	w.Header().Set("Content-Type", metrics.ContentType)
+	return set.String(), nil
 }
 
 func (s *httpServer) printStats(stats []TopicStats, producerStats []ClientStats, ms *memStats, health string, startTime time.Time, uptime time.Duration) []byte {
@@ -571,6 +1380,9 @@ func (s *httpServer) printStats(stats []TopicStats, producerStats []ClientStats,
 	fmt.Fprintf(w, "%s\n", version.String("nsqd"))
 	fmt.Fprintf(w, "start_time %v\n", startTime.Format(time.RFC3339))
 	fmt.Fprintf(w, "uptime %s\n", uptime)
+	if expiry := s.ctx.nsqd.TLSCertExpiry(); !expiry.IsZero() {
+		fmt.Fprintf(w, "tls_cert_expiry %v\n", expiry.Format(time.RFC3339))
+	}
 
 	fmt.Fprintf(w, "\nHealth: %s\n", health)
 
@@ -600,21 +1412,27 @@ func (s *httpServer) printStats(stats []TopicStats, producerStats []ClientStats,
 		} else {
 			pausedPrefix = "   "
 		}
-		fmt.Fprintf(w, "\n%s[%-15s] depth: %-5d be-depth: %-5d msgs: %-8d e2e%%: %s\n",
+		fmt.Fprintf(w, "\n%s[%-15s] depth: %-5d be-depth: %-5d msgs: %-8d throttled: %-5d overflow: %-5d scheduled: %-5d e2e%%: %s\n",
 			pausedPrefix,
 			t.TopicName,
 			t.Depth,
 			t.BackendDepth,
 			t.MessageCount,
+			t.ThrottledCount,
+			t.OverflowDroppedCount+t.OverflowRejectedCount,
+			t.ScheduledCount,
 			t.E2eProcessingLatency,
 		)
+		if t.ResumeAt > 0 {
+			fmt.Fprintf(w, "   resumes in: %s\n", time.Unix(t.ResumeAt, 0).Sub(now).Truncate(time.Second))
+		}
 		for _, c := range t.Channels {
 			if c.Paused {
 				pausedPrefix = "   *P "
 			} else {
 				pausedPrefix = "      "
 			}
-			fmt.Fprintf(w, "%s[%-25s] depth: %-5d be-depth: %-5d inflt: %-4d def: %-4d re-q: %-5d timeout: %-5d msgs: %-8d e2e%%: %s\n",
+			fmt.Fprintf(w, "%s[%-25s] depth: %-5d be-depth: %-5d inflt: %-4d def: %-4d re-q: %-5d timeout: %-5d dead: %-5d expired: %-5d overflow: %-5d msgs: %-8d e2e%%: %s\n",
 				pausedPrefix,
 				c.ChannelName,
 				c.Depth,
@@ -623,9 +1441,22 @@ func (s *httpServer) printStats(stats []TopicStats, producerStats []ClientStats,
 				c.DeferredCount,
 				c.RequeueCount,
 				c.TimeoutCount,
+				c.DeadLetterCount,
+				c.ExpiredCount,
+				c.OverflowDroppedCount+c.OverflowRejectedCount,
 				c.MessageCount,
 				c.E2eProcessingLatency,
 			)
+			if c.MaxDeliveryRate > 0 {
+				fmt.Fprintf(w, "        delivery rate: %.1f/%d msgs/s\n", c.DeliveryRate, c.MaxDeliveryRate)
+			}
+			if c.ResumeAt > 0 {
+				fmt.Fprintf(w, "        resumes in: %s\n", time.Unix(c.ResumeAt, 0).Sub(now).Truncate(time.Second))
+			}
+			if c.Transfer != nil {
+				fmt.Fprintf(w, "        transfer: %s to %s %d/%d (%s)\n",
+					c.Transfer.Kind, c.Transfer.To, c.Transfer.Done, c.Transfer.Total, c.Transfer.State)
+			}
 			for _, client := range c.Clients {
 				connectTime := time.Unix(client.ConnectTime, 0)
 				// truncate to the second
@@ -657,10 +1488,11 @@ func (s *httpServer) printStats(stats []TopicStats, producerStats []ClientStats,
 			for _, v := range client.PubCounts {
 				totalPubCount += v.Count
 			}
-			fmt.Fprintf(w, "\n   [%s %-21s] msgs: %-8d connected: %s\n",
+			fmt.Fprintf(w, "\n   [%s %-21s] msgs: %-8d throttled: %-8d connected: %s\n",
 				client.Version,
 				client.ClientID,
 				totalPubCount,
+				client.ThrottledCount,
 				duration,
 			)
 			for _, v := range client.PubCounts {
@@ -724,18 +1556,21 @@ func getOptByCfgName(opts interface{}, name string) (interface{}, bool) {
 	typ := val.Type()
 	for i := 0; i < typ.NumField(); i++ {
 		field := typ.Field(i)
-		flagName := field.Tag.Get("flag")
-		cfgName := field.Tag.Get("cfg")
-		if flagName == "" {
-			continue
-		}
-		if cfgName == "" {
-			cfgName = strings.Replace(flagName, "-", "_", -1)
-		}
-		if name != cfgName {
+		cfgName := optCfgName(field)
+		if cfgName == "" || name != cfgName {
 			continue
 		}
 		return val.FieldByName(field.Name).Interface(), true
 	}
 	return nil, false
 }
+
+// doConfigReload re-reads the config file and applies the options that
+// can be changed without a restart
+func (s *httpServer) doConfigReload(w http.ResponseWriter, req *http.Request, ps httprouter.Params) (interface{}, error) {
+	result, err := s.ctx.nsqd.Reload()
+	if err != nil {
+		return nil, http_api.Err{500, "RELOAD_FAILED"}
+	}
+	return result, nil
+}
@@ -8,10 +8,14 @@ import (
 	"io/ioutil"
 	"net"
 	"net/http"
+	"net/http/httptest"
+	"net/url"
 	"os"
+	"path/filepath"
 	"runtime"
 	"strconv"
 	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
 
@@ -60,6 +64,412 @@ func TestHTTPpub(t *testing.T) {
 	test.Equal(t, int64(1), topic.Depth())
 }
 
+func TestHTTPpubAuthFile(t *testing.T) {
+	opts := NewOptions()
+	opts.Logger = test.NewTestLogger(t)
+	opts.DataPath, _ = ioutil.TempDir("", "nsq-test-")
+	defer os.RemoveAll(opts.DataPath)
+	opts.AuthFile = filepath.Join(opts.DataPath, "auth.json")
+	err := ioutil.WriteFile(opts.AuthFile, []byte(`{"secrets":{
+		"pubsecret":{"authorizations":[
+			{"topic":"^test_http_pub_auth$", "channels":[".*"], "permissions":["publish"]}]}
+	}}`), 0644)
+	test.Nil(t, err)
+	_, httpAddr, nsqd := mustStartNSQD(opts)
+	defer nsqd.Exit()
+
+	pub := func(path string, secret string, body string) (int, string) {
+		req, err := http.NewRequest("POST", fmt.Sprintf("http://%s%s", httpAddr, path), strings.NewReader(body))
+		test.Nil(t, err)
+		if secret != "" {
+			req.Header.Set("Authorization", "Bearer "+secret)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		test.Nil(t, err)
+		defer resp.Body.Close()
+		data, _ := ioutil.ReadAll(resp.Body)
+		return resp.StatusCode, string(data)
+	}
+
+	code, body := pub("/pub?topic=test_http_pub_auth", "", "test message")
+	test.Equal(t, 401, code)
+	test.Equal(t, `{"message":"AUTH_REQUIRED"}`, body)
+	code, body = pub("/pub?topic=test_http_pub_auth", "badsecret", "test message")
+	test.Equal(t, 401, code)
+	test.Equal(t, `{"message":"AUTH_FAILED"}`, body)
+	code, body = pub("/pub?topic=test_http_pub_other", "pubsecret", "test message")
+	test.Equal(t, 403, code)
+	test.Equal(t, `{"message":"UNAUTHORIZED"}`, body)
+	code, body = pub("/mpub?topic=test_http_pub_other", "pubsecret", "test message")
+	test.Equal(t, 403, code)
+
+	code, body = pub("/pub?topic=test_http_pub_auth", "pubsecret", "test message")
+	test.Equal(t, 200, code)
+	test.Equal(t, "OK", body)
+	code, body = pub("/mpub?topic=test_http_pub_auth&auth_secret=pubsecret", "", "test message\ntest message")
+	test.Equal(t, 200, code)
+	test.Equal(t, "OK", body)
+
+	topic, err := nsqd.GetExistingTopic("test_http_pub_auth")
+	test.Nil(t, err)
+	test.Equal(t, int64(3), topic.Depth())
+	_, err = nsqd.GetExistingTopic("test_http_pub_other")
+	test.NotNil(t, err)
+
+	// the file is re-read on reload
+	err = ioutil.WriteFile(opts.AuthFile, []byte(`{"secrets":{}}`), 0644)
+	test.Nil(t, err)
+	reloadOpts := *nsqd.getOpts()
+	_, err = nsqd.ApplyOpts(&reloadOpts)
+	test.Nil(t, err)
+	code, _ = pub("/pub?topic=test_http_pub_auth", "pubsecret", "test message")
+	test.Equal(t, 401, code)
+}
+
+func TestHTTPAuth(t *testing.T) {
+	var queries int32
+	authd := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&queries, 1)
+		r.ParseForm()
+		switch r.Form.Get("secret") {
+		case "pubsecret":
+			fmt.Fprint(w, `{"ttl":60,"authorizations":[
+				{"topic":"^test_http_auth$","channels":[".*"],"permissions":["publish"]}]}`)
+		case "adminsecret":
+			fmt.Fprint(w, `{"ttl":60,"authorizations":[
+				{"topic":"^test_http_auth$","channels":["^ch$"],"permissions":["admin"]}]}`)
+		default:
+			w.WriteHeader(403)
+		}
+	}))
+	defer authd.Close()
+	authdURL, err := url.Parse(authd.URL)
+	test.Nil(t, err)
+
+	opts := NewOptions()
+	opts.Logger = test.NewTestLogger(t)
+	opts.AuthHTTPAddresses = []string{authdURL.Host}
+	tcpAddr, httpAddr, nsqd := mustStartNSQD(opts)
+	defer os.RemoveAll(opts.DataPath)
+	defer nsqd.Exit()
+
+	post := func(path string, secret string, body string) int {
+		req, err := http.NewRequest("POST", fmt.Sprintf("http://%s%s", httpAddr, path), strings.NewReader(body))
+		test.Nil(t, err)
+		if secret != "" {
+			req.Header.Set("Authorization", "Bearer "+secret)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		test.Nil(t, err)
+		resp.Body.Close()
+		return resp.StatusCode
+	}
+
+	test.Equal(t, 401, post("/pub?topic=test_http_auth", "", "test message"))
+	test.Equal(t, 401, post("/pub?topic=test_http_auth", "badsecret", "test message"))
+	test.Equal(t, 200, post("/pub?topic=test_http_auth", "pubsecret", "test message"))
+	test.Equal(t, 200, post("/mpub?topic=test_http_auth&auth_secret=pubsecret", "", "test message"))
+	// the state is cached until it expires
+	test.Equal(t, int32(2), atomic.LoadInt32(&queries))
+
+	// but not for TCP clients, they query the auth servers on each AUTH
+	conn, err := mustConnectNSQD(tcpAddr)
+	test.Nil(t, err)
+	identify(t, conn, nil, frameTypeResponse)
+	authCmd(t, conn, "pubsecret", `{"identity":"","identity_url":"","permission_count":1}`)
+	conn.Close()
+	test.Equal(t, int32(3), atomic.LoadInt32(&queries))
+
+	test.Equal(t, 401, post("/topic/create?topic=test_http_auth", "", ""))
+	test.Equal(t, 403, post("/topic/create?topic=test_http_auth", "pubsecret", ""))
+	test.Equal(t, 403, post("/pub?topic=test_http_auth", "adminsecret", "test message"))
+	test.Equal(t, 200, post("/topic/create?topic=test_http_auth", "adminsecret", ""))
+	test.Equal(t, 403, post("/channel/create?topic=test_http_auth&channel=ch", "pubsecret", ""))
+	test.Equal(t, 403, post("/channel/create?topic=test_http_auth&channel=other", "adminsecret", ""))
+	test.Equal(t, 200, post("/channel/create?topic=test_http_auth&channel=ch", "adminsecret", ""))
+	test.Equal(t, 403, post("/channel/pause?topic=test_http_auth&channel=ch", "pubsecret", ""))
+	test.Equal(t, 200, post("/channel/pause?topic=test_http_auth&channel=ch", "adminsecret", ""))
+	test.Equal(t, 403, post("/topic/empty?topic=test_http_auth", "pubsecret", ""))
+	test.Equal(t, 200, post("/topic/pause?topic=test_http_auth", "adminsecret", ""))
+	test.Equal(t, 403, post("/topic/delete?topic=test_http_auth", "pubsecret", ""))
+
+	topic, err := nsqd.GetExistingTopic("test_http_auth")
+	test.Nil(t, err)
+	test.Equal(t, true, topic.IsPaused())
+	channel, err := topic.GetExistingChannel("ch")
+	test.Nil(t, err)
+	test.Equal(t, true, channel.IsPaused())
+	test.Equal(t, int64(2), topic.Depth()+channel.Depth())
+
+	test.Equal(t, 200, post("/topic/delete?topic=test_http_auth", "adminsecret", ""))
+	_, err = nsqd.GetExistingTopic("test_http_auth")
+	test.NotNil(t, err)
+}
+
+func TestHTTPpubRateLimit(t *testing.T) {
+	opts := NewOptions()
+	opts.Logger = test.NewTestLogger(t)
+	_, httpAddr, nsqd := mustStartNSQD(opts)
+	defer os.RemoveAll(opts.DataPath)
+	defer nsqd.Exit()
+
+	topicName := "test_http_pub_rate_limit" + strconv.Itoa(int(time.Now().Unix()))
+
+	url := fmt.Sprintf("http://%s/topic/create?topic=%s&pub_rate_limit=1&pub_byte_rate_limit=100", httpAddr, topicName)
+	resp, err := http.Post(url, "application/octet-stream", nil)
+	test.Nil(t, err)
+	resp.Body.Close()
+	test.Equal(t, 200, resp.StatusCode)
+
+	url = fmt.Sprintf("http://%s/pub?topic=%s", httpAddr, topicName)
+	resp, err = http.Post(url, "application/octet-stream", bytes.NewBufferString("test message"))
+	test.Nil(t, err)
+	resp.Body.Close()
+	test.Equal(t, 200, resp.StatusCode)
+
+	resp, err = http.Post(url, "application/octet-stream", bytes.NewBufferString("test message"))
+	test.Nil(t, err)
+	body, _ := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	test.Equal(t, 429, resp.StatusCode)
+	test.Equal(t, `{"message":"THROTTLED"}`, string(body))
+
+	stats := nsqd.GetStats(topicName, "", false)
+	test.Equal(t, uint64(1), stats[0].MessageCount)
+	test.Equal(t, uint64(1), stats[0].ThrottledCount)
+	test.Equal(t, int64(1), stats[0].PubRateLimit)
+	test.Equal(t, int64(100), stats[0].PubByteRateLimit)
+
+	// the limits are persisted
+	data, err := ioutil.ReadFile(newMetadataFile(opts))
+	test.Nil(t, err)
+	var m meta
+	err = json.Unmarshal(data, &m)
+	test.Nil(t, err)
+	test.Equal(t, topicName, m.Topics[0].Name)
+	test.Equal(t, int64(1), m.Topics[0].PubRateLimit)
+	test.Equal(t, int64(100), m.Topics[0].PubByteRateLimit)
+
+	url = fmt.Sprintf("http://%s/topic/create?topic=%s&pub_rate_limit=-1", httpAddr, topicName)
+	resp, err = http.Post(url, "application/octet-stream", nil)
+	test.Nil(t, err)
+	resp.Body.Close()
+	test.Equal(t, 400, resp.StatusCode)
+}
+
+func TestHTTPBacklogQuota(t *testing.T) {
+	opts := NewOptions()
+	opts.Logger = test.NewTestLogger(t)
+	_, httpAddr, nsqd := mustStartNSQD(opts)
+	defer os.RemoveAll(opts.DataPath)
+	defer nsqd.Exit()
+
+	topicName := "test_http_backlog_quota" + strconv.Itoa(int(time.Now().Unix()))
+
+	url := fmt.Sprintf("http://%s/topic/create?topic=%s&max_backlog_msgs=1&overflow_policy=reject", httpAddr, topicName)
+	resp, err := http.Post(url, "application/octet-stream", nil)
+	test.Nil(t, err)
+	resp.Body.Close()
+	test.Equal(t, 200, resp.StatusCode)
+
+	url = fmt.Sprintf("http://%s/pub?topic=%s", httpAddr, topicName)
+	resp, err = http.Post(url, "application/octet-stream", bytes.NewBufferString("test message"))
+	test.Nil(t, err)
+	resp.Body.Close()
+	test.Equal(t, 200, resp.StatusCode)
+
+	resp, err = http.Post(url, "application/octet-stream", bytes.NewBufferString("test message"))
+	test.Nil(t, err)
+	body, _ := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	test.Equal(t, 507, resp.StatusCode)
+	test.Equal(t, `{"message":"BACKLOG_FULL"}`, string(body))
+
+	stats := nsqd.GetStats(topicName, "", false)
+	test.Equal(t, int64(1), stats[0].MaxBacklogMsgs)
+	test.Equal(t, "reject", stats[0].OverflowPolicy)
+	test.Equal(t, uint64(1), stats[0].OverflowRejectedCount)
+	test.Equal(t, true, stats[0].BacklogAlert)
+
+	url = fmt.Sprintf("http://%s/channel/create?topic=%s&channel=ch&max_backlog_bytes=1024&overflow_policy=drop_oldest", httpAddr, topicName)
+	resp, err = http.Post(url, "application/octet-stream", nil)
+	test.Nil(t, err)
+	resp.Body.Close()
+	test.Equal(t, 200, resp.StatusCode)
+
+	stats = nsqd.GetStats(topicName, "", false)
+	test.Equal(t, int64(1024), stats[0].Channels[0].MaxBacklogBytes)
+	test.Equal(t, "drop_oldest", stats[0].Channels[0].OverflowPolicy)
+
+	// the quotas are persisted
+	data, err := ioutil.ReadFile(newMetadataFile(opts))
+	test.Nil(t, err)
+	var m meta
+	err = json.Unmarshal(data, &m)
+	test.Nil(t, err)
+	test.Equal(t, topicName, m.Topics[0].Name)
+	test.Equal(t, int64(1), m.Topics[0].MaxBacklogMsgs)
+	test.Equal(t, "reject", m.Topics[0].OverflowPolicy)
+	test.Equal(t, int64(1024), m.Topics[0].Channels[0].MaxBacklogBytes)
+	test.Equal(t, "drop_oldest", m.Topics[0].Channels[0].OverflowPolicy)
+
+	url = fmt.Sprintf("http://%s/topic/create?topic=%s&overflow_policy=drop_everything", httpAddr, topicName)
+	resp, err = http.Post(url, "application/octet-stream", nil)
+	test.Nil(t, err)
+	body, _ = ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	test.Equal(t, 400, resp.StatusCode)
+	test.Equal(t, `{"message":"INVALID_OVERFLOW_POLICY"}`, string(body))
+}
+
+func TestHTTPpubHeaders(t *testing.T) {
+	opts := NewOptions()
+	opts.Logger = test.NewTestLogger(t)
+	opts.MaxHeadersSize = 32
+	_, httpAddr, nsqd := mustStartNSQD(opts)
+	defer os.RemoveAll(opts.DataPath)
+	defer nsqd.Exit()
+
+	topicName := "test_http_pub_headers" + strconv.Itoa(int(time.Now().Unix()))
+	topic := nsqd.GetTopic(topicName)
+	channel := topic.GetChannel("ch")
+
+	url := fmt.Sprintf("http://%s/pub?topic=%s", httpAddr, topicName)
+	req, _ := http.NewRequest("POST", url, bytes.NewBufferString("test message"))
+	req.Header.Set("X-Nsq-Header-Trace-Id", "abc")
+	req.Header.Set("Content-Type", "application/octet-stream")
+	resp, err := http.DefaultClient.Do(req)
+	test.Nil(t, err)
+	body, _ := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	test.Equal(t, "OK", string(body))
+
+	msg := <-channel.memoryMsgChan
+	test.Equal(t, map[string]string{"trace-id": "abc"}, msg.Headers)
+
+	req, _ = http.NewRequest("POST", url, bytes.NewBufferString("test message"))
+	req.Header.Set("X-Nsq-Header-Big", strings.Repeat("a", 64))
+	resp, err = http.DefaultClient.Do(req)
+	test.Nil(t, err)
+	body, _ = ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	test.Equal(t, 413, resp.StatusCode)
+	test.Equal(t, `{"message":"HEADERS_TOO_BIG"}`, string(body))
+}
+
+func TestHTTPpubPriority(t *testing.T) {
+	opts := NewOptions()
+	opts.Logger = test.NewTestLogger(t)
+	_, httpAddr, nsqd := mustStartNSQD(opts)
+	defer os.RemoveAll(opts.DataPath)
+	defer nsqd.Exit()
+
+	topicName := "test_http_pub_priority" + strconv.Itoa(int(time.Now().Unix()))
+	topic := nsqd.GetTopic(topicName)
+	channel := topic.GetChannel("ch")
+
+	url := fmt.Sprintf("http://%s/pub?topic=%s&priority=2", httpAddr, topicName)
+	resp, err := http.Post(url, "application/octet-stream", bytes.NewBufferString("test message"))
+	test.Nil(t, err)
+	body, _ := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	test.Equal(t, "OK", string(body))
+
+	msg := <-channel.priorityMsgChans[1]
+	test.Equal(t, uint8(2), msg.Priority)
+
+	url = fmt.Sprintf("http://%s/mpub?topic=%s&priority=high", httpAddr, topicName)
+	resp, err = http.Post(url, "application/octet-stream", bytes.NewBufferString("test message"))
+	test.Nil(t, err)
+	body, _ = ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	test.Equal(t, 400, resp.StatusCode)
+	test.Equal(t, `{"message":"INVALID_PRIORITY"}`, string(body))
+}
+
+func TestHTTPpubIdempotencyKey(t *testing.T) {
+	opts := NewOptions()
+	opts.Logger = test.NewTestLogger(t)
+	_, httpAddr, nsqd := mustStartNSQD(opts)
+	defer os.RemoveAll(opts.DataPath)
+	defer nsqd.Exit()
+
+	topicName := "test_http_pub_idempotency_key" + strconv.Itoa(int(time.Now().Unix()))
+	topic := nsqd.GetTopic(topicName)
+
+	type pubResponse struct {
+		ID        string `json:"id"`
+		Duplicate bool   `json:"duplicate"`
+	}
+	pub := func() pubResponse {
+		url := fmt.Sprintf("http://%s/pub?topic=%s&idempotency_key=abc", httpAddr, topicName)
+		resp, err := http.Post(url, "application/octet-stream", bytes.NewBufferString("test message"))
+		test.Nil(t, err)
+		defer resp.Body.Close()
+		test.Equal(t, 200, resp.StatusCode)
+		var r pubResponse
+		err = json.NewDecoder(resp.Body).Decode(&r)
+		test.Nil(t, err)
+		return r
+	}
+
+	r1 := pub()
+	test.Equal(t, false, r1.Duplicate)
+	r2 := pub()
+	test.Equal(t, true, r2.Duplicate)
+	test.Equal(t, r1.ID, r2.ID)
+	test.Equal(t, int64(1), topic.Depth())
+
+	url := fmt.Sprintf("http://%s/topic/create?topic=%s&dedup_window=10s", httpAddr, topicName)
+	resp, err := http.Post(url, "application/json", nil)
+	test.Nil(t, err)
+	resp.Body.Close()
+	test.Equal(t, 200, resp.StatusCode)
+	test.Equal(t, 10*time.Second, topic.DedupWindow())
+
+	url = fmt.Sprintf("http://%s/topic/create?topic=%s&dedup_window=-1s", httpAddr, topicName)
+	resp, err = http.Post(url, "application/json", nil)
+	test.Nil(t, err)
+	body, _ := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	test.Equal(t, 400, resp.StatusCode)
+	test.Equal(t, `{"message":"INVALID_DEDUP_WINDOW"}`, string(body))
+}
+
+func TestHTTPcreateTopicPartitions(t *testing.T) {
+	opts := NewOptions()
+	opts.Logger = test.NewTestLogger(t)
+	_, httpAddr, nsqd := mustStartNSQD(opts)
+	defer os.RemoveAll(opts.DataPath)
+	defer nsqd.Exit()
+
+	topicName := "test_http_create_topic_partitions" + strconv.Itoa(int(time.Now().Unix()))
+
+	create := func(partitions string) (int, string) {
+		url := fmt.Sprintf("http://%s/topic/create?topic=%s&partitions=%s", httpAddr, topicName, partitions)
+		resp, err := http.Post(url, "application/json", nil)
+		test.Nil(t, err)
+		body, _ := ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		return resp.StatusCode, string(body)
+	}
+
+	code, _ := create("4")
+	test.Equal(t, 200, code)
+	topic, err := nsqd.GetExistingTopic(topicName)
+	test.Nil(t, err)
+	test.Equal(t, 4, topic.Partitions())
+
+	code, body := create("-1")
+	test.Equal(t, 400, code)
+	test.Equal(t, `{"message":"INVALID_PARTITIONS"}`, body)
+
+	topic.GetChannel("ch")
+	code, body = create("8")
+	test.Equal(t, 400, code)
+	test.Equal(t, `{"message":"PARTITIONS_IN_USE"}`, body)
+}
+
 func TestHTTPpubEmpty(t *testing.T) {
 	opts := NewOptions()
 	opts.Logger = test.NewTestLogger(t)
@@ -223,10 +633,8 @@ func TestHTTPpubDefer(t *testing.T) {
 
 	time.Sleep(5 * time.Millisecond)
 
-	ch.deferredMutex.Lock()
-	numDef := len(ch.deferredMessages)
-	ch.deferredMutex.Unlock()
-	test.Equal(t, 1, numDef)
+	test.Equal(t, int64(1), topic.ScheduledCount())
+	test.Equal(t, int64(0), ch.Depth())
 }
 
 func TestHTTPSRequire(t *testing.T) {
@@ -368,6 +776,112 @@ func TestTLSRequireVerifyExceptHTTP(t *testing.T) {
 	test.Equal(t, int64(1), topic.Depth())
 }
 
+func TestHTTPChannelCreateFilter(t *testing.T) {
+	opts := NewOptions()
+	opts.Logger = test.NewTestLogger(t)
+	_, httpAddr, nsqd := mustStartNSQD(opts)
+	defer os.RemoveAll(opts.DataPath)
+	defer nsqd.Exit()
+
+	topicName := "test_http_channel_filter" + strconv.Itoa(int(time.Now().Unix()))
+	topic := nsqd.GetTopic(topicName)
+
+	url := fmt.Sprintf("http://%s/channel/create?topic=%s&channel=ch&filter=json:type%%3Dorder", httpAddr, topicName)
+	resp, err := http.Post(url, "application/json", nil)
+	test.Nil(t, err)
+	resp.Body.Close()
+	test.Equal(t, 200, resp.StatusCode)
+
+	channel, err := topic.GetExistingChannel("ch")
+	test.Nil(t, err)
+	test.Equal(t, "json:type=order", channel.Filter())
+
+	data, err := ioutil.ReadFile(newMetadataFile(opts))
+	test.Nil(t, err)
+	test.Equal(t, true, strings.Contains(string(data), `"filter":"json:type=order"`))
+
+	url = fmt.Sprintf("http://%s/channel/create?topic=%s&channel=ch&filter=bogus", httpAddr, topicName)
+	resp, err = http.Post(url, "application/json", nil)
+	test.Nil(t, err)
+	body, _ := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	test.Equal(t, 400, resp.StatusCode)
+	test.Equal(t, `{"message":"INVALID_FILTER"}`, string(body))
+	test.Equal(t, "json:type=order", channel.Filter())
+}
+
+func TestHTTPChannelCreateMessageTTL(t *testing.T) {
+	opts := NewOptions()
+	opts.Logger = test.NewTestLogger(t)
+	_, httpAddr, nsqd := mustStartNSQD(opts)
+	defer os.RemoveAll(opts.DataPath)
+	defer nsqd.Exit()
+
+	topicName := "test_http_channel_message_ttl" + strconv.Itoa(int(time.Now().Unix()))
+	topic := nsqd.GetTopic(topicName)
+
+	url := fmt.Sprintf("http://%s/channel/create?topic=%s&channel=ch&message_ttl=1m&dead_letter_expired=true", httpAddr, topicName)
+	resp, err := http.Post(url, "application/json", nil)
+	test.Nil(t, err)
+	resp.Body.Close()
+	test.Equal(t, 200, resp.StatusCode)
+
+	channel, err := topic.GetExistingChannel("ch")
+	test.Nil(t, err)
+	test.Equal(t, time.Minute, channel.MessageTTL())
+	test.Equal(t, true, channel.DeadLetterExpired())
+
+	data, err := ioutil.ReadFile(newMetadataFile(opts))
+	test.Nil(t, err)
+	var m meta
+	err = json.Unmarshal(data, &m)
+	test.Nil(t, err)
+	test.Equal(t, time.Minute, m.Topics[0].Channels[0].MessageTTL)
+	test.Equal(t, true, m.Topics[0].Channels[0].DeadLetterExpired)
+
+	url = fmt.Sprintf("http://%s/channel/create?topic=%s&channel=ch&message_ttl=-1s", httpAddr, topicName)
+	resp, err = http.Post(url, "application/json", nil)
+	test.Nil(t, err)
+	body, _ := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	test.Equal(t, 400, resp.StatusCode)
+	test.Equal(t, `{"message":"INVALID_MESSAGE_TTL"}`, string(body))
+}
+
+func TestHTTPChannelCreateMaxDeliveryRate(t *testing.T) {
+	opts := NewOptions()
+	opts.Logger = test.NewTestLogger(t)
+	_, httpAddr, nsqd := mustStartNSQD(opts)
+	defer os.RemoveAll(opts.DataPath)
+	defer nsqd.Exit()
+
+	topicName := "test_http_channel_max_delivery_rate" + strconv.Itoa(int(time.Now().Unix()))
+	topic := nsqd.GetTopic(topicName)
+
+	url := fmt.Sprintf("http://%s/channel/create?topic=%s&channel=ch&max_delivery_rate=100", httpAddr, topicName)
+	resp, err := http.Post(url, "application/json", nil)
+	test.Nil(t, err)
+	resp.Body.Close()
+	test.Equal(t, 200, resp.StatusCode)
+
+	channel, err := topic.GetExistingChannel("ch")
+	test.Nil(t, err)
+	test.Equal(t, int64(100), channel.MaxDeliveryRate())
+
+	m, err := getMetadata(nsqd)
+	test.Nil(t, err)
+	test.Equal(t, int64(100), m.Topics[0].Channels[0].MaxDeliveryRate)
+
+	url = fmt.Sprintf("http://%s/channel/create?topic=%s&channel=ch&max_delivery_rate=-1", httpAddr, topicName)
+	resp, err = http.Post(url, "application/json", nil)
+	test.Nil(t, err)
+	body, _ := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	test.Equal(t, 400, resp.StatusCode)
+	test.Equal(t, `{"message":"INVALID_MAX_DELIVERY_RATE"}`, string(body))
+	test.Equal(t, int64(100), channel.MaxDeliveryRate())
+}
+
 func TestHTTPV1TopicChannel(t *testing.T) {
 	opts := NewOptions()
 	opts.Logger = test.NewTestLogger(t)
@@ -603,6 +1117,35 @@ func TestHTTPgetStatusText(t *testing.T) {
 	test.NotNil(t, body)
 }
 
+func TestHTTPmetrics(t *testing.T) {
+	opts := NewOptions()
+	opts.Logger = test.NewTestLogger(t)
+	_, httpAddr, nsqd := mustStartNSQD(opts)
+	defer os.RemoveAll(opts.DataPath)
+	defer nsqd.Exit()
+
+	topicName := "test_http_metrics" + strconv.Itoa(int(time.Now().Unix()))
+	topic := nsqd.GetTopic(topicName)
+	topic.GetChannel("ch")
+	topic.PutMessage(NewMessage(topic.GenerateID(), []byte("test")))
+
+	url := fmt.Sprintf("http://%s/metrics", httpAddr)
+	resp, err := http.Get(url)
+	test.Nil(t, err)
+	defer resp.Body.Close()
+	body, _ := ioutil.ReadAll(resp.Body)
+	test.Equal(t, 200, resp.StatusCode)
+	test.Equal(t, "text/plain; version=0.0.4; charset=utf-8", resp.Header.Get("Content-Type"))
+	for _, line := range []string{
+		"# TYPE nsq_topic_messages_total counter",
+		fmt.Sprintf(`nsq_topic_messages_total{topic="%s"} 1`, topicName),
+		fmt.Sprintf(`nsq_channel_clients{topic="%s",channel="ch"} 0`, topicName),
+		"# TYPE nsq_mem_heap_objects gauge",
+	} {
+		test.Equal(t, true, strings.Contains(string(body), line+"\n"))
+	}
+}
+
 func TestHTTPconfig(t *testing.T) {
 	lopts := nsqlookupd.NewOptions()
 	lopts.Logger = test.NewTestLogger(t)
@@ -660,6 +1203,118 @@ func TestHTTPconfig(t *testing.T) {
 	test.Equal(t, 400, resp.StatusCode)
 }
 
+func TestHTTPconfigReload(t *testing.T) {
+	opts := NewOptions()
+	opts.Logger = test.NewTestLogger(t)
+	opts.TLSCert = "./test/certs/server.pem"
+	opts.TLSKey = "./test/certs/server.key"
+	_, httpAddr, nsqd := mustStartNSQD(opts)
+	defer os.RemoveAll(opts.DataPath)
+	defer nsqd.Exit()
+
+	url := fmt.Sprintf("http://%s/config/reload", httpAddr)
+	resp, err := http.Post(url, "text/plain", nil)
+	test.Nil(t, err)
+	resp.Body.Close()
+	test.Equal(t, 500, resp.StatusCode)
+
+	oldCert, _ := nsqd.tlsReloader.GetCertificate(nil)
+
+	var info struct {
+		TLSCertExpiry int64 `json:"tls_cert_expiry"`
+	}
+	endpoint := fmt.Sprintf("http://%s/info", httpAddr)
+	err = http_api.NewClient(nil, ConnectTimeout, RequestTimeout).GETV1(endpoint, &info)
+	test.Nil(t, err)
+	test.Equal(t, nsqd.TLSCertExpiry().Unix(), info.TLSCertExpiry)
+	test.Equal(t, 2027, nsqd.TLSCertExpiry().Year())
+
+	var loaded Options
+	nsqd.SetConfigLoader(func() (*Options, error) {
+		reloaded := loaded
+		return &reloaded, nil
+	})
+
+	loaded = *nsqd.getOpts()
+	loaded.MsgTimeout = 5 * time.Second
+	loaded.TCPAddress = "127.0.0.1:1"
+	loaded.TLSCert = "./test/certs/cert.pem"
+	loaded.TLSKey = "./test/certs/key.pem"
+	resp, err = http.Post(url, "text/plain", nil)
+	test.Nil(t, err)
+	body, _ := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	test.Equal(t, 200, resp.StatusCode)
+	test.Equal(t, `{"applied":["msg_timeout","tls_cert","tls_key"],"restart_required":["tcp_address"]}`, string(body))
+	test.Equal(t, 5*time.Second, nsqd.getOpts().MsgTimeout)
+	test.NotEqual(t, "127.0.0.1:1", nsqd.getOpts().TCPAddress)
+	newCert, _ := nsqd.tlsReloader.GetCertificate(nil)
+	test.NotEqual(t, oldCert.Certificate[0], newCert.Certificate[0])
+	test.Equal(t, 2016, nsqd.TLSCertExpiry().Year())
+
+	// nothing is applied if anything is invalid
+	loaded = *nsqd.getOpts()
+	loaded.MsgTimeout = 10 * time.Second
+	loaded.TLSKey = "./test/certs/missing.key"
+	resp, err = http.Post(url, "text/plain", nil)
+	test.Nil(t, err)
+	resp.Body.Close()
+	test.Equal(t, 500, resp.StatusCode)
+	test.Equal(t, 5*time.Second, nsqd.getOpts().MsgTimeout)
+}
+
+func TestHTTPconfigReloadMaxMsgSize(t *testing.T) {
+	opts := NewOptions()
+	opts.Logger = test.NewTestLogger(t)
+	opts.MemQueueSize = 1
+	opts.MaxMsgSize = 100
+	_, httpAddr, nsqd := mustStartNSQD(opts)
+	defer os.RemoveAll(opts.DataPath)
+	defer nsqd.Exit()
+
+	topicName := "test_http_config_reload_max_msg_size" + strconv.Itoa(int(time.Now().Unix()))
+	channel := nsqd.GetTopic(topicName).GetChannel("ch")
+
+	var loaded Options
+	nsqd.SetConfigLoader(func() (*Options, error) {
+		reloaded := loaded
+		return &reloaded, nil
+	})
+	loaded = *nsqd.getOpts()
+	loaded.MaxMsgSize = 1000
+	loaded.MaxHeadersSize = 1000
+	resp, err := http.Post(fmt.Sprintf("http://%s/config/reload", httpAddr), "text/plain", nil)
+	test.Nil(t, err)
+	body, _ := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	test.Equal(t, 200, resp.StatusCode)
+	test.Equal(t, `{"applied":[],"restart_required":["max_headers_size","max_msg_size"]}`, string(body))
+
+	// the larger limit isn't applied, past MemQueueSize the messages go to
+	// the backend, which would drop anything bigger than the old limit
+	url := fmt.Sprintf("http://%s/pub?topic=%s", httpAddr, topicName)
+	resp, err = http.Post(url, "application/octet-stream", bytes.NewBuffer(make([]byte, 500)))
+	test.Nil(t, err)
+	resp.Body.Close()
+	test.Equal(t, 413, resp.StatusCode)
+
+	for i := 0; i < 5; i++ {
+		resp, err = http.Post(url, "application/octet-stream", bytes.NewBuffer(make([]byte, 100)))
+		test.Nil(t, err)
+		resp.Body.Close()
+		test.Equal(t, 200, resp.StatusCode)
+	}
+	for i := 0; i < 100 && channel.Depth() < 5; i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	test.Equal(t, int64(5), channel.Depth())
+	for i := 0; i < 4; i++ {
+		msg, err := decodeMessage(<-channel.backend.ReadChan())
+		test.Nil(t, err)
+		test.Equal(t, 100, len(msg.Body))
+	}
+}
+
 func TestHTTPerrors(t *testing.T) {
 	opts := NewOptions()
 	opts.Logger = test.NewTestLogger(t)
@@ -937,3 +1592,229 @@ func BenchmarkHTTPpub(b *testing.B) {
 	b.StopTimer()
 	nsqd.Exit()
 }
+
+func TestHTTPchannelRewind(t *testing.T) {
+	opts := NewOptions()
+	opts.Logger = test.NewTestLogger(t)
+	_, httpAddr, nsqd := mustStartNSQD(opts)
+	defer os.RemoveAll(opts.DataPath)
+	defer nsqd.Exit()
+
+	topicName := "test_http_channel_rewind" + strconv.Itoa(int(time.Now().Unix()))
+	topic := nsqd.GetTopic(topicName)
+	channel := topic.GetChannel("ch")
+
+	url := fmt.Sprintf("http://%s/channel/rewind?topic=%s&channel=ch&since=0", httpAddr, topicName)
+	resp, err := http.Post(url, "application/json", nil)
+	test.Nil(t, err)
+	body, _ := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	test.Equal(t, 400, resp.StatusCode)
+	test.Equal(t, `{"message":"RETENTION_DISABLED"}`, string(body))
+
+	url = fmt.Sprintf("http://%s/topic/create?topic=%s&retention_time=1h&retention_bytes=1048576", httpAddr, topicName)
+	resp, err = http.Post(url, "application/json", nil)
+	test.Nil(t, err)
+	resp.Body.Close()
+	test.Equal(t, 200, resp.StatusCode)
+	maxAge, maxBytes := topic.Retention()
+	test.Equal(t, time.Hour, maxAge)
+	test.Equal(t, int64(1048576), maxBytes)
+
+	topic.PutMessage(NewMessage(topic.GenerateID(), []byte("test")))
+	<-channel.memoryMsgChan
+
+	url = fmt.Sprintf("http://%s/channel/rewind?topic=%s&channel=ch&since=%s",
+		httpAddr, topicName, time.Now().Add(-time.Minute).UTC().Format(time.RFC3339))
+	resp, err = http.Post(url, "application/json", nil)
+	test.Nil(t, err)
+	body, _ = ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	test.Equal(t, 200, resp.StatusCode)
+	test.Equal(t, `{"count":1}`, string(body))
+	msg := <-channel.memoryMsgChan
+	test.Equal(t, []byte("test"), msg.Body)
+
+	url = fmt.Sprintf("http://%s/channel/rewind?topic=%s&channel=ch&since=yesterday", httpAddr, topicName)
+	resp, err = http.Post(url, "application/json", nil)
+	test.Nil(t, err)
+	resp.Body.Close()
+	test.Equal(t, 400, resp.StatusCode)
+}
+
+func TestHTTPPubDeliverAt(t *testing.T) {
+	opts := NewOptions()
+	opts.Logger = test.NewTestLogger(t)
+	opts.MaxScheduleAhead = 24 * time.Hour
+	_, httpAddr, nsqd := mustStartNSQD(opts)
+	defer os.RemoveAll(opts.DataPath)
+	defer nsqd.Exit()
+
+	topicName := "test_http_pub_deliver_at" + strconv.Itoa(int(time.Now().Unix()))
+	topic := nsqd.GetTopic(topicName)
+
+	deliverAt := time.Now().Add(time.Hour).UnixNano() / int64(time.Millisecond)
+	url := fmt.Sprintf("http://%s/pub?topic=%s&deliver_at=%d", httpAddr, topicName, deliverAt)
+	resp, err := http.Post(url, "application/octet-stream", bytes.NewBufferString("test message"))
+	test.Nil(t, err)
+	body, _ := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	test.Equal(t, "OK", string(body))
+	test.Equal(t, int64(1), topic.ScheduledCount())
+
+	for _, q := range []string{
+		fmt.Sprintf("deliver_at=%d", deliverAt+int64(48*time.Hour/time.Millisecond)),
+		fmt.Sprintf("deliver_at=%d&defer=1000", deliverAt),
+		"deliver_at=abc",
+	} {
+		url = fmt.Sprintf("http://%s/pub?topic=%s&%s", httpAddr, topicName, q)
+		resp, err = http.Post(url, "application/octet-stream", bytes.NewBufferString("test message"))
+		test.Nil(t, err)
+		body, _ = ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		test.Equal(t, 400, resp.StatusCode)
+		test.Equal(t, `{"message":"INVALID_DELIVER_AT"}`, string(body))
+	}
+	test.Equal(t, int64(1), topic.ScheduledCount())
+}
+
+func TestHTTPChannelPeek(t *testing.T) {
+	opts := NewOptions()
+	opts.Logger = test.NewTestLogger(t)
+	_, httpAddr, nsqd := mustStartNSQD(opts)
+	defer os.RemoveAll(opts.DataPath)
+	defer nsqd.Exit()
+
+	topicName := "test_http_channel_peek" + strconv.Itoa(int(time.Now().Unix()))
+	topic := nsqd.GetTopic(topicName)
+	channel := topic.GetChannel("ch")
+
+	msg := NewMessage(topic.GenerateID(), []byte("test"))
+	topic.PutMessage(msg)
+	topic.PutMessage(NewMessage(topic.GenerateID(), []byte{0xff, 0xfe}))
+	for channel.Depth() != 2 {
+		time.Sleep(time.Millisecond)
+	}
+
+	url := fmt.Sprintf("http://%s/channel/peek?topic=%s&channel=ch&n=5", httpAddr, topicName)
+	resp, err := http.Get(url)
+	test.Nil(t, err)
+	body, _ := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	test.Equal(t, 200, resp.StatusCode)
+	var peeked struct {
+		Messages []peekedMessage `json:"messages"`
+	}
+	err = json.Unmarshal(body, &peeked)
+	test.Nil(t, err)
+	test.Equal(t, 2, len(peeked.Messages))
+	test.Equal(t, string(msg.ID[:]), peeked.Messages[0].ID)
+	test.Equal(t, "test", peeked.Messages[0].Body)
+	test.Equal(t, "//4=", peeked.Messages[1].BodyBase64)
+	test.Equal(t, int64(2), channel.Depth())
+
+	url = fmt.Sprintf("http://%s/channel/peek?topic=%s&channel=ch&n=0", httpAddr, topicName)
+	resp, err = http.Get(url)
+	test.Nil(t, err)
+	body, _ = ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	test.Equal(t, 400, resp.StatusCode)
+	test.Equal(t, `{"message":"INVALID_N"}`, string(body))
+
+	url = fmt.Sprintf("http://%s/channel/peek?topic=%s&channel=nope", httpAddr, topicName)
+	resp, err = http.Get(url)
+	test.Nil(t, err)
+	resp.Body.Close()
+	test.Equal(t, 404, resp.StatusCode)
+}
+
+func TestHTTPMessageDelete(t *testing.T) {
+	opts := NewOptions()
+	opts.Logger = test.NewTestLogger(t)
+	_, httpAddr, nsqd := mustStartNSQD(opts)
+	defer os.RemoveAll(opts.DataPath)
+	defer nsqd.Exit()
+
+	topicName := "test_http_message_delete" + strconv.Itoa(int(time.Now().Unix()))
+	topic := nsqd.GetTopic(topicName)
+	channel := topic.GetChannel("ch")
+	msg := NewMessage(topic.GenerateID(), []byte("test"))
+	channel.StartInFlightTimeout(msg, 0, time.Minute)
+
+	url := fmt.Sprintf("http://%s/message/delete?topic=%s&channel=ch&id=%s", httpAddr, topicName, msg.ID[:])
+	resp, err := http.Post(url, "application/json", nil)
+	test.Nil(t, err)
+	body, _ := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	test.Equal(t, 200, resp.StatusCode)
+	test.Equal(t, `{"state":"in_flight"}`, string(body))
+
+	resp, err = http.Post(url, "application/json", nil)
+	test.Nil(t, err)
+	resp.Body.Close()
+	test.Equal(t, 404, resp.StatusCode)
+
+	url = fmt.Sprintf("http://%s/message/requeue?topic=%s&channel=ch&id=nope", httpAddr, topicName)
+	resp, err = http.Post(url, "application/json", nil)
+	test.Nil(t, err)
+	body, _ = ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	test.Equal(t, 400, resp.StatusCode)
+	test.Equal(t, `{"message":"INVALID_ID"}`, string(body))
+
+	channel.PutMessage(NewMessage(topic.GenerateID(), []byte(`{"poison":true}`)))
+	url = fmt.Sprintf("http://%s/channel/purge?topic=%s&channel=ch&filter=json:poison", httpAddr, topicName)
+	resp, err = http.Post(url, "application/json", nil)
+	test.Nil(t, err)
+	body, _ = ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	test.Equal(t, 200, resp.StatusCode)
+	test.Equal(t, `{"count":1}`, string(body))
+	test.Equal(t, int64(0), channel.Depth())
+}
+
+func TestHTTPChannelMove(t *testing.T) {
+	opts := NewOptions()
+	opts.Logger = test.NewTestLogger(t)
+	_, httpAddr, nsqd := mustStartNSQD(opts)
+	defer os.RemoveAll(opts.DataPath)
+	defer nsqd.Exit()
+
+	topicName := "test_http_channel_move" + strconv.Itoa(int(time.Now().Unix()))
+	topic := nsqd.GetTopic(topicName)
+	channel := topic.GetChannel("old")
+	channel.PutMessage(NewMessage(topic.GenerateID(), []byte("test")))
+
+	url := fmt.Sprintf("http://%s/channel/move?topic=%s&channel=old&to_topic=%s", httpAddr, topicName, topicName)
+	resp, err := http.Post(url, "application/json", nil)
+	test.Nil(t, err)
+	body, _ := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	test.Equal(t, 400, resp.StatusCode)
+	test.Equal(t, `{"message":"INVALID_DESTINATION"}`, string(body))
+
+	url = fmt.Sprintf("http://%s/channel/move?topic=%s&channel=old&to_topic=%s&to_channel=new", httpAddr, topicName, topicName)
+	resp, err = http.Post(url, "application/json", nil)
+	test.Nil(t, err)
+	resp.Body.Close()
+	test.Equal(t, 200, resp.StatusCode)
+	waitTransfer(t, channel)
+
+	url = fmt.Sprintf("http://%s/stats?format=json&topic=%s&channel=old", httpAddr, topicName)
+	resp, err = http.Get(url)
+	test.Nil(t, err)
+	body, _ = ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	var sr struct {
+		Topics []TopicStats `json:"topics"`
+	}
+	err = json.Unmarshal(body, &sr)
+	test.Nil(t, err)
+	test.Equal(t, &TransferStats{
+		Kind:  transferMove,
+		To:    topicName + "/new",
+		Done:  1,
+		Total: 1,
+		State: transferFinished,
+	}, sr.Topics[0].Channels[0].Transfer)
+}
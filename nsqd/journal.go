@@ -0,0 +1,369 @@
+package nsqd
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"sync"
+	"time"
+)
+
+// the durability levels of the in-flight journal (--inflight-durability),
+// i.e. how much of the in-flight and deferred state of a channel survives
+// nsqd being killed (a clean shutdown flushes it all to the backend)
+const (
+	// no journal, in-flight and deferred messages are lost
+	inFlightDurabilityNone = "none"
+	// the journal is written every --inflight-flush-interval, the changes
+	// made since are lost
+	inFlightDurabilityInterval = "interval"
+	// every change is written as it's made, which survives the process
+	// being killed (kill -9, OOM)
+	inFlightDurabilityWrite = "write"
+	// every change is also fsynced, which survives the OS going down
+	inFlightDurabilitySync = "sync"
+)
+
+// journal record types
+const (
+	journalRecordSet   byte = 1
+	journalRecordClear byte = 2
+)
+
+// journalCompactMin is the number of records below which the journal is
+// never compacted, past it it's compacted once 3/4 of them are stale
+const journalCompactMin = 1024
+
+func validateJournalOpts(opts *Options) error {
+	switch opts.InFlightDurability {
+	case inFlightDurabilityNone, inFlightDurabilityInterval,
+		inFlightDurabilityWrite, inFlightDurabilitySync:
+	default:
+		return fmt.Errorf("unknown --inflight-durability %q", opts.InFlightDurability)
+	}
+	if opts.InFlightDurability == inFlightDurabilityInterval && opts.InFlightFlushInterval <= 0 {
+		return errors.New("--inflight-flush-interval must be positive")
+	}
+	return nil
+}
+
+// journalEntry is a message in flight (deadline 0) or deferred until
+// deadline (a nanosecond timestamp)
+type journalEntry struct {
+	msg      *Message
+	deadline int64
+}
+
+// inFlightJournal is a write-ahead log of the messages of a channel that
+// are in flight or deferred, so that they can be requeued if nsqd dies
+// without flushing them to the backend (see Channel.flush)
+//
+// it's a sequence of records setting (i.e. adding or replacing) or
+// clearing a message by ID, replayed on startup, a record cut short by a
+// crash is ignored
+type inFlightJournal struct {
+	sync.Mutex
+
+	fileName string
+	level    string
+	f        *os.File
+	w        *bufio.Writer
+
+	// the IDs set in the journal, and the number of records in it
+	live    map[MessageID]struct{}
+	records int
+	dirty   bool
+	closed  bool
+
+	// returns the in-flight and deferred messages of the channel, which
+	// make up the journal once compacted (nil until they're restored)
+	entries func() []journalEntry
+}
+
+// openInFlightJournal opens (or creates) the journal in fileName and
+// returns the messages that are set in it
+//
+// these are left in the journal for the channel to restore (see
+// Channel.restoreJournal), it's only compacted once entries is set
+func openInFlightJournal(fileName string, level string) (*inFlightJournal, []journalEntry, error) {
+	loaded, records, size, err := readJournal(fileName)
+	if err != nil {
+		return nil, nil, err
+	}
+	f, err := os.OpenFile(fileName, os.O_WRONLY|os.O_CREATE, 0600)
+	if err != nil {
+		return nil, nil, err
+	}
+	// drop a record cut short by a crash, and append from there
+	err = f.Truncate(size)
+	if err == nil {
+		_, err = f.Seek(size, 0)
+	}
+	if err != nil {
+		f.Close()
+		return nil, nil, err
+	}
+
+	j := &inFlightJournal{
+		fileName: fileName,
+		level:    level,
+		f:        f,
+		w:        bufio.NewWriter(f),
+		live:     make(map[MessageID]struct{}),
+		records:  records,
+	}
+	for _, e := range loaded {
+		j.live[e.msg.ID] = struct{}{}
+	}
+	return j, loaded, nil
+}
+
+// readJournal replays the journal in fileName, returning the messages set
+// in it, the number of records and the size of those that are complete
+func readJournal(fileName string) ([]journalEntry, int, int64, error) {
+	f, err := os.Open(fileName)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, 0, 0, nil
+		}
+		return nil, 0, 0, err
+	}
+	defer f.Close()
+
+	r := bufio.NewReader(f)
+	set := make(map[MessageID]journalEntry)
+	var order []MessageID
+	var records int
+	var size int64
+	for {
+		typ, err := r.ReadByte()
+		if err != nil {
+			break
+		}
+		if typ == journalRecordClear {
+			var id MessageID
+			if _, err := io.ReadFull(r, id[:]); err != nil {
+				break
+			}
+			delete(set, id)
+			records++
+			size += 1 + MsgIDLength
+			continue
+		}
+		if typ != journalRecordSet {
+			return nil, 0, 0, fmt.Errorf("invalid journal record type %d in %s", typ, fileName)
+		}
+		var hdr [12]byte
+		if _, err := io.ReadFull(r, hdr[:]); err != nil {
+			break
+		}
+		data := make([]byte, binary.BigEndian.Uint32(hdr[8:]))
+		if _, err := io.ReadFull(r, data); err != nil {
+			break
+		}
+		msg, err := decodeMessage(data)
+		if err != nil {
+			return nil, 0, 0, fmt.Errorf("invalid journal record in %s - %s", fileName, err)
+		}
+		if _, ok := set[msg.ID]; !ok {
+			order = append(order, msg.ID)
+		}
+		set[msg.ID] = journalEntry{msg, int64(binary.BigEndian.Uint64(hdr[:8]))}
+		records++
+		size += 1 + int64(len(hdr)) + int64(len(data))
+	}
+
+	var entries []journalEntry
+	for _, id := range order {
+		e, ok := set[id]
+		if !ok {
+			continue
+		}
+		delete(set, id)
+		entries = append(entries, e)
+	}
+	return entries, records, size, nil
+}
+
+func writeJournalSet(w io.Writer, msg *Message, deadline int64) error {
+	var buf bytes.Buffer
+	_, err := msg.writeBackendTo(&buf)
+	if err != nil {
+		return err
+	}
+	var hdr [13]byte
+	hdr[0] = journalRecordSet
+	binary.BigEndian.PutUint64(hdr[1:9], uint64(deadline))
+	binary.BigEndian.PutUint32(hdr[9:], uint32(buf.Len()))
+	if _, err := w.Write(hdr[:]); err != nil {
+		return err
+	}
+	_, err = w.Write(buf.Bytes())
+	return err
+}
+
+// set records msg as in flight (deadline 0) or deferred until deadline
+func (j *inFlightJournal) set(msg *Message, deadline int64) error {
+	j.Lock()
+	defer j.Unlock()
+	if j.closed {
+		return nil
+	}
+	err := writeJournalSet(j.w, msg, deadline)
+	if err != nil {
+		return err
+	}
+	j.live[msg.ID] = struct{}{}
+	return j.written()
+}
+
+// clear records that the message id is neither in flight nor deferred
+func (j *inFlightJournal) clear(id MessageID) error {
+	j.Lock()
+	defer j.Unlock()
+	if _, ok := j.live[id]; !ok || j.closed {
+		return nil
+	}
+	var rec [1 + MsgIDLength]byte
+	rec[0] = journalRecordClear
+	copy(rec[1:], id[:])
+	if _, err := j.w.Write(rec[:]); err != nil {
+		return err
+	}
+	delete(j.live, id)
+	return j.written()
+}
+
+// written applies the durability level after a record is written
+//
+// this expects the caller to handle locking
+func (j *inFlightJournal) written() error {
+	j.records++
+	j.dirty = true
+	if j.entries != nil && j.records >= journalCompactMin && j.records > 4*len(j.live) {
+		return j.compact()
+	}
+	switch j.level {
+	case inFlightDurabilityWrite:
+		return j.flush(false)
+	case inFlightDurabilitySync:
+		return j.flush(true)
+	}
+	return nil
+}
+
+// Flush writes out the buffered records, if any (see
+// inFlightDurabilityInterval)
+func (j *inFlightJournal) Flush() error {
+	j.Lock()
+	defer j.Unlock()
+	if j.closed {
+		return nil
+	}
+	return j.flush(false)
+}
+
+// Compact compacts the journal right away, e.g. once the channel is emptied
+func (j *inFlightJournal) Compact() error {
+	j.Lock()
+	defer j.Unlock()
+	if j.closed {
+		return nil
+	}
+	return j.compact()
+}
+
+func (j *inFlightJournal) flush(sync bool) error {
+	if !j.dirty {
+		return nil
+	}
+	err := j.w.Flush()
+	if err != nil {
+		return err
+	}
+	j.dirty = false
+	if sync {
+		return j.f.Sync()
+	}
+	return nil
+}
+
+// compact rewrites the journal with only the messages currently in flight
+// or deferred
+//
+// the channel updates its state before writing the matching record, so
+// a record written after the snapshot at worst repeats it
+//
+// this expects the caller to handle locking
+func (j *inFlightJournal) compact() error {
+	tmpFileName := fmt.Sprintf("%s.%d.tmp", j.fileName, time.Now().UnixNano())
+	f, err := os.OpenFile(tmpFileName, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return err
+	}
+	w := bufio.NewWriter(f)
+	live := make(map[MessageID]struct{})
+	for _, e := range j.entries() {
+		err = writeJournalSet(w, e.msg, e.deadline)
+		if err != nil {
+			break
+		}
+		live[e.msg.ID] = struct{}{}
+	}
+	if err == nil {
+		err = w.Flush()
+	}
+	if err == nil && j.level != inFlightDurabilityInterval {
+		err = f.Sync()
+	}
+	if err != nil {
+		f.Close()
+		os.Remove(tmpFileName)
+		return err
+	}
+	err = os.Rename(tmpFileName, j.fileName)
+	if err != nil {
+		f.Close()
+		os.Remove(tmpFileName)
+		return err
+	}
+
+	j.f.Close()
+	j.f = f
+	j.w = w
+	j.live = live
+	j.records = len(live)
+	j.dirty = false
+	return nil
+}
+
+// Delete closes and removes the journal, once its messages have been
+// flushed to the backend (or discarded)
+func (j *inFlightJournal) Delete() error {
+	j.Lock()
+	defer j.Unlock()
+	j.closed = true
+	j.f.Close()
+	return os.Remove(j.fileName)
+}
+
+// journalLoop writes out the in-flight journals of all the channels every
+// --inflight-flush-interval (see inFlightDurabilityInterval)
+func (n *NSQD) journalLoop() {
+	ticker := time.NewTicker(n.getOpts().InFlightFlushInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			for _, c := range n.channels() {
+				c.flushJournal()
+			}
+		case <-n.exitChan:
+			return
+		}
+	}
+}
@@ -0,0 +1,163 @@
+package nsqd
+
+import (
+	"io/ioutil"
+	"os"
+	"path"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/nsqio/nsq/internal/test"
+)
+
+func TestInFlightJournal(t *testing.T) {
+	tmpDir, err := ioutil.TempDir("", "nsq-test-")
+	test.Nil(t, err)
+	defer os.RemoveAll(tmpDir)
+	fileName := path.Join(tmpDir, "test.inflight.dat")
+
+	j, entries, err := openInFlightJournal(fileName, inFlightDurabilityWrite)
+	test.Nil(t, err)
+	test.Equal(t, 0, len(entries))
+
+	a := NewMessage(MessageID{'a'}, []byte("a"))
+	b := NewMessage(MessageID{'b'}, []byte("b"))
+	test.Nil(t, j.set(a, 0))
+	test.Nil(t, j.set(b, 0))
+	test.Nil(t, j.set(b, 12345))
+	test.Nil(t, j.clear(a.ID))
+
+	// a record cut short by a crash is dropped
+	f, err := os.OpenFile(fileName, os.O_WRONLY|os.O_APPEND, 0600)
+	test.Nil(t, err)
+	_, err = f.Write([]byte{journalRecordSet, 0, 0, 0})
+	test.Nil(t, err)
+	f.Close()
+
+	j, entries, err = openInFlightJournal(fileName, inFlightDurabilityWrite)
+	test.Nil(t, err)
+	test.Equal(t, 1, len(entries))
+	test.Equal(t, b.ID, entries[0].msg.ID)
+	test.Equal(t, "b", string(entries[0].msg.Body))
+	test.Equal(t, int64(12345), entries[0].deadline)
+	test.Equal(t, 4, j.records)
+
+	c := NewMessage(MessageID{'c'}, []byte("c"))
+	test.Nil(t, j.set(c, 0))
+	_, entries, err = openInFlightJournal(fileName, inFlightDurabilityWrite)
+	test.Nil(t, err)
+	test.Equal(t, 2, len(entries))
+	test.Equal(t, c.ID, entries[1].msg.ID)
+
+	// with the interval durability records are only written when flushed
+	fileName = path.Join(tmpDir, "test2.inflight.dat")
+	j, _, err = openInFlightJournal(fileName, inFlightDurabilityInterval)
+	test.Nil(t, err)
+	test.Nil(t, j.set(a, 0))
+	_, entries, _ = openInFlightJournal(fileName, inFlightDurabilityInterval)
+	test.Equal(t, 0, len(entries))
+	test.Nil(t, j.Flush())
+	_, entries, _ = openInFlightJournal(fileName, inFlightDurabilityInterval)
+	test.Equal(t, 1, len(entries))
+
+	test.Nil(t, j.Delete())
+	_, err = os.Stat(fileName)
+	test.Equal(t, true, os.IsNotExist(err))
+}
+
+func TestInFlightJournalCompact(t *testing.T) {
+	tmpDir, err := ioutil.TempDir("", "nsq-test-")
+	test.Nil(t, err)
+	defer os.RemoveAll(tmpDir)
+	fileName := path.Join(tmpDir, "test.inflight.dat")
+
+	j, _, err := openInFlightJournal(fileName, inFlightDurabilityWrite)
+	test.Nil(t, err)
+	live := NewMessage(MessageID{'l'}, []byte("live"))
+	j.entries = func() []journalEntry {
+		return []journalEntry{{live, 0}}
+	}
+
+	test.Nil(t, j.set(live, 0))
+	for i := 0; i < journalCompactMin; i++ {
+		msg := NewMessage(MessageID{byte(i), byte(i >> 8)}, []byte("test body"))
+		test.Nil(t, j.set(msg, 0))
+		test.Nil(t, j.clear(msg.ID))
+	}
+	test.Equal(t, true, j.records < journalCompactMin)
+
+	_, entries, err := openInFlightJournal(fileName, inFlightDurabilityWrite)
+	test.Nil(t, err)
+	test.Equal(t, 1, len(entries))
+	test.Equal(t, live.ID, entries[0].msg.ID)
+}
+
+func TestChannelInFlightJournal(t *testing.T) {
+	opts := NewOptions()
+	opts.Logger = test.NewTestLogger(t)
+	opts.InFlightDurability = inFlightDurabilityWrite
+	_, _, nsqd := mustStartNSQD(opts)
+	defer os.RemoveAll(opts.DataPath)
+	defer nsqd.Exit()
+
+	topicName := "test_inflight_journal" + strconv.Itoa(int(time.Now().Unix()))
+	topic := nsqd.GetTopic(topicName)
+	channel := topic.GetChannel("ch")
+
+	var msgs []*Message
+	for i := 0; i < 4; i++ {
+		msg := NewMessage(topic.GenerateID(), []byte("test body "+strconv.Itoa(i)))
+		test.Nil(t, channel.PutMessage(msg))
+		msg = <-channel.memoryMsgChan
+		test.Nil(t, channel.StartInFlightTimeout(msg, 1, time.Minute))
+		msgs = append(msgs, msg)
+	}
+	test.Nil(t, channel.FinishMessage(1, msgs[0].ID))
+	test.Nil(t, channel.RequeueMessage(1, msgs[1].ID, time.Hour))
+	test.Nil(t, channel.RequeueMessage(1, msgs[2].ID, 0))
+	<-channel.memoryMsgChan
+
+	// simulate nsqd being killed by starting a new one off a copy of the
+	// data on disk as it is now
+	crashDataPath, err := ioutil.TempDir("", "nsq-test-")
+	test.Nil(t, err)
+	defer os.RemoveAll(crashDataPath)
+	files, err := ioutil.ReadDir(opts.DataPath)
+	test.Nil(t, err)
+	for _, fi := range files {
+		if fi.IsDir() {
+			continue
+		}
+		data, err := ioutil.ReadFile(path.Join(opts.DataPath, fi.Name()))
+		test.Nil(t, err)
+		err = ioutil.WriteFile(path.Join(crashDataPath, fi.Name()), data, 0600)
+		test.Nil(t, err)
+	}
+
+	opts2 := NewOptions()
+	opts2.Logger = test.NewTestLogger(t)
+	opts2.DataPath = crashDataPath
+	_, _, nsqd2 := mustStartNSQD(opts2)
+	defer nsqd2.Exit()
+
+	// the message in flight is requeued and the deferred one stays
+	// deferred, the journal is dropped with --inflight-durability=none
+	channel2 := nsqd2.GetTopic(topicName).GetChannel("ch")
+	test.Equal(t, int64(1), channel2.Depth())
+	test.Equal(t, 1, len(channel2.deferredMessages))
+	test.Equal(t, true, channel2.deferredMessages[msgs[1].ID] != nil)
+	test.Equal(t, true, channel2.journal == nil)
+	_, err = os.Stat(path.Join(crashDataPath, getBackendName(topicName, "ch")+".inflight.dat"))
+	test.Equal(t, true, os.IsNotExist(err))
+
+	msg, err := decodeMessage(<-channel2.backend.ReadChan())
+	test.Nil(t, err)
+	test.Equal(t, msgs[3].ID, msg.ID)
+	test.Equal(t, msgs[3].Body, msg.Body)
+
+	// a clean shutdown flushes the messages to the backend instead
+	topic.Close()
+	_, err = os.Stat(path.Join(opts.DataPath, getBackendName(topicName, "ch")+".inflight.dat"))
+	test.Equal(t, true, os.IsNotExist(err))
+}
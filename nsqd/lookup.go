@@ -60,7 +60,10 @@ func connectCallback(n *NSQD, hostname string) func(*lookupPeer) {
 				commands = append(commands, nsq.Register(topic.name, ""))
 			} else {
 				for _, channel := range topic.channelMap {
-					commands = append(commands, nsq.Register(channel.topicName, channel.name))
+					channel.RLock()
+					consumers := len(channel.clients)
+					channel.RUnlock()
+					commands = append(commands, registerConsumers(channel.topicName, channel.name, consumers))
 				}
 			}
 			topic.RUnlock()
@@ -78,10 +81,42 @@ func connectCallback(n *NSQD, hostname string) func(*lookupPeer) {
 	}
 }
 
+// registerConsumers is a REGISTER command that also reports the number of
+// consumers of the channel, so that nsqlookupd can balance consumers across
+// producers (older nsqlookupd ignore the extra param)
+func registerConsumers(topicName string, channelName string, consumers int) *nsq.Command {
+	params := [][]byte{[]byte(topicName), []byte(channelName), []byte(strconv.Itoa(consumers))}
+	return &nsq.Command{Name: []byte("REGISTER"), Params: params}
+}
+
+type channelKey struct {
+	topic   string
+	channel string
+}
+
+// consumerCounts returns the number of consumers of every channel
+func (n *NSQD) consumerCounts() map[channelKey]int {
+	counts := make(map[channelKey]int)
+	n.RLock()
+	for _, topic := range n.topicMap {
+		topic.RLock()
+		for _, channel := range topic.channelMap {
+			channel.RLock()
+			counts[channelKey{channel.topicName, channel.name}] = len(channel.clients)
+			channel.RUnlock()
+		}
+		topic.RUnlock()
+	}
+	n.RUnlock()
+	return counts
+}
+
 func (n *NSQD) lookupLoop() {
 	var lookupPeers []*lookupPeer
 	var lookupAddrs []string
 	connect := true
+	// consumer counts as of the last report, see registerConsumers
+	reportedConsumers := make(map[channelKey]int)
 
 	hostname, err := os.Hostname()
 	if err != nil {
@@ -125,6 +160,27 @@ func (n *NSQD) lookupLoop() {
 					n.logf(LOG_ERROR, "LOOKUPD(%s): %s - %s", lookupPeer, cmd, err)
 				}
 			}
+
+			// report the channels whose number of consumers changed
+			var commands []*nsq.Command
+			counts := n.consumerCounts()
+			for key, count := range counts {
+				if last, ok := reportedConsumers[key]; ok && last == count {
+					continue
+				}
+				commands = append(commands, registerConsumers(key.topic, key.channel, count))
+			}
+			reportedConsumers = counts
+			for _, lookupPeer := range lookupPeers {
+				for _, cmd := range commands {
+					n.logf(LOG_DEBUG, "LOOKUPD(%s): %s", lookupPeer, cmd)
+					_, err := lookupPeer.Command(cmd)
+					if err != nil {
+						n.logf(LOG_ERROR, "LOOKUPD(%s): %s - %s", lookupPeer, cmd, err)
+						break
+					}
+				}
+			}
 		case val := <-n.notifyChan://增删topic,增删channel都会走这里，通知nsqlookupd
 			var cmd *nsq.Command
 			var branch string
@@ -0,0 +1,200 @@
+package nsqd
+
+import (
+	"errors"
+	"sync"
+	"sync/atomic"
+
+	"github.com/nsqio/nsq/internal/lg"
+)
+
+// memoryBackendQueue is a bounded in-memory ring that drops the oldest
+// message when full, trading durability (messages are lost on exit) for
+// throughput
+type memoryBackendQueue struct {
+	// 64bit atomic vars need to be first for proper alignment on 32bit platforms
+	depth   int64
+	dropped uint64
+
+	sync.Mutex
+	ring  [][]byte
+	head  int
+	count int
+	// the message popped off the ring by ioLoop until it's read, for Scan
+	pending []byte
+
+	name      string
+	logf      lg.AppLogFunc
+	readChan  chan []byte
+	writeChan chan struct{}
+	emptyChan chan chan struct{}
+	exitChan  chan int
+	exitFlag  int32
+	exitOnce  sync.Once
+	wg        sync.WaitGroup
+}
+
+func newMemoryBackendQueue(name string, opts *Options, logf lg.AppLogFunc) BackendQueue {
+	size := opts.MemBackendQueueSize
+	if size < 1 {
+		size = 1
+	}
+	q := &memoryBackendQueue{
+		ring:      make([][]byte, size),
+		name:      name,
+		logf:      logf,
+		readChan:  make(chan []byte),
+		writeChan: make(chan struct{}, 1),
+		emptyChan: make(chan chan struct{}),
+		exitChan:  make(chan int),
+	}
+	q.wg.Add(1)
+	go q.ioLoop()
+	return q
+}
+
+func (q *memoryBackendQueue) Put(data []byte) error {
+	if atomic.LoadInt32(&q.exitFlag) == 1 {
+		return errors.New("exiting")
+	}
+
+	// callers reuse their buffers
+	b := make([]byte, len(data))
+	copy(b, data)
+
+	q.Lock()
+	if q.count == len(q.ring) {
+		q.ring[q.head] = nil
+		q.head = (q.head + 1) % len(q.ring)
+		q.count--
+		atomic.AddInt64(&q.depth, -1)
+		if atomic.AddUint64(&q.dropped, 1)%1000 == 1 {
+			q.logf(LOG_WARN, "MEMORY_BACKEND(%s): full, dropped %d oldest messages so far",
+				q.name, atomic.LoadUint64(&q.dropped))
+		}
+	}
+	q.ring[(q.head+q.count)%len(q.ring)] = b
+	q.count++
+	atomic.AddInt64(&q.depth, 1)
+	q.Unlock()
+
+	select {
+	case q.writeChan <- struct{}{}:
+	default:
+	}
+	return nil
+}
+
+func (q *memoryBackendQueue) pop() []byte {
+	q.Lock()
+	defer q.Unlock()
+	if q.count == 0 {
+		return nil
+	}
+	b := q.ring[q.head]
+	q.ring[q.head] = nil
+	q.head = (q.head + 1) % len(q.ring)
+	q.count--
+	q.pending = b
+	return b
+}
+
+func (q *memoryBackendQueue) ioLoop() {
+	defer q.wg.Done()
+
+	// the message being offered on readChan, still counted in depth
+	var pending []byte
+	for {
+		if pending == nil {
+			pending = q.pop()
+		}
+		var r chan []byte
+		if pending != nil {
+			r = q.readChan
+		}
+
+		select {
+		case r <- pending:
+			pending = nil
+			q.Lock()
+			q.pending = nil
+			q.Unlock()
+			atomic.AddInt64(&q.depth, -1)
+		case <-q.writeChan:
+		case done := <-q.emptyChan:
+			q.Lock()
+			for i := range q.ring {
+				q.ring[i] = nil
+			}
+			q.head = 0
+			q.count = 0
+			q.pending = nil
+			pending = nil
+			atomic.StoreInt64(&q.depth, 0)
+			q.Unlock()
+			close(done)
+		case <-q.exitChan:
+			return
+		}
+	}
+}
+
+func (q *memoryBackendQueue) ReadChan() <-chan []byte {
+	return q.readChan
+}
+
+// Scan calls fn with the messages queued, without removing them, until it
+// returns false
+func (q *memoryBackendQueue) Scan(fn func(b []byte) bool) error {
+	q.Lock()
+	defer q.Unlock()
+	if q.pending != nil && !fn(q.pending) {
+		return nil
+	}
+	for i := 0; i < q.count; i++ {
+		if !fn(q.ring[(q.head+i)%len(q.ring)]) {
+			return nil
+		}
+	}
+	return nil
+}
+
+func (q *memoryBackendQueue) Depth() int64 {
+	return atomic.LoadInt64(&q.depth)
+}
+
+func (q *memoryBackendQueue) Empty() error {
+	if atomic.LoadInt32(&q.exitFlag) == 1 {
+		return errors.New("exiting")
+	}
+	done := make(chan struct{})
+	select {
+	case q.emptyChan <- done:
+		<-done
+	case <-q.exitChan:
+		return errors.New("exiting")
+	}
+	return nil
+}
+
+// Close discards any messages left in the ring
+func (q *memoryBackendQueue) Close() error {
+	q.exitOnce.Do(func() {
+		atomic.StoreInt32(&q.exitFlag, 1)
+		close(q.exitChan)
+	})
+	q.wg.Wait()
+	if n := q.Depth(); n > 0 {
+		q.logf(LOG_WARN, "MEMORY_BACKEND(%s): discarding %d messages on close", q.name, n)
+	}
+	return nil
+}
+
+func (q *memoryBackendQueue) Delete() error {
+	q.exitOnce.Do(func() {
+		atomic.StoreInt32(&q.exitFlag, 1)
+		close(q.exitChan)
+	})
+	q.wg.Wait()
+	return nil
+}
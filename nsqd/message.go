@@ -3,16 +3,40 @@ package nsqd
 import (
 	"bytes"
 	"encoding/binary"
+	"errors"
 	"fmt"
 	"io"
+	"math"
+	"sort"
 	"time"
 )
 
 const (
 	MsgIDLength       = 16
 	minValidMsgLength = MsgIDLength + 8 + 2 // Timestamp + Attempts
+
+	// msgExtReserve bounds the per-message overhead of the extension block
+	// written to the backend (excluding the header block itself)
+	msgExtReserve = 1024
 )
 
+// msgFlagExtended is set on the timestamp of messages written to the backend
+// that carry an extension block after the message ID. Timestamps are always
+// positive so this never collides with messages written by older versions.
+const msgFlagExtended = uint64(1) << 63
+
+// extension block field types
+const (
+	msgExtHeaders      byte = 1
+	msgExtPriority     byte = 2
+	msgExtPartitionKey byte = 3
+	msgExtExpires      byte = 4
+)
+
+// MaxMsgPriority is the highest priority a message can be published with,
+// messages default to (the lowest) priority 0
+const MaxMsgPriority = 3
+
 type MessageID [MsgIDLength]byte
 
 type Message struct {
@@ -20,6 +44,20 @@ type Message struct {
 	Body      []byte
 	Timestamp int64
 	Attempts  uint16
+	Headers   map[string]string
+	Priority  uint8
+
+	// messages with the same key are delivered in order on partitioned
+	// topics, see partitionQueue
+	PartitionKey string
+
+	// nanosecond timestamp after which the message is discarded instead of
+	// delivered, 0 if it doesn't expire (see Channel.dropExpired)
+	Expires int64
+
+	// nanosecond timestamp the message is scheduled for, 0 if it isn't (see
+	// scheduleStore), only set while it's being published
+	deliverAt int64
 
 	// for in-flight handling
 	deliveryTS time.Time
@@ -37,11 +75,36 @@ func NewMessage(id MessageID, body []byte) *Message {
 	}
 }
 
+// WriteTo writes the message in the format sent to clients that did not
+// negotiate headers (and to the backend when there is nothing to extend)
 func (m *Message) WriteTo(w io.Writer) (int64, error) {
+	return m.writeTo(w, uint64(m.Timestamp), nil)
+}
+
+// WriteHeadersTo writes the message in the format sent to clients that
+// negotiated headers, the header block is always present (possibly empty)
+func (m *Message) WriteHeadersTo(w io.Writer) (int64, error) {
+	hdr := encodeHeaders(m.Headers)
+	ext := make([]byte, 4+len(hdr))
+	binary.BigEndian.PutUint32(ext[:4], uint32(len(hdr)))
+	copy(ext[4:], hdr)
+	return m.writeTo(w, uint64(m.Timestamp), ext)
+}
+
+// writeBackendTo writes the message in the format persisted by the backend
+func (m *Message) writeBackendTo(w io.Writer) (int64, error) {
+	ext := m.encodeExt()
+	if ext == nil {
+		return m.WriteTo(w)
+	}
+	return m.writeTo(w, uint64(m.Timestamp)|msgFlagExtended, ext)
+}
+
+func (m *Message) writeTo(w io.Writer, ts uint64, ext []byte) (int64, error) {
 	var buf [10]byte
 	var total int64
 
-	binary.BigEndian.PutUint64(buf[:8], uint64(m.Timestamp))
+	binary.BigEndian.PutUint64(buf[:8], ts)
 	binary.BigEndian.PutUint16(buf[8:10], uint16(m.Attempts))
 
 	n, err := w.Write(buf[:])
@@ -56,6 +119,14 @@ func (m *Message) WriteTo(w io.Writer) (int64, error) {
 		return total, err
 	}
 
+	if ext != nil {
+		n, err = w.Write(ext)
+		total += int64(n)
+		if err != nil {
+			return total, err
+		}
+	}
+
 	n, err = w.Write(m.Body)
 	total += int64(n)
 	if err != nil {
@@ -65,6 +136,171 @@ func (m *Message) WriteTo(w io.Writer) (int64, error) {
 	return total, nil
 }
 
+// encodeExt returns the extension block persisted after the message ID,
+// or nil if the message has nothing to extend
+//
+// extension block format:
+// [x][x][x][x][x][x][x][x][x]...[x][x][x][x][x][x]...
+// |  (uint32)  || ||  (uint32)  ||  (binary)
+// |   4-byte   || ||   4-byte   ||   N-byte
+// ------------------------------------------------...
+//   total size   ^^   field size      field
+//                type              (repeated)
+func (m *Message) encodeExt() []byte {
+	var fields []byte
+	if len(m.Headers) > 0 {
+		fields = appendExtField(fields, msgExtHeaders, encodeHeaders(m.Headers))
+	}
+	if m.Priority > 0 {
+		fields = appendExtField(fields, msgExtPriority, []byte{m.Priority})
+	}
+	if m.PartitionKey != "" {
+		fields = appendExtField(fields, msgExtPartitionKey, []byte(m.PartitionKey))
+	}
+	if m.Expires > 0 {
+		var buf [8]byte
+		binary.BigEndian.PutUint64(buf[:], uint64(m.Expires))
+		fields = appendExtField(fields, msgExtExpires, buf[:])
+	}
+	if fields == nil {
+		return nil
+	}
+	ext := make([]byte, 4, 4+len(fields))
+	binary.BigEndian.PutUint32(ext, uint32(len(fields)))
+	return append(ext, fields...)
+}
+
+func appendExtField(b []byte, typ byte, data []byte) []byte {
+	var buf [5]byte
+	buf[0] = typ
+	binary.BigEndian.PutUint32(buf[1:], uint32(len(data)))
+	b = append(b, buf[:]...)
+	return append(b, data...)
+}
+
+func (m *Message) decodeExt(b []byte) error {
+	for len(b) > 0 {
+		if len(b) < 5 {
+			return fmt.Errorf("invalid extension field size (%d)", len(b))
+		}
+		typ := b[0]
+		size := binary.BigEndian.Uint32(b[1:5])
+		b = b[5:]
+		if uint64(size) > uint64(len(b)) {
+			return fmt.Errorf("invalid extension field size (%d)", size)
+		}
+		data := b[:size]
+		b = b[size:]
+
+		switch typ {
+		case msgExtHeaders:
+			headers, err := decodeHeaders(data)
+			if err != nil {
+				return err
+			}
+			m.Headers = headers
+		case msgExtPriority:
+			if len(data) != 1 || data[0] > MaxMsgPriority {
+				return fmt.Errorf("invalid priority field (%v)", data)
+			}
+			m.Priority = data[0]
+		case msgExtPartitionKey:
+			m.PartitionKey = string(data)
+		case msgExtExpires:
+			if len(data) != 8 {
+				return fmt.Errorf("invalid expires field (%v)", data)
+			}
+			m.Expires = int64(binary.BigEndian.Uint64(data))
+		default:
+			// skip fields written by newer versions
+		}
+	}
+	return nil
+}
+
+// encodeHeaders serializes headers (sorted by key)
+// header block format:
+// [x][x][x][x]...[x][x][x][x]...
+// | (uint16) || (string) || (uint16) || (string)
+// |  2-byte  ||  N-byte  ||  2-byte  ||  N-byte
+// ------------------------------------------------...
+//   key size     key       value size    value
+//                                      (repeated)
+func encodeHeaders(headers map[string]string) []byte {
+	if len(headers) == 0 {
+		return nil
+	}
+	keys := make([]string, 0, len(headers))
+	for k := range headers {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	b := make([]byte, 0, headersSize(headers))
+	var buf [2]byte
+	for _, k := range keys {
+		v := headers[k]
+		binary.BigEndian.PutUint16(buf[:], uint16(len(k)))
+		b = append(b, buf[:]...)
+		b = append(b, k...)
+		binary.BigEndian.PutUint16(buf[:], uint16(len(v)))
+		b = append(b, buf[:]...)
+		b = append(b, v...)
+	}
+	return b
+}
+
+func decodeHeaders(b []byte) (map[string]string, error) {
+	if len(b) == 0 {
+		return nil, nil
+	}
+	headers := make(map[string]string)
+	for len(b) > 0 {
+		var kv [2]string
+		for i := range kv {
+			if len(b) < 2 {
+				return nil, errors.New("invalid header block")
+			}
+			size := int(binary.BigEndian.Uint16(b[:2]))
+			b = b[2:]
+			if size > len(b) {
+				return nil, errors.New("invalid header block")
+			}
+			kv[i] = string(b[:size])
+			b = b[size:]
+		}
+		if kv[0] == "" {
+			return nil, errors.New("invalid header block - empty key")
+		}
+		headers[kv[0]] = kv[1]
+	}
+	return headers, nil
+}
+
+// headersSize returns the size of the encoded header block
+func headersSize(headers map[string]string) int {
+	size := 0
+	for k, v := range headers {
+		size += 2 + len(k) + 2 + len(v)
+	}
+	return size
+}
+
+func validateHeaders(headers map[string]string, maxSize int64) error {
+	for k, v := range headers {
+		if k == "" {
+			return errors.New("header key cannot be empty")
+		}
+		if len(k) > math.MaxUint16 || len(v) > math.MaxUint16 {
+			return fmt.Errorf("header %q too big", k)
+		}
+	}
+	if size := headersSize(headers); int64(size) > maxSize {
+		return fmt.Errorf("headers too big %d > %d", size, maxSize)
+	}
+	return nil
+}
+
 // decodeMessage deserializes data (as []byte) and creates a new Message
 // message format:
 // [x][x][x][x][x][x][x][x][x][x][x][x][x][x][x][x][x][x][x][x][x][x][x][x][x][x][x][x][x][x]...
@@ -82,17 +318,43 @@ func decodeMessage(b []byte) (*Message, error) {
 		return nil, fmt.Errorf("invalid message buffer size (%d)", len(b))
 	}
 
-	msg.Timestamp = int64(binary.BigEndian.Uint64(b[:8]))
+	ts := binary.BigEndian.Uint64(b[:8])
+	msg.Timestamp = int64(ts &^ msgFlagExtended)
 	msg.Attempts = binary.BigEndian.Uint16(b[8:10])
 	copy(msg.ID[:], b[10:10+MsgIDLength])
-	msg.Body = b[10+MsgIDLength:]
+	b = b[10+MsgIDLength:]
+
+	// messages written by the backend may carry an extension block
+	// (see encodeExt) between the ID and the body
+	if ts&msgFlagExtended != 0 {
+		if len(b) < 4 {
+			return nil, fmt.Errorf("invalid message extension size (%d)", len(b))
+		}
+		extLen := binary.BigEndian.Uint32(b[:4])
+		b = b[4:]
+		if uint64(extLen) > uint64(len(b)) {
+			return nil, fmt.Errorf("invalid message extension size (%d)", extLen)
+		}
+		err := msg.decodeExt(b[:extLen])
+		if err != nil {
+			return nil, err
+		}
+		b = b[extLen:]
+	}
+	msg.Body = b
 
 	return &msg, nil
 }
 
+// maxBackendMsgLength returns the size of the largest message the backend
+// must accept, the message itself plus its headers and extension overhead
+func maxBackendMsgLength(opts *Options) int32 {
+	return int32(opts.MaxMsgSize+opts.MaxHeadersSize) + minValidMsgLength + msgExtReserve
+}
+
 func writeMessageToBackend(buf *bytes.Buffer, msg *Message, bq BackendQueue) error {
 	buf.Reset()
-	_, err := msg.WriteTo(buf)
+	_, err := msg.writeBackendTo(buf)
 	if err != nil {
 		return err
 	}
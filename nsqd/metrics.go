@@ -0,0 +1,128 @@
+package nsqd
+
+import (
+	"strconv"
+	"time"
+
+	"github.com/nsqio/nsq/internal/metrics"
+	"github.com/nsqio/nsq/internal/quantile"
+	"github.com/nsqio/nsq/internal/version"
+)
+
+// writeMetrics renders the same data as /stats as Prometheus metrics
+func writeMetrics(s *metrics.Set, stats []TopicStats, producerStats []ClientStats, ms *memStats, healthy bool, uptime time.Duration) {
+	s.Gauge("nsq_nsqd_info", "nsqd version", 1, "version", version.Binary)
+	s.Gauge("nsq_nsqd_healthy", "Whether or not nsqd is healthy", metrics.Bool(healthy))
+	s.Gauge("nsq_nsqd_uptime_seconds", "Time since nsqd started", uptime.Seconds())
+
+	for _, t := range stats {
+		topic := t.TopicName
+		s.Gauge("nsq_topic_depth", "Messages queued in the topic (memory + backend)", float64(t.Depth), "topic", topic)
+		s.Gauge("nsq_topic_backend_depth", "Messages queued in the topic backend", float64(t.BackendDepth), "topic", topic)
+		s.Counter("nsq_topic_messages_total", "Messages published to the topic", float64(t.MessageCount), "topic", topic)
+		s.Counter("nsq_topic_message_bytes_total", "Bytes published to the topic", float64(t.MessageBytes), "topic", topic)
+		s.Gauge("nsq_topic_paused", "Whether or not the topic is paused", metrics.Bool(t.Paused), "topic", topic)
+		if t.ResumeAt > 0 {
+			s.Gauge("nsq_topic_resume_timestamp_seconds", "When the paused topic resumes", float64(t.ResumeAt), "topic", topic)
+		}
+		s.Gauge("nsq_topic_retained_messages", "Messages kept in the topic retention log", float64(t.RetainedMessages), "topic", topic)
+		s.Gauge("nsq_topic_retained_bytes", "Bytes kept in the topic retention log", float64(t.RetainedBytes), "topic", topic)
+		s.Gauge("nsq_topic_partitions", "Number of partitions of the topic (0 if not partitioned)", float64(t.Partitions), "topic", topic)
+		s.Gauge("nsq_topic_dedup_keys", "Idempotency keys remembered by the topic", float64(t.DedupKeys), "topic", topic)
+		s.Counter("nsq_topic_deduplicated_total", "Duplicate publishes dropped by idempotency key", float64(t.DedupCount), "topic", topic)
+		s.Counter("nsq_topic_throttled_total", "Messages rejected by publish rate limits", float64(t.ThrottledCount), "topic", topic)
+		s.Gauge("nsq_topic_backlog_bytes", "Bytes queued in the topic backend", float64(t.BacklogBytes), "topic", topic)
+		s.Gauge("nsq_topic_backlog_alert", "Whether or not the topic backlog is close to its quota", metrics.Bool(t.BacklogAlert), "topic", topic)
+		s.Counter("nsq_topic_overflow_dropped_total", "Messages dropped by the topic backlog quota", float64(t.OverflowDroppedCount), "topic", topic)
+		s.Counter("nsq_topic_overflow_rejected_total", "Messages rejected by the topic backlog quota", float64(t.OverflowRejectedCount), "topic", topic)
+		s.Gauge("nsq_topic_scheduled", "Messages scheduled for later delivery to the topic", float64(t.ScheduledCount), "topic", topic)
+		writeLatencyMetrics(s, "nsq_topic_e2e_processing_latency_seconds",
+			"End to end processing latency of the topic's channels", t.E2eProcessingLatency, "topic", topic)
+
+		for _, c := range t.Channels {
+			channel := c.ChannelName
+			s.Gauge("nsq_channel_depth", "Messages queued in the channel (memory + backend)", float64(c.Depth), "topic", topic, "channel", channel)
+			s.Gauge("nsq_channel_backend_depth", "Messages queued in the channel backend", float64(c.BackendDepth), "topic", topic, "channel", channel)
+			s.Gauge("nsq_channel_in_flight", "Messages in flight in the channel", float64(c.InFlightCount), "topic", topic, "channel", channel)
+			s.Gauge("nsq_channel_deferred", "Deferred messages in the channel", float64(c.DeferredCount), "topic", topic, "channel", channel)
+			s.Counter("nsq_channel_messages_total", "Messages received by the channel", float64(c.MessageCount), "topic", topic, "channel", channel)
+			s.Counter("nsq_channel_requeued_total", "Messages requeued by the channel", float64(c.RequeueCount), "topic", topic, "channel", channel)
+			s.Counter("nsq_channel_timed_out_total", "Messages timed out in the channel", float64(c.TimeoutCount), "topic", topic, "channel", channel)
+			s.Counter("nsq_channel_dead_lettered_total", "Messages moved to the dead-letter topic", float64(c.DeadLetterCount), "topic", topic, "channel", channel)
+			s.Counter("nsq_channel_filtered_total", "Messages rejected by the channel filter", float64(c.FilteredCount), "topic", topic, "channel", channel)
+			s.Counter("nsq_channel_expired_total", "Messages discarded by the channel as expired", float64(c.ExpiredCount), "topic", topic, "channel", channel)
+			if c.MaxDeliveryRate > 0 {
+				s.Gauge("nsq_channel_max_delivery_rate", "Maximum messages per second delivered by the channel", float64(c.MaxDeliveryRate),
+					"topic", topic, "channel", channel)
+				s.Gauge("nsq_channel_delivery_rate", "Messages per second delivered by the channel over the last second", c.DeliveryRate,
+					"topic", topic, "channel", channel)
+			}
+			s.Gauge("nsq_channel_backlog_bytes", "Bytes queued in the channel backend", float64(c.BacklogBytes), "topic", topic, "channel", channel)
+			s.Gauge("nsq_channel_backlog_alert", "Whether or not the channel backlog is close to its quota", metrics.Bool(c.BacklogAlert), "topic", topic, "channel", channel)
+			s.Counter("nsq_channel_overflow_dropped_total", "Messages dropped by the channel backlog quota", float64(c.OverflowDroppedCount), "topic", topic, "channel", channel)
+			s.Counter("nsq_channel_overflow_rejected_total", "Publishes rejected by the channel backlog quota", float64(c.OverflowRejectedCount), "topic", topic, "channel", channel)
+			for pri, depth := range c.PriorityDepths {
+				s.Gauge("nsq_channel_priority_depth", "Messages queued in memory in the channel by priority", float64(depth),
+					"topic", topic, "channel", channel, "priority", strconv.Itoa(pri))
+			}
+			s.Gauge("nsq_channel_clients", "Clients subscribed to the channel", float64(c.ClientCount), "topic", topic, "channel", channel)
+			s.Gauge("nsq_channel_paused", "Whether or not the channel is paused", metrics.Bool(c.Paused), "topic", topic, "channel", channel)
+			if c.ResumeAt > 0 {
+				s.Gauge("nsq_channel_resume_timestamp_seconds", "When the paused channel resumes", float64(c.ResumeAt),
+					"topic", topic, "channel", channel)
+			}
+			if c.Transfer != nil {
+				s.Gauge("nsq_channel_transfer_done", "Messages moved/copied by the running (or last) backlog transfer", float64(c.Transfer.Done),
+					"topic", topic, "channel", channel, "kind", c.Transfer.Kind, "to", c.Transfer.To)
+				s.Gauge("nsq_channel_transfer_total", "Messages queued when the running (or last) backlog transfer started", float64(c.Transfer.Total),
+					"topic", topic, "channel", channel, "kind", c.Transfer.Kind, "to", c.Transfer.To)
+			}
+			writeLatencyMetrics(s, "nsq_channel_e2e_processing_latency_seconds",
+				"End to end processing latency of the channel", c.E2eProcessingLatency, "topic", topic, "channel", channel)
+
+			for _, client := range c.Clients {
+				labels := []string{"topic", topic, "channel", channel,
+					"client_id", client.ClientID, "hostname", client.Hostname, "remote_address", client.RemoteAddress}
+				s.Gauge("nsq_client_ready", "RDY count of the client", float64(client.ReadyCount), labels...)
+				s.Gauge("nsq_client_in_flight", "Messages in flight to the client", float64(client.InFlightCount), labels...)
+				s.Counter("nsq_client_messages_total", "Messages sent to the client", float64(client.MessageCount), labels...)
+				s.Counter("nsq_client_finished_total", "Messages finished by the client", float64(client.FinishCount), labels...)
+				s.Counter("nsq_client_requeued_total", "Messages requeued by the client", float64(client.RequeueCount), labels...)
+			}
+		}
+	}
+
+	for _, client := range producerStats {
+		for _, pc := range client.PubCounts {
+			s.Counter("nsq_producer_published_total", "Messages published by the client", float64(pc.Count),
+				"topic", pc.Topic, "client_id", client.ClientID, "hostname", client.Hostname, "remote_address", client.RemoteAddress)
+		}
+		s.Counter("nsq_producer_throttled_total", "Messages of the client rejected by publish rate limits", float64(client.ThrottledCount),
+			"client_id", client.ClientID, "hostname", client.Hostname, "remote_address", client.RemoteAddress)
+	}
+
+	if ms != nil {
+		s.Gauge("nsq_mem_heap_objects", "Number of allocated heap objects", float64(ms.HeapObjects))
+		s.Gauge("nsq_mem_heap_idle_bytes", "Bytes in idle heap spans", float64(ms.HeapIdleBytes))
+		s.Gauge("nsq_mem_heap_in_use_bytes", "Bytes in in-use heap spans", float64(ms.HeapInUseBytes))
+		s.Gauge("nsq_mem_heap_released_bytes", "Bytes of physical memory returned to the OS", float64(ms.HeapReleasedBytes))
+		s.Gauge("nsq_mem_next_gc_bytes", "Target heap size of the next GC cycle", float64(ms.NextGCBytes))
+		s.Counter("nsq_mem_gc_runs_total", "Completed GC cycles", float64(ms.GCTotalRuns))
+		for _, p := range []struct {
+			q string
+			v uint64
+		}{{"0.95", ms.GCPauseUsec95}, {"0.99", ms.GCPauseUsec99}, {"1", ms.GCPauseUsec100}} {
+			s.Gauge("nsq_mem_gc_pause_seconds", "Recent GC pause durations", float64(p.v)/1e6, "quantile", p.q)
+		}
+	}
+}
+
+func writeLatencyMetrics(s *metrics.Set, name string, help string, r *quantile.Result, labels ...string) {
+	if r == nil {
+		return
+	}
+	for _, item := range r.Percentiles {
+		l := append(labels[:len(labels):len(labels)], "quantile", strconv.FormatFloat(item["quantile"], 'f', -1, 64))
+		s.Gauge(name, help, item["value"]/float64(time.Second), l...)
+	}
+}
@@ -2,7 +2,6 @@ package nsqd
 
 import (
 	"crypto/tls"
-	"crypto/x509"
 	"encoding/json"
 	"errors"
 	"fmt"
@@ -17,11 +16,13 @@ import (
 	"sync/atomic"
 	"time"
 
+	"github.com/nsqio/nsq/internal/auth"
 	"github.com/nsqio/nsq/internal/clusterinfo"
 	"github.com/nsqio/nsq/internal/dirlock"
 	"github.com/nsqio/nsq/internal/http_api"
 	"github.com/nsqio/nsq/internal/protocol"
 	"github.com/nsqio/nsq/internal/statsd"
+	"github.com/nsqio/nsq/internal/tlsreload"
 	"github.com/nsqio/nsq/internal/util"
 	"github.com/nsqio/nsq/internal/version"
 )
@@ -69,6 +70,20 @@ type NSQD struct {
 	httpListener  net.Listener
 	httpsListener net.Listener
 	tlsConfig     *tls.Config
+	tlsReloader   *tlsreload.Reloader
+
+	// the *auth.File of --auth-file, see queryAuth
+	authFile  atomic.Value
+	authCache *auth.Cache
+
+	// publish rate limits, see checkPubRate
+	pubLimiter       pubLimiter
+	limiterLock      sync.Mutex
+	identityLimiters map[string]*pubLimiter
+
+	// re-reads the options for Reload, see SetConfigLoader
+	configLoader atomic.Value
+	reloadLock   sync.Mutex
 
 	poolSize int
 
@@ -100,6 +115,8 @@ func New(opts *Options) (*NSQD, error) {
 		notifyChan:           make(chan interface{}),
 		optsNotificationChan: make(chan struct{}, 1),
 		dl:                   dirlock.New(dataPath),
+		authCache:            auth.NewCache(),
+		identityLimiters:     make(map[string]*pubLimiter),
 	}
 	httpcli := http_api.NewClient(nil, opts.HTTPClientConnectTimeout, opts.HTTPClientRequestTimeout)
 	n.ci = clusterinfo.New(n.logf, httpcli)
@@ -122,25 +139,12 @@ func New(opts *Options) (*NSQD, error) {
 		return nil, errors.New("--node-id must be [0,1024)")
 	}
 
-	if opts.StatsdPrefix != "" {
-		var port string
-		_, port, err = net.SplitHostPort(opts.HTTPAddress)
-		if err != nil {
-			return nil, fmt.Errorf("failed to parse HTTP address (%s) - %s", opts.HTTPAddress, err)
-		}
-		statsdHostKey := statsd.HostKey(net.JoinHostPort(opts.BroadcastAddress, port))
-		prefixWithHost := strings.Replace(opts.StatsdPrefix, "%s", statsdHostKey, -1)
-		if prefixWithHost[len(prefixWithHost)-1] != '.' {
-			prefixWithHost += "."
-		}
-		opts.StatsdPrefix = prefixWithHost
-	}
-
-	if opts.TLSClientAuthPolicy != "" && opts.TLSRequired == TLSNotRequired {
-		opts.TLSRequired = TLSRequired
+	err = resolveOpts(opts)
+	if err != nil {
+		return nil, err
 	}
 
-	tlsConfig, err := buildTLSConfig(opts)
+	tlsConfig, err := n.buildTLSConfig(opts)
 	if err != nil {
 		return nil, fmt.Errorf("failed to build TLS config - %s", err)
 	}
@@ -149,6 +153,28 @@ func New(opts *Options) (*NSQD, error) {
 	}
 	n.tlsConfig = tlsConfig
 
+	if opts.AuthFile != "" && len(opts.AuthHTTPAddresses) != 0 {
+		return nil, errors.New("--auth-file and --auth-http-address are mutually exclusive")
+	}
+	var authFile *auth.File
+	if opts.AuthFile != "" {
+		authFile, err = auth.LoadFile(opts.AuthFile)
+		if err != nil {
+			return nil, err
+		}
+	}
+	n.authFile.Store(authFile)
+
+	err = validateBackendQueueOpts(opts)
+	if err != nil {
+		return nil, err
+	}
+
+	err = validateJournalOpts(opts)
+	if err != nil {
+		return nil, err
+	}
+
 	for _, v := range opts.E2EProcessingLatencyPercentiles {
 		if v <= 0 || v > 1 {
 			return nil, fmt.Errorf("invalid E2E processing latency percentile: %v", v)
@@ -284,8 +310,14 @@ func (n *NSQD) Main() error {
 	n.waitGroup.Wrap(n.queueScanLoop)
 	//注册至lookupd
 	n.waitGroup.Wrap(n.lookupLoop)
-	if n.getOpts().StatsdAddress != "" {
-		n.waitGroup.Wrap(n.statsdLoop)
+	n.waitGroup.Wrap(n.statsdLoop)
+	if n.getOpts().InFlightDurability == inFlightDurabilityInterval {
+		n.waitGroup.Wrap(n.journalLoop)
+	}
+	if n.tlsReloader != nil && n.getOpts().TLSReloadInterval > 0 {
+		n.waitGroup.Wrap(func() {
+			n.tlsReloader.Watch(n.getOpts().TLSReloadInterval, n.exitChan)
+		})
 	}
 
 	err := <-exitCh
@@ -294,11 +326,40 @@ func (n *NSQD) Main() error {
 
 type meta struct {
 	Topics []struct {
-		Name     string `json:"name"`
-		Paused   bool   `json:"paused"`
+		Name     string    `json:"name"`
+		Paused   bool      `json:"paused"`
+		ResumeAt time.Time `json:"resume_at"`
+
+		RetentionTime  time.Duration `json:"retention_time"`
+		RetentionBytes int64         `json:"retention_bytes"`
+
+		// nil falls back to --dedup-window
+		DedupWindow *time.Duration `json:"dedup_window"`
+
+		Partitions int `json:"partitions"`
+
+		PubRateLimit     int64 `json:"pub_rate_limit"`
+		PubByteRateLimit int64 `json:"pub_byte_rate_limit"`
+
+		MaxBacklogMsgs  int64  `json:"max_backlog_msgs"`
+		MaxBacklogBytes int64  `json:"max_backlog_bytes"`
+		OverflowPolicy  string `json:"overflow_policy"`
+
 		Channels []struct {
-			Name   string `json:"name"`
-			Paused bool   `json:"paused"`
+			Name        string    `json:"name"`
+			Paused      bool      `json:"paused"`
+			ResumeAt    time.Time `json:"resume_at"`
+			MaxAttempts uint16    `json:"max_attempts"`
+			Filter      string    `json:"filter"`
+
+			MessageTTL        time.Duration `json:"message_ttl"`
+			DeadLetterExpired bool          `json:"dead_letter_expired"`
+
+			MaxDeliveryRate int64 `json:"max_delivery_rate"`
+
+			MaxBacklogMsgs  int64  `json:"max_backlog_msgs"`
+			MaxBacklogBytes int64  `json:"max_backlog_bytes"`
+			OverflowPolicy  string `json:"overflow_policy"`
 		} `json:"channels"`
 	} `json:"topics"`
 }
@@ -367,9 +428,25 @@ func (n *NSQD) LoadMetadata() error {
 		}
 		//初始化topic
 		topic := n.GetTopic(t.Name)
-		if t.Paused {
+		if t.Paused && pausedUntil(t.ResumeAt) {
 			//暂停
-			topic.Pause()
+			topic.PauseUntil(t.ResumeAt)
+		}
+		if t.RetentionTime > 0 || t.RetentionBytes > 0 {
+			err := topic.SetRetention(t.RetentionTime, t.RetentionBytes)
+			if err != nil {
+				n.logf(LOG_ERROR, "failed to enable retention of topic (%s) - %s", t.Name, err)
+			}
+		}
+		if t.DedupWindow != nil {
+			topic.SetDedupWindow(*t.DedupWindow)
+		}
+		if err := topic.SetPartitions(t.Partitions); err != nil {
+			n.logf(LOG_ERROR, "failed to set partitions of topic (%s) - %s", t.Name, err)
+		}
+		topic.SetPubRateLimit(t.PubRateLimit, t.PubByteRateLimit)
+		if err := topic.SetBacklogQuota(t.MaxBacklogMsgs, t.MaxBacklogBytes, t.OverflowPolicy); err != nil {
+			n.logf(LOG_ERROR, "failed to set backlog quota of topic (%s) - %s", t.Name, err)
 		}
 		//初始化topic下的channel
 		for _, c := range t.Channels {
@@ -380,9 +457,19 @@ func (n *NSQD) LoadMetadata() error {
 			}
 			//初始化channel
 			channel := topic.GetChannel(c.Name)
-			if c.Paused {
+			if c.Paused && pausedUntil(c.ResumeAt) {
 				//暂停
-				channel.Pause()
+				channel.PauseUntil(c.ResumeAt)
+			}
+			channel.SetMaxAttempts(c.MaxAttempts)
+			if err := channel.SetFilter(c.Filter); err != nil {
+				n.logf(LOG_WARN, "ignoring filter of channel (%s/%s) - %s", t.Name, c.Name, err)
+			}
+			channel.SetMessageTTL(c.MessageTTL)
+			channel.SetDeadLetterExpired(c.DeadLetterExpired)
+			channel.SetMaxDeliveryRate(c.MaxDeliveryRate)
+			if err := channel.SetBacklogQuota(c.MaxBacklogMsgs, c.MaxBacklogBytes, c.OverflowPolicy); err != nil {
+				n.logf(LOG_ERROR, "failed to set backlog quota of channel (%s/%s) - %s", t.Name, c.Name, err)
 			}
 		}
 		//启动
@@ -407,6 +494,18 @@ func (n *NSQD) PersistMetadata() error {
 		topicData := make(map[string]interface{})
 		topicData["name"] = topic.name
 		topicData["paused"] = topic.IsPaused()
+		if resumeAt := topic.ResumeAt(); !resumeAt.IsZero() {
+			topicData["resume_at"] = resumeAt
+		}
+		retentionTime, retentionBytes := topic.Retention()
+		topicData["retention_time"] = retentionTime
+		topicData["retention_bytes"] = retentionBytes
+		if dedupWindow, ok := topic.dedupWindowOverride(); ok {
+			topicData["dedup_window"] = dedupWindow
+		}
+		topicData["partitions"] = topic.Partitions()
+		topicData["pub_rate_limit"], topicData["pub_byte_rate_limit"] = topic.PubRateLimit()
+		topicData["max_backlog_msgs"], topicData["max_backlog_bytes"], topicData["overflow_policy"] = topic.BacklogQuota()
 		channels := []interface{}{}
 		topic.Lock()
 		for _, channel := range topic.channelMap {
@@ -418,6 +517,15 @@ func (n *NSQD) PersistMetadata() error {
 			channelData := make(map[string]interface{})
 			channelData["name"] = channel.name
 			channelData["paused"] = channel.IsPaused()
+			if resumeAt := channel.ResumeAt(); !resumeAt.IsZero() {
+				channelData["resume_at"] = resumeAt
+			}
+			channelData["max_attempts"] = atomic.LoadInt32(&channel.maxAttempts)
+			channelData["filter"] = channel.Filter()
+			channelData["message_ttl"] = channel.MessageTTL()
+			channelData["dead_letter_expired"] = channel.DeadLetterExpired()
+			channelData["max_delivery_rate"] = channel.MaxDeliveryRate()
+			channelData["max_backlog_msgs"], channelData["max_backlog_bytes"], channelData["overflow_policy"] = channel.BacklogQuota()
 			channels = append(channels, channelData)
 			channel.Unlock()
 		}
@@ -754,7 +862,28 @@ exit:
 	refreshTicker.Stop()
 }
 
-func buildTLSConfig(opts *Options) (*tls.Config, error) {
+// resolveOpts fills in the options derived from others
+func resolveOpts(opts *Options) error {
+	if opts.StatsdPrefix != "" {
+		_, port, err := net.SplitHostPort(opts.HTTPAddress)
+		if err != nil {
+			return fmt.Errorf("failed to parse HTTP address (%s) - %s", opts.HTTPAddress, err)
+		}
+		statsdHostKey := statsd.HostKey(net.JoinHostPort(opts.BroadcastAddress, port))
+		prefixWithHost := strings.Replace(opts.StatsdPrefix, "%s", statsdHostKey, -1)
+		if prefixWithHost[len(prefixWithHost)-1] != '.' {
+			prefixWithHost += "."
+		}
+		opts.StatsdPrefix = prefixWithHost
+	}
+
+	if opts.TLSClientAuthPolicy != "" && opts.TLSRequired == TLSNotRequired {
+		opts.TLSRequired = TLSRequired
+	}
+	return nil
+}
+
+func (n *NSQD) buildTLSConfig(opts *Options) (*tls.Config, error) {
 	var tlsConfig *tls.Config
 
 	if opts.TLSCert == "" && opts.TLSKey == "" {
@@ -763,7 +892,7 @@ func buildTLSConfig(opts *Options) (*tls.Config, error) {
 
 	tlsClientAuthPolicy := tls.VerifyClientCertIfGiven
 
-	cert, err := tls.LoadX509KeyPair(opts.TLSCert, opts.TLSKey)
+	reloader, err := tlsreload.New(opts.TLSCert, opts.TLSKey, opts.TLSRootCAFile, n.logf)
 	if err != nil {
 		return nil, err
 	}
@@ -777,29 +906,54 @@ func buildTLSConfig(opts *Options) (*tls.Config, error) {
 	}
 
 	tlsConfig = &tls.Config{
-		Certificates: []tls.Certificate{cert},
-		ClientAuth:   tlsClientAuthPolicy,
-		MinVersion:   opts.TLSMinVersion,
-		MaxVersion:   tls.VersionTLS12, // enable TLS_FALLBACK_SCSV prior to Go 1.5: https://go-review.googlesource.com/#/c/1776/
+		ClientAuth: tlsClientAuthPolicy,
+		MinVersion: opts.TLSMinVersion,
+		MaxVersion: tls.VersionTLS12, // enable TLS_FALLBACK_SCSV prior to Go 1.5: https://go-review.googlesource.com/#/c/1776/
 	}
+	// the certificate and root CAs are reloaded when the files change (see
+	// --tls-reload-interval) or on Reload
+	n.tlsReloader = reloader
+	reloader.ServerConfig(tlsConfig)
 
-	if opts.TLSRootCAFile != "" {
-		tlsCertPool := x509.NewCertPool()
-		caCertFile, err := ioutil.ReadFile(opts.TLSRootCAFile)
-		if err != nil {
-			return nil, err
-		}
-		if !tlsCertPool.AppendCertsFromPEM(caCertFile) {
-			return nil, errors.New("failed to append certificate to pool")
-		}
-		tlsConfig.ClientCAs = tlsCertPool
+	return tlsConfig, nil
+}
+
+// TLSCertExpiry returns when the TLS certificate expires, the zero time if
+// TLS isn't enabled
+func (n *NSQD) TLSCertExpiry() time.Time {
+	if n.tlsReloader == nil {
+		return time.Time{}
 	}
+	return n.tlsReloader.NotAfter()
+}
 
-	tlsConfig.BuildNameToCertificate()
+func (n *NSQD) IsAuthEnabled() bool {
+	return len(n.getOpts().AuthHTTPAddresses) != 0 || n.getOpts().AuthFile != ""
+}
 
-	return tlsConfig, nil
+func (n *NSQD) getAuthFile() *auth.File {
+	return n.authFile.Load().(*auth.File)
 }
 
-func (n *NSQD) IsAuthEnabled() bool {
-	return len(n.getOpts().AuthHTTPAddresses) != 0
+// queryAuth returns the authorizations of secret, from the --auth-file if
+// there is one and otherwise from the auth servers
+func (n *NSQD) queryAuth(remoteIP string, tlsEnabled bool, commonName string, secret string) (*auth.State, error) {
+	if authFile := n.getAuthFile(); authFile != nil {
+		return authFile.Query(secret)
+	}
+	opts := n.getOpts()
+	return auth.QueryAnyAuthd(opts.AuthHTTPAddresses, remoteIP, tlsEnabled, commonName, secret,
+		opts.HTTPClientConnectTimeout, opts.HTTPClientRequestTimeout)
+}
+
+// queryCachedAuth is queryAuth with the responses of the auth servers cached
+// until they expire, for HTTP requests which (unlike a TCP client) don't keep
+// their authorizations from one request to the next
+func (n *NSQD) queryCachedAuth(remoteIP string, tlsEnabled bool, commonName string, secret string) (*auth.State, error) {
+	if n.getAuthFile() != nil {
+		return n.queryAuth(remoteIP, tlsEnabled, commonName, secret)
+	}
+	return n.authCache.Query(remoteIP, tlsEnabled, commonName, secret, func() (*auth.State, error) {
+		return n.queryAuth(remoteIP, tlsEnabled, commonName, secret)
+	})
 }
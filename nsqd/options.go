@@ -25,6 +25,7 @@ type Options struct {
 	BroadcastAddress         string        `flag:"broadcast-address"`
 	NSQLookupdTCPAddresses   []string      `flag:"lookupd-tcp-address" cfg:"nsqlookupd_tcp_addresses"`
 	AuthHTTPAddresses        []string      `flag:"auth-http-address" cfg:"auth_http_addresses"`
+	AuthFile                 string        `flag:"auth-file"`
 	HTTPClientConnectTimeout time.Duration `flag:"http-client-connect-timeout" cfg:"http_client_connect_timeout"`
 	HTTPClientRequestTimeout time.Duration `flag:"http-client-request-timeout" cfg:"http_client_request_timeout"`
 
@@ -35,6 +36,22 @@ type Options struct {
 	SyncEvery       int64         `flag:"sync-every"`
 	SyncTimeout     time.Duration `flag:"sync-timeout"`
 
+	// the size of each in-memory priority lane of a channel
+	PriorityMemQueueSize int64 `flag:"priority-mem-queue-size"`
+
+	// the number of deleted messages a channel keeps track of until they
+	// come up in its backend, see purgeQueued
+	MaxPurgedMsgs int64 `flag:"max-purged-msgs"`
+
+	// in-flight journal options, see inFlightJournal
+	InFlightDurability    string        `flag:"inflight-durability"`
+	InFlightFlushInterval time.Duration `flag:"inflight-flush-interval"`
+
+	// backend queue options
+	BackendQueue         string   `flag:"backend-queue"`
+	BackendQueueSuffixes []string `flag:"backend-queue-suffix" cfg:"backend_queue_suffixes"`
+	MemBackendQueueSize  int64    `flag:"mem-backend-queue-size"`
+
 	QueueScanInterval        time.Duration
 	QueueScanRefreshInterval time.Duration
 	QueueScanSelectionCount  int `flag:"queue-scan-selection-count"`
@@ -42,12 +59,17 @@ type Options struct {
 	QueueScanDirtyPercent    float64
 
 	// msg and command options
-	MsgTimeout    time.Duration `flag:"msg-timeout"`
-	MaxMsgTimeout time.Duration `flag:"max-msg-timeout"`
-	MaxMsgSize    int64         `flag:"max-msg-size"`
-	MaxBodySize   int64         `flag:"max-body-size"`
-	MaxReqTimeout time.Duration `flag:"max-req-timeout"`
-	ClientTimeout time.Duration
+	MsgTimeout       time.Duration `flag:"msg-timeout"`
+	MaxMsgTimeout    time.Duration `flag:"max-msg-timeout"`
+	MaxMsgSize       int64         `flag:"max-msg-size"`
+	MaxBodySize      int64         `flag:"max-body-size"`
+	MaxHeadersSize   int64         `flag:"max-headers-size"`
+	MaxReqTimeout    time.Duration `flag:"max-req-timeout"`
+	MaxScheduleAhead time.Duration `flag:"max-schedule-ahead"`
+	MaxAttempts      uint16        `flag:"max-attempts"`
+	DedupWindow      time.Duration `flag:"dedup-window"`
+	MaxDedupKeys     int           `flag:"max-dedup-keys"`
+	ClientTimeout    time.Duration
 
 	// client overridable configuration options
 	MaxHeartbeatInterval   time.Duration `flag:"max-heartbeat-interval"`
@@ -58,6 +80,12 @@ type Options struct {
 	OutputBufferTimeout    time.Duration `flag:"output-buffer-timeout"`
 	MaxChannelConsumers    int           `flag:"max-channel-consumers"`
 
+	// publish rate limits (per second, 0 = unlimited)
+	PubRateLimit           int64 `flag:"pub-rate-limit"`
+	PubByteRateLimit       int64 `flag:"pub-byte-rate-limit"`
+	ClientPubRateLimit     int64 `flag:"client-pub-rate-limit"`
+	ClientPubByteRateLimit int64 `flag:"client-pub-byte-rate-limit"`
+
 	// statsd integration
 	StatsdAddress       string        `flag:"statsd-address"`
 	StatsdPrefix        string        `flag:"statsd-prefix"`
@@ -70,17 +98,21 @@ type Options struct {
 	E2EProcessingLatencyPercentiles []float64     `flag:"e2e-processing-latency-percentile" cfg:"e2e_processing_latency_percentiles"`
 
 	// TLS config
-	TLSCert             string `flag:"tls-cert"`
-	TLSKey              string `flag:"tls-key"`
-	TLSClientAuthPolicy string `flag:"tls-client-auth-policy"`
-	TLSRootCAFile       string `flag:"tls-root-ca-file"`
-	TLSRequired         int    `flag:"tls-required"`
-	TLSMinVersion       uint16 `flag:"tls-min-version"`
+	TLSCert             string        `flag:"tls-cert"`
+	TLSKey              string        `flag:"tls-key"`
+	TLSClientAuthPolicy string        `flag:"tls-client-auth-policy"`
+	TLSRootCAFile       string        `flag:"tls-root-ca-file"`
+	TLSRequired         int           `flag:"tls-required"`
+	TLSMinVersion       uint16        `flag:"tls-min-version"`
+	TLSReloadInterval   time.Duration `flag:"tls-reload-interval"`
 
 	// compression
 	DeflateEnabled  bool `flag:"deflate"`
 	MaxDeflateLevel int  `flag:"max-deflate-level"`
 	SnappyEnabled   bool `flag:"snappy"`
+
+	// message headers
+	HeadersEnabled bool `flag:"headers"`
 }
 
 func NewOptions() *Options {
@@ -114,18 +146,34 @@ func NewOptions() *Options {
 		SyncEvery:       2500,
 		SyncTimeout:     2 * time.Second,
 
+		PriorityMemQueueSize: 1000,
+
+		MaxPurgedMsgs: 10000,
+
+		InFlightDurability:    "none",
+		InFlightFlushInterval: time.Second,
+
+		BackendQueue:         "diskqueue",
+		BackendQueueSuffixes: make([]string, 0),
+		MemBackendQueueSize:  100000,
+
 		QueueScanInterval:        100 * time.Millisecond,
 		QueueScanRefreshInterval: 5 * time.Second,
 		QueueScanSelectionCount:  20,
 		QueueScanWorkerPoolMax:   4,
 		QueueScanDirtyPercent:    0.25,
 
-		MsgTimeout:    60 * time.Second,
-		MaxMsgTimeout: 15 * time.Minute,
-		MaxMsgSize:    1024 * 1024,
-		MaxBodySize:   5 * 1024 * 1024,
-		MaxReqTimeout: 1 * time.Hour,
-		ClientTimeout: 60 * time.Second,
+		MsgTimeout:       60 * time.Second,
+		MaxMsgTimeout:    15 * time.Minute,
+		MaxMsgSize:       1024 * 1024,
+		MaxBodySize:      5 * 1024 * 1024,
+		MaxHeadersSize:   4 * 1024,
+		MaxReqTimeout:    1 * time.Hour,
+		MaxScheduleAhead: 30 * 24 * time.Hour,
+		MaxAttempts:      0,
+		DedupWindow:      2 * time.Minute,
+		MaxDedupKeys:     100000,
+		ClientTimeout:    60 * time.Second,
 
 		MaxHeartbeatInterval:   60 * time.Second,
 		MaxRdyCount:            2500,
@@ -146,6 +194,10 @@ func NewOptions() *Options {
 		MaxDeflateLevel: 6,
 		SnappyEnabled:   true,
 
+		HeadersEnabled: true,
+
 		TLSMinVersion: tls.VersionTLS10,
+
+		TLSReloadInterval: time.Minute,
 	}
 }
@@ -0,0 +1,244 @@
+package nsqd
+
+import (
+	"hash/fnv"
+	"sync"
+
+	"github.com/nsqio/nsq/internal/util"
+)
+
+const (
+	// maxPartitions bounds the number of partitions of a topic
+	maxPartitions = 1024
+
+	// maxPartitionKeyLength bounds the size of a message partition key
+	maxPartitionKeyLength = 256
+)
+
+// partitionFor returns which of n partitions msg belongs to, messages with
+// the same partition key always map to the same partition and messages
+// without one are spread by ID
+func partitionFor(msg *Message, n int) int {
+	h := fnv.New32a()
+	if msg.PartitionKey != "" {
+		h.Write([]byte(msg.PartitionKey))
+	} else {
+		h.Write(msg.ID[:])
+	}
+	return int(h.Sum32() % uint32(n))
+}
+
+type channelPartition struct {
+	queue []*Message
+	// the message of this partition currently being processed by a
+	// client, nothing else is delivered from the partition until it's
+	// finished (or requeued to the front of the queue)
+	inFlight *Message
+}
+
+// partitionQueue replaces the memory queue of channels of partitioned
+// topics, delivering the messages of each partition in order and one at a
+// time (i.e. with at most one in flight per partition)
+//
+// messages are held in memory (up to --mem-queue-size across partitions)
+// and overflow to the channel backend, which is read back only by pump
+// so that the order is kept. Ordering is not guaranteed for messages that
+// are flushed to the backend when nsqd exits.
+type partitionQueue struct {
+	sync.Mutex
+
+	c          *Channel
+	partitions []channelPartition
+	next       int
+	depth      int64
+	maxDepth   int64
+
+	// messages written to the backend that pump has yet to read back, new
+	// messages go to the backend while this is > 0 to stay behind them
+	backendPending int64
+
+	// unbuffered, read by protocolV2.messagePump
+	msgChan    chan *Message
+	updateChan chan int
+	exitChan   chan int
+	waitGroup  util.WaitGroupWrapper
+}
+
+func newPartitionQueue(c *Channel, n int) *partitionQueue {
+	maxDepth := c.ctx.nsqd.getOpts().MemQueueSize
+	if maxDepth < 1 {
+		maxDepth = 1
+	}
+	q := &partitionQueue{
+		c:          c,
+		partitions: make([]channelPartition, n),
+		maxDepth:   maxDepth,
+		msgChan:    make(chan *Message),
+		updateChan: make(chan int, 1),
+		exitChan:   make(chan int),
+	}
+	if !c.ephemeral {
+		q.backendPending = c.backend.Depth()
+	}
+	q.waitGroup.Wrap(q.pump)
+	return q
+}
+
+// put queues msg at the back of its partition, unless msg is the one in
+// flight for its partition (i.e. it was requeued) which goes back to the
+// front
+func (q *partitionQueue) put(msg *Message) error {
+	q.Lock()
+	defer q.Unlock()
+
+	p := &q.partitions[partitionFor(msg, len(q.partitions))]
+	switch {
+	case p.inFlight == msg:
+		p.queue = append([]*Message{msg}, p.queue...)
+		p.inFlight = nil
+		q.depth++
+	case q.backendPending == 0 && q.depth < q.maxDepth:
+		p.queue = append(p.queue, msg)
+		q.depth++
+	default:
+		b := bufferPoolGet()
+		err := writeMessageToBackend(b, msg, q.c.backend)
+		bufferPoolPut(b)
+		q.c.ctx.nsqd.SetHealth(err)
+		if err != nil {
+			q.c.ctx.nsqd.logf(LOG_ERROR, "CHANNEL(%s): failed to write message to backend - %s",
+				q.c.name, err)
+			return err
+		}
+		if !q.c.ephemeral {
+			q.backendPending++
+		}
+	}
+	q.notify()
+	return nil
+}
+
+// release unblocks the partition of msg if msg is the one in flight
+func (q *partitionQueue) release(msg *Message) {
+	q.Lock()
+	p := &q.partitions[partitionFor(msg, len(q.partitions))]
+	if p.inFlight == msg {
+		p.inFlight = nil
+		q.notify()
+	}
+	q.Unlock()
+}
+
+// this expects the caller to handle locking
+func (q *partitionQueue) notify() {
+	select {
+	case q.updateChan <- 1:
+	default:
+	}
+}
+
+// pop returns the message at the front of the next (round-robin) partition
+// that isn't blocked, marking it in flight
+//
+// this expects the caller to handle locking
+func (q *partitionQueue) pop() *Message {
+	for i := 0; i < len(q.partitions); i++ {
+		idx := (q.next + i) % len(q.partitions)
+		p := &q.partitions[idx]
+		if p.inFlight != nil || len(p.queue) == 0 {
+			continue
+		}
+		msg := p.queue[0]
+		p.queue[0] = nil
+		p.queue = p.queue[1:]
+		p.inFlight = msg
+		q.depth--
+		q.next = idx + 1
+		return msg
+	}
+	return nil
+}
+
+// pump offers the next deliverable message to the channel's clients and
+// moves messages from the backend into the partitions as room allows
+func (q *partitionQueue) pump() {
+	for {
+		q.Lock()
+		msg := q.pop()
+		var backendChan <-chan []byte
+		if q.backendPending > 0 && q.depth < q.maxDepth {
+			backendChan = q.c.backend.ReadChan()
+		}
+		q.Unlock()
+
+		var msgChan chan *Message
+		if msg != nil {
+			msgChan = q.msgChan
+		}
+
+		select {
+		case msgChan <- msg:
+			continue
+		case b := <-backendChan:
+			backendRead(q.c.backend, b)
+			m, err := decodeMessage(b)
+			q.Lock()
+			q.backendPending--
+			if err == nil {
+				p := &q.partitions[partitionFor(m, len(q.partitions))]
+				p.queue = append(p.queue, m)
+				q.depth++
+			}
+			q.Unlock()
+			if err != nil {
+				q.c.ctx.nsqd.logf(LOG_ERROR, "failed to decode message - %s", err)
+			}
+		case <-q.updateChan:
+		case <-q.exitChan:
+			if msg != nil {
+				q.put(msg)
+			}
+			return
+		}
+
+		if msg != nil {
+			// not delivered, back to the front of the partition
+			q.put(msg)
+		}
+	}
+}
+
+// Depth returns the number of messages queued in memory
+func (q *partitionQueue) Depth() int64 {
+	q.Lock()
+	defer q.Unlock()
+	return q.depth
+}
+
+// messages returns the queued messages, in order within each partition
+func (q *partitionQueue) messages() []*Message {
+	q.Lock()
+	defer q.Unlock()
+	var msgs []*Message
+	for _, p := range q.partitions {
+		msgs = append(msgs, p.queue...)
+	}
+	return msgs
+}
+
+// empty drops the queued messages and unblocks every partition
+func (q *partitionQueue) empty() {
+	q.Lock()
+	for i := range q.partitions {
+		q.partitions[i] = channelPartition{}
+	}
+	q.depth = 0
+	q.backendPending = 0
+	q.notify()
+	q.Unlock()
+}
+
+func (q *partitionQueue) close() {
+	close(q.exitChan)
+	q.waitGroup.Wait()
+}
@@ -0,0 +1,76 @@
+package nsqd
+
+import (
+	"fmt"
+	"os"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/nsqio/nsq/internal/test"
+)
+
+func TestPartitionFor(t *testing.T) {
+	msg1 := NewMessage(MessageID{'1'}, []byte("test"))
+	msg2 := NewMessage(MessageID{'2'}, []byte("test"))
+	msg1.PartitionKey = "key"
+	msg2.PartitionKey = "key"
+	test.Equal(t, partitionFor(msg1, 16), partitionFor(msg2, 16))
+	test.Equal(t, 0, partitionFor(msg1, 1))
+}
+
+func TestPartitionedChannel(t *testing.T) {
+	opts := NewOptions()
+	opts.Logger = test.NewTestLogger(t)
+	// overflow to the backends, order must be kept regardless
+	opts.MemQueueSize = 2
+	_, _, nsqd := mustStartNSQD(opts)
+	defer os.RemoveAll(opts.DataPath)
+	defer nsqd.Exit()
+
+	topicName := "test_partitioned_channel" + strconv.Itoa(int(time.Now().Unix()))
+	topic := nsqd.GetTopic(topicName)
+	err := topic.SetPartitions(4)
+	test.Nil(t, err)
+	channel := topic.GetChannel("ch")
+	test.NotNil(t, channel.partitions)
+
+	err = topic.SetPartitions(8)
+	test.NotNil(t, err)
+
+	for i := 0; i < 10; i++ {
+		msg := NewMessage(topic.GenerateID(), []byte(fmt.Sprintf("a%d", i)))
+		msg.PartitionKey = "a"
+		err := topic.PutMessage(msg)
+		test.Nil(t, err)
+	}
+
+	msgChan := channel.partitionMsgChan()
+	msg := <-msgChan
+	test.Equal(t, []byte("a0"), msg.Body)
+	channel.StartInFlightTimeout(msg, 1, time.Minute)
+
+	// nothing else from the partition while a0 is in flight
+	select {
+	case msg := <-msgChan:
+		t.Fatalf("unexpected message %s", msg.Body)
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	// requeued messages go back to the front of the partition
+	err = channel.RequeueMessage(1, msg.ID, 0)
+	test.Nil(t, err)
+
+	for i := 0; i < 10; i++ {
+		msg := <-msgChan
+		test.Equal(t, []byte(fmt.Sprintf("a%d", i)), msg.Body)
+		channel.StartInFlightTimeout(msg, 1, time.Minute)
+		err := channel.FinishMessage(1, msg.ID)
+		test.Nil(t, err)
+	}
+	// the backend depth is updated asynchronously after a read
+	for i := 0; i < 100 && channel.Depth() != 0; i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	test.Equal(t, int64(0), channel.Depth())
+}
@@ -0,0 +1,90 @@
+package nsqd
+
+import (
+	"errors"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/nsqio/nsq/internal/http_api"
+)
+
+// resumeTimer resumes a topic or channel that's paused until a given time
+// (see Topic.PauseUntil and Channel.PauseUntil)
+type resumeTimer struct {
+	sync.Mutex
+	at    time.Time
+	timer *time.Timer
+}
+
+// set schedules resume at at, replacing what was scheduled before, a zero
+// at schedules nothing
+func (r *resumeTimer) set(at time.Time, resume func()) {
+	r.Lock()
+	defer r.Unlock()
+	if r.timer != nil {
+		r.timer.Stop()
+		r.timer = nil
+	}
+	r.at = at
+	if at.IsZero() {
+		return
+	}
+	r.timer = time.AfterFunc(time.Until(at), func() {
+		r.Lock()
+		if !r.at.Equal(at) {
+			// paused again (or unpaused) meanwhile
+			r.Unlock()
+			return
+		}
+		r.at = time.Time{}
+		r.timer = nil
+		r.Unlock()
+		resume()
+	})
+}
+
+// get returns when the topic or channel resumes, zero if it doesn't
+func (r *resumeTimer) get() time.Time {
+	r.Lock()
+	defer r.Unlock()
+	return r.at
+}
+
+// parseResumeAt returns when a pause requested with reqParams ends, from
+// either a duration (e.g. 30m) or a resume_at time (unix seconds or
+// RFC3339, in the future), zero if the pause is indefinite
+func parseResumeAt(reqParams *http_api.ReqParams) (time.Time, error) {
+	if s, err := reqParams.Get("duration"); err == nil {
+		d, err := time.ParseDuration(s)
+		if err != nil || d <= 0 {
+			return time.Time{}, errors.New("INVALID_DURATION")
+		}
+		return time.Now().Add(d), nil
+	}
+	if s, err := reqParams.Get("resume_at"); err == nil {
+		if sec, err := strconv.ParseInt(s, 10, 64); err == nil {
+			s = time.Unix(sec, 0).Format(time.RFC3339Nano)
+		}
+		at, err := time.Parse(time.RFC3339Nano, s)
+		if err != nil || !at.After(time.Now()) {
+			return time.Time{}, errors.New("INVALID_RESUME_AT")
+		}
+		return at, nil
+	}
+	return time.Time{}, nil
+}
+
+// pausedUntil returns whether a pause persisted with resumeAt still holds,
+// i.e. it's indefinite or hasn't ended while nsqd was down
+func pausedUntil(resumeAt time.Time) bool {
+	return resumeAt.IsZero() || resumeAt.After(time.Now())
+}
+
+// unixOrZero returns t as unix seconds, 0 if it's zero
+func unixOrZero(t time.Time) int64 {
+	if t.IsZero() {
+		return 0
+	}
+	return t.Unix()
+}
@@ -0,0 +1,102 @@
+package nsqd
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/nsqio/nsq/internal/test"
+)
+
+func TestPauseUntil(t *testing.T) {
+	opts := NewOptions()
+	opts.Logger = test.NewTestLogger(t)
+	_, _, nsqd := mustStartNSQD(opts)
+	defer os.RemoveAll(opts.DataPath)
+	defer nsqd.Exit()
+
+	topicName := "test_pause_until" + strconv.Itoa(int(time.Now().Unix()))
+	topic := nsqd.GetTopic(topicName)
+	channel := topic.GetChannel("ch")
+
+	resumeAt := time.Now().Add(100 * time.Millisecond)
+	topic.PauseUntil(resumeAt)
+	channel.PauseUntil(resumeAt)
+	test.Equal(t, true, topic.IsPaused())
+	test.Equal(t, true, channel.IsPaused())
+	test.Equal(t, true, topic.ResumeAt().Equal(resumeAt))
+	test.Equal(t, true, channel.ResumeAt().Equal(resumeAt))
+
+	nsqd.Lock()
+	nsqd.PersistMetadata()
+	nsqd.Unlock()
+	m, err := getMetadata(nsqd)
+	test.Nil(t, err)
+	test.Equal(t, true, m.Topics[0].ResumeAt.Equal(resumeAt))
+	test.Equal(t, true, m.Topics[0].Channels[0].ResumeAt.Equal(resumeAt))
+
+	for i := 0; i < 100 && (topic.IsPaused() || channel.IsPaused()); i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	test.Equal(t, false, topic.IsPaused())
+	test.Equal(t, false, channel.IsPaused())
+	test.Equal(t, true, topic.ResumeAt().IsZero())
+	test.Equal(t, true, channel.ResumeAt().IsZero())
+
+	// pausing again, indefinitely, cancels the scheduled resume
+	channel.PauseUntil(time.Now().Add(50 * time.Millisecond))
+	channel.Pause()
+	time.Sleep(100 * time.Millisecond)
+	test.Equal(t, true, channel.IsPaused())
+	test.Equal(t, true, channel.ResumeAt().IsZero())
+}
+
+func TestHTTPPauseChannelDuration(t *testing.T) {
+	opts := NewOptions()
+	opts.Logger = test.NewTestLogger(t)
+	_, httpAddr, nsqd := mustStartNSQD(opts)
+	defer os.RemoveAll(opts.DataPath)
+	defer nsqd.Exit()
+
+	topicName := "test_http_pause_channel_duration" + strconv.Itoa(int(time.Now().Unix()))
+	topic := nsqd.GetTopic(topicName)
+	channel := topic.GetChannel("ch")
+
+	url := fmt.Sprintf("http://%s/channel/pause?topic=%s&channel=ch&duration=bogus", httpAddr, topicName)
+	resp, err := http.Post(url, "application/json", nil)
+	test.Nil(t, err)
+	body, _ := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	test.Equal(t, 400, resp.StatusCode)
+	test.Equal(t, `{"message":"INVALID_DURATION"}`, string(body))
+
+	url = fmt.Sprintf("http://%s/channel/pause?topic=%s&channel=ch&resume_at=1", httpAddr, topicName)
+	resp, err = http.Post(url, "application/json", nil)
+	test.Nil(t, err)
+	body, _ = ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	test.Equal(t, 400, resp.StatusCode)
+	test.Equal(t, `{"message":"INVALID_RESUME_AT"}`, string(body))
+	test.Equal(t, false, channel.IsPaused())
+
+	url = fmt.Sprintf("http://%s/channel/pause?topic=%s&channel=ch&duration=1h", httpAddr, topicName)
+	resp, err = http.Post(url, "application/json", nil)
+	test.Nil(t, err)
+	resp.Body.Close()
+	test.Equal(t, 200, resp.StatusCode)
+	test.Equal(t, true, channel.IsPaused())
+	remaining := time.Until(channel.ResumeAt())
+	test.Equal(t, true, remaining > 59*time.Minute && remaining <= time.Hour)
+
+	url = fmt.Sprintf("http://%s/channel/unpause?topic=%s&channel=ch", httpAddr, topicName)
+	resp, err = http.Post(url, "application/json", nil)
+	test.Nil(t, err)
+	resp.Body.Close()
+	test.Equal(t, 200, resp.StatusCode)
+	test.Equal(t, false, channel.IsPaused())
+	test.Equal(t, true, channel.ResumeAt().IsZero())
+}
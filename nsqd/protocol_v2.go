@@ -134,7 +134,12 @@ func (p *protocolV2) SendMessage(client *clientV2, msg *Message) error {
 	p.ctx.nsqd.logf(LOG_DEBUG, "PROTOCOL(V2): writing msg(%s) to client(%s) - %s", msg.ID, client, msg.Body)
 	var buf = &bytes.Buffer{}
 
-	_, err := msg.WriteTo(buf)
+	var err error
+	if client.HeadersEnabled() {
+		_, err = msg.WriteHeadersTo(buf)
+	} else {
+		_, err = msg.WriteTo(buf)
+	}
 	if err != nil {
 		return err
 	}
@@ -198,6 +203,10 @@ func (p *protocolV2) Exec(client *clientV2, params [][]byte) ([]byte, error) {
 		return p.MPUB(client, params)
 	case bytes.Equal(params[0], []byte("DPUB")):
 		return p.DPUB(client, params)
+	case bytes.Equal(params[0], []byte("HPUB")):
+		return p.HPUB(client, params)
+	case bytes.Equal(params[0], []byte("HMPUB")):
+		return p.HMPUB(client, params)
 	case bytes.Equal(params[0], []byte("NOP")):
 		return p.NOP(client, params)
 	case bytes.Equal(params[0], []byte("TOUCH")):
@@ -215,12 +224,20 @@ func (p *protocolV2) Exec(client *clientV2, params [][]byte) ([]byte, error) {
 func (p *protocolV2) messagePump(client *clientV2, startedChan chan bool) {
 	var err error
 	var memoryMsgChan chan *Message
+	var priorityReadyChan chan struct{}
 	var backendMsgChan <-chan []byte
+	var partitionMsgChan chan *Message
 	var subChannel *Channel
 	// NOTE: `flusherChan` is used to bound message latency for
 	// the pathological case of a channel on a low volume topic
 	// with >1 clients having >1 RDY counts
 	var flusherChan <-chan time.Time
+	// set while the channel is over its max delivery rate, fires once it's
+	// back under
+	var throttleChan <-chan time.Time
+	// whether a delivery is reserved (see Channel.reserveDelivery) for the
+	// next message taken
+	var reserved bool
 	var sampleRate int32
 
 	subEventChan := client.SubEventChan
@@ -245,8 +262,14 @@ func (p *protocolV2) messagePump(client *clientV2, startedChan chan bool) {
 	for {
 		if subChannel == nil || !client.IsReadyForMessages() {
 			// the client is not ready to receive messages...
+			if reserved {
+				subChannel.releaseDelivery()
+				reserved = false
+			}
 			memoryMsgChan = nil
+			priorityReadyChan = nil
 			backendMsgChan = nil
+			partitionMsgChan = nil
 			flusherChan = nil
 			// force flush
 			client.writeLock.Lock()
@@ -260,16 +283,53 @@ func (p *protocolV2) messagePump(client *clientV2, startedChan chan bool) {
 			// last iteration we flushed...
 			// do not select on the flusher ticker channel
 			memoryMsgChan = subChannel.memoryMsgChan
+			priorityReadyChan = subChannel.priorityReady
 			backendMsgChan = subChannel.backend.ReadChan()
+			partitionMsgChan = subChannel.partitionMsgChan()
 			flusherChan = nil
 		} else {
 			// we're buffered (if there isn't any more data we should flush)...
 			// select on the flusher ticker channel, too
 			memoryMsgChan = subChannel.memoryMsgChan
+			priorityReadyChan = subChannel.priorityReady
 			backendMsgChan = subChannel.backend.ReadChan()
+			partitionMsgChan = subChannel.partitionMsgChan()
 			flusherChan = outputBufferTicker.C
 		}
 
+		if partitionMsgChan != nil {
+			// everything goes through the partitions for ordered delivery
+			memoryMsgChan = nil
+			priorityReadyChan = nil
+			backendMsgChan = nil
+		}
+
+		throttleChan = nil
+		if subChannel != nil && client.IsReadyForMessages() && !reserved {
+			var delay time.Duration
+			reserved, delay = subChannel.reserveDelivery(time.Now())
+			if delay > 0 {
+				// wait for the channel to be under its delivery rate before
+				// taking any message
+				memoryMsgChan = nil
+				priorityReadyChan = nil
+				backendMsgChan = nil
+				partitionMsgChan = nil
+				throttleChan = time.After(delay)
+			}
+		}
+
+		// higher priority lanes are always drained first, we only fall
+		// through to the select below (which waits on everything) once
+		// they're empty
+		var msg *Message
+		if priorityReadyChan != nil {
+			msg = subChannel.nextPriorityMessage()
+			if msg != nil {
+				goto send
+			}
+		}
+
 		select {
 		case <-flusherChan:
 			// if this case wins, we're either starved
@@ -283,6 +343,7 @@ func (p *protocolV2) messagePump(client *clientV2, startedChan chan bool) {
 			}
 			flushed = true
 		case <-client.ReadyStateChan:
+		case <-throttleChan:
 		case subChannel = <-subEventChan: //这里是订阅以后确定了客户端所接受的channel,订阅过就不能改了
 			// you can't SUB anymore
 			subEventChan = nil
@@ -316,45 +377,58 @@ func (p *protocolV2) messagePump(client *clientV2, startedChan chan bool) {
 				goto exit
 			}
 		case b := <-backendMsgChan:
-			if sampleRate > 0 && rand.Int31n(100) > sampleRate {
+			backendRead(subChannel.backend, b)
+			var decodeErr error
+			msg, decodeErr = decodeMessage(b)
+			if decodeErr != nil {
+				p.ctx.nsqd.logf(LOG_ERROR, "failed to decode message - %s", decodeErr)
 				continue
 			}
-
-			msg, err := decodeMessage(b)
-			if err != nil {
-				p.ctx.nsqd.logf(LOG_ERROR, "failed to decode message - %s", err)
-				continue
+			goto send
+		case <-priorityReadyChan:
+			msg = subChannel.nextPriorityMessage()
+			if msg != nil {
+				goto send
 			}
-			msg.Attempts++
+		case msg = <-memoryMsgChan: //从内存消息通道接受了消息
+			goto send
+		case msg = <-partitionMsgChan:
+			goto send
+		case <-client.ExitChan:
+			goto exit
+		}
+		continue
 
-			subChannel.StartInFlightTimeout(msg, client.ID, msgTimeout)
-			client.SendingMessage()
-			err = p.SendMessage(client, msg)
-			if err != nil {
-				goto exit
-			}
-			flushed = false
-		case msg := <-memoryMsgChan: //从内存消息通道接受了消息
-			//sampleRate不设0可能就丢失了,sampleRate是采样率
-			if sampleRate > 0 && rand.Int31n(100) > sampleRate {
-				continue
-			}
-			msg.Attempts++
+	send:
+		if subChannel.dropPurged(msg) {
+			continue
+		}
+		//sampleRate不设0可能就丢失了,sampleRate是采样率
+		if sampleRate > 0 && rand.Int31n(100) > sampleRate {
+			subChannel.releasePartition(msg)
+			continue
+		}
+		if subChannel.dropExpired(msg, time.Now().UnixNano()) {
+			continue
+		}
+		subChannel.delivering(time.Now(), reserved)
+		reserved = false
+		msg.Attempts++
 
-			subChannel.StartInFlightTimeout(msg, client.ID, msgTimeout)
-			client.SendingMessage()
-			err = p.SendMessage(client, msg)
-			if err != nil {
-				goto exit
-			}
-			flushed = false
-		case <-client.ExitChan:
+		subChannel.StartInFlightTimeout(msg, client.ID, msgTimeout)
+		client.SendingMessage()
+		err = p.SendMessage(client, msg)
+		if err != nil {
 			goto exit
 		}
+		flushed = false
 	}
 
 exit:
 	p.ctx.nsqd.logf(LOG_INFO, "PROTOCOL(V2): [%s] exiting messagePump", client)
+	if reserved {
+		subChannel.releaseDelivery()
+	}
 	heartbeatTicker.Stop()
 	outputBufferTicker.Stop()
 	if err != nil {
@@ -422,6 +496,7 @@ func (p *protocolV2) IDENTIFY(client *clientV2, params [][]byte) ([]byte, error)
 		deflateLevel = max
 	}
 	snappy := p.ctx.nsqd.getOpts().SnappyEnabled && identifyData.Snappy
+	headers := p.ctx.nsqd.getOpts().HeadersEnabled && identifyData.Headers
 
 	if deflate && snappy {
 		return nil, protocol.NewFatalClientErr(nil, "E_IDENTIFY_FAILED", "cannot enable both deflate and snappy compression")
@@ -438,6 +513,7 @@ func (p *protocolV2) IDENTIFY(client *clientV2, params [][]byte) ([]byte, error)
 		DeflateLevel        int    `json:"deflate_level"`
 		MaxDeflateLevel     int    `json:"max_deflate_level"`
 		Snappy              bool   `json:"snappy"`
+		Headers             bool   `json:"headers"`
 		SampleRate          int32  `json:"sample_rate"`
 		AuthRequired        bool   `json:"auth_required"`
 		OutputBufferSize    int    `json:"output_buffer_size"`
@@ -452,6 +528,7 @@ func (p *protocolV2) IDENTIFY(client *clientV2, params [][]byte) ([]byte, error)
 		DeflateLevel:        deflateLevel,
 		MaxDeflateLevel:     p.ctx.nsqd.getOpts().MaxDeflateLevel,
 		Snappy:              snappy, //压缩
+		Headers:             headers,
 		SampleRate:          client.SampleRate,
 		AuthRequired:        p.ctx.nsqd.IsAuthEnabled(),
 		OutputBufferSize:    client.OutputBufferSize,
@@ -466,6 +543,10 @@ func (p *protocolV2) IDENTIFY(client *clientV2, params [][]byte) ([]byte, error)
 		return nil, protocol.NewFatalClientErr(err, "E_IDENTIFY_FAILED", "IDENTIFY failed "+err.Error())
 	}
 
+	if headers {
+		client.EnableHeaders()
+	}
+
 	if tlsv1 {
 		p.ctx.nsqd.logf(LOG_INFO, "PROTOCOL(V2): [%s] upgrading connection to TLS", client)
 		err = client.UpgradeTLS()
@@ -600,6 +681,25 @@ func (p *protocolV2) CheckAuth(client *clientV2, cmd, topicName, channelName str
 	return nil
 }
 
+// checkPubRate applies the publish rate limits to the messages of cmd, a
+// throttled publish isn't fatal so the client can retry it
+func (p *protocolV2) checkPubRate(client *clientV2, cmd string, topic *Topic, msgs []*Message) error {
+	var bytes int
+	for _, msg := range msgs {
+		bytes += len(msg.Body)
+	}
+	identity := ""
+	if client.AuthState != nil {
+		identity = client.AuthState.Identity
+	}
+	err := p.ctx.nsqd.checkPubRate(topic, pubIdentity(identity, client.String()), len(msgs), bytes)
+	if err != nil {
+		client.ThrottledMessages(len(msgs))
+		return protocol.NewClientErr(err, "E_THROTTLED", fmt.Sprintf("%s failed %s", cmd, err))
+	}
+	return nil
+}
+
 //订阅
 func (p *protocolV2) SUB(client *clientV2, params [][]byte) ([]byte, error) {
 	if atomic.LoadInt32(&client.State) != stateInit {
@@ -626,6 +726,19 @@ func (p *protocolV2) SUB(client *clientV2, params [][]byte) ([]byte, error) {
 			fmt.Sprintf("SUB channel name %q is not valid", channelName))
 	}
 
+	// an optional filter expression applies to the whole channel, it's only
+	// set by the SUB that creates the channel (otherwise /channel/create
+	// sets it), every other one must agree with the channel's filter
+	var filter *msgFilter
+	if len(params) > 3 {
+		var err error
+		filter, err = parseFilter(string(params[3]))
+		if err != nil {
+			return nil, protocol.NewFatalClientErr(nil, "E_BAD_FILTER",
+				fmt.Sprintf("SUB %s", err))
+		}
+	}
+
 	if err := p.CheckAuth(client, "SUB", topicName, channelName); err != nil {
 		return nil, err
 	}
@@ -634,11 +747,12 @@ func (p *protocolV2) SUB(client *clientV2, params [][]byte) ([]byte, error) {
 	// last client can leave the channel between GetChannel() and AddClient().
 	// Avoid adding a client to an ephemeral channel / topic which has started exiting.
 	var channel *Channel
+	var created bool
 	for {
 		//获取topic
 		topic := p.ctx.nsqd.GetTopic(topicName)
 		//获取channel
-		channel = topic.GetChannel(channelName)
+		channel, created = topic.getFilteredChannel(channelName, filter)
 		//channel存入client
 		if err := channel.AddClient(client.ID, client); err != nil {
 			return nil, protocol.NewFatalClientErr(nil, "E_TOO_MANY_CHANNEL_CONSUMERS",
@@ -654,6 +768,19 @@ func (p *protocolV2) SUB(client *clientV2, params [][]byte) ([]byte, error) {
 		}
 		break
 	}
+
+	if filter != nil {
+		if !created && channel.Filter() != filter.String() {
+			channel.RemoveClient(client.ID)
+			return nil, protocol.NewFatalClientErr(nil, "E_BAD_FILTER",
+				fmt.Sprintf("SUB filter %q does not match channel filter %q", filter, channel.Filter()))
+		}
+		if created && !channel.ephemeral {
+			p.ctx.nsqd.Lock()
+			p.ctx.nsqd.PersistMetadata()
+			p.ctx.nsqd.Unlock()
+		}
+	}
 	//状态标记成已订阅
 	atomic.StoreInt32(&client.State, stateSubscribed)
 	client.Channel = channel
@@ -799,6 +926,11 @@ func (p *protocolV2) PUB(client *clientV2, params [][]byte) ([]byte, error) {
 		return nil, protocol.NewFatalClientErr(nil, "E_BAD_TOPIC",
 			fmt.Sprintf("PUB topic name %q is not valid", topicName))
 	}
+
+	pubOpts, err := parsePubOptions(params[2:], p.ctx.nsqd.getOpts().MaxScheduleAhead)
+	if err != nil {
+		return nil, protocol.NewFatalClientErr(err, "E_INVALID", "PUB "+err.Error())
+	}
 	//读取消息长度
 	bodyLen, err := readLen(client.Reader, client.lenSlice)
 	if err != nil {
@@ -828,9 +960,16 @@ func (p *protocolV2) PUB(client *clientV2, params [][]byte) ([]byte, error) {
 	topic := p.ctx.nsqd.GetTopic(topicName)
 	//构建消息结构体
 	msg := NewMessage(topic.GenerateID(), messageBody)
+	pubOpts.apply(msg)
+	if err := p.checkPubRate(client, "PUB", topic, []*Message{msg}); err != nil {
+		return nil, err
+	}
+	if pubOpts.idempotencyKey != "" {
+		return p.putKeyed(client, topic, pubOpts.idempotencyKey, []*Message{msg}, "PUB", "E_PUB_FAILED")
+	}
 	err = topic.PutMessage(msg)//存入topic
 	if err != nil {
-		return nil, protocol.NewFatalClientErr(err, "E_PUB_FAILED", "PUB failed "+err.Error())
+		return nil, putErr(err, "E_PUB_FAILED", "PUB")
 	}
 	client.PublishedMessage(topicName, 1)
 
@@ -850,6 +989,11 @@ func (p *protocolV2) MPUB(client *clientV2, params [][]byte) ([]byte, error) {
 			fmt.Sprintf("E_BAD_TOPIC MPUB topic name %q is not valid", topicName))
 	}
 
+	pubOpts, err := parsePubOptions(params[2:], p.ctx.nsqd.getOpts().MaxScheduleAhead)
+	if err != nil {
+		return nil, protocol.NewFatalClientErr(err, "E_INVALID", "MPUB "+err.Error())
+	}
+
 	if err := p.CheckAuth(client, "MPUB", topicName, ""); err != nil {
 		return nil, err
 	}
@@ -876,13 +1020,23 @@ func (p *protocolV2) MPUB(client *clientV2, params [][]byte) ([]byte, error) {
 	if err != nil {
 		return nil, err
 	}
+	for _, msg := range messages {
+		pubOpts.apply(msg)
+	}
+
+	if err := p.checkPubRate(client, "MPUB", topic, messages); err != nil {
+		return nil, err
+	}
 
 	// if we've made it this far we've validated all the input,
 	// the only possible error is that the topic is exiting during
 	// this next call (and no messages will be queued in that case)
+	if pubOpts.idempotencyKey != "" {
+		return p.putKeyed(client, topic, pubOpts.idempotencyKey, messages, "MPUB", "E_MPUB_FAILED")
+	}
 	err = topic.PutMessages(messages)
 	if err != nil {
-		return nil, protocol.NewFatalClientErr(err, "E_MPUB_FAILED", "MPUB failed "+err.Error())
+		return nil, putErr(err, "E_MPUB_FAILED", "MPUB")
 	}
 
 	client.PublishedMessage(topicName, uint64(len(messages)))
@@ -916,6 +1070,14 @@ func (p *protocolV2) DPUB(client *clientV2, params [][]byte) ([]byte, error) {
 				timeoutMs, p.ctx.nsqd.getOpts().MaxReqTimeout/time.Millisecond))
 	}
 
+	pubOpts, err := parsePubOptions(params[3:], p.ctx.nsqd.getOpts().MaxScheduleAhead)
+	if err != nil {
+		return nil, protocol.NewFatalClientErr(err, "E_INVALID", "DPUB "+err.Error())
+	}
+	if pubOpts.deliverAt > 0 {
+		return nil, protocol.NewFatalClientErr(nil, "E_INVALID", "DPUB cannot take a deliver_at")
+	}
+
 	bodyLen, err := readLen(client.Reader, client.lenSlice)
 	if err != nil {
 		return nil, protocol.NewFatalClientErr(err, "E_BAD_MESSAGE", "DPUB failed to read message body size")
@@ -943,17 +1105,190 @@ func (p *protocolV2) DPUB(client *clientV2, params [][]byte) ([]byte, error) {
 
 	topic := p.ctx.nsqd.GetTopic(topicName)
 	msg := NewMessage(topic.GenerateID(), messageBody)
-	msg.deferred = timeoutDuration
+	pubOpts.apply(msg)
+	topic.deferMessage(msg, timeoutDuration)
+	if err := p.checkPubRate(client, "DPUB", topic, []*Message{msg}); err != nil {
+		return nil, err
+	}
+	if pubOpts.idempotencyKey != "" {
+		return p.putKeyed(client, topic, pubOpts.idempotencyKey, []*Message{msg}, "DPUB", "E_DPUB_FAILED")
+	}
 	err = topic.PutMessage(msg)
 	if err != nil {
-		return nil, protocol.NewFatalClientErr(err, "E_DPUB_FAILED", "DPUB failed "+err.Error())
+		return nil, putErr(err, "E_DPUB_FAILED", "DPUB")
+	}
+
+	client.PublishedMessage(topicName, 1)
+
+	return okBytes, nil
+}
+
+func (p *protocolV2) HPUB(client *clientV2, params [][]byte) ([]byte, error) {
+	var err error
+
+	if !client.HeadersEnabled() {
+		return nil, protocol.NewFatalClientErr(nil, "E_INVALID", "cannot HPUB without negotiating headers")
+	}
+
+	if len(params) < 2 {
+		return nil, protocol.NewFatalClientErr(nil, "E_INVALID", "HPUB insufficient number of parameters")
+	}
+
+	topicName := string(params[1])
+	if !protocol.IsValidTopicName(topicName) {
+		return nil, protocol.NewFatalClientErr(nil, "E_BAD_TOPIC",
+			fmt.Sprintf("HPUB topic name %q is not valid", topicName))
+	}
+
+	pubOpts, err := parsePubOptions(params[2:], p.ctx.nsqd.getOpts().MaxScheduleAhead)
+	if err != nil {
+		return nil, protocol.NewFatalClientErr(err, "E_INVALID", "HPUB "+err.Error())
+	}
+
+	bodyLen, err := readLen(client.Reader, client.lenSlice)
+	if err != nil {
+		return nil, protocol.NewFatalClientErr(err, "E_BAD_MESSAGE", "HPUB failed to read message body size")
+	}
+
+	if bodyLen <= 0 {
+		return nil, protocol.NewFatalClientErr(nil, "E_BAD_MESSAGE",
+			fmt.Sprintf("HPUB invalid message body size %d", bodyLen))
+	}
+
+	maxMsgSize := p.ctx.nsqd.getOpts().MaxMsgSize
+	maxHeadersSize := p.ctx.nsqd.getOpts().MaxHeadersSize
+	if int64(bodyLen) > 4+maxHeadersSize+maxMsgSize {
+		return nil, protocol.NewFatalClientErr(nil, "E_BAD_MESSAGE",
+			fmt.Sprintf("HPUB message too big %d > %d", bodyLen, 4+maxHeadersSize+maxMsgSize))
+	}
+
+	body := make([]byte, bodyLen)
+	_, err = io.ReadFull(client.Reader, body)
+	if err != nil {
+		return nil, protocol.NewFatalClientErr(err, "E_BAD_MESSAGE", "HPUB failed to read message body")
+	}
+
+	headers, messageBody, err := parseHeadersMessage("HPUB", body, maxMsgSize, maxHeadersSize)
+	if err != nil {
+		return nil, err
 	}
 
+	if err := p.CheckAuth(client, "HPUB", topicName, ""); err != nil {
+		return nil, err
+	}
+
+	topic := p.ctx.nsqd.GetTopic(topicName)
+	msg := NewMessage(topic.GenerateID(), messageBody)
+	msg.Headers = headers
+	pubOpts.apply(msg)
+	if err := p.checkPubRate(client, "HPUB", topic, []*Message{msg}); err != nil {
+		return nil, err
+	}
+	if pubOpts.idempotencyKey != "" {
+		return p.putKeyed(client, topic, pubOpts.idempotencyKey, []*Message{msg}, "HPUB", "E_PUB_FAILED")
+	}
+	err = topic.PutMessage(msg)
+	if err != nil {
+		return nil, putErr(err, "E_PUB_FAILED", "HPUB")
+	}
 	client.PublishedMessage(topicName, 1)
 
 	return okBytes, nil
 }
 
+func (p *protocolV2) HMPUB(client *clientV2, params [][]byte) ([]byte, error) {
+	var err error
+
+	if !client.HeadersEnabled() {
+		return nil, protocol.NewFatalClientErr(nil, "E_INVALID", "cannot HMPUB without negotiating headers")
+	}
+
+	if len(params) < 2 {
+		return nil, protocol.NewFatalClientErr(nil, "E_INVALID", "HMPUB insufficient number of parameters")
+	}
+
+	topicName := string(params[1])
+	if !protocol.IsValidTopicName(topicName) {
+		return nil, protocol.NewFatalClientErr(nil, "E_BAD_TOPIC",
+			fmt.Sprintf("E_BAD_TOPIC HMPUB topic name %q is not valid", topicName))
+	}
+
+	pubOpts, err := parsePubOptions(params[2:], p.ctx.nsqd.getOpts().MaxScheduleAhead)
+	if err != nil {
+		return nil, protocol.NewFatalClientErr(err, "E_INVALID", "HMPUB "+err.Error())
+	}
+
+	if err := p.CheckAuth(client, "HMPUB", topicName, ""); err != nil {
+		return nil, err
+	}
+
+	topic := p.ctx.nsqd.GetTopic(topicName)
+
+	bodyLen, err := readLen(client.Reader, client.lenSlice)
+	if err != nil {
+		return nil, protocol.NewFatalClientErr(err, "E_BAD_BODY", "HMPUB failed to read body size")
+	}
+
+	if bodyLen <= 0 {
+		return nil, protocol.NewFatalClientErr(nil, "E_BAD_BODY",
+			fmt.Sprintf("HMPUB invalid body size %d", bodyLen))
+	}
+
+	if int64(bodyLen) > p.ctx.nsqd.getOpts().MaxBodySize {
+		return nil, protocol.NewFatalClientErr(nil, "E_BAD_BODY",
+			fmt.Sprintf("HMPUB body too big %d > %d", bodyLen, p.ctx.nsqd.getOpts().MaxBodySize))
+	}
+
+	messages, err := readHMPUB(client.Reader, client.lenSlice, topic,
+		p.ctx.nsqd.getOpts().MaxMsgSize, p.ctx.nsqd.getOpts().MaxHeadersSize,
+		p.ctx.nsqd.getOpts().MaxBodySize)
+	if err != nil {
+		return nil, err
+	}
+	for _, msg := range messages {
+		pubOpts.apply(msg)
+	}
+
+	if err := p.checkPubRate(client, "HMPUB", topic, messages); err != nil {
+		return nil, err
+	}
+	if pubOpts.idempotencyKey != "" {
+		return p.putKeyed(client, topic, pubOpts.idempotencyKey, messages, "HMPUB", "E_MPUB_FAILED")
+	}
+	err = topic.PutMessages(messages)
+	if err != nil {
+		return nil, putErr(err, "E_MPUB_FAILED", "HMPUB")
+	}
+
+	client.PublishedMessage(topicName, uint64(len(messages)))
+
+	return okBytes, nil
+}
+
+// putKeyed publishes msgs de-duplicated by an idempotency key, responding
+// with the ID of the (first) message of the original publish
+func (p *protocolV2) putKeyed(client *clientV2, topic *Topic, key string, msgs []*Message,
+	cmd string, errCode string) ([]byte, error) {
+	id, dup, err := topic.PutMessagesKeyed(key, msgs)
+	if err != nil {
+		return nil, putErr(err, errCode, cmd)
+	}
+	if dup {
+		return append([]byte("DUPLICATE "), id[:]...), nil
+	}
+	client.PublishedMessage(topic.name, uint64(len(msgs)))
+	return append([]byte("OK "), id[:]...), nil
+}
+
+// putErr returns the error for a failed put of cmd, only a full backlog
+// (see backlogQuota) isn't fatal
+func putErr(err error, errCode string, cmd string) error {
+	if _, ok := err.(errBacklogFull); ok {
+		return protocol.NewClientErr(err, "E_BACKLOG_FULL", cmd+" failed "+err.Error())
+	}
+	return protocol.NewFatalClientErr(err, errCode, cmd+" failed "+err.Error())
+}
+
 func (p *protocolV2) TOUCH(client *clientV2, params [][]byte) ([]byte, error) {
 	state := atomic.LoadInt32(&client.State)
 	if state != stateSubscribed && state != stateClosing {
@@ -982,16 +1317,32 @@ func (p *protocolV2) TOUCH(client *clientV2, params [][]byte) ([]byte, error) {
 }
 
 func readMPUB(r io.Reader, tmp []byte, topic *Topic, maxMessageSize int64, maxBodySize int64) ([]*Message, error) {
+	return readMultiPub("MPUB", r, tmp, topic, false, maxMessageSize, 0, maxBodySize)
+}
+
+// readHMPUB reads the same framing as readMPUB except that each message
+// is prefixed with its header block (see parseHeadersMessage)
+func readHMPUB(r io.Reader, tmp []byte, topic *Topic, maxMessageSize int64, maxHeadersSize int64, maxBodySize int64) ([]*Message, error) {
+	return readMultiPub("HMPUB", r, tmp, topic, true, maxMessageSize, maxHeadersSize, maxBodySize)
+}
+
+func readMultiPub(cmd string, r io.Reader, tmp []byte, topic *Topic, withHeaders bool,
+	maxMessageSize int64, maxHeadersSize int64, maxBodySize int64) ([]*Message, error) {
 	numMessages, err := readLen(r, tmp)
 	if err != nil {
-		return nil, protocol.NewFatalClientErr(err, "E_BAD_BODY", "MPUB failed to read message count")
+		return nil, protocol.NewFatalClientErr(err, "E_BAD_BODY", cmd+" failed to read message count")
 	}
 
 	// 4 == total num, 5 == length + min 1
 	maxMessages := (maxBodySize - 4) / 5
 	if numMessages <= 0 || int64(numMessages) > maxMessages {
 		return nil, protocol.NewFatalClientErr(err, "E_BAD_BODY",
-			fmt.Sprintf("MPUB invalid message count %d", numMessages))
+			fmt.Sprintf("%s invalid message count %d", cmd, numMessages))
+	}
+
+	maxSize := maxMessageSize
+	if withHeaders {
+		maxSize += 4 + maxHeadersSize
 	}
 
 	messages := make([]*Message, 0, numMessages)
@@ -999,31 +1350,78 @@ func readMPUB(r io.Reader, tmp []byte, topic *Topic, maxMessageSize int64, maxBo
 		messageSize, err := readLen(r, tmp)
 		if err != nil {
 			return nil, protocol.NewFatalClientErr(err, "E_BAD_MESSAGE",
-				fmt.Sprintf("MPUB failed to read message(%d) body size", i))
+				fmt.Sprintf("%s failed to read message(%d) body size", cmd, i))
 		}
 
 		if messageSize <= 0 {
 			return nil, protocol.NewFatalClientErr(nil, "E_BAD_MESSAGE",
-				fmt.Sprintf("MPUB invalid message(%d) body size %d", i, messageSize))
+				fmt.Sprintf("%s invalid message(%d) body size %d", cmd, i, messageSize))
 		}
 
-		if int64(messageSize) > maxMessageSize {
+		if int64(messageSize) > maxSize {
 			return nil, protocol.NewFatalClientErr(nil, "E_BAD_MESSAGE",
-				fmt.Sprintf("MPUB message too big %d > %d", messageSize, maxMessageSize))
+				fmt.Sprintf("%s message too big %d > %d", cmd, messageSize, maxSize))
 		}
 
 		msgBody := make([]byte, messageSize)
 		_, err = io.ReadFull(r, msgBody)
 		if err != nil {
-			return nil, protocol.NewFatalClientErr(err, "E_BAD_MESSAGE", "MPUB failed to read message body")
+			return nil, protocol.NewFatalClientErr(err, "E_BAD_MESSAGE", cmd+" failed to read message body")
+		}
+
+		var headers map[string]string
+		if withHeaders {
+			headers, msgBody, err = parseHeadersMessage(cmd, msgBody, maxMessageSize, maxHeadersSize)
+			if err != nil {
+				return nil, err
+			}
 		}
 
-		messages = append(messages, NewMessage(topic.GenerateID(), msgBody))
+		msg := NewMessage(topic.GenerateID(), msgBody)
+		msg.Headers = headers
+		messages = append(messages, msg)
 	}
 
 	return messages, nil
 }
 
+// parseHeadersMessage splits the body of a HPUB (or each message of a HMPUB)
+//
+//	[ 4-byte header block size ][ N-byte header block ][ N-byte message body ]
+func parseHeadersMessage(cmd string, b []byte, maxMessageSize int64, maxHeadersSize int64) (map[string]string, []byte, error) {
+	if len(b) < 4 {
+		return nil, nil, protocol.NewFatalClientErr(nil, "E_BAD_MESSAGE",
+			fmt.Sprintf("%s failed to read header block size", cmd))
+	}
+	hdrLen := int64(binary.BigEndian.Uint32(b[:4]))
+	if hdrLen > maxHeadersSize {
+		return nil, nil, protocol.NewFatalClientErr(nil, "E_BAD_MESSAGE",
+			fmt.Sprintf("%s headers too big %d > %d", cmd, hdrLen, maxHeadersSize))
+	}
+	if hdrLen > int64(len(b)-4) {
+		return nil, nil, protocol.NewFatalClientErr(nil, "E_BAD_MESSAGE",
+			fmt.Sprintf("%s invalid header block size %d", cmd, hdrLen))
+	}
+
+	headers, err := decodeHeaders(b[4 : 4+hdrLen])
+	if err != nil {
+		return nil, nil, protocol.NewFatalClientErr(err, "E_BAD_MESSAGE",
+			fmt.Sprintf("%s failed to decode headers", cmd))
+	}
+
+	body := b[4+hdrLen:]
+	if len(body) == 0 {
+		return nil, nil, protocol.NewFatalClientErr(nil, "E_BAD_MESSAGE",
+			fmt.Sprintf("%s invalid message body size 0", cmd))
+	}
+	if int64(len(body)) > maxMessageSize {
+		return nil, nil, protocol.NewFatalClientErr(nil, "E_BAD_MESSAGE",
+			fmt.Sprintf("%s message too big %d > %d", cmd, len(body), maxMessageSize))
+	}
+
+	return headers, body, nil
+}
+
 // validate and cast the bytes on the wire to a message ID
 func getMessageID(p []byte) (*MessageID, error) {
 	if len(p) != MsgIDLength {
@@ -5,6 +5,7 @@ import (
 	"bytes"
 	"compress/flate"
 	"crypto/tls"
+	"encoding/binary"
 	"encoding/json"
 	"errors"
 	"fmt"
@@ -17,6 +18,7 @@ import (
 	"net/http/httptest"
 	"net/url"
 	"os"
+	"path/filepath"
 	"runtime"
 	"strconv"
 	"sync"
@@ -590,7 +592,28 @@ func TestDPUB(t *testing.T) {
 
 	time.Sleep(25 * time.Millisecond)
 
-	ch := nsqd.GetTopic(topicName).GetChannel("ch")
+	// deferred through the schedule store so it survives a restart
+	topic := nsqd.GetTopic(topicName)
+	ch := topic.GetChannel("ch")
+	test.Equal(t, int64(1), topic.ScheduledCount())
+	test.Equal(t, 0, int(atomic.LoadUint64(&ch.messageCount)))
+
+	// an ephemeral topic has no store and defers in memory
+	ephemeralTopicName := topicName + "#ephemeral"
+	conn2, err := mustConnectNSQD(tcpAddr)
+	test.Nil(t, err)
+	defer conn2.Close()
+	identify(t, conn2, nil, frameTypeResponse)
+	sub(t, conn2, ephemeralTopicName, "ch")
+	nsq.DeferredPublish(ephemeralTopicName, time.Second, make([]byte, 100)).WriteTo(conn2)
+	resp, _ = nsq.ReadResponse(conn2)
+	frameType, data, _ = nsq.UnpackResponse(resp)
+	test.Equal(t, frameTypeResponse, frameType)
+	test.Equal(t, []byte("OK"), data)
+
+	time.Sleep(25 * time.Millisecond)
+
+	ch = nsqd.GetTopic(ephemeralTopicName).GetChannel("ch")
 	ch.deferredMutex.Lock()
 	numDef := len(ch.deferredMessages)
 	ch.deferredMutex.Unlock()
@@ -1576,6 +1599,86 @@ func runAuthTest(t *testing.T, authResponse string, authSecret string, authError
 	}
 }
 
+func TestClientAuthFile(t *testing.T) {
+	opts := NewOptions()
+	opts.Logger = test.NewTestLogger(t)
+	opts.DataPath, _ = ioutil.TempDir("", "nsq-test-")
+	defer os.RemoveAll(opts.DataPath)
+	opts.AuthFile = filepath.Join(opts.DataPath, "auth.json")
+	err := ioutil.WriteFile(opts.AuthFile, []byte(`{"ttl":10,"secrets":{
+		"testsecret":{"identity":"consumer","authorizations":[
+			{"topic":"test", "channels":["^ch$"], "permissions":["subscribe"]}]}
+	}}`), 0644)
+	test.Nil(t, err)
+	tcpAddr, _, nsqd := mustStartNSQD(opts)
+	defer nsqd.Exit()
+
+	conn, err := mustConnectNSQD(tcpAddr)
+	test.Nil(t, err)
+	defer conn.Close()
+	identify(t, conn, nil, frameTypeResponse)
+	authCmd(t, conn, "testsecret", `{"identity":"consumer","identity_url":"","permission_count":1}`)
+	sub(t, conn, "test", "ch")
+
+	conn, err = mustConnectNSQD(tcpAddr)
+	test.Nil(t, err)
+	defer conn.Close()
+	identify(t, conn, nil, frameTypeResponse)
+	authCmd(t, conn, "testsecret", `{"identity":"consumer","identity_url":"","permission_count":1}`)
+	_, err = nsq.Subscribe("test", "other").WriteTo(conn)
+	test.Nil(t, err)
+	readValidate(t, conn, frameTypeError, `E_UNAUTHORIZED AUTH failed for SUB on "test" "other"`)
+
+	conn, err = mustConnectNSQD(tcpAddr)
+	test.Nil(t, err)
+	defer conn.Close()
+	identify(t, conn, nil, frameTypeResponse)
+	authCmd(t, conn, "unknown", "")
+	readValidate(t, conn, frameTypeError, "E_AUTH_FAILED AUTH failed")
+}
+
+func TestPubRateLimit(t *testing.T) {
+	opts := NewOptions()
+	opts.Logger = test.NewTestLogger(t)
+	opts.ClientPubRateLimit = 2
+	tcpAddr, _, nsqd := mustStartNSQD(opts)
+	defer os.RemoveAll(opts.DataPath)
+	defer nsqd.Exit()
+
+	topicName := "test_pub_rate_limit" + strconv.Itoa(int(time.Now().Unix()))
+
+	conn, err := mustConnectNSQD(tcpAddr)
+	test.Nil(t, err)
+	defer conn.Close()
+	identify(t, conn, nil, frameTypeResponse)
+
+	for i := 0; i < 2; i++ {
+		_, err = nsq.Publish(topicName, []byte("test body")).WriteTo(conn)
+		test.Nil(t, err)
+		readValidate(t, conn, frameTypeResponse, "OK")
+	}
+	_, err = nsq.Publish(topicName, []byte("test body")).WriteTo(conn)
+	test.Nil(t, err)
+	readValidate(t, conn, frameTypeError, "E_THROTTLED PUB failed client publish rate limit exceeded")
+	cmd, _ := nsq.MultiPublish(topicName, [][]byte{[]byte("a"), []byte("b")})
+	_, err = cmd.WriteTo(conn)
+	test.Nil(t, err)
+	readValidate(t, conn, frameTypeError, "E_THROTTLED MPUB failed client publish rate limit exceeded")
+
+	// the connection is still usable once the limit refills
+	time.Sleep(600 * time.Millisecond)
+	_, err = nsq.Publish(topicName, []byte("test body")).WriteTo(conn)
+	test.Nil(t, err)
+	readValidate(t, conn, frameTypeResponse, "OK")
+
+	stats := nsqd.GetStats(topicName, "", false)
+	test.Equal(t, uint64(3), stats[0].MessageCount)
+	test.Equal(t, uint64(3), stats[0].ThrottledCount)
+	producers := nsqd.GetProducerStats()
+	test.Equal(t, 1, len(producers))
+	test.Equal(t, uint64(3), producers[0].ThrottledCount)
+}
+
 func TestIOLoopReturnsClientErrWhenSendFails(t *testing.T) {
 	fakeConn := test.NewFakeNetConn()
 	fakeConn.WriteFunc = func(b []byte) (int, error) {
@@ -1926,3 +2029,514 @@ func BenchmarkProtocolV2MultiSub2(b *testing.B)  { benchmarkProtocolV2MultiSub(b
 func BenchmarkProtocolV2MultiSub4(b *testing.B)  { benchmarkProtocolV2MultiSub(b, 4) }
 func BenchmarkProtocolV2MultiSub8(b *testing.B)  { benchmarkProtocolV2MultiSub(b, 8) }
 func BenchmarkProtocolV2MultiSub16(b *testing.B) { benchmarkProtocolV2MultiSub(b, 16) }
+
+func hpubCmd(topicName string, headers map[string]string, body []byte) *nsq.Command {
+	hdr := encodeHeaders(headers)
+	buf := make([]byte, 4, 4+len(hdr)+len(body))
+	binary.BigEndian.PutUint32(buf, uint32(len(hdr)))
+	buf = append(buf, hdr...)
+	buf = append(buf, body...)
+	return &nsq.Command{Name: []byte("HPUB"), Params: [][]byte{[]byte(topicName)}, Body: buf}
+}
+
+// decodeHeadersMessage decodes a message frame sent to a client that
+// negotiated headers
+func decodeHeadersMessage(b []byte) (*Message, error) {
+	if len(b) < minValidMsgLength+4 {
+		return nil, fmt.Errorf("invalid message buffer size (%d)", len(b))
+	}
+	var msg Message
+	msg.Timestamp = int64(binary.BigEndian.Uint64(b[:8]))
+	msg.Attempts = binary.BigEndian.Uint16(b[8:10])
+	copy(msg.ID[:], b[10:10+MsgIDLength])
+	b = b[minValidMsgLength:]
+	hdrLen := int(binary.BigEndian.Uint32(b[:4]))
+	if hdrLen > len(b)-4 {
+		return nil, fmt.Errorf("invalid header block size (%d)", hdrLen)
+	}
+	headers, err := decodeHeaders(b[4 : 4+hdrLen])
+	if err != nil {
+		return nil, err
+	}
+	msg.Headers = headers
+	msg.Body = b[4+hdrLen:]
+	return &msg, nil
+}
+
+func TestHeaders(t *testing.T) {
+	opts := NewOptions()
+	opts.Logger = test.NewTestLogger(t)
+	opts.LogLevel = LOG_DEBUG
+	opts.MemQueueSize = 0
+	tcpAddr, _, nsqd := mustStartNSQD(opts)
+	defer os.RemoveAll(opts.DataPath)
+	defer nsqd.Exit()
+
+	topicName := "test_headers" + strconv.Itoa(int(time.Now().Unix()))
+
+	conn, err := mustConnectNSQD(tcpAddr)
+	test.Nil(t, err)
+	defer conn.Close()
+
+	data := identify(t, conn, map[string]interface{}{
+		"headers": true,
+	}, frameTypeResponse)
+	r := struct {
+		Headers bool `json:"headers"`
+	}{}
+	err = json.Unmarshal(data, &r)
+	test.Nil(t, err)
+	test.Equal(t, true, r.Headers)
+
+	headers := map[string]string{"trace-id": "abc", "empty": ""}
+	_, err = hpubCmd(topicName, headers, []byte("test body")).WriteTo(conn)
+	test.Nil(t, err)
+	readValidate(t, conn, frameTypeResponse, "OK")
+
+	sub(t, conn, topicName, "ch")
+	_, err = nsq.Ready(1).WriteTo(conn)
+	test.Nil(t, err)
+
+	resp, err := nsq.ReadResponse(conn)
+	test.Nil(t, err)
+	frameType, data, err := nsq.UnpackResponse(resp)
+	test.Nil(t, err)
+	test.Equal(t, frameTypeMessage, frameType)
+	msgOut, err := decodeHeadersMessage(data)
+	test.Nil(t, err)
+	test.Equal(t, headers, msgOut.Headers)
+	test.Equal(t, []byte("test body"), msgOut.Body)
+
+	// clients that did not negotiate headers keep the legacy format
+	conn2, err := mustConnectNSQD(tcpAddr)
+	test.Nil(t, err)
+	defer conn2.Close()
+
+	identify(t, conn2, nil, frameTypeResponse)
+	_, err = hpubCmd(topicName, headers, []byte("test body")).WriteTo(conn2)
+	test.Nil(t, err)
+	resp, err = nsq.ReadResponse(conn2)
+	test.Nil(t, err)
+	frameType, data, _ = nsq.UnpackResponse(resp)
+	test.Equal(t, frameTypeError, frameType)
+	test.Equal(t, "E_INVALID cannot HPUB without negotiating headers", string(data))
+}
+
+func TestPriority(t *testing.T) {
+	opts := NewOptions()
+	opts.Logger = test.NewTestLogger(t)
+	opts.LogLevel = LOG_DEBUG
+	tcpAddr, _, nsqd := mustStartNSQD(opts)
+	defer os.RemoveAll(opts.DataPath)
+	defer nsqd.Exit()
+
+	topicName := "test_priority" + strconv.Itoa(int(time.Now().Unix()))
+
+	conn, err := mustConnectNSQD(tcpAddr)
+	test.Nil(t, err)
+	defer conn.Close()
+
+	identify(t, conn, nil, frameTypeResponse)
+	sub(t, conn, topicName, "ch")
+
+	for i, pri := range []string{"0", "1", "0", "3"} {
+		cmd := &nsq.Command{
+			Name:   []byte("PUB"),
+			Params: [][]byte{[]byte(topicName), []byte("priority=" + pri)},
+			Body:   []byte(fmt.Sprintf("%d-%s", i, pri)),
+		}
+		_, err = cmd.WriteTo(conn)
+		test.Nil(t, err)
+		readValidate(t, conn, frameTypeResponse, "OK")
+	}
+
+	channel, _ := nsqd.GetTopic(topicName).GetExistingChannel("ch")
+	for channel.Depth() != 4 {
+		time.Sleep(time.Millisecond)
+	}
+	test.Equal(t, []int64{2, 1, 0, 1}, channel.PriorityDepths())
+
+	_, err = nsq.Ready(4).WriteTo(conn)
+	test.Nil(t, err)
+
+	var bodies []string
+	for i := 0; i < 4; i++ {
+		resp, err := nsq.ReadResponse(conn)
+		test.Nil(t, err)
+		frameType, data, err := nsq.UnpackResponse(resp)
+		test.Nil(t, err)
+		test.Equal(t, frameTypeMessage, frameType)
+		msgOut, err := decodeMessage(data)
+		test.Nil(t, err)
+		bodies = append(bodies, string(msgOut.Body))
+	}
+	test.Equal(t, "3-3", bodies[0])
+	test.Equal(t, "1-1", bodies[1])
+
+	cmd := &nsq.Command{
+		Name:   []byte("PUB"),
+		Params: [][]byte{[]byte(topicName), []byte("priority=4")},
+		Body:   []byte("test body"),
+	}
+	_, err = cmd.WriteTo(conn)
+	test.Nil(t, err)
+	resp, err := nsq.ReadResponse(conn)
+	test.Nil(t, err)
+	frameType, data, _ := nsq.UnpackResponse(resp)
+	test.Equal(t, frameTypeError, frameType)
+	test.Equal(t, `E_INVALID PUB invalid priority "4" (expected 0-3)`, string(data))
+}
+
+func TestMessageTTL(t *testing.T) {
+	opts := NewOptions()
+	opts.Logger = test.NewTestLogger(t)
+	opts.LogLevel = LOG_DEBUG
+	tcpAddr, _, nsqd := mustStartNSQD(opts)
+	defer os.RemoveAll(opts.DataPath)
+	defer nsqd.Exit()
+
+	topicName := "test_message_ttl" + strconv.Itoa(int(time.Now().Unix()))
+
+	conn, err := mustConnectNSQD(tcpAddr)
+	test.Nil(t, err)
+	defer conn.Close()
+
+	identify(t, conn, nil, frameTypeResponse)
+	sub(t, conn, topicName, "ch")
+
+	for _, param := range []string{"ttl=1", "ttl=60000"} {
+		cmd := &nsq.Command{
+			Name:   []byte("PUB"),
+			Params: [][]byte{[]byte(topicName), []byte(param)},
+			Body:   []byte(param),
+		}
+		_, err = cmd.WriteTo(conn)
+		test.Nil(t, err)
+		readValidate(t, conn, frameTypeResponse, "OK")
+	}
+
+	channel, _ := nsqd.GetTopic(topicName).GetExistingChannel("ch")
+	for channel.Depth() != 2 {
+		time.Sleep(time.Millisecond)
+	}
+	time.Sleep(5 * time.Millisecond)
+
+	_, err = nsq.Ready(2).WriteTo(conn)
+	test.Nil(t, err)
+
+	resp, err := nsq.ReadResponse(conn)
+	test.Nil(t, err)
+	frameType, data, err := nsq.UnpackResponse(resp)
+	test.Nil(t, err)
+	test.Equal(t, frameTypeMessage, frameType)
+	msgOut, err := decodeMessage(data)
+	test.Nil(t, err)
+	test.Equal(t, "ttl=60000", string(msgOut.Body))
+	test.Equal(t, uint64(1), atomic.LoadUint64(&channel.expiredCount))
+
+	cmd := &nsq.Command{
+		Name:   []byte("PUB"),
+		Params: [][]byte{[]byte(topicName), []byte("ttl=0")},
+		Body:   []byte("test body"),
+	}
+	_, err = cmd.WriteTo(conn)
+	test.Nil(t, err)
+	resp, err = nsq.ReadResponse(conn)
+	test.Nil(t, err)
+	frameType, data, _ = nsq.UnpackResponse(resp)
+	test.Equal(t, frameTypeError, frameType)
+	test.Equal(t, `E_INVALID PUB invalid ttl "0" (expected a positive number of milliseconds)`, string(data))
+}
+
+func TestIdempotentPublish(t *testing.T) {
+	opts := NewOptions()
+	opts.Logger = test.NewTestLogger(t)
+	opts.LogLevel = LOG_DEBUG
+	tcpAddr, _, nsqd := mustStartNSQD(opts)
+	defer os.RemoveAll(opts.DataPath)
+	defer nsqd.Exit()
+
+	topicName := "test_idempotent_pub" + strconv.Itoa(int(time.Now().Unix()))
+
+	conn, err := mustConnectNSQD(tcpAddr)
+	test.Nil(t, err)
+	defer conn.Close()
+
+	identify(t, conn, nil, frameTypeResponse)
+
+	pub := func(name string, key string) string {
+		cmd := &nsq.Command{
+			Name:   []byte(name),
+			Params: [][]byte{[]byte(topicName), []byte("idempotency_key=" + key)},
+			Body:   []byte("test body"),
+		}
+		if name == "MPUB" {
+			cmd, _ = nsq.MultiPublish(topicName, [][]byte{[]byte("a"), []byte("b")})
+			cmd.Params = append(cmd.Params, []byte("idempotency_key="+key))
+		}
+		_, err := cmd.WriteTo(conn)
+		test.Nil(t, err)
+		resp, err := nsq.ReadResponse(conn)
+		test.Nil(t, err)
+		frameType, data, err := nsq.UnpackResponse(resp)
+		test.Nil(t, err)
+		test.Equal(t, frameTypeResponse, frameType)
+		return string(data)
+	}
+
+	resp := pub("PUB", "k1")
+	test.Equal(t, "OK ", resp[:3])
+	id := resp[3:]
+	test.Equal(t, "DUPLICATE "+id, pub("PUB", "k1"))
+
+	resp = pub("MPUB", "k2")
+	test.Equal(t, "OK ", resp[:3])
+	test.Equal(t, "DUPLICATE "+resp[3:], pub("MPUB", "k2"))
+
+	topic := nsqd.GetTopic(topicName)
+	test.Equal(t, int64(3), topic.Depth())
+	stats := nsqd.GetStats(topicName, "", false)
+	test.Equal(t, uint64(2), stats[0].DedupCount)
+	test.Equal(t, 2, stats[0].DedupKeys)
+
+	// disabling the window publishes every time
+	topic.SetDedupWindow(0)
+	test.Equal(t, "OK ", pub("PUB", "k1")[:3])
+	test.Equal(t, int64(4), topic.Depth())
+}
+
+func TestPartitionedDelivery(t *testing.T) {
+	opts := NewOptions()
+	opts.Logger = test.NewTestLogger(t)
+	opts.LogLevel = LOG_DEBUG
+	tcpAddr, _, nsqd := mustStartNSQD(opts)
+	defer os.RemoveAll(opts.DataPath)
+	defer nsqd.Exit()
+
+	topicName := "test_partitioned_delivery" + strconv.Itoa(int(time.Now().Unix()))
+	err := nsqd.GetTopic(topicName).SetPartitions(4)
+	test.Nil(t, err)
+
+	conn, err := mustConnectNSQD(tcpAddr)
+	test.Nil(t, err)
+	defer conn.Close()
+
+	identify(t, conn, nil, frameTypeResponse)
+	sub(t, conn, topicName, "ch")
+
+	for i := 0; i < 3; i++ {
+		cmd := &nsq.Command{
+			Name:   []byte("PUB"),
+			Params: [][]byte{[]byte(topicName), []byte("partition_key=user-1")},
+			Body:   []byte(strconv.Itoa(i)),
+		}
+		_, err = cmd.WriteTo(conn)
+		test.Nil(t, err)
+		readValidate(t, conn, frameTypeResponse, "OK")
+	}
+
+	_, err = nsq.Ready(10).WriteTo(conn)
+	test.Nil(t, err)
+
+	for i := 0; i < 3; i++ {
+		resp, err := nsq.ReadResponse(conn)
+		test.Nil(t, err)
+		frameType, data, err := nsq.UnpackResponse(resp)
+		test.Nil(t, err)
+		test.Equal(t, frameTypeMessage, frameType)
+		msgOut, err := decodeMessage(data)
+		test.Nil(t, err)
+		test.Equal(t, []byte(strconv.Itoa(i)), msgOut.Body)
+
+		// the next message of the partition is only sent once this one
+		// is finished
+		conn.SetReadDeadline(time.Now().Add(50 * time.Millisecond))
+		_, err = nsq.ReadResponse(conn)
+		test.NotNil(t, err)
+		conn.SetReadDeadline(time.Time{})
+
+		_, err = nsq.Finish(nsq.MessageID(msgOut.ID)).WriteTo(conn)
+		test.Nil(t, err)
+	}
+}
+
+func TestPubDeliverAt(t *testing.T) {
+	opts := NewOptions()
+	opts.Logger = test.NewTestLogger(t)
+	opts.LogLevel = LOG_DEBUG
+	opts.MaxScheduleAhead = 24 * time.Hour
+	tcpAddr, _, nsqd := mustStartNSQD(opts)
+	defer os.RemoveAll(opts.DataPath)
+	defer nsqd.Exit()
+
+	topicName := "test_pub_deliver_at" + strconv.Itoa(int(time.Now().Unix()))
+
+	conn, err := mustConnectNSQD(tcpAddr)
+	test.Nil(t, err)
+	defer conn.Close()
+
+	identify(t, conn, nil, frameTypeResponse)
+
+	deliverAt := time.Now().Add(time.Hour).UnixNano() / int64(time.Millisecond)
+	cmd := &nsq.Command{
+		Name:   []byte("PUB"),
+		Params: [][]byte{[]byte(topicName), []byte(fmt.Sprintf("deliver_at=%d", deliverAt))},
+		Body:   []byte("test body"),
+	}
+	_, err = cmd.WriteTo(conn)
+	test.Nil(t, err)
+	readValidate(t, conn, frameTypeResponse, "OK")
+	test.Equal(t, int64(1), nsqd.GetTopic(topicName).ScheduledCount())
+
+	deliverAt = time.Now().Add(48*time.Hour).UnixNano() / int64(time.Millisecond)
+	cmd.Params[1] = []byte(fmt.Sprintf("deliver_at=%d", deliverAt))
+	_, err = cmd.WriteTo(conn)
+	test.Nil(t, err)
+	resp, err := nsq.ReadResponse(conn)
+	test.Nil(t, err)
+	frameType, data, _ := nsq.UnpackResponse(resp)
+	test.Equal(t, frameTypeError, frameType)
+	test.Equal(t, "E_INVALID PUB invalid deliver_at (more than 24h0m0s ahead)", string(data))
+}
+
+func TestMaxDeliveryRate(t *testing.T) {
+	opts := NewOptions()
+	opts.Logger = test.NewTestLogger(t)
+	tcpAddr, _, nsqd := mustStartNSQD(opts)
+	defer os.RemoveAll(opts.DataPath)
+	defer nsqd.Exit()
+
+	topicName := "test_max_delivery_rate" + strconv.Itoa(int(time.Now().Unix()))
+	topic := nsqd.GetTopic(topicName)
+	channel := topic.GetChannel("ch")
+	channel.SetMaxDeliveryRate(5)
+	for i := 0; i < 10; i++ {
+		topic.PutMessage(NewMessage(topic.GenerateID(), []byte("test body")))
+	}
+
+	conn, err := mustConnectNSQD(tcpAddr)
+	test.Nil(t, err)
+	defer conn.Close()
+	identify(t, conn, nil, frameTypeResponse)
+	sub(t, conn, topicName, "ch")
+
+	start := time.Now()
+	_, err = nsq.Ready(10).WriteTo(conn)
+	test.Nil(t, err)
+	for i := 0; i < 10; i++ {
+		resp, err := nsq.ReadResponse(conn)
+		test.Nil(t, err)
+		frameType, _, err := nsq.UnpackResponse(resp)
+		test.Nil(t, err)
+		test.Equal(t, frameTypeMessage, frameType)
+	}
+	// a second's worth of burst, then 5 more at 5/s
+	elapsed := time.Since(start)
+	test.Equal(t, true, elapsed >= 800*time.Millisecond)
+
+	stats := nsqd.GetStats(topicName, "ch", false)
+	test.Equal(t, int64(5), stats[0].Channels[0].MaxDeliveryRate)
+}
+
+func TestSubFilter(t *testing.T) {
+	opts := NewOptions()
+	opts.Logger = test.NewTestLogger(t)
+	tcpAddr, _, nsqd := mustStartNSQD(opts)
+	defer os.RemoveAll(opts.DataPath)
+	defer nsqd.Exit()
+
+	topicName := "test_sub_filter" + strconv.Itoa(int(time.Now().Unix()))
+	subFilter := func(channelName string, filter string) (int32, []byte) {
+		conn, err := mustConnectNSQD(tcpAddr)
+		test.Nil(t, err)
+		defer conn.Close()
+		identify(t, conn, nil, frameTypeResponse)
+		cmd := &nsq.Command{
+			Name:   []byte("SUB"),
+			Params: [][]byte{[]byte(topicName), []byte(channelName), []byte(filter)},
+		}
+		_, err = cmd.WriteTo(conn)
+		test.Nil(t, err)
+		resp, err := nsq.ReadResponse(conn)
+		test.Nil(t, err)
+		frameType, data, err := nsq.UnpackResponse(resp)
+		test.Nil(t, err)
+		return frameType, data
+	}
+
+	// the SUB that creates the channel sets its filter
+	frameType, _ := subFilter("orders", "prefix:order")
+	test.Equal(t, frameTypeResponse, frameType)
+	channel, err := nsqd.GetTopic(topicName).GetExistingChannel("orders")
+	test.Nil(t, err)
+	test.Equal(t, "prefix:order", channel.Filter())
+	frameType, _ = subFilter("orders", "prefix:order")
+	test.Equal(t, frameTypeResponse, frameType)
+	frameType, data := subFilter("orders", "prefix:refund")
+	test.Equal(t, frameTypeError, frameType)
+	test.Equal(t, true, bytes.HasPrefix(data, []byte("E_BAD_FILTER")))
+
+	// an existing channel without a filter keeps getting every message
+	nsqd.GetTopic(topicName).GetChannel("all")
+	frameType, data = subFilter("all", "prefix:order")
+	test.Equal(t, frameTypeError, frameType)
+	test.Equal(t, true, bytes.HasPrefix(data, []byte("E_BAD_FILTER")))
+	channel, err = nsqd.GetTopic(topicName).GetExistingChannel("all")
+	test.Nil(t, err)
+	test.Equal(t, "", channel.Filter())
+}
+
+func TestMaxDeliveryRateConcurrentConsumers(t *testing.T) {
+	opts := NewOptions()
+	opts.Logger = test.NewTestLogger(t)
+	tcpAddr, _, nsqd := mustStartNSQD(opts)
+	defer os.RemoveAll(opts.DataPath)
+	defer nsqd.Exit()
+
+	topicName := "test_max_delivery_rate_concurrent" + strconv.Itoa(int(time.Now().Unix()))
+	topic := nsqd.GetTopic(topicName)
+	channel := topic.GetChannel("ch")
+	channel.SetMaxDeliveryRate(5)
+	for i := 0; i < 50; i++ {
+		topic.PutMessage(NewMessage(topic.GenerateID(), []byte("test body")))
+	}
+
+	var conns []net.Conn
+	for i := 0; i < 4; i++ {
+		conn, err := mustConnectNSQD(tcpAddr)
+		test.Nil(t, err)
+		defer conn.Close()
+		identify(t, conn, nil, frameTypeResponse)
+		sub(t, conn, topicName, "ch")
+		conns = append(conns, conn)
+	}
+
+	// however many clients are ready, no more than a second's worth of
+	// burst plus the rate is delivered over a second
+	var received int32
+	var wg sync.WaitGroup
+	deadline := time.Now().Add(time.Second)
+	for _, conn := range conns {
+		_, err := nsq.Ready(50).WriteTo(conn)
+		test.Nil(t, err)
+		wg.Add(1)
+		go func(conn net.Conn) {
+			defer wg.Done()
+			conn.SetReadDeadline(deadline)
+			for {
+				resp, err := nsq.ReadResponse(conn)
+				if err != nil {
+					return
+				}
+				frameType, _, _ := nsq.UnpackResponse(resp)
+				if frameType == frameTypeMessage {
+					atomic.AddInt32(&received, 1)
+				}
+			}
+		}(conn)
+	}
+	wg.Wait()
+	n := atomic.LoadInt32(&received)
+	t.Logf("received %d messages", n)
+	test.Equal(t, true, n >= 5 && n <= 10)
+}
@@ -0,0 +1,144 @@
+package nsqd
+
+import (
+	"bytes"
+	"fmt"
+	"math"
+	"net/url"
+	"strconv"
+	"time"
+)
+
+// pubOptions are the optional per-message attributes a producer can set
+//
+// over TCP they're trailing <name>=<value> params of the publish commands:
+//
+//	PUB <topic_name> [<name>=<value> ...]
+//	DPUB <topic_name> <defer_time> [<name>=<value> ...]
+//
+// over HTTP they're query params of /pub and /mpub with the same names
+type pubOptions struct {
+	priority uint8
+
+	// identifies the publish for de-duplication, see Topic.PutMessagesKeyed
+	idempotencyKey string
+
+	partitionKey string
+
+	// how long after being published the message expires, 0 if it doesn't
+	// (or rather, if the channel default applies)
+	ttl time.Duration
+
+	// nanosecond timestamp the message is to be delivered at, 0 if it's
+	// delivered right away (see scheduleStore)
+	deliverAt int64
+}
+
+// pubOptionNames lists every option understood by pubOptions.set
+var pubOptionNames = []string{"priority", "idempotency_key", "partition_key", "ttl", "deliver_at"}
+
+func (o *pubOptions) set(name string, value string) error {
+	switch name {
+	case "priority":
+		n, err := strconv.ParseUint(value, 10, 8)
+		if err != nil || n > MaxMsgPriority {
+			return fmt.Errorf("invalid priority %q (expected 0-%d)", value, MaxMsgPriority)
+		}
+		o.priority = uint8(n)
+	case "idempotency_key":
+		if value == "" || len(value) > maxIdempotencyKeyLength {
+			return fmt.Errorf("invalid idempotency_key (expected 1-%d bytes)", maxIdempotencyKeyLength)
+		}
+		o.idempotencyKey = value
+	case "partition_key":
+		if value == "" || len(value) > maxPartitionKeyLength {
+			return fmt.Errorf("invalid partition_key (expected 1-%d bytes)", maxPartitionKeyLength)
+		}
+		o.partitionKey = value
+	case "ttl":
+		// milliseconds, like the defer time of DPUB
+		n, err := strconv.ParseInt(value, 10, 64)
+		if err != nil || n <= 0 || n > int64(math.MaxInt64/time.Millisecond) {
+			return fmt.Errorf("invalid ttl %q (expected a positive number of milliseconds)", value)
+		}
+		o.ttl = time.Duration(n) * time.Millisecond
+	case "deliver_at":
+		// a unix timestamp in milliseconds
+		n, err := strconv.ParseInt(value, 10, 64)
+		if err != nil || n <= 0 || n > int64(math.MaxInt64/time.Millisecond) {
+			return fmt.Errorf("invalid deliver_at %q (expected a unix timestamp in milliseconds)", value)
+		}
+		o.deliverAt = n * int64(time.Millisecond)
+	default:
+		return fmt.Errorf("unknown option %q", name)
+	}
+	return nil
+}
+
+// checkDeliverAt returns an error if the message is scheduled more than
+// maxAhead from now (see --max-schedule-ahead)
+func (o *pubOptions) checkDeliverAt(maxAhead time.Duration) error {
+	if o.deliverAt-time.Now().UnixNano() > int64(maxAhead) {
+		return fmt.Errorf("invalid deliver_at (more than %s ahead)", maxAhead)
+	}
+	return nil
+}
+
+// apply sets the options on a message about to be published
+//
+// a deliver_at in the past delivers the message right away, and the ttl
+// of a scheduled message runs from when it's due
+func (o *pubOptions) apply(msg *Message) {
+	msg.Priority = o.priority
+	msg.PartitionKey = o.partitionKey
+	start := msg.Timestamp
+	if o.deliverAt > msg.Timestamp {
+		msg.deliverAt = o.deliverAt
+		start = o.deliverAt
+	}
+	if o.ttl > 0 {
+		msg.Expires = start + int64(o.ttl)
+	}
+}
+
+// parsePubOptions parses trailing <name>=<value> command params, maxAhead
+// bounds deliver_at
+func parsePubOptions(params [][]byte, maxAhead time.Duration) (*pubOptions, error) {
+	o := &pubOptions{}
+	for _, param := range params {
+		idx := bytes.IndexByte(param, '=')
+		if idx < 1 {
+			return nil, fmt.Errorf("invalid option %q (expected <name>=<value>)", param)
+		}
+		err := o.set(string(param[:idx]), string(param[idx+1:]))
+		if err != nil {
+			return nil, err
+		}
+	}
+	err := o.checkDeliverAt(maxAhead)
+	if err != nil {
+		return nil, err
+	}
+	return o, nil
+}
+
+// pubOptionsFromQuery parses the options set in the query params of an
+// HTTP publish request, returning the name of the first invalid one
+func pubOptionsFromQuery(reqParams url.Values, maxAhead time.Duration) (*pubOptions, string, error) {
+	o := &pubOptions{}
+	for _, name := range pubOptionNames {
+		vals, ok := reqParams[name]
+		if !ok {
+			continue
+		}
+		err := o.set(name, vals[0])
+		if err != nil {
+			return nil, name, err
+		}
+	}
+	err := o.checkDeliverAt(maxAhead)
+	if err != nil {
+		return nil, "deliver_at", err
+	}
+	return o, "", nil
+}
@@ -0,0 +1,387 @@
+package nsqd
+
+import (
+	"container/heap"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"math/rand"
+	"os"
+	"sync/atomic"
+)
+
+// the states a message deleted or requeued by ID was found in
+const (
+	msgStateInFlight = "in_flight"
+	msgStateDeferred = "deferred"
+	msgStateQueued   = "queued"
+)
+
+var (
+	errMessageNotFound = errors.New("message not found")
+	errTooManyPurged   = errors.New("too many deleted messages queued")
+)
+
+// DeleteMessage deletes the message id from the channel, wherever it is,
+// returning the state it was found in (or errMessageNotFound)
+//
+// an in-flight message is taken away from its client (which fails to FIN
+// it) and a queued one is removed from memory right away, but it can only
+// be skipped once it comes up in the backend (and no more than
+// --max-purged-msgs can be waiting for that, see errTooManyPurged)
+func (c *Channel) DeleteMessage(id MessageID) (string, error) {
+	if c.deleteInFlight(id) {
+		return msgStateInFlight, nil
+	}
+	if c.deleteDeferred(id) {
+		return msgStateDeferred, nil
+	}
+	n, err := c.purgeQueued(func(msg *Message) bool { return msg.ID == id }, 1)
+	if err != nil {
+		return "", err
+	}
+	if n == 0 {
+		return "", errMessageNotFound
+	}
+	// it might have been delivered while it was looked up
+	if c.deleteInFlight(id) || c.deleteDeferred(id) {
+		c.unpurge(id)
+	}
+	return msgStateQueued, nil
+}
+
+// ForceRequeueMessage requeues the message id right away if it's in flight
+// (taking it away from its client) or deferred, returning the state it
+// was found in (or errMessageNotFound), a queued message is left as is
+func (c *Channel) ForceRequeueMessage(id MessageID) (string, error) {
+	c.exitMutex.RLock()
+	if c.Exiting() {
+		c.exitMutex.RUnlock()
+		return "", errors.New("exiting")
+	}
+	state := msgStateInFlight
+	msg := c.takeInFlight(id)
+	if msg != nil {
+		atomic.AddUint64(&c.requeueCount, 1)
+	} else {
+		state = msgStateDeferred
+		msg = c.takeDeferred(id)
+	}
+	var err error
+	if msg != nil {
+		err = c.put(msg)
+		if err == nil {
+			c.journalClear(id)
+		}
+	}
+	c.exitMutex.RUnlock()
+	if msg != nil {
+		return state, err
+	}
+
+	ok, err := c.isQueued(id)
+	if err != nil {
+		return "", err
+	}
+	if !ok {
+		return "", errMessageNotFound
+	}
+	return msgStateQueued, nil
+}
+
+// PurgeMessages deletes the messages matching f from the channel, wherever
+// they are (see DeleteMessage), returning how many there were
+func (c *Channel) PurgeMessages(f *msgFilter) (int, error) {
+	var ids []MessageID
+	c.inFlightMutex.Lock()
+	for id, msg := range c.inFlightMessages {
+		if f.Match(msg) {
+			ids = append(ids, id)
+		}
+	}
+	c.inFlightMutex.Unlock()
+	c.deferredMutex.Lock()
+	for id, item := range c.deferredMessages {
+		if f.Match(item.Value.(*Message)) {
+			ids = append(ids, id)
+		}
+	}
+	c.deferredMutex.Unlock()
+
+	var count int
+	for _, id := range ids {
+		if c.deleteInFlight(id) || c.deleteDeferred(id) {
+			count++
+		}
+	}
+	n, err := c.purgeQueued(f.Match, 0)
+	return count + n, err
+}
+
+// takeInFlight removes the message id from the in-flight messages,
+// whichever client it was sent to, returning it (nil if it's not there)
+func (c *Channel) takeInFlight(id MessageID) *Message {
+	c.inFlightMutex.Lock()
+	msg, ok := c.inFlightMessages[id]
+	if ok {
+		delete(c.inFlightMessages, id)
+	}
+	c.inFlightMutex.Unlock()
+	if !ok {
+		return nil
+	}
+	c.removeFromInFlightPQ(msg)
+
+	c.RLock()
+	client, ok := c.clients[msg.clientID]
+	c.RUnlock()
+	if ok {
+		client.TimedOutMessage()
+	}
+	return msg
+}
+
+// takeDeferred removes the message id from the deferred messages,
+// returning it (nil if it's not there)
+func (c *Channel) takeDeferred(id MessageID) *Message {
+	item, err := c.popDeferredMessage(id)
+	if err != nil {
+		return nil
+	}
+	c.deferredMutex.Lock()
+	if item.Index != -1 {
+		heap.Remove(&c.deferredPQ, item.Index)
+	}
+	c.deferredMutex.Unlock()
+	return item.Value.(*Message)
+}
+
+func (c *Channel) deleteInFlight(id MessageID) bool {
+	msg := c.takeInFlight(id)
+	if msg == nil {
+		return false
+	}
+	c.releasePartition(msg)
+	c.journalClear(id)
+	return true
+}
+
+func (c *Channel) deleteDeferred(id MessageID) bool {
+	msg := c.takeDeferred(id)
+	if msg == nil {
+		return false
+	}
+	c.releasePartition(msg)
+	c.journalClear(id)
+	return true
+}
+
+// purgeQueued deletes (up to limit, 0 for all) queued messages match
+// returns true for, returning how many
+//
+// those in memory are dropped, those in the backend (or the partitions)
+// are marked purged, failing with errTooManyPurged (having purged count)
+// once there are --max-purged-msgs of them
+func (c *Channel) purgeQueued(match func(msg *Message) bool, limit int) (int, error) {
+	c.exitMutex.RLock()
+	defer c.exitMutex.RUnlock()
+	if c.Exiting() {
+		return 0, errors.New("exiting")
+	}
+
+	var count int
+	done := func() bool { return limit > 0 && count >= limit }
+	if c.partitions != nil {
+		for _, msg := range c.partitions.messages() {
+			if done() {
+				break
+			}
+			if !c.isPurged(msg.ID) && match(msg) {
+				if !c.purge(msg.ID) {
+					return count, errTooManyPurged
+				}
+				count++
+			}
+		}
+	} else {
+		c.filterMemory(func(msg *Message) bool {
+			if done() || !match(msg) {
+				return true
+			}
+			count++
+			return false
+		})
+	}
+	if done() {
+		return count, nil
+	}
+
+	var err error
+	scanErr := c.scanBackend(func(msg *Message) bool {
+		if match(msg) {
+			if !c.purge(msg.ID) {
+				err = errTooManyPurged
+				return false
+			}
+			count++
+		}
+		return !done()
+	})
+	if scanErr != nil {
+		return count, scanErr
+	}
+	return count, err
+}
+
+// isQueued returns whether the message id is queued (and not purged)
+func (c *Channel) isQueued(id MessageID) (bool, error) {
+	c.exitMutex.RLock()
+	defer c.exitMutex.RUnlock()
+	if c.Exiting() {
+		return false, errors.New("exiting")
+	}
+
+	found := false
+	if c.partitions != nil {
+		for _, msg := range c.partitions.messages() {
+			if msg.ID == id {
+				return !c.isPurged(id), nil
+			}
+		}
+	} else {
+		c.filterMemory(func(msg *Message) bool {
+			found = found || msg.ID == id
+			return true
+		})
+	}
+	if found {
+		return true, nil
+	}
+	err := c.scanBackend(func(msg *Message) bool {
+		found = msg.ID == id
+		return !found
+	})
+	return found, err
+}
+
+// purge marks the message id deleted, returning false if there are
+// already --max-purged-msgs marked
+func (c *Channel) purge(id MessageID) bool {
+	c.purgeMutex.Lock()
+	defer c.purgeMutex.Unlock()
+	if _, ok := c.purged[id]; ok {
+		return true
+	}
+	if int64(len(c.purged)) >= c.ctx.nsqd.getOpts().MaxPurgedMsgs {
+		return false
+	}
+	if c.purged == nil {
+		c.purged = make(map[MessageID]struct{})
+	}
+	c.purged[id] = struct{}{}
+	atomic.AddInt32(&c.purgedCount, 1)
+	return true
+}
+
+func (c *Channel) unpurge(id MessageID) bool {
+	c.purgeMutex.Lock()
+	defer c.purgeMutex.Unlock()
+	if _, ok := c.purged[id]; !ok {
+		return false
+	}
+	delete(c.purged, id)
+	atomic.AddInt32(&c.purgedCount, -1)
+	return true
+}
+
+func (c *Channel) isPurged(id MessageID) bool {
+	if atomic.LoadInt32(&c.purgedCount) == 0 {
+		return false
+	}
+	c.purgeMutex.Lock()
+	_, ok := c.purged[id]
+	c.purgeMutex.Unlock()
+	return ok
+}
+
+// dropPurged discards msg, about to be delivered, if it was deleted while
+// it was queued
+func (c *Channel) dropPurged(msg *Message) bool {
+	if atomic.LoadInt32(&c.purgedCount) == 0 || !c.unpurge(msg.ID) {
+		return false
+	}
+	c.releasePartition(msg)
+	return true
+}
+
+// PurgedIDs returns the IDs of the deleted messages still queued
+func (c *Channel) PurgedIDs() []MessageID {
+	c.purgeMutex.Lock()
+	defer c.purgeMutex.Unlock()
+	ids := make([]MessageID, 0, len(c.purged))
+	for id := range c.purged {
+		ids = append(ids, id)
+	}
+	return ids
+}
+
+// persistPurged writes the IDs of the deleted messages still queued to
+// purgedFile (removing it if there are none), so that they are still
+// skipped after a restart
+//
+// the IDs dropped since are only written next time, a few more than
+// needed might be restored after a crash, which is harmless as they
+// don't come up again and are cleared with the channel once it's emptied
+func (c *Channel) persistPurged() error {
+	if c.purgedFile == "" {
+		return nil
+	}
+	ids := c.PurgedIDs()
+	if len(ids) == 0 {
+		err := os.Remove(c.purgedFile)
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+
+	data := make([]byte, 0, len(ids)*len(MessageID{}))
+	for _, id := range ids {
+		data = append(data, id[:]...)
+	}
+	tmpFileName := fmt.Sprintf("%s.%d.tmp", c.purgedFile, rand.Int())
+	err := writeSyncFile(tmpFileName, data)
+	if err != nil {
+		return err
+	}
+	return os.Rename(tmpFileName, c.purgedFile)
+}
+
+// loadPurged marks the messages in purgedFile deleted, see persistPurged
+func (c *Channel) loadPurged() error {
+	data, err := ioutil.ReadFile(c.purgedFile)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+	var id MessageID
+	for len(data) >= len(id) {
+		copy(id[:], data)
+		data = data[len(id):]
+		c.purge(id)
+	}
+	return nil
+}
+
+// clearPurged forgets the deleted messages, once the channel is emptied
+func (c *Channel) clearPurged() {
+	c.purgeMutex.Lock()
+	c.purged = nil
+	atomic.StoreInt32(&c.purgedCount, 0)
+	c.purgeMutex.Unlock()
+	if c.purgedFile != "" {
+		os.Remove(c.purgedFile)
+	}
+}
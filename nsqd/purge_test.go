@@ -0,0 +1,198 @@
+package nsqd
+
+import (
+	"io/ioutil"
+	"os"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/nsqio/nsq/internal/test"
+)
+
+func TestChannelDeleteMessage(t *testing.T) {
+	opts := NewOptions()
+	opts.Logger = test.NewTestLogger(t)
+	opts.MemQueueSize = 1
+	_, _, nsqd := mustStartNSQD(opts)
+	defer os.RemoveAll(opts.DataPath)
+	defer nsqd.Exit()
+
+	topicName := "test_channel_delete_message" + strconv.Itoa(int(time.Now().Unix()))
+	topic := nsqd.GetTopic(topicName)
+	channel := topic.GetChannel("ch")
+
+	var msgs []*Message
+	for i := 0; i < 5; i++ {
+		msg := NewMessage(topic.GenerateID(), []byte(strconv.Itoa(i)))
+		msgs = append(msgs, msg)
+	}
+	channel.StartInFlightTimeout(msgs[0], 0, time.Minute)
+	channel.StartDeferredTimeout(msgs[1], time.Minute)
+	for _, msg := range msgs[2:] {
+		err := channel.PutMessage(msg)
+		test.Nil(t, err)
+	}
+	test.Equal(t, int64(2), channel.backend.Depth())
+
+	state, err := channel.DeleteMessage(msgs[0].ID)
+	test.Nil(t, err)
+	test.Equal(t, msgStateInFlight, state)
+	test.Equal(t, 0, len(channel.inFlightMessages))
+	test.Equal(t, 0, len(channel.inFlightPQ))
+
+	state, err = channel.DeleteMessage(msgs[1].ID)
+	test.Nil(t, err)
+	test.Equal(t, msgStateDeferred, state)
+	test.Equal(t, 0, len(channel.deferredMessages))
+	test.Equal(t, 0, len(channel.deferredPQ))
+
+	// in memory
+	state, err = channel.DeleteMessage(msgs[2].ID)
+	test.Nil(t, err)
+	test.Equal(t, msgStateQueued, state)
+	test.Equal(t, int64(0), channel.memoryDepth())
+
+	// in the backend, skipped once it's read
+	state, err = channel.DeleteMessage(msgs[3].ID)
+	test.Nil(t, err)
+	test.Equal(t, msgStateQueued, state)
+	peeked, err := channel.Peek(10)
+	test.Nil(t, err)
+	test.Equal(t, 1, len(peeked))
+	test.Equal(t, msgs[4].ID, peeked[0].ID)
+	test.Equal(t, []MessageID{msgs[3].ID}, channel.PurgedIDs())
+
+	msg, err := decodeMessage(<-channel.backend.ReadChan())
+	test.Nil(t, err)
+	test.Equal(t, true, channel.dropPurged(msg))
+	test.Equal(t, 0, len(channel.PurgedIDs()))
+
+	_, err = channel.DeleteMessage(msgs[0].ID)
+	test.Equal(t, errMessageNotFound, err)
+}
+
+func TestChannelForceRequeueMessage(t *testing.T) {
+	opts := NewOptions()
+	opts.Logger = test.NewTestLogger(t)
+	_, _, nsqd := mustStartNSQD(opts)
+	defer os.RemoveAll(opts.DataPath)
+	defer nsqd.Exit()
+
+	topicName := "test_channel_requeue_message" + strconv.Itoa(int(time.Now().Unix()))
+	topic := nsqd.GetTopic(topicName)
+	channel := topic.GetChannel("ch")
+
+	inFlight := NewMessage(topic.GenerateID(), []byte("in flight"))
+	deferred := NewMessage(topic.GenerateID(), []byte("deferred"))
+	channel.StartInFlightTimeout(inFlight, 0, time.Minute)
+	channel.StartDeferredTimeout(deferred, time.Minute)
+
+	state, err := channel.ForceRequeueMessage(inFlight.ID)
+	test.Nil(t, err)
+	test.Equal(t, msgStateInFlight, state)
+	state, err = channel.ForceRequeueMessage(deferred.ID)
+	test.Nil(t, err)
+	test.Equal(t, msgStateDeferred, state)
+	test.Equal(t, 0, len(channel.inFlightMessages))
+	test.Equal(t, 0, len(channel.deferredMessages))
+	test.Equal(t, int64(2), channel.Depth())
+
+	state, err = channel.ForceRequeueMessage(inFlight.ID)
+	test.Nil(t, err)
+	test.Equal(t, msgStateQueued, state)
+
+	_, err = channel.ForceRequeueMessage(topic.GenerateID())
+	test.Equal(t, errMessageNotFound, err)
+}
+
+func TestChannelPurgeMessages(t *testing.T) {
+	opts := NewOptions()
+	opts.Logger = test.NewTestLogger(t)
+	opts.MemQueueSize = 2
+	_, _, nsqd := mustStartNSQD(opts)
+	defer os.RemoveAll(opts.DataPath)
+	defer nsqd.Exit()
+
+	topicName := "test_channel_purge" + strconv.Itoa(int(time.Now().Unix()))
+	topic := nsqd.GetTopic(topicName)
+	channel := topic.GetChannel("ch")
+
+	poison := NewMessage(topic.GenerateID(), []byte("poison"))
+	channel.StartInFlightTimeout(poison, 0, time.Minute)
+	for i := 0; i < 6; i++ {
+		body := "ok"
+		if i%2 == 0 {
+			body = "poison"
+		}
+		err := channel.PutMessage(NewMessage(topic.GenerateID(), []byte(body)))
+		test.Nil(t, err)
+	}
+
+	f, err := parseFilter("prefix:poison")
+	test.Nil(t, err)
+	count, err := channel.PurgeMessages(f)
+	test.Nil(t, err)
+	test.Equal(t, 4, count)
+	test.Equal(t, 0, len(channel.inFlightMessages))
+
+	peeked, err := channel.Peek(10)
+	test.Nil(t, err)
+	test.Equal(t, 3, len(peeked))
+	for _, msg := range peeked {
+		test.Equal(t, []byte("ok"), msg.Body)
+	}
+
+	channel.Empty()
+	test.Equal(t, 0, len(channel.PurgedIDs()))
+}
+
+func TestChannelPurgedBounded(t *testing.T) {
+	opts := NewOptions()
+	opts.Logger = test.NewTestLogger(t)
+	opts.MemQueueSize = 1
+	opts.MaxPurgedMsgs = 2
+	_, _, nsqd := mustStartNSQD(opts)
+	defer os.RemoveAll(opts.DataPath)
+
+	topicName := "test_channel_purged_bounded" + strconv.Itoa(int(time.Now().Unix()))
+	topic := nsqd.GetTopic(topicName)
+	channel := topic.GetChannel("ch")
+	for i := 0; i < 6; i++ {
+		err := channel.PutMessage(NewMessage(topic.GenerateID(), []byte("poison")))
+		test.Nil(t, err)
+	}
+
+	// the one in memory is dropped, only 2 of those in the backend are
+	// marked
+	f, err := parseFilter("prefix:poison")
+	test.Nil(t, err)
+	count, err := channel.PurgeMessages(f)
+	test.Equal(t, errTooManyPurged, err)
+	test.Equal(t, 3, count)
+	purged := channel.PurgedIDs()
+	test.Equal(t, 2, len(purged))
+
+	// they are still skipped after a restart, and not in the metadata
+	nsqd.Exit()
+	metadata, err := ioutil.ReadFile(newMetadataFile(opts))
+	test.Nil(t, err)
+	test.Equal(t, false, strings.Contains(string(metadata), `"purged"`))
+
+	origDataPath := opts.DataPath
+	opts = NewOptions()
+	opts.Logger = test.NewTestLogger(t)
+	opts.DataPath = origDataPath
+	_, _, nsqd = mustStartNSQD(opts)
+	defer nsqd.Exit()
+
+	channel = nsqd.GetTopic(topicName).GetChannel("ch")
+	for _, id := range purged {
+		test.Equal(t, true, channel.isPurged(id))
+	}
+
+	channel.Empty()
+	_, err = os.Stat(channel.purgedFile)
+	test.Equal(t, true, os.IsNotExist(err))
+}
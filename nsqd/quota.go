@@ -0,0 +1,126 @@
+package nsqd
+
+import (
+	"errors"
+	"fmt"
+	"time"
+)
+
+// the overflow policies of a backlog quota, i.e. what happens to messages
+// published to a topic (or channel) whose backlog is full
+const (
+	// publishes are rejected (E_BACKLOG_FULL / 507 BACKLOG_FULL)
+	overflowReject = "reject"
+	// queued messages are discarded to make room, those on disk first
+	overflowDropOldest = "drop_oldest"
+	// the published messages are discarded
+	overflowDropNew = "drop_new"
+)
+
+// backlogAlertRatio is how close to its quota a backlog gets before it's
+// flagged in the stats (see backlogQuota.alert)
+const backlogAlertRatio = 0.9
+
+// dropQueuedTimeout bounds how long dropQueued waits for a message from
+// a backend that reports a non-zero depth (see BackendQueue.ReadChan)
+const dropQueuedTimeout = 10 * time.Millisecond
+
+// backlogQuota bounds the backlog of a topic or channel in messages (its
+// depth) and/or in bytes on disk (see sizedBackendQueue), 0 is unlimited
+type backlogQuota struct {
+	maxMsgs  int64
+	maxBytes int64
+	policy   string
+}
+
+// newBacklogQuota validates the given quota, the policy defaults to reject
+//
+// it returns nil if both limits are 0
+func newBacklogQuota(maxMsgs int64, maxBytes int64, policy string) (*backlogQuota, error) {
+	if maxMsgs < 0 || maxBytes < 0 {
+		return nil, errors.New("backlog limits must not be negative")
+	}
+	switch policy {
+	case "":
+		policy = overflowReject
+	case overflowReject, overflowDropOldest, overflowDropNew:
+	default:
+		return nil, fmt.Errorf("invalid overflow policy %q", policy)
+	}
+	if maxMsgs == 0 && maxBytes == 0 {
+		return nil, nil
+	}
+	return &backlogQuota{maxMsgs, maxBytes, policy}, nil
+}
+
+// full returns whether a backlog of depth messages and bytes on disk is at
+// (or over) the quota
+func (q *backlogQuota) full(depth int64, bytes int64) bool {
+	if q == nil {
+		return false
+	}
+	return (q.maxMsgs > 0 && depth >= q.maxMsgs) || (q.maxBytes > 0 && bytes >= q.maxBytes)
+}
+
+// rejects returns whether a publish of n messages is to be rejected, a
+// batch is only let through if all of it fits in the message limit
+func (q *backlogQuota) rejects(depth int64, bytes int64, n int) bool {
+	if q == nil || q.policy != overflowReject {
+		return false
+	}
+	return q.full(depth+int64(n)-1, bytes)
+}
+
+// alert returns whether a backlog is within backlogAlertRatio of the quota
+func (q *backlogQuota) alert(depth int64, bytes int64) bool {
+	if q == nil {
+		return false
+	}
+	return (q.maxMsgs > 0 && float64(depth) >= backlogAlertRatio*float64(q.maxMsgs)) ||
+		(q.maxBytes > 0 && float64(bytes) >= backlogAlertRatio*float64(q.maxBytes))
+}
+
+// values returns the limits and policy of the quota, zeros and "" for nil
+func (q *backlogQuota) values() (int64, int64, string) {
+	if q == nil {
+		return 0, 0, ""
+	}
+	return q.maxMsgs, q.maxBytes, q.policy
+}
+
+// errBacklogFull is returned when a publish is rejected by the backlog quota
+// of the topic or one of its channels
+type errBacklogFull struct {
+	name string
+}
+
+func (e errBacklogFull) Error() string {
+	return fmt.Sprintf("%s backlog is full", e.name)
+}
+
+// dropQueued discards the next message queued in backend or, failing that,
+// in the first non-empty msgChans, it returns false if there was none
+//
+// the backend goes first as it's what the quota bytes are counted against
+// and, the memory queues spilling into it, it's there that the oldest
+// messages pile up
+func dropQueued(backend BackendQueue, msgChans ...chan *Message) bool {
+	if backend.Depth() > 0 {
+		timer := time.NewTimer(dropQueuedTimeout)
+		select {
+		case b := <-backend.ReadChan():
+			timer.Stop()
+			backendRead(backend, b)
+			return true
+		case <-timer.C:
+		}
+	}
+	for _, msgChan := range msgChans {
+		select {
+		case <-msgChan:
+			return true
+		default:
+		}
+	}
+	return false
+}
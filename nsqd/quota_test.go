@@ -0,0 +1,147 @@
+package nsqd
+
+import (
+	"os"
+	"strconv"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/nsqio/nsq/internal/test"
+)
+
+func TestBacklogQuota(t *testing.T) {
+	q, err := newBacklogQuota(0, 0, "")
+	test.Nil(t, err)
+	test.Equal(t, true, q == nil)
+	test.Equal(t, false, q.full(100, 100))
+
+	_, err = newBacklogQuota(-1, 0, "")
+	test.NotNil(t, err)
+	_, err = newBacklogQuota(1, 0, "drop_everything")
+	test.NotNil(t, err)
+
+	q, err = newBacklogQuota(10, 100, "")
+	test.Nil(t, err)
+	test.Equal(t, overflowReject, q.policy)
+
+	test.Equal(t, false, q.full(9, 99))
+	test.Equal(t, true, q.full(10, 0))
+	test.Equal(t, true, q.full(0, 100))
+
+	test.Equal(t, false, q.rejects(8, 0, 2))
+	test.Equal(t, true, q.rejects(9, 0, 2))
+
+	test.Equal(t, false, q.alert(8, 89))
+	test.Equal(t, true, q.alert(9, 0))
+	test.Equal(t, true, q.alert(0, 90))
+
+	q, _ = newBacklogQuota(10, 0, overflowDropNew)
+	test.Equal(t, false, q.rejects(10, 0, 1))
+}
+
+func TestTopicBacklogQuota(t *testing.T) {
+	opts := NewOptions()
+	opts.Logger = test.NewTestLogger(t)
+	opts.MemQueueSize = 2
+	_, _, nsqd := mustStartNSQD(opts)
+	defer os.RemoveAll(opts.DataPath)
+	defer nsqd.Exit()
+
+	// without channels the messages stay in the topic
+	topicName := "test_topic_backlog_quota" + strconv.Itoa(int(time.Now().Unix()))
+	topic := nsqd.GetTopic(topicName)
+	body := []byte("test body")
+
+	err := topic.SetBacklogQuota(5, 0, "")
+	test.Nil(t, err)
+	for i := 0; i < 4; i++ {
+		err = topic.PutMessage(NewMessage(topic.GenerateID(), body))
+		test.Nil(t, err)
+	}
+	err = topic.PutMessages([]*Message{
+		NewMessage(topic.GenerateID(), body),
+		NewMessage(topic.GenerateID(), body),
+	})
+	test.Equal(t, errBacklogFull{"topic " + topicName}, err)
+	err = topic.PutMessage(NewMessage(topic.GenerateID(), body))
+	test.Nil(t, err)
+	err = topic.PutMessage(NewMessage(topic.GenerateID(), body))
+	test.Equal(t, errBacklogFull{"topic " + topicName}, err)
+	test.Equal(t, int64(5), topic.Depth())
+	test.Equal(t, uint64(3), atomic.LoadUint64(&topic.overflowRejected))
+	test.Equal(t, true, topic.BacklogBytes() > 0)
+
+	err = topic.SetBacklogQuota(5, 0, overflowDropNew)
+	test.Nil(t, err)
+	err = topic.PutMessage(NewMessage(topic.GenerateID(), body))
+	test.Nil(t, err)
+	test.Equal(t, int64(5), topic.Depth())
+	test.Equal(t, uint64(1), atomic.LoadUint64(&topic.overflowDropped))
+
+	err = topic.SetBacklogQuota(4, 0, overflowDropOldest)
+	test.Nil(t, err)
+	err = topic.PutMessage(NewMessage(topic.GenerateID(), body))
+	test.Nil(t, err)
+	test.Equal(t, int64(4), topic.Depth())
+	test.Equal(t, uint64(3), atomic.LoadUint64(&topic.overflowDropped))
+
+	stats := NewTopicStats(topic, nil)
+	test.Equal(t, int64(4), stats.MaxBacklogMsgs)
+	test.Equal(t, overflowDropOldest, stats.OverflowPolicy)
+	test.Equal(t, true, stats.BacklogAlert)
+	test.Equal(t, topic.BacklogBytes(), stats.BacklogBytes)
+
+	// the bytes on disk are accounted for, also when starting off an
+	// existing diskqueue
+	err = topic.SetBacklogQuota(0, topic.BacklogBytes(), "")
+	test.Nil(t, err)
+	err = topic.PutMessage(NewMessage(topic.GenerateID(), body))
+	test.Equal(t, errBacklogFull{"topic " + topicName}, err)
+
+	topic.Close()
+	test.Equal(t, topic.BacklogBytes(), diskQueueSize(opts.DataPath, topicName))
+}
+
+func TestChannelBacklogQuota(t *testing.T) {
+	opts := NewOptions()
+	opts.Logger = test.NewTestLogger(t)
+	opts.MemQueueSize = 2
+	_, _, nsqd := mustStartNSQD(opts)
+	defer os.RemoveAll(opts.DataPath)
+	defer nsqd.Exit()
+
+	topicName := "test_channel_backlog_quota" + strconv.Itoa(int(time.Now().Unix()))
+	topic := nsqd.GetTopic(topicName)
+	channel := topic.GetChannel("ch")
+	other := topic.GetChannel("other")
+	body := []byte("test body")
+
+	err := channel.SetBacklogQuota(3, 0, overflowDropNew)
+	test.Nil(t, err)
+	for i := 0; i < 5; i++ {
+		err = topic.PutMessage(NewMessage(topic.GenerateID(), body))
+		test.Nil(t, err)
+	}
+	for i := 0; i < 100 && other.Depth() < 5; i++ {
+		time.Sleep(5 * time.Millisecond)
+	}
+	test.Equal(t, int64(5), other.Depth())
+	test.Equal(t, int64(3), channel.Depth())
+	test.Equal(t, uint64(2), atomic.LoadUint64(&channel.overflowDropped))
+
+	// a channel rejecting publishes holds up the whole topic
+	err = channel.SetBacklogQuota(3, 0, overflowReject)
+	test.Nil(t, err)
+	err = topic.PutMessage(NewMessage(topic.GenerateID(), body))
+	test.Equal(t, errBacklogFull{"channel ch"}, err)
+	test.Equal(t, uint64(1), atomic.LoadUint64(&channel.overflowRejected))
+	test.Equal(t, int64(5), other.Depth())
+
+	stats := NewChannelStats(channel, nil, 0)
+	test.Equal(t, int64(3), stats.MaxBacklogMsgs)
+	test.Equal(t, overflowReject, stats.OverflowPolicy)
+	test.Equal(t, uint64(2), stats.OverflowDroppedCount)
+	test.Equal(t, uint64(1), stats.OverflowRejectedCount)
+	test.Equal(t, true, stats.BacklogAlert)
+}
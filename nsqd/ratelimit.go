@@ -0,0 +1,237 @@
+package nsqd
+
+import (
+	"fmt"
+	"net"
+	"sync"
+	"time"
+)
+
+// maxIdentityLimiters bounds the number of per identity limiters kept
+// around, the idle ones are dropped past it
+const maxIdentityLimiters = 10000
+
+// tokenBucket refills at rate tokens per second, up to a second's worth
+type tokenBucket struct {
+	tokens float64
+	last   time.Time
+}
+
+func (b *tokenBucket) refill(rate float64, now time.Time) {
+	if b.last.IsZero() {
+		b.tokens = rate
+	} else {
+		b.tokens += rate * now.Sub(b.last).Seconds()
+	}
+	if b.tokens > rate {
+		b.tokens = rate
+	}
+	b.last = now
+}
+
+// available reports whether n tokens can be taken, which is always the case
+// for a full bucket so that a batch larger than the rate can still get
+// through (leaving the bucket in debt)
+func (b *tokenBucket) available(n float64, rate float64) bool {
+	return b.tokens >= n || b.tokens >= rate
+}
+
+// pubLimiter limits the messages and bytes published per second, a rate of
+// 0 is unlimited
+type pubLimiter struct {
+	sync.Mutex
+	msgs  tokenBucket
+	bytes tokenBucket
+}
+
+// take takes msgs and bytes from the buckets, nothing is taken if either
+// of them is exhausted
+func (l *pubLimiter) take(msgs int, bytes int, msgRate int64, byteRate int64, now time.Time) bool {
+	l.Lock()
+	defer l.Unlock()
+	if msgRate > 0 {
+		l.msgs.refill(float64(msgRate), now)
+		if !l.msgs.available(float64(msgs), float64(msgRate)) {
+			return false
+		}
+	}
+	if byteRate > 0 {
+		l.bytes.refill(float64(byteRate), now)
+		if !l.bytes.available(float64(bytes), float64(byteRate)) {
+			return false
+		}
+	}
+	if msgRate > 0 {
+		l.msgs.tokens -= float64(msgs)
+	}
+	if byteRate > 0 {
+		l.bytes.tokens -= float64(bytes)
+	}
+	return true
+}
+
+// refund gives back what take took, when a later limit rejected the publish
+func (l *pubLimiter) refund(msgs int, bytes int, msgRate int64, byteRate int64) {
+	l.Lock()
+	defer l.Unlock()
+	if msgRate > 0 {
+		l.msgs.tokens += float64(msgs)
+	}
+	if byteRate > 0 {
+		l.bytes.tokens += float64(bytes)
+	}
+}
+
+// idle reports whether the limiter hasn't been used for a second, in which
+// case it's back to being full (unless it went deep in debt)
+func (l *pubLimiter) idle(now time.Time) bool {
+	l.Lock()
+	defer l.Unlock()
+	return now.Sub(l.msgs.last) > time.Second && now.Sub(l.bytes.last) > time.Second
+}
+
+// errThrottled is returned by checkPubRate, naming the limit that was hit
+type errThrottled struct {
+	scope string
+}
+
+func (e errThrottled) Error() string {
+	return fmt.Sprintf("%s publish rate limit exceeded", e.scope)
+}
+
+// checkPubRate takes msgs messages of bytes total size from the global, the
+// per identity (see pubIdentity) and the topic publish rate limits
+//
+// the throttled messages are counted in the topic stats
+func (n *NSQD) checkPubRate(topic *Topic, identity string, msgs int, bytes int) error {
+	opts := n.getOpts()
+	now := time.Now()
+
+	if !n.pubLimiter.take(msgs, bytes, opts.PubRateLimit, opts.PubByteRateLimit, now) {
+		topic.throttled(msgs)
+		return errThrottled{"global"}
+	}
+
+	var l *pubLimiter
+	if opts.ClientPubRateLimit > 0 || opts.ClientPubByteRateLimit > 0 {
+		l = n.identityLimiter(identity, now)
+		if !l.take(msgs, bytes, opts.ClientPubRateLimit, opts.ClientPubByteRateLimit, now) {
+			n.pubLimiter.refund(msgs, bytes, opts.PubRateLimit, opts.PubByteRateLimit)
+			topic.throttled(msgs)
+			return errThrottled{"client"}
+		}
+	}
+
+	msgRate, byteRate := topic.PubRateLimit()
+	if !topic.pubLimiter.take(msgs, bytes, msgRate, byteRate, now) {
+		n.pubLimiter.refund(msgs, bytes, opts.PubRateLimit, opts.PubByteRateLimit)
+		if l != nil {
+			l.refund(msgs, bytes, opts.ClientPubRateLimit, opts.ClientPubByteRateLimit)
+		}
+		topic.throttled(msgs)
+		return errThrottled{"topic"}
+	}
+	return nil
+}
+
+func (n *NSQD) identityLimiter(identity string, now time.Time) *pubLimiter {
+	n.limiterLock.Lock()
+	defer n.limiterLock.Unlock()
+	l, ok := n.identityLimiters[identity]
+	if ok {
+		return l
+	}
+	if len(n.identityLimiters) >= maxIdentityLimiters {
+		for k, l := range n.identityLimiters {
+			if l.idle(now) {
+				delete(n.identityLimiters, k)
+			}
+		}
+	}
+	l = &pubLimiter{}
+	n.identityLimiters[identity] = l
+	return l
+}
+
+// pubIdentity returns the identity the per client publish rate limit
+// applies to, the one from the auth server if any and otherwise the client
+// IP
+func pubIdentity(authIdentity string, remoteAddr string) string {
+	if authIdentity != "" {
+		return authIdentity
+	}
+	host, _, err := net.SplitHostPort(remoteAddr)
+	if err != nil {
+		return remoteAddr
+	}
+	return host
+}
+
+// deliveryLimiter limits the messages per second a channel delivers, across
+// all of its clients, and measures the rate it actually delivers at
+//
+// a client reserves a delivery before it takes a message, see reserve, so
+// that the clients can't race for the last token
+type deliveryLimiter struct {
+	sync.Mutex
+	msgs tokenBucket
+	// the deliveries reserved and not yet made (or released), which count
+	// against the bucket
+	reserved int64
+
+	// messages delivered since windowStart, and the rate over the last
+	// second-long window
+	windowStart time.Time
+	windowCount int64
+	lastRate    float64
+}
+
+// reserve reserves a delivery at rate, returning 0 if it did or else how
+// long to wait until one can be
+func (l *deliveryLimiter) reserve(rate int64, now time.Time) time.Duration {
+	l.Lock()
+	defer l.Unlock()
+	l.msgs.refill(float64(rate), now)
+	if max := float64(rate - l.reserved); l.msgs.tokens > max {
+		l.msgs.tokens = max
+	}
+	if l.msgs.tokens >= 1 {
+		l.msgs.tokens--
+		l.reserved++
+		return 0
+	}
+	return time.Duration((1 - l.msgs.tokens) / float64(rate) * float64(time.Second))
+}
+
+// release gives back a reserved delivery that wasn't made
+func (l *deliveryLimiter) release() {
+	l.Lock()
+	defer l.Unlock()
+	l.msgs.tokens++
+	l.reserved--
+}
+
+// delivered makes a reserved delivery, at now
+func (l *deliveryLimiter) delivered(now time.Time) {
+	l.Lock()
+	defer l.Unlock()
+	l.reserved--
+
+	if elapsed := now.Sub(l.windowStart); elapsed >= time.Second {
+		l.lastRate = float64(l.windowCount) / elapsed.Seconds()
+		l.windowStart = now
+		l.windowCount = 0
+	}
+	l.windowCount++
+}
+
+// rate returns the messages per second delivered over the last second
+func (l *deliveryLimiter) rate(now time.Time) float64 {
+	l.Lock()
+	defer l.Unlock()
+	if now.Sub(l.windowStart) > 2*time.Second {
+		// nothing delivered lately
+		return 0
+	}
+	return l.lastRate
+}
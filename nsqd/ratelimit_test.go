@@ -0,0 +1,85 @@
+package nsqd
+
+import (
+	"testing"
+	"time"
+
+	"github.com/nsqio/nsq/internal/test"
+)
+
+func TestPubLimiter(t *testing.T) {
+	var l pubLimiter
+	now := time.Now()
+
+	// unlimited
+	test.Equal(t, true, l.take(1000, 1000, 0, 0, now))
+
+	// a second's worth of burst
+	test.Equal(t, true, l.take(1, 10, 2, 100, now))
+	test.Equal(t, true, l.take(1, 10, 2, 100, now))
+	test.Equal(t, false, l.take(1, 10, 2, 100, now))
+	test.Equal(t, true, l.take(1, 10, 2, 100, now.Add(500*time.Millisecond)))
+	test.Equal(t, false, l.take(1, 10, 2, 100, now.Add(500*time.Millisecond)))
+
+	// nothing is taken from the msgs bucket when the bytes one rejects
+	var l2 pubLimiter
+	test.Equal(t, true, l2.take(1, 60, 10, 100, now))
+	test.Equal(t, false, l2.take(1, 60, 10, 100, now))
+	test.Equal(t, true, l2.take(9, 10, 10, 100, now))
+	test.Equal(t, false, l2.take(1, 1, 10, 100, now))
+
+	// a batch larger than the rate gets through a full bucket, in debt
+	now = now.Add(2 * time.Second)
+	test.Equal(t, true, l.take(4, 10, 2, 100, now))
+	test.Equal(t, false, l.take(1, 10, 2, 100, now.Add(time.Second)))
+	test.Equal(t, true, l.take(1, 10, 2, 100, now.Add(1500*time.Millisecond)))
+
+	// refund
+	now = now.Add(10 * time.Second)
+	test.Equal(t, true, l.take(2, 10, 2, 100, now))
+	test.Equal(t, false, l.take(1, 10, 2, 100, now))
+	l.refund(1, 10, 2, 100)
+	test.Equal(t, true, l.take(1, 10, 2, 100, now))
+
+	test.Equal(t, false, l.idle(now))
+	test.Equal(t, true, l.idle(now.Add(2*time.Second)))
+}
+
+func TestDeliveryLimiter(t *testing.T) {
+	var l deliveryLimiter
+	now := time.Now()
+
+	// a second's worth of burst
+	for i := 0; i < 2; i++ {
+		test.Equal(t, time.Duration(0), l.reserve(2, now))
+		l.delivered(now)
+	}
+	test.Equal(t, 500*time.Millisecond, l.reserve(2, now))
+	test.Equal(t, 250*time.Millisecond, l.reserve(2, now.Add(250*time.Millisecond)))
+
+	// a reserved delivery holds its token until it's released
+	test.Equal(t, time.Duration(0), l.reserve(2, now.Add(500*time.Millisecond)))
+	test.Equal(t, 500*time.Millisecond, l.reserve(2, now.Add(500*time.Millisecond)))
+	l.release()
+	test.Equal(t, time.Duration(0), l.reserve(2, now.Add(500*time.Millisecond)))
+	l.delivered(now.Add(500 * time.Millisecond))
+
+	// 3 messages in the first window
+	test.Equal(t, time.Duration(0), l.reserve(2, now.Add(time.Second)))
+	l.delivered(now.Add(time.Second))
+	test.Equal(t, float64(3), l.rate(now.Add(time.Second)))
+	test.Equal(t, float64(0), l.rate(now.Add(5*time.Second)))
+
+	// the reserved deliveries count against the bucket as it refills
+	test.Equal(t, time.Duration(0), l.reserve(2, now.Add(6*time.Second)))
+	test.Equal(t, time.Duration(0), l.reserve(2, now.Add(7*time.Second)))
+	test.Equal(t, 500*time.Millisecond, l.reserve(2, now.Add(8*time.Second)))
+	l.release()
+	l.release()
+}
+
+func TestPubIdentity(t *testing.T) {
+	test.Equal(t, "producer", pubIdentity("producer", "127.0.0.1:4150"))
+	test.Equal(t, "127.0.0.1", pubIdentity("", "127.0.0.1:4150"))
+	test.Equal(t, "::1", pubIdentity("", "[::1]:4150"))
+}
@@ -0,0 +1,185 @@
+package nsqd
+
+import (
+	"errors"
+	"fmt"
+	"reflect"
+	"sort"
+	"strings"
+
+	"github.com/nsqio/nsq/internal/auth"
+)
+
+// reloadableOpts are the options (by config file name) that Reload applies
+// to a running nsqd, changes to any other option require a restart
+//
+// these are all read through getOpts when they're used, so the new values
+// apply from then on (e.g. msg_timeout applies to new clients)
+//
+// max_msg_size and max_headers_size are left out as a diskqueue fixes its
+// max message length when it's created, raising them would make the
+// existing queues drop the larger messages
+var reloadableOpts = map[string]bool{
+	"log_level":                  true,
+	"nsqlookupd_tcp_addresses":   true,
+	"auth_http_addresses":        true,
+	"auth_file":                  true,
+	"msg_timeout":                true,
+	"max_msg_timeout":            true,
+	"max_body_size":              true,
+	"max_req_timeout":            true,
+	"max_schedule_ahead":         true,
+	"max_attempts":               true,
+	"dedup_window":               true,
+	"max_heartbeat_interval":     true,
+	"max_rdy_count":              true,
+	"max_output_buffer_size":     true,
+	"max_output_buffer_timeout":  true,
+	"min_output_buffer_timeout":  true,
+	"output_buffer_timeout":      true,
+	"max_channel_consumers":      true,
+	"pub_rate_limit":             true,
+	"pub_byte_rate_limit":        true,
+	"client_pub_rate_limit":      true,
+	"client_pub_byte_rate_limit": true,
+	"statsd_address":             true,
+	"statsd_prefix":              true,
+	"statsd_interval":            true,
+	"statsd_mem_stats":           true,
+	"statsd_udp_packet_size":     true,
+	"tls_cert":                   true,
+	"tls_key":                    true,
+	"tls_root_ca_file":           true,
+}
+
+// ReloadResult lists the options that changed in a Reload
+type ReloadResult struct {
+	// the options that were applied
+	Applied []string `json:"applied"`
+	// the options that were left unchanged as they require a restart
+	RestartRequired []string `json:"restart_required"`
+}
+
+// SetConfigLoader sets the function Reload uses to re-read the options
+// (i.e. to resolve the command line flags and config file again)
+func (n *NSQD) SetConfigLoader(loader func() (*Options, error)) {
+	n.configLoader.Store(loader)
+}
+
+// Reload re-reads the options with the loader set by SetConfigLoader and
+// applies the ones that changed, see ApplyOpts
+func (n *NSQD) Reload() (*ReloadResult, error) {
+	result, err := n.reload()
+	if err != nil {
+		n.logf(LOG_ERROR, "CONFIG: failed to reload - %s", err)
+	}
+	return result, err
+}
+
+func (n *NSQD) reload() (*ReloadResult, error) {
+	loader, ok := n.configLoader.Load().(func() (*Options, error))
+	if !ok || loader == nil {
+		return nil, errors.New("no config loader")
+	}
+	opts, err := loader()
+	if err != nil {
+		return nil, err
+	}
+	return n.ApplyOpts(opts)
+}
+
+// ApplyOpts applies the reloadable options that differ between opts and
+// the current ones, the others are only reported
+//
+// nothing is applied if any of the new values is invalid
+func (n *NSQD) ApplyOpts(opts *Options) (*ReloadResult, error) {
+	n.reloadLock.Lock()
+	defer n.reloadLock.Unlock()
+
+	cur := n.getOpts()
+	err := resolveOpts(opts)
+	if err != nil {
+		return nil, err
+	}
+
+	result := &ReloadResult{
+		Applied:         []string{},
+		RestartRequired: []string{},
+	}
+	newOpts := *cur
+	newVal := reflect.ValueOf(opts).Elem()
+	curVal := reflect.ValueOf(&newOpts).Elem()
+	typ := curVal.Type()
+	for i := 0; i < typ.NumField(); i++ {
+		name := optCfgName(typ.Field(i))
+		if name == "" {
+			continue
+		}
+		if reflect.DeepEqual(curVal.Field(i).Interface(), newVal.Field(i).Interface()) {
+			continue
+		}
+		// TLS can only be enabled at startup
+		tlsDisabled := n.tlsConfig == nil && strings.HasPrefix(name, "tls_")
+		if !reloadableOpts[name] || tlsDisabled {
+			result.RestartRequired = append(result.RestartRequired, name)
+			continue
+		}
+		curVal.Field(i).Set(newVal.Field(i))
+		result.Applied = append(result.Applied, name)
+	}
+	sort.Strings(result.Applied)
+	sort.Strings(result.RestartRequired)
+
+	if newOpts.StatsdInterval <= 0 {
+		return nil, fmt.Errorf("--statsd-interval (%s) must be positive", newOpts.StatsdInterval)
+	}
+	if newOpts.AuthFile != "" && len(newOpts.AuthHTTPAddresses) != 0 {
+		return nil, errors.New("--auth-file and --auth-http-address are mutually exclusive")
+	}
+	// likewise the auth file is re-read to pick up edits
+	var authFile *auth.File
+	if newOpts.AuthFile != "" {
+		authFile, err = auth.LoadFile(newOpts.AuthFile)
+		if err != nil {
+			return nil, err
+		}
+	}
+	// the TLS files are re-read even if unchanged, as they may have been
+	// rotated in place
+	if n.tlsReloader != nil {
+		err := n.tlsReloader.Load(newOpts.TLSCert, newOpts.TLSKey, newOpts.TLSRootCAFile)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	n.authFile.Store(authFile)
+	if len(result.Applied) > 0 {
+		n.logf(LOG_INFO, "CONFIG: applying %s", strings.Join(result.Applied, ", "))
+		n.swapOpts(&newOpts)
+		n.triggerOptsNotification()
+	}
+	if !reflect.DeepEqual(cur.AuthHTTPAddresses, newOpts.AuthHTTPAddresses) {
+		// states from the previous auth servers no longer apply
+		n.authCache.Purge()
+	}
+	if len(result.RestartRequired) > 0 {
+		n.logf(LOG_WARN, "CONFIG: changes to %s require a restart",
+			strings.Join(result.RestartRequired, ", "))
+	}
+	return result, nil
+}
+
+// optCfgName returns the config file name of an Options field, or "" if
+// the field isn't configurable
+func optCfgName(field reflect.StructField) string {
+	flagName := field.Tag.Get("flag")
+	if flagName == "" {
+		return ""
+	}
+	cfgName := field.Tag.Get("cfg")
+	if cfgName == "" {
+		cfgName = strings.Replace(flagName, "-", "_", -1)
+	}
+	return cfgName
+}
@@ -0,0 +1,329 @@
+package nsqd
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/nsqio/nsq/internal/lg"
+)
+
+type retentionSegment struct {
+	num    int64
+	size   int64
+	count  int64
+	lastTS int64
+}
+
+// retentionLog keeps a copy of every message published to a topic for a
+// bounded amount of time and/or bytes so that it can be replayed into a
+// channel (see Topic.Rewind), independent of whether or not the message
+// was already consumed
+//
+// the log is a series of segment files in the data path, each a sequence
+// of [4-byte size][message] records (messages in the backend format),
+// and is pruned one whole segment at a time
+type retentionLog struct {
+	sync.Mutex
+
+	name        string
+	dataPath    string
+	maxAge      time.Duration
+	maxBytes    int64
+	segmentSize int64
+
+	segments  []*retentionSegment
+	totalSize int64
+	writeFile *os.File
+	writeBuf  bytes.Buffer
+
+	logf lg.AppLogFunc
+}
+
+func newRetentionLog(name string, dataPath string, maxAge time.Duration, maxBytes int64,
+	maxBytesPerFile int64, logf lg.AppLogFunc) (*retentionLog, error) {
+	r := &retentionLog{
+		name:     name,
+		dataPath: dataPath,
+		logf:     logf,
+	}
+	r.setLimits(maxAge, maxBytes, maxBytesPerFile)
+
+	err := r.load()
+	if err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+func (r *retentionLog) fileName(num int64) string {
+	return path.Join(r.dataPath, fmt.Sprintf("%s.retention.%06d.dat", r.name, num))
+}
+
+// setLimits expects the caller to handle locking
+func (r *retentionLog) setLimits(maxAge time.Duration, maxBytes int64, maxBytesPerFile int64) {
+	r.maxAge = maxAge
+	r.maxBytes = maxBytes
+	// keep segments small enough that pruning a whole one doesn't throw
+	// away a significant fraction of the byte limit
+	r.segmentSize = maxBytesPerFile
+	if maxBytes > 0 && maxBytes/4 < r.segmentSize {
+		r.segmentSize = maxBytes / 4
+	}
+}
+
+func (r *retentionLog) SetLimits(maxAge time.Duration, maxBytes int64, maxBytesPerFile int64) {
+	r.Lock()
+	r.setLimits(maxAge, maxBytes, maxBytesPerFile)
+	r.prune(time.Now())
+	r.Unlock()
+}
+
+func (r *retentionLog) Limits() (time.Duration, int64) {
+	r.Lock()
+	defer r.Unlock()
+	return r.maxAge, r.maxBytes
+}
+
+// load indexes the segments left behind by a previous run
+func (r *retentionLog) load() error {
+	fileNames, err := filepath.Glob(path.Join(r.dataPath, r.name+".retention.*.dat"))
+	if err != nil {
+		return err
+	}
+	for _, fn := range fileNames {
+		var num int64
+		_, err := fmt.Sscanf(path.Base(fn), r.name+".retention.%d.dat", &num)
+		if err != nil {
+			continue
+		}
+		seg := &retentionSegment{num: num}
+		err = r.scanSegment(fn, seg)
+		if err != nil {
+			r.logf(LOG_WARN, "RETENTION(%s): ignoring segment %s - %s", r.name, fn, err)
+		}
+		r.segments = append(r.segments, seg)
+		r.totalSize += seg.size
+	}
+	sort.Slice(r.segments, func(i, j int) bool { return r.segments[i].num < r.segments[j].num })
+	return nil
+}
+
+// scanSegment fills in seg with the contents of the segment file, a torn
+// record at the end (i.e. from a crash) is truncated
+func (r *retentionLog) scanSegment(fn string, seg *retentionSegment) error {
+	f, err := os.OpenFile(fn, os.O_RDWR, 0600)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	err = readRetentionSegment(f, -1, func(msg *Message, size int64) error {
+		seg.lastTS = msg.Timestamp
+		seg.count++
+		seg.size += size
+		return nil
+	})
+	if err != nil {
+		return f.Truncate(seg.size)
+	}
+	return nil
+}
+
+// readRetentionSegment calls fn for each message in the first limit bytes
+// of rd (all of it if limit < 0)
+func readRetentionSegment(rd io.Reader, limit int64, fn func(*Message, int64) error) error {
+	if limit >= 0 {
+		rd = io.LimitReader(rd, limit)
+	}
+	br := bufio.NewReader(rd)
+	var sizeBuf [4]byte
+	for {
+		_, err := io.ReadFull(br, sizeBuf[:])
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		size := binary.BigEndian.Uint32(sizeBuf[:])
+		buf := make([]byte, size)
+		_, err = io.ReadFull(br, buf)
+		if err != nil {
+			return err
+		}
+		msg, err := decodeMessage(buf)
+		if err != nil {
+			return err
+		}
+		err = fn(msg, int64(4+size))
+		if err != nil {
+			return err
+		}
+	}
+}
+
+// Append adds msg to the log
+func (r *retentionLog) Append(msg *Message) error {
+	r.Lock()
+	defer r.Unlock()
+
+	r.writeBuf.Reset()
+	r.writeBuf.Write([]byte{0, 0, 0, 0})
+	_, err := msg.writeBackendTo(&r.writeBuf)
+	if err != nil {
+		return err
+	}
+	data := r.writeBuf.Bytes()
+	binary.BigEndian.PutUint32(data, uint32(len(data)-4))
+
+	var seg *retentionSegment
+	if len(r.segments) > 0 {
+		seg = r.segments[len(r.segments)-1]
+	}
+	if seg == nil || (seg.size > 0 && seg.size+int64(len(data)) > r.segmentSize) {
+		num := int64(0)
+		if seg != nil {
+			num = seg.num + 1
+		}
+		if r.writeFile != nil {
+			r.writeFile.Close()
+			r.writeFile = nil
+		}
+		seg = &retentionSegment{num: num}
+		r.segments = append(r.segments, seg)
+	}
+
+	if r.writeFile == nil {
+		r.writeFile, err = os.OpenFile(r.fileName(seg.num), os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0600)
+		if err != nil {
+			return err
+		}
+	}
+
+	_, err = r.writeFile.Write(data)
+	if err != nil {
+		// drop the partial write so that the segment stays readable
+		r.writeFile.Truncate(seg.size)
+		return err
+	}
+
+	seg.lastTS = msg.Timestamp
+	seg.count++
+	seg.size += int64(len(data))
+	r.totalSize += int64(len(data))
+
+	r.prune(time.Now())
+	return nil
+}
+
+// prune removes the oldest segments (never the one being written) that
+// are entirely older than maxAge or exceed maxBytes
+//
+// this expects the caller to handle locking
+func (r *retentionLog) prune(now time.Time) {
+	for len(r.segments) > 1 {
+		seg := r.segments[0]
+		expired := r.maxAge > 0 && seg.lastTS < now.Add(-r.maxAge).UnixNano()
+		overSize := r.maxBytes > 0 && r.totalSize > r.maxBytes
+		if !expired && !overSize {
+			break
+		}
+		err := os.Remove(r.fileName(seg.num))
+		if err != nil && !os.IsNotExist(err) {
+			r.logf(LOG_ERROR, "RETENTION(%s): failed to remove segment %d - %s", r.name, seg.num, err)
+			break
+		}
+		r.segments = r.segments[1:]
+		r.totalSize -= seg.size
+	}
+}
+
+// Replay calls fn, in publish order, for every retained message published
+// at or after since (nanoseconds)
+func (r *retentionLog) Replay(since int64, fn func(*Message) error) error {
+	// snapshot which segments (and how much of the last) to read so that
+	// publishing isn't blocked while we read from disk
+	r.Lock()
+	r.prune(time.Now())
+	var segments []retentionSegment
+	for _, seg := range r.segments {
+		if seg.count > 0 && seg.lastTS >= since {
+			segments = append(segments, *seg)
+		}
+	}
+	r.Unlock()
+
+	for _, seg := range segments {
+		f, err := os.Open(r.fileName(seg.num))
+		if os.IsNotExist(err) {
+			// pruned in the meantime
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		err = readRetentionSegment(f, seg.size, func(msg *Message, _ int64) error {
+			if msg.Timestamp < since {
+				return nil
+			}
+			return fn(msg)
+		})
+		f.Close()
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Stats returns the number of retained messages and bytes
+func (r *retentionLog) Stats() (int64, int64) {
+	r.Lock()
+	defer r.Unlock()
+	var count int64
+	for _, seg := range r.segments {
+		count += seg.count
+	}
+	return count, r.totalSize
+}
+
+func (r *retentionLog) Close() error {
+	r.Lock()
+	defer r.Unlock()
+	if r.writeFile == nil {
+		return nil
+	}
+	err := r.writeFile.Close()
+	r.writeFile = nil
+	return err
+}
+
+// Delete closes the log and removes all of its segments
+func (r *retentionLog) Delete() error {
+	r.Close()
+	r.Lock()
+	defer r.Unlock()
+	var errs []string
+	for _, seg := range r.segments {
+		err := os.Remove(r.fileName(seg.num))
+		if err != nil && !os.IsNotExist(err) {
+			errs = append(errs, err.Error())
+		}
+	}
+	r.segments = nil
+	r.totalSize = 0
+	if len(errs) > 0 {
+		return errors.New("failed to remove retention segments - " + errs[0])
+	}
+	return nil
+}
@@ -0,0 +1,172 @@
+package nsqd
+
+import (
+	"bytes"
+	"container/heap"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/nsqio/nsq/internal/lg"
+	"github.com/nsqio/nsq/internal/pqueue"
+)
+
+// scheduleStore holds the messages published to a topic for delivery at a
+// later time (see the deliver_at publish option) until they're due
+//
+// each message is a file in the store directory, named after its delivery
+// time and ID, so only that index is kept in memory and the messages
+// survive restarts however far ahead they're scheduled
+type scheduleStore struct {
+	sync.Mutex
+
+	dir        string
+	pq         pqueue.PriorityQueue
+	updateChan chan int
+}
+
+// scheduleRetryDelay is how long a due message that failed to be put is
+// held back before it's retried
+const scheduleRetryDelay = time.Second
+
+// scheduledFile returns the name of the file of the message id, due at
+// deliverAt
+func scheduledFile(deliverAt int64, id MessageID) string {
+	return fmt.Sprintf("%d-%s.msg", deliverAt, id[:])
+}
+
+// newScheduleStore opens the store in dir, indexing the messages already
+// in there (if any)
+func newScheduleStore(dir string, logf lg.AppLogFunc) (*scheduleStore, error) {
+	s := &scheduleStore{
+		dir:        dir,
+		pq:         pqueue.New(16),
+		updateChan: make(chan int, 1),
+	}
+
+	files, err := ioutil.ReadDir(dir)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return s, nil
+		}
+		return nil, fmt.Errorf("failed to read schedule dir %s - %s", dir, err)
+	}
+	for _, fi := range files {
+		name := fi.Name()
+		if strings.HasSuffix(name, ".tmp") {
+			// left over from a crash before it was renamed into place
+			os.Remove(path.Join(dir, name))
+			continue
+		}
+		idx := strings.IndexByte(name, '-')
+		if idx < 1 || !strings.HasSuffix(name, ".msg") {
+			continue
+		}
+		deliverAt, err := strconv.ParseInt(name[:idx], 10, 64)
+		if err != nil {
+			continue
+		}
+		heap.Push(&s.pq, &pqueue.Item{Value: name, Priority: deliverAt})
+	}
+	if s.pq.Len() > 0 {
+		logf(lg.INFO, "SCHEDULE(%s): loaded %d scheduled messages", dir, s.pq.Len())
+	}
+	return s, nil
+}
+
+// add writes msg to the store (synced) for delivery at deliverAt
+func (s *scheduleStore) add(msg *Message, deliverAt int64) error {
+	var buf bytes.Buffer
+	_, err := msg.writeBackendTo(&buf)
+	if err != nil {
+		return err
+	}
+
+	err = os.MkdirAll(s.dir, 0755)
+	if err != nil {
+		return err
+	}
+	name := scheduledFile(deliverAt, msg.ID)
+	tmp := path.Join(s.dir, name+".tmp")
+	err = writeSyncFile(tmp, buf.Bytes())
+	if err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	err = os.Rename(tmp, path.Join(s.dir, name))
+	if err != nil {
+		os.Remove(tmp)
+		return err
+	}
+
+	s.push(name, deliverAt)
+	return nil
+}
+
+func (s *scheduleStore) push(name string, deliverAt int64) {
+	s.Lock()
+	heap.Push(&s.pq, &pqueue.Item{Value: name, Priority: deliverAt})
+	s.Unlock()
+	select {
+	case s.updateChan <- 1:
+	default:
+	}
+}
+
+// next returns when the next message is due, false if there is none
+func (s *scheduleStore) next() (int64, bool) {
+	s.Lock()
+	defer s.Unlock()
+	if s.pq.Len() == 0 {
+		return 0, false
+	}
+	return s.pq[0].Priority, true
+}
+
+// pop returns the next message due at now (nil if there is none) and the
+// name of its file, which stays in place until it's removed
+func (s *scheduleStore) pop(now int64) (*Message, string, error) {
+	s.Lock()
+	item, _ := s.pq.PeekAndShift(now)
+	s.Unlock()
+	if item == nil {
+		return nil, "", nil
+	}
+
+	name := item.Value.(string)
+	data, err := ioutil.ReadFile(path.Join(s.dir, name))
+	if err != nil {
+		return nil, name, err
+	}
+	msg, err := decodeMessage(data)
+	return msg, name, err
+}
+
+// retry puts the message in file name back in the store, due at deliverAt
+func (s *scheduleStore) retry(name string, deliverAt int64) {
+	s.push(name, deliverAt)
+}
+
+func (s *scheduleStore) remove(name string) error {
+	return os.Remove(path.Join(s.dir, name))
+}
+
+// Len returns the number of scheduled messages
+func (s *scheduleStore) Len() int {
+	s.Lock()
+	defer s.Unlock()
+	return s.pq.Len()
+}
+
+// Empty removes all the scheduled messages (and the store directory)
+func (s *scheduleStore) Empty() error {
+	s.Lock()
+	defer s.Unlock()
+	s.pq = pqueue.New(16)
+	return os.RemoveAll(s.dir)
+}
@@ -0,0 +1,70 @@
+package nsqd
+
+import (
+	"os"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/nsqio/nsq/internal/test"
+)
+
+func TestScheduledDelivery(t *testing.T) {
+	opts := NewOptions()
+	opts.Logger = test.NewTestLogger(t)
+	_, _, nsqd := mustStartNSQD(opts)
+	defer os.RemoveAll(opts.DataPath)
+
+	topicName := "test_scheduled_delivery" + strconv.Itoa(int(time.Now().Unix()))
+	topic := nsqd.GetTopic(topicName)
+	channel := topic.GetChannel("ch")
+
+	now := time.Now()
+	soon := NewMessage(topic.GenerateID(), []byte("soon"))
+	soon.deliverAt = now.Add(50 * time.Millisecond).UnixNano()
+	later := NewMessage(topic.GenerateID(), []byte("later"))
+	later.deliverAt = now.Add(time.Hour).UnixNano()
+	err := topic.PutMessages([]*Message{soon, later})
+	test.Nil(t, err)
+	test.Equal(t, int64(2), topic.ScheduledCount())
+	test.Equal(t, int64(0), channel.Depth())
+
+	for i := 0; i < 100 && channel.Depth() < 1; i++ {
+		time.Sleep(5 * time.Millisecond)
+	}
+	test.Equal(t, int64(1), channel.Depth())
+	test.Equal(t, int64(1), topic.ScheduledCount())
+	msg := <-channel.memoryMsgChan
+	test.Equal(t, soon.ID, msg.ID)
+	test.Equal(t, "soon", string(msg.Body))
+	test.Equal(t, true, time.Now().UnixNano() >= soon.deliverAt)
+
+	// the messages that aren't due yet survive a restart
+	nsqd.Exit()
+	origDataPath := opts.DataPath
+	opts = NewOptions()
+	opts.Logger = test.NewTestLogger(t)
+	opts.DataPath = origDataPath
+	_, _, nsqd = mustStartNSQD(opts)
+	defer nsqd.Exit()
+
+	topic = nsqd.GetTopic(topicName)
+	test.Equal(t, int64(1), topic.ScheduledCount())
+	next, ok := topic.schedule.next()
+	test.Equal(t, true, ok)
+	test.Equal(t, later.deliverAt, next)
+	msg, name, err := topic.schedule.pop(next)
+	test.Nil(t, err)
+	test.Equal(t, later.ID, msg.ID)
+	test.Equal(t, "later", string(msg.Body))
+	test.Nil(t, topic.schedule.remove(name))
+
+	// emptying the topic drops them
+	later.deliverAt = now.Add(time.Hour).UnixNano()
+	err = topic.PutMessage(later)
+	test.Nil(t, err)
+	test.Equal(t, int64(1), NewTopicStats(topic, nil).ScheduledCount)
+	err = topic.Empty()
+	test.Nil(t, err)
+	test.Equal(t, int64(0), topic.ScheduledCount())
+}
@@ -4,6 +4,7 @@ import (
 	"runtime"
 	"sort"
 	"sync/atomic"
+	"time"
 
 	"github.com/nsqio/nsq/internal/quantile"
 )
@@ -16,19 +17,80 @@ type TopicStats struct {
 	MessageCount uint64         `json:"message_count"`
 	MessageBytes uint64         `json:"message_bytes"`
 	Paused       bool           `json:"paused"`
+	// unix seconds, 0 unless paused until a given time
+	ResumeAt int64 `json:"resume_at"`
+
+	RetainedMessages int64 `json:"retained_messages"`
+	RetainedBytes    int64 `json:"retained_bytes"`
+
+	Partitions int `json:"partitions"`
+
+	DedupKeys  int    `json:"dedup_keys"`
+	DedupCount uint64 `json:"dedup_count"`
+
+	PubRateLimit     int64  `json:"pub_rate_limit"`
+	PubByteRateLimit int64  `json:"pub_byte_rate_limit"`
+	ThrottledCount   uint64 `json:"throttled_count"`
+
+	BacklogBytes          int64  `json:"backlog_bytes"`
+	MaxBacklogMsgs        int64  `json:"max_backlog_msgs"`
+	MaxBacklogBytes       int64  `json:"max_backlog_bytes"`
+	OverflowPolicy        string `json:"overflow_policy"`
+	OverflowDroppedCount  uint64 `json:"overflow_dropped_count"`
+	OverflowRejectedCount uint64 `json:"overflow_rejected_count"`
+	// set once the backlog is close to (or over) its quota
+	BacklogAlert bool `json:"backlog_alert"`
+
+	// messages published with deliver_at that aren't due yet
+	ScheduledCount int64 `json:"scheduled_count"`
 
 	E2eProcessingLatency *quantile.Result `json:"e2e_processing_latency"`
 }
 
 func NewTopicStats(t *Topic, channels []ChannelStats) TopicStats {
+	var retainedMessages, retainedBytes int64
+	t.RLock()
+	if t.retention != nil {
+		retainedMessages, retainedBytes = t.retention.Stats()
+	}
+	t.RUnlock()
+	pubRateLimit, pubByteRateLimit := t.PubRateLimit()
+	depth := t.Depth()
+	backlogBytes := t.BacklogBytes()
+	quota := t.backlogQuota()
+	maxBacklogMsgs, maxBacklogBytes, overflowPolicy := quota.values()
+
 	return TopicStats{
 		TopicName:    t.name,
 		Channels:     channels,
-		Depth:        t.Depth(),
+		Depth:        depth,
 		BackendDepth: t.backend.Depth(),
 		MessageCount: atomic.LoadUint64(&t.messageCount),
 		MessageBytes: atomic.LoadUint64(&t.messageBytes),
 		Paused:       t.IsPaused(),
+		ResumeAt:     unixOrZero(t.ResumeAt()),
+
+		RetainedMessages: retainedMessages,
+		RetainedBytes:    retainedBytes,
+
+		Partitions: t.Partitions(),
+
+		DedupKeys:  t.dedup.Len(),
+		DedupCount: atomic.LoadUint64(&t.dedupCount),
+
+		PubRateLimit:     pubRateLimit,
+		PubByteRateLimit: pubByteRateLimit,
+		ThrottledCount:   atomic.LoadUint64(&t.throttledCount),
+
+		BacklogBytes:          backlogBytes,
+		MaxBacklogMsgs:        maxBacklogMsgs,
+		MaxBacklogBytes:       maxBacklogBytes,
+		OverflowPolicy:        overflowPolicy,
+		OverflowDroppedCount:  atomic.LoadUint64(&t.overflowDropped),
+		OverflowRejectedCount: atomic.LoadUint64(&t.overflowRejected),
+		BacklogAlert:          quota.alert(depth, backlogBytes),
+
+		ScheduledCount: t.ScheduledCount(),
 
 		E2eProcessingLatency: t.AggregateChannelE2eProcessingLatency().Result(),
 	}
@@ -46,10 +108,50 @@ type ChannelStats struct {
 	ClientCount   int           `json:"client_count"`
 	Clients       []ClientStats `json:"clients"`
 	Paused        bool          `json:"paused"`
+	// unix seconds, 0 unless paused until a given time
+	ResumeAt int64 `json:"resume_at"`
+
+	MaxAttempts     uint16 `json:"max_attempts"`
+	DeadLetterCount uint64 `json:"dead_letter_count"`
+
+	Filter        string `json:"filter,omitempty"`
+	FilteredCount uint64 `json:"filtered_count"`
+
+	MessageTTL   time.Duration `json:"message_ttl"`
+	ExpiredCount uint64        `json:"expired_count"`
+
+	// messages per second, the effective rate is only measured while the
+	// delivery rate is limited
+	MaxDeliveryRate int64   `json:"max_delivery_rate"`
+	DeliveryRate    float64 `json:"delivery_rate"`
+
+	BacklogBytes          int64  `json:"backlog_bytes"`
+	MaxBacklogMsgs        int64  `json:"max_backlog_msgs"`
+	MaxBacklogBytes       int64  `json:"max_backlog_bytes"`
+	OverflowPolicy        string `json:"overflow_policy"`
+	OverflowDroppedCount  uint64 `json:"overflow_dropped_count"`
+	OverflowRejectedCount uint64 `json:"overflow_rejected_count"`
+	// set once the backlog is close to (or over) its quota
+	BacklogAlert bool `json:"backlog_alert"`
+
+	// in-memory depth of each priority lane, indexed by priority
+	PriorityDepths []int64 `json:"priority_depths"`
+
+	// the running (or last) backlog move/copy, see Channel.StartTransfer
+	Transfer *TransferStats `json:"transfer,omitempty"`
 
 	E2eProcessingLatency *quantile.Result `json:"e2e_processing_latency"`
 }
 
+type TransferStats struct {
+	Kind  string `json:"kind"`
+	To    string `json:"to"`
+	Done  int64  `json:"done"`
+	Total int64  `json:"total"`
+	State string `json:"state"`
+	Error string `json:"error,omitempty"`
+}
+
 func NewChannelStats(c *Channel, clients []ClientStats, clientCount int) ChannelStats {
 	c.inFlightMutex.Lock()
 	inflight := len(c.inFlightMessages)
@@ -57,10 +159,14 @@ func NewChannelStats(c *Channel, clients []ClientStats, clientCount int) Channel
 	c.deferredMutex.Lock()
 	deferred := len(c.deferredMessages)
 	c.deferredMutex.Unlock()
+	depth := c.Depth()
+	backlogBytes := c.BacklogBytes()
+	quota := c.backlogQuota()
+	maxBacklogMsgs, maxBacklogBytes, overflowPolicy := quota.values()
 
 	return ChannelStats{
 		ChannelName:   c.name,
-		Depth:         c.Depth(),
+		Depth:         depth,
 		BackendDepth:  c.backend.Depth(),
 		InFlightCount: inflight,
 		DeferredCount: deferred,
@@ -70,6 +176,31 @@ func NewChannelStats(c *Channel, clients []ClientStats, clientCount int) Channel
 		ClientCount:   clientCount,
 		Clients:       clients,
 		Paused:        c.IsPaused(),
+		ResumeAt:      unixOrZero(c.ResumeAt()),
+
+		MaxAttempts:     c.MaxAttempts(),
+		DeadLetterCount: atomic.LoadUint64(&c.deadLetterCount),
+
+		Filter:        c.Filter(),
+		FilteredCount: atomic.LoadUint64(&c.filteredCount),
+
+		MessageTTL:   c.MessageTTL(),
+		ExpiredCount: atomic.LoadUint64(&c.expiredCount),
+
+		MaxDeliveryRate: c.MaxDeliveryRate(),
+		DeliveryRate:    c.DeliveryRate(),
+
+		BacklogBytes:          backlogBytes,
+		MaxBacklogMsgs:        maxBacklogMsgs,
+		MaxBacklogBytes:       maxBacklogBytes,
+		OverflowPolicy:        overflowPolicy,
+		OverflowDroppedCount:  atomic.LoadUint64(&c.overflowDropped),
+		OverflowRejectedCount: atomic.LoadUint64(&c.overflowRejected),
+		BacklogAlert:          quota.alert(depth, backlogBytes),
+
+		PriorityDepths: c.PriorityDepths(),
+
+		Transfer: c.TransferStats(),
 
 		E2eProcessingLatency: c.e2eProcessingLatencyStream.Result(),
 	}
@@ -95,12 +226,14 @@ type ClientStats struct {
 	SampleRate      int32  `json:"sample_rate"`
 	Deflate         bool   `json:"deflate"`
 	Snappy          bool   `json:"snappy"`
+	Headers         bool   `json:"headers"`
 	UserAgent       string `json:"user_agent"`
 	Authed          bool   `json:"authed,omitempty"`
 	AuthIdentity    string `json:"auth_identity,omitempty"`
 	AuthIdentityURL string `json:"auth_identity_url,omitempty"`
 
-	PubCounts []PubCount `json:"pub_counts,omitempty"`
+	PubCounts      []PubCount `json:"pub_counts,omitempty"`
+	ThrottledCount uint64     `json:"throttled_count,omitempty"`
 
 	TLS                           bool   `json:"tls"`
 	CipherSuite                   string `json:"tls_cipher_suite"`
@@ -34,7 +34,16 @@ func (n *NSQD) statsdLoop() {
 		case <-n.exitChan:
 			goto exit
 		case <-ticker.C:
+			// the statsd options can be reloaded
+			if opts := n.getOpts(); opts.StatsdInterval != interval {
+				ticker.Stop()
+				interval = opts.StatsdInterval
+				ticker = time.NewTicker(interval)
+			}
 			addr := n.getOpts().StatsdAddress
+			if addr == "" {
+				continue
+			}
 			prefix := n.getOpts().StatsdPrefix
 			conn, err := net.DialTimeout("udp", addr, time.Second)
 			if err != nil {
@@ -65,12 +74,34 @@ func (n *NSQD) statsdLoop() {
 				stat = fmt.Sprintf("topic.%s.message_bytes", topic.TopicName)
 				client.Incr(stat, int64(diff))
 
+				diff = topic.DedupCount - lastTopic.DedupCount
+				stat = fmt.Sprintf("topic.%s.dedup_count", topic.TopicName)
+				client.Incr(stat, int64(diff))
+
+				diff = topic.ThrottledCount - lastTopic.ThrottledCount
+				stat = fmt.Sprintf("topic.%s.throttled_count", topic.TopicName)
+				client.Incr(stat, int64(diff))
+
+				diff = topic.OverflowDroppedCount - lastTopic.OverflowDroppedCount
+				stat = fmt.Sprintf("topic.%s.overflow_dropped_count", topic.TopicName)
+				client.Incr(stat, int64(diff))
+
+				diff = topic.OverflowRejectedCount - lastTopic.OverflowRejectedCount
+				stat = fmt.Sprintf("topic.%s.overflow_rejected_count", topic.TopicName)
+				client.Incr(stat, int64(diff))
+
 				stat = fmt.Sprintf("topic.%s.depth", topic.TopicName)
 				client.Gauge(stat, topic.Depth)
 
 				stat = fmt.Sprintf("topic.%s.backend_depth", topic.TopicName)
 				client.Gauge(stat, topic.BackendDepth)
 
+				stat = fmt.Sprintf("topic.%s.backlog_bytes", topic.TopicName)
+				client.Gauge(stat, topic.BacklogBytes)
+
+				stat = fmt.Sprintf("topic.%s.scheduled_count", topic.TopicName)
+				client.Gauge(stat, topic.ScheduledCount)
+
 				for _, item := range topic.E2eProcessingLatency.Percentiles {
 					stat = fmt.Sprintf("topic.%s.e2e_processing_latency_%.0f", topic.TopicName, item["quantile"]*100.0)
 					// We can cast the value to int64 since a value of 1 is the
@@ -98,6 +129,9 @@ func (n *NSQD) statsdLoop() {
 					stat = fmt.Sprintf("topic.%s.channel.%s.backend_depth", topic.TopicName, channel.ChannelName)
 					client.Gauge(stat, channel.BackendDepth)
 
+					stat = fmt.Sprintf("topic.%s.channel.%s.backlog_bytes", topic.TopicName, channel.ChannelName)
+					client.Gauge(stat, channel.BacklogBytes)
+
 					stat = fmt.Sprintf("topic.%s.channel.%s.in_flight_count", topic.TopicName, channel.ChannelName)
 					client.Gauge(stat, int64(channel.InFlightCount))
 
@@ -112,9 +146,34 @@ func (n *NSQD) statsdLoop() {
 					stat = fmt.Sprintf("topic.%s.channel.%s.timeout_count", topic.TopicName, channel.ChannelName)
 					client.Incr(stat, int64(diff))
 
+					diff = channel.DeadLetterCount - lastChannel.DeadLetterCount
+					stat = fmt.Sprintf("topic.%s.channel.%s.dead_letter_count", topic.TopicName, channel.ChannelName)
+					client.Incr(stat, int64(diff))
+
+					diff = channel.FilteredCount - lastChannel.FilteredCount
+					stat = fmt.Sprintf("topic.%s.channel.%s.filtered_count", topic.TopicName, channel.ChannelName)
+					client.Incr(stat, int64(diff))
+
+					diff = channel.ExpiredCount - lastChannel.ExpiredCount
+					stat = fmt.Sprintf("topic.%s.channel.%s.expired_count", topic.TopicName, channel.ChannelName)
+					client.Incr(stat, int64(diff))
+
+					diff = channel.OverflowDroppedCount - lastChannel.OverflowDroppedCount
+					stat = fmt.Sprintf("topic.%s.channel.%s.overflow_dropped_count", topic.TopicName, channel.ChannelName)
+					client.Incr(stat, int64(diff))
+
+					diff = channel.OverflowRejectedCount - lastChannel.OverflowRejectedCount
+					stat = fmt.Sprintf("topic.%s.channel.%s.overflow_rejected_count", topic.TopicName, channel.ChannelName)
+					client.Incr(stat, int64(diff))
+
 					stat = fmt.Sprintf("topic.%s.channel.%s.clients", topic.TopicName, channel.ChannelName)
 					client.Gauge(stat, int64(channel.ClientCount))
 
+					if channel.Transfer != nil && channel.Transfer.State == transferRunning {
+						stat = fmt.Sprintf("topic.%s.channel.%s.transfer_remaining", topic.TopicName, channel.ChannelName)
+						client.Gauge(stat, channel.Transfer.Total-channel.Transfer.Done)
+					}
+
 					for _, item := range channel.E2eProcessingLatency.Percentiles {
 						stat = fmt.Sprintf("topic.%s.channel.%s.e2e_processing_latency_%.0f", topic.TopicName, channel.ChannelName, item["quantile"]*100.0)
 						client.Gauge(stat, int64(item["value"]))
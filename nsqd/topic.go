@@ -3,13 +3,13 @@ package nsqd
 import (
 	"bytes"
 	"errors"
+	"fmt"
+	"path"
 	"strings"
 	"sync"
 	"sync/atomic"
 	"time"
 
-	"github.com/nsqio/go-diskqueue"
-	"github.com/nsqio/nsq/internal/lg"
 	"github.com/nsqio/nsq/internal/quantile"
 	"github.com/nsqio/nsq/internal/util"
 )
@@ -18,6 +18,16 @@ type Topic struct {
 	// 64bit atomic vars need to be first for proper alignment on 32bit platforms
 	messageCount uint64
 	messageBytes uint64
+	dedupCount   uint64
+
+	// publish rate limits (per second, 0 = unlimited), see checkPubRate
+	pubRateLimit     int64
+	pubByteRateLimit int64
+	throttledCount   uint64
+
+	// messages dropped or rejected by the backlog quota, see SetBacklogQuota
+	overflowDropped  uint64
+	overflowRejected uint64
 
 	sync.RWMutex
 
@@ -38,6 +48,28 @@ type Topic struct {
 
 	paused    int32
 	pauseChan chan int
+	// set when paused until a given time, see PauseUntil
+	resume resumeTimer
+
+	// nil unless retention is enabled, see SetRetention
+	retention *retentionLog
+
+	// messages published with deliver_at, nil for ephemeral topics (see
+	// schedulePump)
+	schedule *scheduleStore
+
+	// idempotency keys, see PutMessagesKeyed
+	dedup *dedupCache
+	// nanoseconds, < 0 falls back to --dedup-window
+	dedupWindow int64
+
+	// 0 unless partitioned, see SetPartitions
+	partitions int32
+
+	pubLimiter pubLimiter
+
+	// *backlogQuota, nil when the backlog is unbounded
+	quota atomic.Value
 
 	ctx *context
 }
@@ -56,7 +88,10 @@ func NewTopic(topicName string, ctx *context, deleteCallback func(*Topic)) *Topi
 		pauseChan:         make(chan int),
 		deleteCallback:    deleteCallback,
 		idFactory:         NewGUIDFactory(ctx.nsqd.getOpts().ID),
+		dedup:             newDedupCache(ctx.nsqd.getOpts().MaxDedupKeys),
+		dedupWindow:       -1,
 	}
+	t.quota.Store((*backlogQuota)(nil))
 	// create mem-queue only if size > 0 (do not use unbuffered chan)
 	if ctx.nsqd.getOpts().MemQueueSize > 0 {
 		t.memoryMsgChan = make(chan *Message, ctx.nsqd.getOpts().MemQueueSize)
@@ -65,20 +100,14 @@ func NewTopic(topicName string, ctx *context, deleteCallback func(*Topic)) *Topi
 		t.ephemeral = true
 		t.backend = newDummyBackendQueue()
 	} else {
-		dqLogf := func(level diskqueue.LogLevel, f string, args ...interface{}) {
-			opts := ctx.nsqd.getOpts()
-			lg.Logf(opts.Logger, opts.LogLevel, lg.LogLevel(level), f, args...)
+		t.backend = newBackendQueue(ctx, topicName, topicName)
+		dir := path.Join(ctx.nsqd.getOpts().DataPath, topicName+".schedule")
+		schedule, err := newScheduleStore(dir, ctx.nsqd.logf)
+		if err != nil {
+			ctx.nsqd.logf(LOG_ERROR, "TOPIC(%s): %s", topicName, err)
+		} else {
+			t.schedule = schedule
 		}
-		t.backend = diskqueue.New(
-			topicName,
-			ctx.nsqd.getOpts().DataPath,
-			ctx.nsqd.getOpts().MaxBytesPerFile,
-			int32(minValidMsgLength),
-			int32(ctx.nsqd.getOpts().MaxMsgSize)+minValidMsgLength,
-			ctx.nsqd.getOpts().SyncEvery,
-			ctx.nsqd.getOpts().SyncTimeout,
-			dqLogf,
-		)
 	}
 	/**
 		消息泵
@@ -124,6 +153,27 @@ func (t *Topic) GetChannel(channelName string) *Channel {
 	return channel
 }
 
+// getFilteredChannel is GetChannel creating the channel with filter f if it
+// doesn't exist yet, it also returns whether the channel was created
+func (t *Topic) getFilteredChannel(channelName string, f *msgFilter) (*Channel, bool) {
+	t.Lock()
+	channel, isNew := t.getOrCreateChannel(channelName)
+	if isNew {
+		// before the messagePump sees it
+		channel.filter.Store(f)
+	}
+	t.Unlock()
+
+	if isNew {
+		select {
+		case t.channelUpdateChan <- 1:
+		case <-t.exitChan:
+		}
+	}
+
+	return channel, isNew
+}
+
 // this expects the caller to handle locking
 func (t *Topic) getOrCreateChannel(channelName string) (*Channel, bool) {
 	channel, ok := t.channelMap[channelName]
@@ -132,6 +182,7 @@ func (t *Topic) getOrCreateChannel(channelName string) (*Channel, bool) {
 			t.DeleteExistingChannel(c.name)
 		}
 		channel = NewChannel(t.name, channelName, t.ctx, deleteCallback)
+		channel.enablePartitions(t.Partitions())
 		t.channelMap[channelName] = channel
 		t.ctx.nsqd.logf(LOG_INFO, "TOPIC(%s): new channel(%s)", t.name, channel.name)
 		return channel, true
@@ -196,10 +247,23 @@ func (t *Topic) PutMessage(m *Message) error {
 	if atomic.LoadInt32(&t.exitFlag) == 1 {
 		return errors.New("exiting")
 	}
-	err := t.put(m)//topic接受消息
+	err := t.checkBacklog(1)
 	if err != nil {
 		return err
 	}
+	// the messagePump owns m once it's put, so the copy is retained
+	retained := *m
+	if m.deliverAt > 0 {
+		err = t.scheduleMessage(m)
+	} else if t.makeRoom() {
+		err = t.put(m) //topic接受消息
+	}
+	if err != nil {
+		return err
+	}
+	if retained.deliverAt == 0 {
+		t.retain(&retained)
+	}
 	//计数修改
 	atomic.AddUint64(&t.messageCount, 1)
 	atomic.AddUint64(&t.messageBytes, uint64(len(m.Body)))
@@ -215,15 +279,28 @@ func (t *Topic) PutMessages(msgs []*Message) error {
 		return errors.New("exiting")
 	}
 
+	err := t.checkBacklog(len(msgs))
+	if err != nil {
+		return err
+	}
+
 	messageTotalBytes := 0
 
 	for i, m := range msgs {
-		err := t.put(m)
+		retained := *m
+		if m.deliverAt > 0 {
+			err = t.scheduleMessage(m)
+		} else if t.makeRoom() {
+			err = t.put(m)
+		}
 		if err != nil {
 			atomic.AddUint64(&t.messageCount, uint64(i))
 			atomic.AddUint64(&t.messageBytes, uint64(messageTotalBytes))
 			return err
 		}
+		if retained.deliverAt == 0 {
+			t.retain(&retained)
+		}
 		messageTotalBytes += len(m.Body)
 	}
 
@@ -232,24 +309,385 @@ func (t *Topic) PutMessages(msgs []*Message) error {
 	return nil
 }
 
+// PutMessagesKeyed writes msgs unless key was already published within the
+// topic's dedup window, in which case nothing is written
+//
+// it returns the ID of the first message of the original publish and
+// whether or not this publish was a duplicate
+func (t *Topic) PutMessagesKeyed(key string, msgs []*Message) (MessageID, bool, error) {
+	window := t.DedupWindow()
+	if window <= 0 {
+		return msgs[0].ID, false, t.PutMessages(msgs)
+	}
+
+	id, dup := t.dedup.reserve(key, msgs[0].ID, window, time.Now())
+	if dup {
+		atomic.AddUint64(&t.dedupCount, 1)
+		return id, true, nil
+	}
+	err := t.PutMessages(msgs)
+	if err != nil {
+		t.dedup.release(key, id)
+		return id, false, err
+	}
+	return id, false, nil
+}
+
+// SetDedupWindow sets how long idempotency keys are remembered, a negative
+// window falls back to the nsqd default (--dedup-window) and 0 disables it
+func (t *Topic) SetDedupWindow(window time.Duration) {
+	if window < 0 {
+		window = -1
+	}
+	atomic.StoreInt64(&t.dedupWindow, int64(window))
+}
+
+// DedupWindow returns how long idempotency keys are remembered
+func (t *Topic) DedupWindow() time.Duration {
+	window, ok := t.dedupWindowOverride()
+	if !ok {
+		return t.ctx.nsqd.getOpts().DedupWindow
+	}
+	return window
+}
+
+// dedupWindowOverride returns the window set by SetDedupWindow, if any
+func (t *Topic) dedupWindowOverride() (time.Duration, bool) {
+	window := atomic.LoadInt64(&t.dedupWindow)
+	return time.Duration(window), window >= 0
+}
+
+// SetPartitions switches the topic to (or from, with 0) partitioned mode,
+// where messages with the same partition key are delivered by each channel
+// in publish order, one at a time
+//
+// the number of partitions can't be changed once the topic has channels
+func (t *Topic) SetPartitions(n int) error {
+	if n < 0 || n > maxPartitions {
+		return fmt.Errorf("invalid number of partitions %d (expected 0-%d)", n, maxPartitions)
+	}
+	t.Lock()
+	defer t.Unlock()
+	if n != t.Partitions() && len(t.channelMap) > 0 {
+		return errors.New("cannot change the partitions of a topic with channels")
+	}
+	atomic.StoreInt32(&t.partitions, int32(n))
+	return nil
+}
+
+// Partitions returns the number of partitions of the topic (0 if it isn't
+// partitioned)
+func (t *Topic) Partitions() int {
+	return int(atomic.LoadInt32(&t.partitions))
+}
+
+// SetPubRateLimit sets the maximum messages and bytes per second published
+// to the topic, 0 is unlimited
+func (t *Topic) SetPubRateLimit(msgs int64, bytes int64) {
+	atomic.StoreInt64(&t.pubRateLimit, msgs)
+	atomic.StoreInt64(&t.pubByteRateLimit, bytes)
+}
+
+// PubRateLimit returns the maximum messages and bytes per second published
+// to the topic
+func (t *Topic) PubRateLimit() (int64, int64) {
+	return atomic.LoadInt64(&t.pubRateLimit), atomic.LoadInt64(&t.pubByteRateLimit)
+}
+
+func (t *Topic) throttled(msgs int) {
+	atomic.AddUint64(&t.throttledCount, uint64(msgs))
+}
+
+// SetBacklogQuota bounds the backlog of the topic to maxMsgs messages and/or
+// maxBytes bytes on disk (0 is unlimited), policy (reject, drop_oldest or
+// drop_new, reject if empty) is what happens to publishes once it's full
+//
+// the bytes are only accounted for with the diskqueue backend
+func (t *Topic) SetBacklogQuota(maxMsgs int64, maxBytes int64, policy string) error {
+	q, err := newBacklogQuota(maxMsgs, maxBytes, policy)
+	if err != nil {
+		return err
+	}
+	t.quota.Store(q)
+	return nil
+}
+
+// BacklogQuota returns the backlog limits and overflow policy of the topic
+func (t *Topic) BacklogQuota() (int64, int64, string) {
+	return t.backlogQuota().values()
+}
+
+func (t *Topic) backlogQuota() *backlogQuota {
+	return t.quota.Load().(*backlogQuota)
+}
+
+// BacklogBytes returns the size of the backlog of the topic on disk
+func (t *Topic) BacklogBytes() int64 {
+	return backendSize(t.backend)
+}
+
+// checkBacklog returns errBacklogFull if n more messages don't fit in the
+// backlog of the topic, or in that of any of its channels, with the reject
+// overflow policy
+//
+// this expects the caller to handle locking
+func (t *Topic) checkBacklog(n int) error {
+	if t.backlogQuota().rejects(t.Depth(), t.BacklogBytes(), n) {
+		atomic.AddUint64(&t.overflowRejected, uint64(n))
+		return errBacklogFull{"topic " + t.name}
+	}
+	for _, c := range t.channelMap {
+		if c.backlogQuota().rejects(c.Depth(), c.BacklogBytes(), n) {
+			atomic.AddUint64(&c.overflowRejected, uint64(n))
+			return errBacklogFull{"channel " + c.name}
+		}
+	}
+	return nil
+}
+
+// makeRoom applies the overflow policy of the topic ahead of a message
+// being put, it returns false if the message is to be dropped
+func (t *Topic) makeRoom() bool {
+	q := t.backlogQuota()
+	depth := t.Depth()
+	if !q.full(depth, t.BacklogBytes()) {
+		return true
+	}
+	switch q.policy {
+	case overflowDropNew:
+		atomic.AddUint64(&t.overflowDropped, 1)
+		return false
+	case overflowDropOldest:
+		// the depth of a diskqueue lags behind its reads
+		for q.full(depth, t.BacklogBytes()) && dropQueued(t.backend, t.memoryMsgChan) {
+			atomic.AddUint64(&t.overflowDropped, 1)
+			depth--
+		}
+	}
+	return true
+}
+
 func (t *Topic) put(m *Message) error {
+	// partitioned topics must hand messages to the channels in publish
+	// order, so once a message goes to the backend all of those that follow
+	// have to until it has been drained (see messagePump)
+	if t.Partitions() > 0 && t.backend.Depth() > 0 {
+		return t.putBackend(m)
+	}
 	select {
 	case t.memoryMsgChan <- m: //如果内存消息channel未满，则写入，已满则写入文件
 	default:
-		b := bufferPoolGet()
-		err := writeMessageToBackend(b, m, t.backend)
-		bufferPoolPut(b)
-		t.ctx.nsqd.SetHealth(err)
+		return t.putBackend(m)
+	}
+	return nil
+}
+
+func (t *Topic) putBackend(m *Message) error {
+	b := bufferPoolGet()
+	err := writeMessageToBackend(b, m, t.backend)
+	bufferPoolPut(b)
+	t.ctx.nsqd.SetHealth(err)
+	if err != nil {
+		t.ctx.nsqd.logf(LOG_ERROR,
+			"TOPIC(%s) ERROR: failed to write message to backend - %s",
+			t.name, err)
+		return err
+	}
+	return nil
+}
+
+// scheduleMessage writes m to the schedule store for delivery at its
+// deliver_at time
+func (t *Topic) scheduleMessage(m *Message) error {
+	if t.schedule == nil {
+		return errors.New("scheduled delivery is not available")
+	}
+	err := t.schedule.add(m, m.deliverAt)
+	if err != nil {
+		t.ctx.nsqd.logf(LOG_ERROR,
+			"TOPIC(%s) ERROR: failed to schedule msg(%s) - %s",
+			t.name, m.ID, err)
+	}
+	return err
+}
+
+// deferMessage defers m by timeout, through the schedule store so that it
+// survives a restart, or in memory for an ephemeral topic (which has no store)
+func (t *Topic) deferMessage(m *Message, timeout time.Duration) {
+	if timeout <= 0 {
+		return
+	}
+	if t.schedule == nil {
+		m.deferred = timeout
+		return
+	}
+	m.deliverAt = m.Timestamp + int64(timeout)
+}
+
+// ScheduledCount returns the number of messages scheduled for later delivery
+func (t *Topic) ScheduledCount() int64 {
+	if t.schedule == nil {
+		return 0
+	}
+	return int64(t.schedule.Len())
+}
+
+// schedulePump puts the scheduled messages in the topic as they come due
+//
+// a message is only removed from the store once it's been put, so one may
+// be delivered again if nsqd dies in between
+func (t *Topic) schedulePump() {
+	timer := time.NewTimer(0)
+	defer timer.Stop()
+	for {
+		select {
+		case <-timer.C:
+		case <-t.schedule.updateChan:
+		case <-t.exitChan:
+			return
+		}
+		t.putScheduled()
+
+		if !timer.Stop() {
+			select {
+			case <-timer.C:
+			default:
+			}
+		}
+		if next, ok := t.schedule.next(); ok {
+			timer.Reset(time.Duration(next - time.Now().UnixNano()))
+		}
+	}
+}
+
+// putScheduled puts the scheduled messages that are due in the topic,
+// subject to its backlog quota
+func (t *Topic) putScheduled() {
+	for {
+		now := time.Now().UnixNano()
+		msg, name, err := t.schedule.pop(now)
+		if name == "" {
+			return
+		}
 		if err != nil {
 			t.ctx.nsqd.logf(LOG_ERROR,
-				"TOPIC(%s) ERROR: failed to write message to backend - %s",
-				t.name, err)
-			return err
+				"TOPIC(%s) ERROR: failed to read scheduled message %s - %s",
+				t.name, name, err)
+			t.schedule.remove(name)
+			continue
+		}
+
+		retained := *msg
+		t.RLock()
+		if t.makeRoom() {
+			err = t.put(msg)
+		}
+		if err == nil {
+			t.retain(&retained)
 		}
+		t.RUnlock()
+		if err != nil {
+			t.schedule.retry(name, now+int64(scheduleRetryDelay))
+			return
+		}
+		t.schedule.remove(name)
+	}
+}
+
+// retain appends m to the retention log (if enabled), failing to do so
+// does not fail the publish
+//
+// this expects the caller to handle locking
+func (t *Topic) retain(m *Message) {
+	if t.retention == nil {
+		return
 	}
+	err := t.retention.Append(m)
+	if err != nil {
+		t.ctx.nsqd.logf(LOG_ERROR,
+			"TOPIC(%s) ERROR: failed to append msg(%s) to retention log - %s",
+			t.name, m.ID, err)
+	}
+}
+
+// SetRetention enables retaining published messages for maxAge and/or up
+// to maxBytes so that they can be replayed with Rewind, both zero disables
+// retention and removes the retained messages
+func (t *Topic) SetRetention(maxAge time.Duration, maxBytes int64) error {
+	t.Lock()
+	defer t.Unlock()
+
+	if maxAge == 0 && maxBytes == 0 {
+		if t.retention == nil {
+			return nil
+		}
+		err := t.retention.Delete()
+		t.retention = nil
+		return err
+	}
+
+	if t.ephemeral {
+		return errors.New("ephemeral topics do not support retention")
+	}
+
+	opts := t.ctx.nsqd.getOpts()
+	if t.retention != nil {
+		t.retention.SetLimits(maxAge, maxBytes, opts.MaxBytesPerFile)
+		return nil
+	}
+
+	r, err := newRetentionLog(t.name, opts.DataPath, maxAge, maxBytes, opts.MaxBytesPerFile, t.ctx.nsqd.logf)
+	if err != nil {
+		return err
+	}
+	t.retention = r
 	return nil
 }
 
+// Retention returns the retention limits of the topic
+func (t *Topic) Retention() (time.Duration, int64) {
+	t.RLock()
+	defer t.RUnlock()
+	if t.retention == nil {
+		return 0, 0
+	}
+	return t.retention.Limits()
+}
+
+// Rewind re-delivers to channel every retained message published at or
+// after since, returning the number of messages delivered
+//
+// replayed messages are given new IDs (the originals may still be in
+// flight) but keep their original timestamp and headers
+func (t *Topic) Rewind(channel *Channel, since time.Time) (int64, error) {
+	t.RLock()
+	r := t.retention
+	t.RUnlock()
+	if r == nil {
+		return 0, errors.New("retention is not enabled")
+	}
+
+	var count int64
+	err := r.Replay(since.UnixNano(), func(msg *Message) error {
+		if !channel.matches(msg) {
+			return nil
+		}
+		m := NewMessage(t.GenerateID(), msg.Body)
+		m.Timestamp = msg.Timestamp
+		m.Headers = msg.Headers
+		m.Priority = msg.Priority
+		m.PartitionKey = msg.PartitionKey
+		m.Expires = msg.Expires
+		err := channel.PutMessage(m)
+		if err != nil {
+			return err
+		}
+		count++
+		return nil
+	})
+	return count, err
+}
+
 func (t *Topic) Depth() int64 {
 	return int64(len(t.memoryMsgChan)) + t.backend.Depth()
 }
@@ -277,6 +715,9 @@ func (t *Topic) messagePump() {
 		}
 		break
 	}
+	if t.schedule != nil {
+		t.waitGroup.Wrap(t.schedulePump)
+	}
 	t.RLock()
 	/**
 		这里为啥不直接用t.channelMap 而是重新赋值
@@ -297,9 +738,17 @@ func (t *Topic) messagePump() {
 
 	// main message loop
 	for {
+		// for partitioned topics every message in memory is older than
+		// those in the backend (see put) so it's drained first
+		if len(memoryMsgChan) > 0 && t.Partitions() > 0 {
+			msg = <-memoryMsgChan
+			goto route
+		}
+
 		select {
 		case msg = <-memoryMsgChan: //内存消息通过取出msg
 		case buf = <-backendChan:
+			backendRead(t.backend, buf)
 			msg, err = decodeMessage(buf)
 			if err != nil {
 				t.ctx.nsqd.logf(LOG_ERROR, "failed to decode message - %s", err)
@@ -334,7 +783,11 @@ func (t *Topic) messagePump() {
 			goto exit
 		}
 
+	route:
 		for i, channel := range chans {
+			if !channel.accepts(msg) {
+				continue
+			}
 			chanMsg := msg
 			// copy the message because each channel
 			// needs a unique instance but...
@@ -344,6 +797,10 @@ func (t *Topic) messagePump() {
 				//拷贝，不然各个channel的消息都是引用关系
 				chanMsg = NewMessage(msg.ID, msg.Body)
 				chanMsg.Timestamp = msg.Timestamp
+				chanMsg.Headers = msg.Headers
+				chanMsg.Priority = msg.Priority
+				chanMsg.PartitionKey = msg.PartitionKey
+				chanMsg.Expires = msg.Expires
 				chanMsg.deferred = msg.deferred
 			}
 			if chanMsg.deferred != 0 {
@@ -401,6 +858,12 @@ func (t *Topic) exit(deleted bool) error {
 		}
 		t.Unlock()
 
+		t.Lock()
+		if t.retention != nil {
+			t.retention.Delete()
+		}
+		t.Unlock()
+
 		// empty the queue (deletes the backend files, too)
 		t.Empty()
 		return t.backend.Delete()
@@ -415,6 +878,12 @@ func (t *Topic) exit(deleted bool) error {
 		}
 	}
 
+	t.Lock()
+	if t.retention != nil {
+		t.retention.Close()
+	}
+	t.Unlock()
+
 	// write anything leftover to disk
 	t.flush()
 	return t.backend.Close()
@@ -430,6 +899,9 @@ func (t *Topic) Empty() error {
 	}
 
 finish:
+	if t.schedule != nil {
+		t.schedule.Empty()
+	}
 	return t.backend.Empty()
 }
 
@@ -482,13 +954,36 @@ func (t *Topic) AggregateChannelE2eProcessingLatency() *quantile.Quantile {
 }
 
 func (t *Topic) Pause() error {
+	return t.PauseUntil(time.Time{})
+}
+
+// PauseUntil pauses the topic until resumeAt, or indefinitely if it's zero
+func (t *Topic) PauseUntil(resumeAt time.Time) error {
+	t.resume.set(resumeAt, t.autoResume)
 	return t.doPause(true)
 }
 
 func (t *Topic) UnPause() error {
+	t.resume.set(time.Time{}, nil)
 	return t.doPause(false)
 }
 
+// ResumeAt returns when the paused topic resumes, zero if it doesn't
+func (t *Topic) ResumeAt() time.Time {
+	return t.resume.get()
+}
+
+func (t *Topic) autoResume() {
+	if t.Exiting() {
+		return
+	}
+	t.ctx.nsqd.logf(LOG_INFO, "TOPIC(%s): resuming as scheduled", t.name)
+	t.doPause(false)
+	t.ctx.nsqd.Lock()
+	t.ctx.nsqd.PersistMetadata()
+	t.ctx.nsqd.Unlock()
+}
+
 func (t *Topic) doPause(pause bool) error {
 	if pause {
 		atomic.StoreInt32(&t.paused, 1)
@@ -239,3 +239,132 @@ func BenchmarkTopicToChannelPut(b *testing.B) {
 		runtime.Gosched()
 	}
 }
+
+func TestChannelFilter(t *testing.T) {
+	opts := NewOptions()
+	opts.Logger = test.NewTestLogger(t)
+	_, _, nsqd := mustStartNSQD(opts)
+	defer os.RemoveAll(opts.DataPath)
+	defer nsqd.Exit()
+
+	topicName := "test_channel_filter" + strconv.Itoa(int(time.Now().Unix()))
+	topic := nsqd.GetTopic(topicName)
+	all := topic.GetChannel("all")
+	orders := topic.GetChannel("orders")
+	err := orders.SetFilter("prefix:order")
+	test.Nil(t, err)
+
+	topic.PutMessage(NewMessage(topic.GenerateID(), []byte("order 1")))
+	topic.PutMessage(NewMessage(topic.GenerateID(), []byte("refund 1")))
+	topic.PutMessage(NewMessage(topic.GenerateID(), []byte("order 2")))
+
+	for i := 0; i < 3; i++ {
+		<-all.memoryMsgChan
+	}
+	msg := <-orders.memoryMsgChan
+	test.Equal(t, []byte("order 1"), msg.Body)
+	msg = <-orders.memoryMsgChan
+	test.Equal(t, []byte("order 2"), msg.Body)
+	test.Equal(t, int64(0), orders.Depth())
+	test.Equal(t, uint64(1), orders.filteredCount)
+
+	err = orders.SetFilter("")
+	test.Nil(t, err)
+	test.Equal(t, "", orders.Filter())
+}
+
+func TestTopicRetentionConcurrentDelivery(t *testing.T) {
+	opts := NewOptions()
+	opts.Logger = test.NewTestLogger(t)
+	_, _, nsqd := mustStartNSQD(opts)
+	defer os.RemoveAll(opts.DataPath)
+	defer nsqd.Exit()
+
+	topicName := "test_topic_retention_delivery" + strconv.Itoa(int(time.Now().Unix()))
+	topic := nsqd.GetTopic(topicName)
+	channel := topic.GetChannel("ch")
+	err := topic.SetRetention(time.Hour, 0)
+	test.Nil(t, err)
+
+	// delivered messages are updated (as by protocolV2.messagePump) while
+	// they're retained, which go test -race checks
+	done := make(chan struct{})
+	go func() {
+		for i := 0; i < 100; i++ {
+			msg := <-channel.memoryMsgChan
+			msg.Attempts++
+		}
+		close(done)
+	}()
+	for i := 0; i < 100; i++ {
+		err := topic.PutMessage(NewMessage(topic.GenerateID(), []byte("test")))
+		test.Nil(t, err)
+	}
+	<-done
+
+	count, _ := topic.retention.Stats()
+	test.Equal(t, int64(100), count)
+}
+
+func TestTopicRetentionRewind(t *testing.T) {
+	opts := NewOptions()
+	opts.Logger = test.NewTestLogger(t)
+	opts.MaxBytesPerFile = 1
+	_, _, nsqd := mustStartNSQD(opts)
+	defer os.RemoveAll(opts.DataPath)
+	defer nsqd.Exit()
+
+	topicName := "test_topic_retention" + strconv.Itoa(int(time.Now().Unix()))
+	topic := nsqd.GetTopic(topicName)
+	channel := topic.GetChannel("ch")
+	err := topic.SetRetention(time.Hour, 0)
+	test.Nil(t, err)
+
+	start := time.Now()
+	for i := 0; i < 5; i++ {
+		msg := NewMessage(topic.GenerateID(), []byte(fmt.Sprintf("msg %d", i)))
+		msg.Headers = map[string]string{"n": strconv.Itoa(i)}
+		topic.PutMessage(msg)
+	}
+	for i := 0; i < 5; i++ {
+		<-channel.memoryMsgChan
+	}
+
+	count, _ := topic.retention.Stats()
+	test.Equal(t, int64(5), count)
+	// small MaxBytesPerFile rolls a segment per message
+	test.Equal(t, 5, len(topic.retention.segments))
+
+	n, err := topic.Rewind(channel, start)
+	test.Nil(t, err)
+	test.Equal(t, int64(5), n)
+	for i := 0; i < 5; i++ {
+		msg := <-channel.memoryMsgChan
+		test.Equal(t, fmt.Sprintf("msg %d", i), string(msg.Body))
+		test.Equal(t, strconv.Itoa(i), msg.Headers["n"])
+	}
+
+	n, err = topic.Rewind(channel, time.Now().Add(time.Minute))
+	test.Nil(t, err)
+	test.Equal(t, int64(0), n)
+
+	// a byte limit prunes whole segments, oldest first
+	_, size := topic.retention.Stats()
+	err = topic.SetRetention(time.Hour, size/2)
+	test.Nil(t, err)
+	count, _ = topic.retention.Stats()
+	test.Equal(t, int64(2), count)
+
+	// the log is reloaded from disk
+	topic.retention.Close()
+	r, err := newRetentionLog(topicName, opts.DataPath, time.Hour, 0, opts.MaxBytesPerFile, nsqd.logf)
+	test.Nil(t, err)
+	count, _ = r.Stats()
+	test.Equal(t, int64(2), count)
+
+	err = topic.SetRetention(0, 0)
+	test.Nil(t, err)
+	test.Equal(t, (*retentionLog)(nil), topic.retention)
+	_, err = topic.Rewind(channel, start)
+	test.NotNil(t, err)
+}
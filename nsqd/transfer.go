@@ -0,0 +1,312 @@
+package nsqd
+
+import (
+	"errors"
+	"fmt"
+	"sync/atomic"
+	"time"
+)
+
+// the kinds of backlog transfers
+const (
+	transferMove = "move"
+	transferCopy = "copy"
+)
+
+// the states of a backlog transfer
+const (
+	transferRunning  = "running"
+	transferFinished = "finished"
+	transferFailed   = "failed"
+)
+
+var (
+	errTransferToSelf   = errors.New("cannot transfer a channel to itself or its topic")
+	errTransferRunning  = errors.New("a transfer is already running")
+	errMoveNotSupported = errors.New("move is not supported by partitioned topics")
+)
+
+// transferReadTimeout is how long a move waits on the backend of the
+// channel before checking again whether it has been emptied meanwhile
+// (i.e. read by its clients)
+const transferReadTimeout = 100 * time.Millisecond
+
+// backlogTransfer moves or copies the backlog (the queued messages, not
+// those in flight or deferred) of a channel to another channel or topic
+// on the same node, one message at a time
+//
+// the messages get new IDs, from the topic they're transferred to, and
+// keep their attempts when they go to a channel
+type backlogTransfer struct {
+	// 64bit atomic vars need to be first for proper alignment on 32bit platforms
+	done int64
+
+	kind  string
+	to    string
+	total int64
+	state atomic.Value
+	err   atomic.Value
+
+	dstTopic   *Topic
+	dstChannel *Channel
+}
+
+// StartTransfer starts moving (kind transferMove) or copying (kind
+// transferCopy) the backlog of the channel to the channel dstChannelName
+// of the topic dstTopicName, or to that topic if dstChannelName is empty,
+// which are created if need be
+//
+// it runs in the background, see TransferStats for its progress
+func (c *Channel) StartTransfer(kind string, dstTopicName string, dstChannelName string) (*TransferStats, error) {
+	if kind != transferMove && kind != transferCopy {
+		return nil, fmt.Errorf("unknown transfer %q", kind)
+	}
+	if dstTopicName == c.topicName && (dstChannelName == "" || dstChannelName == c.name) {
+		// the messages would (also) end up back in the channel
+		return nil, errTransferToSelf
+	}
+	if kind == transferMove && c.partitions != nil {
+		// the partitions read the backend
+		return nil, errMoveNotSupported
+	}
+
+	// the destination is only created once the transfer is accepted, and
+	// not under the lock of the channel (GetTopic takes the lock of nsqd)
+	c.RLock()
+	running := c.transferRunning()
+	c.RUnlock()
+	if running {
+		return nil, errTransferRunning
+	}
+	t := &backlogTransfer{
+		kind:     kind,
+		to:       dstTopicName,
+		dstTopic: c.ctx.nsqd.GetTopic(dstTopicName),
+	}
+	if dstChannelName != "" {
+		t.to += "/" + dstChannelName
+		t.dstChannel = t.dstTopic.GetChannel(dstChannelName)
+	}
+	t.state.Store(transferRunning)
+	t.err.Store("")
+
+	c.Lock()
+	defer c.Unlock()
+	if c.transferRunning() {
+		return nil, errTransferRunning
+	}
+	t.total = c.Depth()
+	c.transfer.Store(t)
+
+	go c.runTransfer(t)
+	return t.stats(), nil
+}
+
+// transferRunning returns true if a transfer of the backlog of the channel
+// is running
+func (c *Channel) transferRunning() bool {
+	last := c.transfer.Load().(*backlogTransfer)
+	return last != nil && last.state.Load().(string) == transferRunning
+}
+
+func (c *Channel) runTransfer(t *backlogTransfer) {
+	c.ctx.nsqd.logf(LOG_INFO, "CHANNEL(%s): %s of %d messages to %s started", c.name, t.kind, t.total, t.to)
+
+	var err error
+	if t.kind == transferMove {
+		err = c.moveBacklog(t)
+	} else {
+		err = c.copyBacklog(t)
+	}
+	if err != nil {
+		c.ctx.nsqd.logf(LOG_ERROR, "CHANNEL(%s): %s to %s failed after %d messages - %s",
+			c.name, t.kind, t.to, atomic.LoadInt64(&t.done), err)
+		t.err.Store(err.Error())
+		t.state.Store(transferFailed)
+		return
+	}
+	c.ctx.nsqd.logf(LOG_INFO, "CHANNEL(%s): %s of %d messages to %s finished",
+		c.name, t.kind, atomic.LoadInt64(&t.done), t.to)
+	t.state.Store(transferFinished)
+}
+
+// copyBacklog puts a copy of each message queued in the channel to the
+// destination, leaving them in place
+func (c *Channel) copyBacklog(t *backlogTransfer) error {
+	c.exitMutex.RLock()
+	if c.Exiting() {
+		c.exitMutex.RUnlock()
+		return errors.New("exiting")
+	}
+	var err error
+	if c.partitions != nil {
+		for _, msg := range c.partitions.messages() {
+			if c.isPurged(msg.ID) {
+				continue
+			}
+			if err = t.put(msg); err != nil {
+				break
+			}
+		}
+	} else {
+		// the copies are taken under the lock of the memory queues and
+		// put once it's released, so that the channel isn't held up by
+		// the destination
+		var copies []*Message
+		c.filterMemory(func(msg *Message) bool {
+			m := *msg
+			copies = append(copies, &m)
+			return true
+		})
+		for _, msg := range copies {
+			if err = t.put(msg); err != nil {
+				break
+			}
+		}
+	}
+	c.exitMutex.RUnlock()
+	if err != nil {
+		return err
+	}
+
+	// the backend is read straight from its files, the channel isn't held
+	// up meanwhile
+	scanErr := c.scanBackend(func(msg *Message) bool {
+		if c.Exiting() {
+			err = errors.New("exiting")
+			return false
+		}
+		err = t.put(msg)
+		return err == nil
+	})
+	if scanErr != nil {
+		return scanErr
+	}
+	return err
+}
+
+// moveBacklog takes the messages queued in the channel, as its clients
+// would, and puts them to the destination
+func (c *Channel) moveBacklog(t *backlogTransfer) error {
+	c.exitMutex.RLock()
+	if c.Exiting() {
+		c.exitMutex.RUnlock()
+		return errors.New("exiting")
+	}
+	// the messages are taken out under the lock of the memory queues and
+	// put once it's released, those that fail to be put go back in the
+	// channel
+	var taken []*Message
+	c.filterMemory(func(msg *Message) bool {
+		taken = append(taken, msg)
+		return false
+	})
+	var err error
+	for i, msg := range taken {
+		if err = t.put(msg); err != nil {
+			for _, msg := range taken[i:] {
+				c.put(msg)
+			}
+			break
+		}
+	}
+	c.exitMutex.RUnlock()
+	if err != nil {
+		return err
+	}
+
+	for {
+		done, err := c.moveNext(t)
+		if err != nil || done {
+			return err
+		}
+	}
+}
+
+// moveNext moves the next message in the backend, returning true once
+// it's empty
+//
+// exitMutex is held meanwhile so that a message read is never lost to the
+// channel exiting, a message that fails to be put goes back in the channel
+func (c *Channel) moveNext(t *backlogTransfer) (bool, error) {
+	c.exitMutex.RLock()
+	defer c.exitMutex.RUnlock()
+	if c.Exiting() {
+		return false, errors.New("exiting")
+	}
+	if c.backend.Depth() == 0 {
+		return true, nil
+	}
+
+	var b []byte
+	select {
+	case b = <-c.backend.ReadChan():
+	default:
+		select {
+		case b = <-c.backend.ReadChan():
+		case <-time.After(transferReadTimeout):
+			return false, nil
+		}
+	}
+	backendRead(c.backend, b)
+	msg, err := decodeMessage(b)
+	if err != nil {
+		c.ctx.nsqd.logf(LOG_ERROR, "failed to decode message - %s", err)
+		return false, nil
+	}
+	if c.dropPurged(msg) {
+		return false, nil
+	}
+	err = t.put(msg)
+	if err != nil {
+		c.put(msg)
+		return false, err
+	}
+	return false, nil
+}
+
+// put puts a copy of msg to the destination of the transfer
+func (t *backlogTransfer) put(msg *Message) error {
+	m := &Message{
+		ID:           t.dstTopic.GenerateID(),
+		Body:         msg.Body,
+		Timestamp:    msg.Timestamp,
+		Headers:      msg.Headers,
+		Priority:     msg.Priority,
+		PartitionKey: msg.PartitionKey,
+		Expires:      msg.Expires,
+	}
+	var err error
+	if t.dstChannel != nil {
+		m.Attempts = msg.Attempts
+		err = t.dstChannel.PutMessage(m)
+	} else {
+		err = t.dstTopic.PutMessage(m)
+	}
+	if err != nil {
+		return err
+	}
+	atomic.AddInt64(&t.done, 1)
+	return nil
+}
+
+func (t *backlogTransfer) stats() *TransferStats {
+	return &TransferStats{
+		Kind:  t.kind,
+		To:    t.to,
+		Done:  atomic.LoadInt64(&t.done),
+		Total: t.total,
+		State: t.state.Load().(string),
+		Error: t.err.Load().(string),
+	}
+}
+
+// TransferStats returns the progress of the running (or last) backlog
+// transfer of the channel, nil if there was none
+func (c *Channel) TransferStats() *TransferStats {
+	t := c.transfer.Load().(*backlogTransfer)
+	if t == nil {
+		return nil
+	}
+	return t.stats()
+}
@@ -0,0 +1,119 @@
+package nsqd
+
+import (
+	"os"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/nsqio/nsq/internal/test"
+)
+
+func waitTransfer(t *testing.T, c *Channel) *TransferStats {
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		stats := c.TransferStats()
+		if stats.State != transferRunning {
+			return stats
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("transfer still running - %+v", stats)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestChannelMoveBacklog(t *testing.T) {
+	opts := NewOptions()
+	opts.Logger = test.NewTestLogger(t)
+	opts.MemQueueSize = 2
+	_, _, nsqd := mustStartNSQD(opts)
+	defer os.RemoveAll(opts.DataPath)
+	defer nsqd.Exit()
+
+	topicName := "test_channel_move" + strconv.Itoa(int(time.Now().Unix()))
+	topic := nsqd.GetTopic(topicName)
+	channel := topic.GetChannel("old")
+
+	for i := 0; i < 10; i++ {
+		msg := NewMessage(topic.GenerateID(), []byte(strconv.Itoa(i)))
+		msg.Attempts = 1
+		err := channel.PutMessage(msg)
+		test.Nil(t, err)
+	}
+
+	_, err := channel.StartTransfer(transferMove, topicName, "old")
+	test.Equal(t, errTransferToSelf, err)
+
+	stats, err := channel.StartTransfer(transferMove, topicName, "new")
+	test.Nil(t, err)
+	test.Equal(t, int64(10), stats.Total)
+	stats = waitTransfer(t, channel)
+	test.Equal(t, transferFinished, stats.State)
+	test.Equal(t, int64(10), stats.Done)
+	test.Equal(t, int64(0), channel.Depth())
+
+	dst, err := topic.GetExistingChannel("new")
+	test.Nil(t, err)
+	test.Equal(t, int64(10), dst.Depth())
+	msgs, err := dst.Peek(10)
+	test.Nil(t, err)
+	test.Equal(t, uint16(1), msgs[0].Attempts)
+}
+
+func TestChannelCopyBacklog(t *testing.T) {
+	opts := NewOptions()
+	opts.Logger = test.NewTestLogger(t)
+	opts.MemQueueSize = 2
+	_, _, nsqd := mustStartNSQD(opts)
+	defer os.RemoveAll(opts.DataPath)
+	defer nsqd.Exit()
+
+	topicName := "test_channel_copy" + strconv.Itoa(int(time.Now().Unix()))
+	topic := nsqd.GetTopic(topicName)
+	channel := topic.GetChannel("ch")
+	dstTopic := nsqd.GetTopic(topicName + "_dst")
+	dstChannel := dstTopic.GetChannel("ch")
+
+	for i := 0; i < 10; i++ {
+		err := channel.PutMessage(NewMessage(topic.GenerateID(), []byte(strconv.Itoa(i))))
+		test.Nil(t, err)
+	}
+
+	_, err := channel.StartTransfer(transferCopy, topicName+"_dst", "")
+	test.Nil(t, err)
+	stats := waitTransfer(t, channel)
+	test.Equal(t, transferFinished, stats.State)
+	test.Equal(t, int64(10), stats.Done)
+	test.Equal(t, int64(10), channel.Depth())
+
+	for dstChannel.Depth() != 10 {
+		time.Sleep(time.Millisecond)
+	}
+	msgs, err := dstChannel.Peek(10)
+	test.Nil(t, err)
+	test.Equal(t, 10, len(msgs))
+	test.Equal(t, uint16(0), msgs[0].Attempts)
+}
+
+func TestChannelTransferRunning(t *testing.T) {
+	opts := NewOptions()
+	opts.Logger = test.NewTestLogger(t)
+	_, _, nsqd := mustStartNSQD(opts)
+	defer os.RemoveAll(opts.DataPath)
+	defer nsqd.Exit()
+
+	topicName := "test_channel_transfer_running" + strconv.Itoa(int(time.Now().Unix()))
+	channel := nsqd.GetTopic(topicName).GetChannel("ch")
+
+	running := &backlogTransfer{kind: transferCopy}
+	running.state.Store(transferRunning)
+	running.err.Store("")
+	channel.transfer.Store(running)
+
+	// the destination isn't created for a transfer that's refused
+	_, err := channel.StartTransfer(transferCopy, topicName+"_dst", "ch")
+	test.Equal(t, errTransferRunning, err)
+	_, err = nsqd.GetExistingTopic(topicName + "_dst")
+	test.NotNil(t, err)
+}
@@ -0,0 +1,233 @@
+package nsqlookupd
+
+import (
+	"strings"
+	"sync"
+	"time"
+)
+
+// clusterState is the part of the registration state that outlives
+// producer connections: the topics and channels that were created (via
+// the HTTP API or by an nsqd REGISTER), the ones that were deleted (via the
+// HTTP API or by the last nsqd UNREGISTER) and the producer tombstones
+//
+// every entry carries the (wall clock) time it last changed, so that the
+// state of peer nsqlookupd instances can be merged in any order and
+// converges: the most recent change to an entry wins and a deletion wins a
+// tie. It's persisted to --data-path and exchanged with the peers given by
+// --peer-http-address (see NSQLookupd.syncLoop).
+//
+// deletions are kept for --deletion-lifetime, and tombstones for
+// --tombstone-lifetime, so that they reach the peers, after which they're
+// dropped (see expire).
+type clusterState struct {
+	sync.Mutex
+
+	registrations map[Registration]registrationEntry
+	tombstones    map[tombstoneKey]int64
+
+	// set when the state changed since it was last persisted
+	dirty bool
+}
+
+type registrationEntry struct {
+	updatedAt int64
+	deleted   bool
+}
+
+type tombstoneKey struct {
+	topic string
+	node  string
+}
+
+// stateDoc is the state as persisted and served by GET /state
+type stateDoc struct {
+	Version       string            `json:"version"`
+	Registrations []registrationDoc `json:"registrations"`
+	Tombstones    []tombstoneDoc    `json:"tombstones"`
+}
+
+type registrationDoc struct {
+	Category  string `json:"category"`
+	Key       string `json:"key"`
+	SubKey    string `json:"subkey"`
+	UpdatedAt int64  `json:"updated_at"`
+	Deleted   bool   `json:"deleted"`
+}
+
+type tombstoneDoc struct {
+	Topic        string `json:"topic"`
+	Node         string `json:"node"`
+	TombstonedAt int64  `json:"tombstoned_at"`
+}
+
+func newClusterState() *clusterState {
+	return &clusterState{
+		registrations: make(map[Registration]registrationEntry),
+		tombstones:    make(map[tombstoneKey]int64),
+	}
+}
+
+// isEphemeralRegistration reports whether k is for an ephemeral topic or
+// channel, which only live as long as their producers and aren't tracked
+func isEphemeralRegistration(k Registration) bool {
+	return strings.HasSuffix(k.Key, "#ephemeral") || strings.HasSuffix(k.SubKey, "#ephemeral")
+}
+
+// set records the change of k at ts unless a more recent one is known,
+// returning whether it was recorded
+//
+// this expects the caller to handle locking
+func (s *clusterState) set(k Registration, deleted bool, ts int64) bool {
+	e, ok := s.registrations[k]
+	if ok && (e.updatedAt > ts || (e.updatedAt == ts && (e.deleted || !deleted))) {
+		return false
+	}
+	s.registrations[k] = registrationEntry{updatedAt: ts, deleted: deleted}
+	s.dirty = true
+	return true
+}
+
+// create records that k exists, unless it's already known to
+func (s *clusterState) create(k Registration, now time.Time) bool {
+	if isEphemeralRegistration(k) {
+		return false
+	}
+	s.Lock()
+	defer s.Unlock()
+	if e, ok := s.registrations[k]; ok && !e.deleted {
+		return false
+	}
+	return s.set(k, false, now.UnixNano())
+}
+
+// remove records that k was deleted
+func (s *clusterState) remove(k Registration, now time.Time) bool {
+	if isEphemeralRegistration(k) {
+		return false
+	}
+	s.Lock()
+	defer s.Unlock()
+	return s.set(k, true, now.UnixNano())
+}
+
+// tombstone records that the producer of topic at node (its
+// <broadcast_address>:<http_port>) was tombstoned
+func (s *clusterState) tombstone(topic string, node string, now time.Time) {
+	s.Lock()
+	defer s.Unlock()
+	s.tombstones[tombstoneKey{topic, node}] = now.UnixNano()
+	s.dirty = true
+}
+
+// tombstonedAt returns when the producer of topic at node was tombstoned,
+// if it was within lifetime
+func (s *clusterState) tombstonedAt(topic string, node string, lifetime time.Duration) (time.Time, bool) {
+	s.Lock()
+	defer s.Unlock()
+	ts, ok := s.tombstones[tombstoneKey{topic, node}]
+	if !ok || time.Since(time.Unix(0, ts)) >= lifetime {
+		return time.Time{}, false
+	}
+	return time.Unix(0, ts), true
+}
+
+// expire drops the tombstones and the deletions that are past their
+// lifetime
+func (s *clusterState) expire(tombstoneLifetime time.Duration, deletionLifetime time.Duration) {
+	s.Lock()
+	defer s.Unlock()
+	s.expireLocked(tombstoneLifetime, deletionLifetime)
+}
+
+// this expects the caller to handle locking
+func (s *clusterState) expireLocked(tombstoneLifetime time.Duration, deletionLifetime time.Duration) {
+	now := time.Now()
+	cutoff := now.Add(-deletionLifetime).UnixNano()
+	for k, e := range s.registrations {
+		if e.deleted && e.updatedAt < cutoff {
+			delete(s.registrations, k)
+			s.dirty = true
+		}
+	}
+	cutoff = now.Add(-tombstoneLifetime).UnixNano()
+	for k, ts := range s.tombstones {
+		if ts < cutoff {
+			delete(s.tombstones, k)
+			s.dirty = true
+		}
+	}
+}
+
+// snapshot returns the current state, dropping what expired
+func (s *clusterState) snapshot(tombstoneLifetime time.Duration, deletionLifetime time.Duration) *stateDoc {
+	s.Lock()
+	defer s.Unlock()
+
+	s.expireLocked(tombstoneLifetime, deletionLifetime)
+	doc := &stateDoc{
+		Registrations: []registrationDoc{},
+		Tombstones:    []tombstoneDoc{},
+	}
+	for k, e := range s.registrations {
+		doc.Registrations = append(doc.Registrations, registrationDoc{
+			Category:  k.Category,
+			Key:       k.Key,
+			SubKey:    k.SubKey,
+			UpdatedAt: e.updatedAt,
+			Deleted:   e.deleted,
+		})
+	}
+	for k, ts := range s.tombstones {
+		doc.Tombstones = append(doc.Tombstones, tombstoneDoc{
+			Topic:        k.topic,
+			Node:         k.node,
+			TombstonedAt: ts,
+		})
+	}
+	return doc
+}
+
+// merge applies the entries of doc that are more recent than the local
+// ones, returning those that were applied
+func (s *clusterState) merge(doc *stateDoc, tombstoneLifetime time.Duration, deletionLifetime time.Duration) ([]registrationDoc, []tombstoneDoc) {
+	s.Lock()
+	defer s.Unlock()
+
+	var registrations []registrationDoc
+	cutoff := time.Now().Add(-deletionLifetime).UnixNano()
+	for _, r := range doc.Registrations {
+		k := Registration{r.Category, r.Key, r.SubKey}
+		if (k.Category != "topic" && k.Category != "channel") || isEphemeralRegistration(k) {
+			continue
+		}
+		if r.Deleted && r.UpdatedAt < cutoff {
+			continue
+		}
+		if s.set(k, r.Deleted, r.UpdatedAt) {
+			registrations = append(registrations, r)
+		}
+	}
+
+	var tombstones []tombstoneDoc
+	cutoff = time.Now().Add(-tombstoneLifetime).UnixNano()
+	for _, t := range doc.Tombstones {
+		k := tombstoneKey{t.Topic, t.Node}
+		if t.TombstonedAt < cutoff || s.tombstones[k] >= t.TombstonedAt {
+			continue
+		}
+		s.tombstones[k] = t.TombstonedAt
+		s.dirty = true
+		tombstones = append(tombstones, t)
+	}
+	return registrations, tombstones
+}
+
+// takeDirty returns whether the state changed since the last call
+func (s *clusterState) takeDirty() bool {
+	s.Lock()
+	defer s.Unlock()
+	dirty := s.dirty
+	s.dirty = false
+	return dirty
+}
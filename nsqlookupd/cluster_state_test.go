@@ -0,0 +1,70 @@
+package nsqlookupd
+
+import (
+	"testing"
+	"time"
+
+	"github.com/nsqio/nsq/internal/test"
+)
+
+func TestClusterStateMerge(t *testing.T) {
+	now := time.Now()
+	topic := Registration{"topic", "a", ""}
+	channel := Registration{"channel", "a", "ch"}
+
+	s1 := newClusterState()
+	s2 := newClusterState()
+
+	test.Equal(t, true, s1.create(topic, now))
+	test.Equal(t, false, s1.create(topic, now.Add(time.Second)))
+	test.Equal(t, true, s1.create(channel, now))
+	test.Equal(t, false, s1.create(Registration{"channel", "a", "ch#ephemeral"}, now))
+
+	regs, _ := s2.merge(s1.snapshot(time.Minute, time.Hour), time.Minute, time.Hour)
+	test.Equal(t, 2, len(regs))
+	regs, _ = s2.merge(s1.snapshot(time.Minute, time.Hour), time.Minute, time.Hour)
+	test.Equal(t, 0, len(regs))
+
+	// the most recent change wins, regardless of the order of merges
+	s2.remove(channel, now.Add(2*time.Second))
+	s1.create(Registration{"topic", "b", ""}, now.Add(time.Second))
+	regs, _ = s1.merge(s2.snapshot(time.Minute, time.Hour), time.Minute, time.Hour)
+	test.Equal(t, 1, len(regs))
+	test.Equal(t, true, regs[0].Deleted)
+	s2.merge(s1.snapshot(time.Minute, time.Hour), time.Minute, time.Hour)
+	test.Equal(t, s1.registrations, s2.registrations)
+
+	// a deletion wins a tie
+	s1.remove(topic, now.Add(3*time.Second))
+	s2.set(topic, false, now.Add(3*time.Second).UnixNano())
+	s2.merge(s1.snapshot(time.Minute, time.Hour), time.Minute, time.Hour)
+	test.Equal(t, true, s2.registrations[topic].deleted)
+
+	// recreating a deleted registration
+	test.Equal(t, true, s2.create(topic, now.Add(4*time.Second)))
+	s1.merge(s2.snapshot(time.Minute, time.Hour), time.Minute, time.Hour)
+	test.Equal(t, false, s1.registrations[topic].deleted)
+
+	// tombstones, expired ones are dropped
+	s1.tombstone("a", "host:4151", now)
+	s1.tombstone("a", "host:4152", now.Add(-time.Hour))
+	_, tombstones := s2.merge(s1.snapshot(time.Minute, time.Hour), time.Minute, time.Hour)
+	test.Equal(t, 1, len(tombstones))
+	test.Equal(t, "host:4151", tombstones[0].Node)
+	ts, ok := s2.tombstonedAt("a", "host:4151", time.Minute)
+	test.Equal(t, true, ok)
+	test.Equal(t, now.UnixNano(), ts.UnixNano())
+	_, ok = s2.tombstonedAt("a", "host:4151", 0)
+	test.Equal(t, false, ok)
+
+	// deletions are forgotten once past their lifetime, and not merged
+	old := Registration{"topic", "c", ""}
+	s1.remove(old, now.Add(-2*time.Hour))
+	s1.expire(time.Minute, time.Hour)
+	_, ok = s1.registrations[old]
+	test.Equal(t, false, ok)
+	regs, _ = s2.merge(&stateDoc{Registrations: []registrationDoc{
+		{Category: "topic", Key: "c", UpdatedAt: now.Add(-2 * time.Hour).UnixNano(), Deleted: true},
+	}}, time.Minute, time.Hour)
+	test.Equal(t, 0, len(regs))
+}
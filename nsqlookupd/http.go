@@ -1,13 +1,15 @@
 package nsqlookupd
 
 import (
-	"fmt"
 	"net/http"
 	"net/http/pprof"
+	"strconv"
 	"sync/atomic"
+	"time"
 
 	"github.com/julienschmidt/httprouter"
 	"github.com/nsqio/nsq/internal/http_api"
+	"github.com/nsqio/nsq/internal/metrics"
 	"github.com/nsqio/nsq/internal/protocol"
 	"github.com/nsqio/nsq/internal/version"
 )
@@ -39,6 +41,8 @@ func newHTTPServer(ctx *Context) *httpServer {
 	router.Handle("GET", "/topics", http_api.Decorate(s.doTopics, log, http_api.V1))
 	router.Handle("GET", "/channels", http_api.Decorate(s.doChannels, log, http_api.V1))
 	router.Handle("GET", "/nodes", http_api.Decorate(s.doNodes, log, http_api.V1))
+	router.Handle("GET", "/metrics", http_api.Decorate(s.doMetrics, log, http_api.PlainText))
+	router.Handle("GET", "/state", http_api.Decorate(s.doState, log, http_api.V1))
 
 	// only v1
 	router.Handle("POST", "/topic/create", http_api.Decorate(s.doCreateTopic, log, http_api.V1))
@@ -121,6 +125,29 @@ func (s *httpServer) doLookup(w http.ResponseWriter, req *http.Request, ps httpr
 	producers := s.ctx.nsqlookupd.DB.FindProducers("topic", topicName, "")
 	producers = producers.FilterByActive(s.ctx.nsqlookupd.opts.InactiveProducerTimeout,
 		s.ctx.nsqlookupd.opts.TombstoneLifetime)
+
+	// consumers can ask for a balanced subset of the producers of a channel
+	if consumer, err := reqParams.Get("consumer"); err == nil {
+		channelName, err := reqParams.Get("channel")
+		if err != nil {
+			return nil, http_api.Err{400, "MISSING_ARG_CHANNEL"}
+		}
+
+		n := s.ctx.nsqlookupd.opts.ConsumerSubsetSize
+		if subset, err := reqParams.Get("subset"); err == nil {
+			n, err = strconv.Atoi(subset)
+			if err != nil || n < 0 {
+				return nil, http_api.Err{400, "INVALID_ARG_SUBSET"}
+			}
+		}
+
+		consumers := make(map[string]int64)
+		for _, p := range s.ctx.nsqlookupd.DB.FindProducers("channel", topicName, channelName) {
+			consumers[p.peerInfo.id] = p.Consumers()
+		}
+		producers = consumerSubset(consumer, producers, consumers, n)
+	}
+
 	return map[string]interface{}{
 		"channels":  channels,
 		"producers": producers.PeerInfo(),
@@ -144,7 +171,8 @@ func (s *httpServer) doCreateTopic(w http.ResponseWriter, req *http.Request, ps
 
 	s.ctx.nsqlookupd.logf(LOG_INFO, "DB: adding topic(%s)", topicName)
 	key := Registration{"topic", topicName, ""}
-	s.ctx.nsqlookupd.DB.AddRegistration(key)
+	s.ctx.nsqlookupd.addRegistration(key)
+	s.ctx.nsqlookupd.persistState()
 
 	return nil, nil
 }
@@ -163,14 +191,15 @@ func (s *httpServer) doDeleteTopic(w http.ResponseWriter, req *http.Request, ps
 	registrations := s.ctx.nsqlookupd.DB.FindRegistrations("channel", topicName, "*")
 	for _, registration := range registrations {
 		s.ctx.nsqlookupd.logf(LOG_INFO, "DB: removing channel(%s) from topic(%s)", registration.SubKey, topicName)
-		s.ctx.nsqlookupd.DB.RemoveRegistration(registration)
+		s.ctx.nsqlookupd.removeRegistration(registration)
 	}
 
 	registrations = s.ctx.nsqlookupd.DB.FindRegistrations("topic", topicName, "")
 	for _, registration := range registrations {
 		s.ctx.nsqlookupd.logf(LOG_INFO, "DB: removing topic(%s)", topicName)
-		s.ctx.nsqlookupd.DB.RemoveRegistration(registration)
+		s.ctx.nsqlookupd.removeRegistration(registration)
 	}
+	s.ctx.nsqlookupd.persistState()
 
 	return nil, nil
 }
@@ -192,13 +221,8 @@ func (s *httpServer) doTombstoneTopicProducer(w http.ResponseWriter, req *http.R
 	}
 
 	s.ctx.nsqlookupd.logf(LOG_INFO, "DB: setting tombstone for producer@%s of topic(%s)", node, topicName)
-	producers := s.ctx.nsqlookupd.DB.FindProducers("topic", topicName, "")
-	for _, p := range producers {
-		thisNode := fmt.Sprintf("%s:%d", p.peerInfo.BroadcastAddress, p.peerInfo.HTTPPort)
-		if thisNode == node {
-			p.Tombstone()
-		}
-	}
+	s.ctx.nsqlookupd.tombstoneProducer(topicName, node, time.Now())
+	s.ctx.nsqlookupd.persistState()
 
 	return nil, nil
 }
@@ -216,11 +240,12 @@ func (s *httpServer) doCreateChannel(w http.ResponseWriter, req *http.Request, p
 
 	s.ctx.nsqlookupd.logf(LOG_INFO, "DB: adding channel(%s) in topic(%s)", channelName, topicName)
 	key := Registration{"channel", topicName, channelName}
-	s.ctx.nsqlookupd.DB.AddRegistration(key)
+	s.ctx.nsqlookupd.addRegistration(key)
 
 	s.ctx.nsqlookupd.logf(LOG_INFO, "DB: adding topic(%s)", topicName)
 	key = Registration{"topic", topicName, ""}
-	s.ctx.nsqlookupd.DB.AddRegistration(key)
+	s.ctx.nsqlookupd.addRegistration(key)
+	s.ctx.nsqlookupd.persistState()
 
 	return nil, nil
 }
@@ -243,12 +268,21 @@ func (s *httpServer) doDeleteChannel(w http.ResponseWriter, req *http.Request, p
 
 	s.ctx.nsqlookupd.logf(LOG_INFO, "DB: removing channel(%s) from topic(%s)", channelName, topicName)
 	for _, registration := range registrations {
-		s.ctx.nsqlookupd.DB.RemoveRegistration(registration)
+		s.ctx.nsqlookupd.removeRegistration(registration)
 	}
+	s.ctx.nsqlookupd.persistState()
 
 	return nil, nil
 }
 
+// doState returns the registration state exchanged with peer nsqlookupds
+func (s *httpServer) doState(w http.ResponseWriter, req *http.Request, ps httprouter.Params) (interface{}, error) {
+	doc := s.ctx.nsqlookupd.state.snapshot(s.ctx.nsqlookupd.opts.TombstoneLifetime,
+		s.ctx.nsqlookupd.opts.DeletionLifetime)
+	doc.Version = version.Binary
+	return doc, nil
+}
+
 type node struct {
 	RemoteAddress    string   `json:"remote_address"`
 	Hostname         string   `json:"hostname"`
@@ -311,6 +345,7 @@ func (s *httpServer) doDebug(w http.ResponseWriter, req *http.Request, ps httpro
 	for r, producers := range s.ctx.nsqlookupd.DB.registrationMap {
 		key := r.Category + ":" + r.Key + ":" + r.SubKey
 		for _, p := range producers {
+			tombstoned, tombstonedAt := p.tombstoneState()
 			m := map[string]interface{}{
 				"id":                p.peerInfo.id,
 				"hostname":          p.peerInfo.Hostname,
@@ -319,8 +354,8 @@ func (s *httpServer) doDebug(w http.ResponseWriter, req *http.Request, ps httpro
 				"http_port":         p.peerInfo.HTTPPort,
 				"version":           p.peerInfo.Version,
 				"last_update":       atomic.LoadInt64(&p.peerInfo.lastUpdate),
-				"tombstoned":        p.tombstoned,
-				"tombstoned_at":     p.tombstonedAt.UnixNano(),
+				"tombstoned":        tombstoned,
+				"tombstoned_at":     tombstonedAt.UnixNano(),
 			}
 			data[key] = append(data[key], m)
 		}
@@ -328,3 +363,50 @@ func (s *httpServer) doDebug(w http.ResponseWriter, req *http.Request, ps httpro
 
 	return data, nil
 }
+
+// doMetrics exposes registration and peer counts in the Prometheus text format
+func (s *httpServer) doMetrics(w http.ResponseWriter, req *http.Request, ps httprouter.Params) (interface{}, error) {
+	db := s.ctx.nsqlookupd.DB
+	opts := s.ctx.nsqlookupd.opts
+	set := metrics.NewSet()
+
+	set.Gauge("nsq_lookupd_info", "nsqlookupd version", 1, "version", version.Binary)
+
+	peers := db.FindProducers("client", "", "")
+	set.Gauge("nsq_lookupd_peers", "nsqd peers connected to nsqlookupd", float64(len(peers)))
+	set.Gauge("nsq_lookupd_active_peers", "nsqd peers that pinged within the inactive producer timeout",
+		float64(len(peers.FilterByActive(opts.InactiveProducerTimeout, 0))))
+
+	topics := db.FindRegistrations("topic", "*", "").Keys()
+	set.Gauge("nsq_lookupd_topics", "Registered topics", float64(len(topics)))
+	set.Gauge("nsq_lookupd_channels", "Registered channels",
+		float64(len(db.FindRegistrations("channel", "*", "*"))))
+
+	for _, topic := range topics {
+		producers := db.FindProducers("topic", topic, "")
+		var tombstoned int
+		for _, p := range producers {
+			if p.IsTombstoned(opts.TombstoneLifetime) {
+				tombstoned++
+			}
+		}
+		set.Gauge("nsq_lookupd_topic_producers", "nsqd producers registered for the topic",
+			float64(len(producers)), "topic", topic)
+		set.Gauge("nsq_lookupd_topic_tombstoned_producers", "Tombstoned nsqd producers of the topic",
+			float64(tombstoned), "topic", topic)
+		set.Gauge("nsq_lookupd_topic_channels", "Channels registered for the topic",
+			float64(len(db.FindRegistrations("channel", topic, "*"))), "topic", topic)
+	}
+
+	for _, r := range db.FindRegistrations("channel", "*", "*") {
+		var consumers int64
+		for _, p := range db.FindProducers("channel", r.Key, r.SubKey) {
+			consumers += p.Consumers()
+		}
+		set.Gauge("nsq_lookupd_channel_consumers", "Consumers of the channel reported by its producers",
+			float64(consumers), "topic", r.Key, "channel", r.SubKey)
+	}
+
+	w.Header().Set("Content-Type", metrics.ContentType)
+	return set.String(), nil
+}
@@ -7,6 +7,7 @@ import (
 	"net/http"
 	"os"
 	"strconv"
+	"strings"
 	"testing"
 	"time"
 
@@ -482,3 +483,31 @@ func TestDeleteChannel(t *testing.T) {
 	t.Logf("%s", body)
 	test.Equal(t, []byte(""), body)
 }
+
+func TestMetrics(t *testing.T) {
+	dataPath, nsqds, nsqlookupd1 := bootstrapNSQCluster(t)
+	defer os.RemoveAll(dataPath)
+	defer nsqds[0].Exit()
+	defer nsqlookupd1.Exit()
+
+	topicName := "sampletopicA" + strconv.Itoa(int(time.Now().Unix()))
+	makeChannel(nsqlookupd1, topicName, "ch")
+
+	client := http.Client{}
+	url := fmt.Sprintf("http://%s/metrics", nsqlookupd1.RealHTTPAddr())
+	req, _ := http.NewRequest("GET", url, nil)
+	resp, err := client.Do(req)
+	test.Nil(t, err)
+	test.Equal(t, 200, resp.StatusCode)
+	body, _ := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+
+	t.Logf("%s", body)
+	for _, line := range []string{
+		"nsq_lookupd_peers 1",
+		"nsq_lookupd_active_peers 1",
+		fmt.Sprintf(`nsq_lookupd_topic_channels{topic="%s"} 1`, topicName),
+	} {
+		test.Equal(t, true, strings.Contains(string(body), line+"\n"))
+	}
+}
@@ -9,6 +9,7 @@ import (
 	"log"
 	"net"
 	"os"
+	"strconv"
 	"strings"
 	"sync/atomic"
 	"time"
@@ -137,18 +138,40 @@ func (p *LookupProtocolV1) REGISTER(client *ClientV1, reader *bufio.Reader, para
 		return nil, err
 	}
 
+	// an optional 3rd param is the number of consumers of the channel
+	consumers := int64(-1)
+	if channel != "" && len(params) >= 3 {
+		consumers, err = strconv.ParseInt(params[2], 10, 64)
+		if err != nil || consumers < 0 {
+			return nil, protocol.NewFatalClientErr(nil, "E_INVALID",
+				fmt.Sprintf("REGISTER consumer count '%s' is not valid", params[2]))
+		}
+	}
+
+	now := time.Now()
 	if channel != "" {
 		key := Registration{"channel", topic, channel}
 		if p.ctx.nsqlookupd.DB.AddProducer(key, &Producer{peerInfo: client.peerInfo}) {
 			p.ctx.nsqlookupd.logf(LOG_INFO, "DB: client(%s) REGISTER category:%s key:%s subkey:%s",
 				client, "channel", topic, channel)
 		}
+		if consumers >= 0 {
+			p.ctx.nsqlookupd.DB.SetConsumers(key, client.peerInfo.id, consumers)
+		}
+		p.ctx.nsqlookupd.state.create(key, now)
 	}
 	key := Registration{"topic", topic, ""}
-	if p.ctx.nsqlookupd.DB.AddProducer(key, &Producer{peerInfo: client.peerInfo}) {
+	producer := &Producer{peerInfo: client.peerInfo}
+	// the producer may have been tombstoned through a peer nsqlookupd
+	// before it registered here
+	if t, ok := p.ctx.nsqlookupd.state.tombstonedAt(topic, producer.node(), p.ctx.nsqlookupd.opts.TombstoneLifetime); ok {
+		producer.tombstoneAt(t)
+	}
+	if p.ctx.nsqlookupd.DB.AddProducer(key, producer) {
 		p.ctx.nsqlookupd.logf(LOG_INFO, "DB: client(%s) REGISTER category:%s key:%s subkey:%s",
 			client, "topic", topic, "")
 	}
+	p.ctx.nsqlookupd.state.create(key, now)
 
 	return []byte("OK"), nil
 }
@@ -174,6 +197,9 @@ func (p *LookupProtocolV1) UNREGISTER(client *ClientV1, reader *bufio.Reader, pa
 		if left == 0 && strings.HasSuffix(channel, "#ephemeral") {
 			p.ctx.nsqlookupd.DB.RemoveRegistration(key)
 		}
+		if removed && left == 0 {
+			p.ctx.nsqlookupd.state.remove(key, time.Now())
+		}
 	} else {
 		// no channel was specified so this is a topic unregistration
 		// remove all of the channel registrations...
@@ -181,11 +207,14 @@ func (p *LookupProtocolV1) UNREGISTER(client *ClientV1, reader *bufio.Reader, pa
 		// if anything is actually removed
 		registrations := p.ctx.nsqlookupd.DB.FindRegistrations("channel", topic, "*")
 		for _, r := range registrations {
-			removed, _ := p.ctx.nsqlookupd.DB.RemoveProducer(r, client.peerInfo.id)
+			removed, left := p.ctx.nsqlookupd.DB.RemoveProducer(r, client.peerInfo.id)
 			if removed {
 				p.ctx.nsqlookupd.logf(LOG_WARN, "client(%s) unexpected UNREGISTER category:%s key:%s subkey:%s",
 					client, "channel", topic, r.SubKey)
 			}
+			if removed && left == 0 {
+				p.ctx.nsqlookupd.state.remove(r, time.Now())
+			}
 		}
 
 		key := Registration{"topic", topic, ""}
@@ -197,6 +226,9 @@ func (p *LookupProtocolV1) UNREGISTER(client *ClientV1, reader *bufio.Reader, pa
 		if left == 0 && strings.HasSuffix(topic, "#ephemeral") {
 			p.ctx.nsqlookupd.DB.RemoveRegistration(key)
 		}
+		if removed && left == 0 {
+			p.ctx.nsqlookupd.state.remove(key, time.Now())
+		}
 	}
 
 	return []byte("OK"), nil
@@ -1,11 +1,16 @@
 package nsqlookupd
 
 import (
+	"encoding/json"
 	"fmt"
+	"io/ioutil"
 	"log"
+	"math/rand"
 	"net"
 	"os"
+	"path"
 	"sync"
+	"time"
 
 	"github.com/nsqio/nsq/internal/http_api"
 	"github.com/nsqio/nsq/internal/protocol"
@@ -13,6 +18,11 @@ import (
 	"github.com/nsqio/nsq/internal/version"
 )
 
+const (
+	syncConnectTimeout = 2 * time.Second
+	syncRequestTimeout = 5 * time.Second
+)
+
 type NSQLookupd struct {
 	sync.RWMutex
 	opts         *Options //配置参数
@@ -21,6 +31,11 @@ type NSQLookupd struct {
 	tcpServer    *tcpServer //tcp服务
 	waitGroup    util.WaitGroupWrapper
 	DB           *RegistrationDB //注册DB
+
+	// registration state persisted and exchanged with peers
+	state    *clusterState
+	httpcli  *http_api.Client
+	exitChan chan int
 }
 
 func New(opts *Options) (*NSQLookupd, error) {
@@ -31,14 +46,26 @@ func New(opts *Options) (*NSQLookupd, error) {
 		opts.Logger = log.New(os.Stderr, opts.LogPrefix, log.Ldate|log.Ltime|log.Lmicroseconds)
 	}
 
+	if opts.SyncInterval <= 0 {
+		return nil, fmt.Errorf("--sync-interval (%s) must be positive", opts.SyncInterval)
+	}
+
 	l := &NSQLookupd{
-		opts: opts,
-		DB:   NewRegistrationDB(),
+		opts:     opts,
+		DB:       NewRegistrationDB(),
+		state:    newClusterState(),
+		httpcli:  http_api.NewClient(nil, syncConnectTimeout, syncRequestTimeout),
+		exitChan: make(chan int),
 	}
 
 	//打印版本
 	l.logf(LOG_INFO, version.String("nsqlookupd"))
 
+	err = l.LoadState()
+	if err != nil {
+		return nil, fmt.Errorf("failed to load state - %s", err)
+	}
+
 	//tcp监听
 	l.tcpListener, err = net.Listen("tcp", opts.TCPAddress)
 	if err != nil {
@@ -89,6 +116,8 @@ func (l *NSQLookupd) Main() error {
 		exitFunc(http_api.Serve(l.httpListener, httpServer, "HTTP", l.logf))
 	})
 
+	l.waitGroup.Wrap(l.syncLoop)
+
 	err := <-exitCh
 	return err
 }
@@ -116,6 +145,157 @@ func (l *NSQLookupd) Exit() {
 	if l.httpListener != nil {
 		l.httpListener.Close()
 	}
+	close(l.exitChan)
+
 	//由于tcp协程和http协程可能还有连接 正在处理，等待处理完成
 	l.waitGroup.Wait()
+
+	l.persistState()
+}
+
+func stateFile(opts *Options) string {
+	return path.Join(opts.DataPath, "nsqlookupd.dat")
+}
+
+// LoadState restores the registration state persisted to --data-path
+func (l *NSQLookupd) LoadState() error {
+	if l.opts.DataPath == "" {
+		return nil
+	}
+
+	fn := stateFile(l.opts)
+	data, err := ioutil.ReadFile(fn)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return fmt.Errorf("failed to read state from %s - %s", fn, err)
+	}
+
+	var doc stateDoc
+	err = json.Unmarshal(data, &doc)
+	if err != nil {
+		return fmt.Errorf("failed to parse state file %s - %s", fn, err)
+	}
+
+	l.applyState(l.state.merge(&doc, l.opts.TombstoneLifetime, l.opts.DeletionLifetime))
+	l.state.takeDirty()
+	return nil
+}
+
+// PersistState writes the registration state to --data-path
+func (l *NSQLookupd) PersistState() error {
+	if l.opts.DataPath == "" {
+		return nil
+	}
+
+	fn := stateFile(l.opts)
+	l.logf(LOG_INFO, "DB: persisting state to %s", fn)
+
+	doc := l.state.snapshot(l.opts.TombstoneLifetime, l.opts.DeletionLifetime)
+	doc.Version = version.Binary
+	data, err := json.Marshal(doc)
+	if err != nil {
+		return err
+	}
+
+	tmpFileName := fmt.Sprintf("%s.%d.tmp", fn, rand.Int())
+	f, err := os.OpenFile(tmpFileName, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return err
+	}
+	_, err = f.Write(data)
+	if err == nil {
+		err = f.Sync()
+	}
+	f.Close()
+	if err != nil {
+		return err
+	}
+	return os.Rename(tmpFileName, fn)
+}
+
+// persistState persists the state if it changed, logging failures
+func (l *NSQLookupd) persistState() {
+	if !l.state.takeDirty() {
+		return
+	}
+	err := l.PersistState()
+	if err != nil {
+		l.logf(LOG_ERROR, "failed to persist state - %s", err)
+	}
+}
+
+// addRegistration adds k to the DB and records it in the state
+func (l *NSQLookupd) addRegistration(k Registration) {
+	l.DB.AddRegistration(k)
+	l.state.create(k, time.Now())
+}
+
+// removeRegistration removes k from the DB and records its deletion in
+// the state
+func (l *NSQLookupd) removeRegistration(k Registration) {
+	l.DB.RemoveRegistration(k)
+	l.state.remove(k, time.Now())
+}
+
+// tombstoneProducer tombstones the producer of topic at node and records
+// it in the state
+func (l *NSQLookupd) tombstoneProducer(topic string, node string, t time.Time) {
+	producers := l.DB.FindProducers("topic", topic, "")
+	for _, p := range producers {
+		if p.node() == node {
+			p.tombstoneAt(t)
+		}
+	}
+	l.state.tombstone(topic, node, t)
+}
+
+// applyState applies the changes merged into the state to the DB
+func (l *NSQLookupd) applyState(registrations []registrationDoc, tombstones []tombstoneDoc) {
+	for _, r := range registrations {
+		k := Registration{r.Category, r.Key, r.SubKey}
+		if r.Deleted {
+			l.logf(LOG_INFO, "DB: removing category:%s key:%s subkey:%s (synced)", k.Category, k.Key, k.SubKey)
+			l.DB.RemoveRegistration(k)
+		} else {
+			l.DB.AddRegistration(k)
+		}
+	}
+	for _, t := range tombstones {
+		l.logf(LOG_INFO, "DB: setting tombstone for producer@%s of topic(%s) (synced)", t.Node, t.Topic)
+		for _, p := range l.DB.FindProducers("topic", t.Topic, "") {
+			if p.node() == t.Node {
+				p.tombstoneAt(time.Unix(0, t.TombstonedAt))
+			}
+		}
+	}
+}
+
+// syncLoop periodically merges the state of the --peer-http-address peers
+// and persists the state when it changed
+func (l *NSQLookupd) syncLoop() {
+	ticker := time.NewTicker(l.opts.SyncInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+		case <-l.exitChan:
+			return
+		}
+
+		for _, addr := range l.opts.PeerHTTPAddresses {
+			var doc stateDoc
+			endpoint := fmt.Sprintf("http://%s/state", addr)
+			err := l.httpcli.GETV1(endpoint, &doc)
+			if err != nil {
+				l.logf(LOG_WARN, "SYNC: failed to get state from peer(%s) - %s", addr, err)
+				continue
+			}
+			l.applyState(l.state.merge(&doc, l.opts.TombstoneLifetime, l.opts.DeletionLifetime))
+		}
+		l.state.expire(l.opts.TombstoneLifetime, l.opts.DeletionLifetime)
+		l.persistState()
+	}
 }
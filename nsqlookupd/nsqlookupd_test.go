@@ -2,7 +2,9 @@ package nsqlookupd
 
 import (
 	"fmt"
+	"io/ioutil"
 	"net"
+	"os"
 	"testing"
 	"time"
 
@@ -357,3 +359,211 @@ func TestTombstonedNodes(t *testing.T) {
 	test.Equal(t, topicName, producers[0].Topics[0].Topic)
 	test.Equal(t, true, producers[0].Topics[0].Tombstoned)
 }
+
+func TestConsumerLookup(t *testing.T) {
+	opts := NewOptions()
+	opts.Logger = test.NewTestLogger(t)
+	tcpAddr, httpAddr, nsqlookupd := mustStartLookupd(opts)
+	defer nsqlookupd.Exit()
+
+	topicName := "consumer_lookup"
+
+	for i := 0; i < 4; i++ {
+		conn := mustConnectLookupd(t, tcpAddr)
+		defer conn.Close()
+
+		ci := map[string]interface{}{
+			"tcp_port":          TCPPort + i,
+			"http_port":         HTTPPort + i,
+			"broadcast_address": HostAddr,
+			"hostname":          HostAddr,
+			"version":           NSQDVersion,
+		}
+		cmd, _ := nsq.Identify(ci)
+		_, err := cmd.WriteTo(conn)
+		test.Nil(t, err)
+		_, err = nsq.ReadResponse(conn)
+		test.Nil(t, err)
+
+		// the first producer is already overloaded
+		consumers := "0"
+		if i == 0 {
+			consumers = "10"
+		}
+		cmd = &nsq.Command{
+			Name:   []byte("REGISTER"),
+			Params: [][]byte{[]byte(topicName), []byte("channel1"), []byte(consumers)},
+		}
+		_, err = cmd.WriteTo(conn)
+		test.Nil(t, err)
+		_, err = nsq.ReadResponse(conn)
+		test.Nil(t, err)
+	}
+
+	client := http_api.NewClient(nil, ConnectTimeout, RequestTimeout)
+
+	lr := LookupDoc{}
+	endpoint := fmt.Sprintf("http://%s/lookup?topic=%s", httpAddr, topicName)
+	err := client.GETV1(endpoint, &lr)
+	test.Nil(t, err)
+	test.Equal(t, 4, len(lr.Producers))
+
+	endpoint = fmt.Sprintf("http://%s/lookup?topic=%s&channel=channel1&consumer=c1&subset=2",
+		httpAddr, topicName)
+	err = client.GETV1(endpoint, &lr)
+	test.Nil(t, err)
+	test.Equal(t, 2, len(lr.Producers))
+	for _, p := range lr.Producers {
+		test.NotEqual(t, TCPPort, p.TCPPort)
+	}
+
+	endpoint = fmt.Sprintf("http://%s/lookup?topic=%s&consumer=c1", httpAddr, topicName)
+	err = client.GETV1(endpoint, &lr)
+	test.NotNil(t, err)
+}
+
+func TestStatePersistence(t *testing.T) {
+	dataPath, err := ioutil.TempDir("", "nsqlookupd-test-")
+	test.Nil(t, err)
+	defer os.RemoveAll(dataPath)
+
+	opts := NewOptions()
+	opts.Logger = test.NewTestLogger(t)
+	opts.DataPath = dataPath
+	_, httpAddr, nsqlookupd := mustStartLookupd(opts)
+
+	client := http_api.NewClient(nil, ConnectTimeout, RequestTimeout)
+	for _, endpoint := range []string{
+		"/topic/create?topic=persisted",
+		"/channel/create?topic=persisted&channel=ch",
+		"/topic/create?topic=deleted",
+		"/topic/delete?topic=deleted",
+	} {
+		err := client.POSTV1(fmt.Sprintf("http://%s%s", httpAddr, endpoint))
+		test.Nil(t, err)
+	}
+	nsqlookupd.Exit()
+
+	opts = NewOptions()
+	opts.Logger = test.NewTestLogger(t)
+	opts.DataPath = dataPath
+	_, httpAddr, nsqlookupd = mustStartLookupd(opts)
+	defer nsqlookupd.Exit()
+
+	var tr TopicsDoc
+	err = client.GETV1(fmt.Sprintf("http://%s/topics", httpAddr), &tr)
+	test.Nil(t, err)
+	test.Equal(t, []interface{}{"persisted"}, tr.Topics)
+
+	var cr ChannelsDoc
+	err = client.GETV1(fmt.Sprintf("http://%s/channels?topic=persisted", httpAddr), &cr)
+	test.Nil(t, err)
+	test.Equal(t, []interface{}{"ch"}, cr.Channels)
+}
+
+func TestStateUnregister(t *testing.T) {
+	dataPath, err := ioutil.TempDir("", "nsqlookupd-test-")
+	test.Nil(t, err)
+	defer os.RemoveAll(dataPath)
+
+	opts := NewOptions()
+	opts.Logger = test.NewTestLogger(t)
+	opts.DataPath = dataPath
+	tcpAddr, httpAddr, nsqlookupd := mustStartLookupd(opts)
+
+	topicName := "unregistered"
+	conn := mustConnectLookupd(t, tcpAddr)
+	identify(t, conn)
+	for _, cmd := range []*nsq.Command{
+		nsq.Register(topicName, "ch"),
+		nsq.UnRegister(topicName, "ch"),
+		nsq.UnRegister(topicName, ""),
+	} {
+		cmd.WriteTo(conn)
+		_, err = nsq.ReadResponse(conn)
+		test.Nil(t, err)
+	}
+	conn.Close()
+
+	// the deletions by the last producer are recorded, for the peers
+	client := http_api.NewClient(nil, ConnectTimeout, RequestTimeout)
+	var doc stateDoc
+	err = client.GETV1(fmt.Sprintf("http://%s/state", httpAddr), &doc)
+	test.Nil(t, err)
+	test.Equal(t, 2, len(doc.Registrations))
+	for _, r := range doc.Registrations {
+		test.Equal(t, true, r.Deleted)
+	}
+	nsqlookupd.Exit()
+
+	opts = NewOptions()
+	opts.Logger = test.NewTestLogger(t)
+	opts.DataPath = dataPath
+	_, httpAddr, nsqlookupd = mustStartLookupd(opts)
+	defer nsqlookupd.Exit()
+
+	var tr TopicsDoc
+	err = client.GETV1(fmt.Sprintf("http://%s/topics", httpAddr), &tr)
+	test.Nil(t, err)
+	test.Equal(t, 0, len(tr.Topics))
+}
+
+func TestPeerSync(t *testing.T) {
+	opts := NewOptions()
+	opts.Logger = test.NewTestLogger(t)
+	tcpAddr1, httpAddr1, nsqlookupd1 := mustStartLookupd(opts)
+	defer nsqlookupd1.Exit()
+
+	opts = NewOptions()
+	opts.Logger = test.NewTestLogger(t)
+	opts.PeerHTTPAddresses = []string{httpAddr1.String()}
+	opts.SyncInterval = 10 * time.Millisecond
+	tcpAddr2, httpAddr2, nsqlookupd2 := mustStartLookupd(opts)
+	defer nsqlookupd2.Exit()
+
+	topicName := "peer_sync"
+
+	// the same producer registered with both
+	for _, addr := range []*net.TCPAddr{tcpAddr1, tcpAddr2} {
+		conn := mustConnectLookupd(t, addr)
+		defer conn.Close()
+		identify(t, conn)
+		nsq.Register(topicName, "").WriteTo(conn)
+		_, err := nsq.ReadResponse(conn)
+		test.Nil(t, err)
+	}
+
+	client := http_api.NewClient(nil, ConnectTimeout, RequestTimeout)
+	waitFor := func(endpoint string, v interface{}, cond func() bool) {
+		for i := 0; i < 100; i++ {
+			err := client.GETV1(fmt.Sprintf("http://%s%s", httpAddr2, endpoint), v)
+			test.Nil(t, err)
+			if cond() {
+				return
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+		t.Fatalf("%s never converged", endpoint)
+	}
+
+	err := client.POSTV1(fmt.Sprintf("http://%s/channel/create?topic=%s&channel=ch", httpAddr1, topicName))
+	test.Nil(t, err)
+	var cr ChannelsDoc
+	waitFor("/channels?topic="+topicName, &cr, func() bool {
+		return len(cr.Channels) == 1 && cr.Channels[0] == "ch"
+	})
+
+	err = client.POSTV1(fmt.Sprintf("http://%s/topic/tombstone?topic=%s&node=%s:%d",
+		httpAddr1, topicName, HostAddr, HTTPPort))
+	test.Nil(t, err)
+	var lr LookupDoc
+	waitFor("/lookup?topic="+topicName, &lr, func() bool {
+		return len(lr.Producers) == 0
+	})
+
+	err = client.POSTV1(fmt.Sprintf("http://%s/channel/delete?topic=%s&channel=ch", httpAddr1, topicName))
+	test.Nil(t, err)
+	waitFor("/channels?topic="+topicName, &cr, func() bool {
+		return len(cr.Channels) == 0
+	})
+}
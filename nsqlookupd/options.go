@@ -19,6 +19,13 @@ type Options struct {
 
 	InactiveProducerTimeout time.Duration `flag:"inactive-producer-timeout"`
 	TombstoneLifetime       time.Duration `flag:"tombstone-lifetime"`
+
+	ConsumerSubsetSize int `flag:"consumer-subset-size"`
+
+	DataPath          string        `flag:"data-path"`
+	PeerHTTPAddresses []string      `flag:"peer-http-address" cfg:"peer_http_addresses"`
+	SyncInterval      time.Duration `flag:"sync-interval"`
+	DeletionLifetime  time.Duration `flag:"deletion-lifetime"`
 }
 
 func NewOptions() *Options {
@@ -37,5 +44,11 @@ func NewOptions() *Options {
 
 		InactiveProducerTimeout: 300 * time.Second,
 		TombstoneLifetime:       45 * time.Second,
+
+		ConsumerSubsetSize: 3,
+
+		PeerHTTPAddresses: make([]string, 0),
+		SyncInterval:      15 * time.Second,
+		DeletionLifetime:  24 * time.Hour,
 	}
 }
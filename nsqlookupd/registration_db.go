@@ -32,9 +32,17 @@ type PeerInfo struct {
 }
 
 type Producer struct {
-	peerInfo     *PeerInfo
-	tombstoned   bool
-	tombstonedAt time.Time
+	peerInfo *PeerInfo
+
+	// tombstoned and tombstonedAt are set by the HTTP API and the peer syncs
+	// while lookups read them
+	tombstoneMutex sync.RWMutex
+	tombstoned     bool
+	tombstonedAt   time.Time
+
+	// for channel registrations, the number of consumers the producer
+	// last reported for the channel
+	consumers int64
 }
 
 type Producers []*Producer
@@ -45,15 +53,42 @@ func (p *Producer) String() string {
 	return fmt.Sprintf("%s [%d, %d]", p.peerInfo.BroadcastAddress, p.peerInfo.TCPPort, p.peerInfo.HTTPPort)
 }
 
+// Consumers returns the number of consumers the producer reported for the
+// channel (0 for topic registrations)
+func (p *Producer) Consumers() int64 {
+	return atomic.LoadInt64(&p.consumers)
+}
+
+// node returns the <broadcast_address>:<http_port> identifying the producer
+// in /topic/tombstone requests
+func (p *Producer) node() string {
+	return fmt.Sprintf("%s:%d", p.peerInfo.BroadcastAddress, p.peerInfo.HTTPPort)
+}
+
 func (p *Producer) Tombstone() {
+	p.tombstoneAt(time.Now())
+}
+
+func (p *Producer) tombstoneAt(t time.Time) {
+	p.tombstoneMutex.Lock()
 	p.tombstoned = true
-	p.tombstonedAt = time.Now()
+	p.tombstonedAt = t
+	p.tombstoneMutex.Unlock()
 }
 
 func (p *Producer) IsTombstoned(lifetime time.Duration) bool {
+	p.tombstoneMutex.RLock()
+	defer p.tombstoneMutex.RUnlock()
 	return p.tombstoned && time.Now().Sub(p.tombstonedAt) < lifetime
 }
 
+// tombstoneState returns whether the producer was tombstoned and when
+func (p *Producer) tombstoneState() (bool, time.Time) {
+	p.tombstoneMutex.RLock()
+	defer p.tombstoneMutex.RUnlock()
+	return p.tombstoned, p.tombstonedAt
+}
+
 //注册DB实例化
 func NewRegistrationDB() *RegistrationDB {
 	return &RegistrationDB{
@@ -88,6 +123,19 @@ func (r *RegistrationDB) AddProducer(k Registration, p *Producer) bool {
 	return !found
 }
 
+// SetConsumers records the number of consumers a producer reported for a
+// channel registration, returning false if it isn't registered
+func (r *RegistrationDB) SetConsumers(k Registration, id string, count int64) bool {
+	r.RLock()
+	defer r.RUnlock()
+	producer, ok := r.registrationMap[k][id]
+	if !ok {
+		return false
+	}
+	atomic.StoreInt64(&producer.consumers, count)
+	return true
+}
+
 // remove a producer from a registration
 func (r *RegistrationDB) RemoveProducer(k Registration, id string) (bool, int) {
 	r.Lock()
@@ -15,10 +15,10 @@ func TestRegistrationDB(t *testing.T) {
 	pi1 := &PeerInfo{beginningOfTime.UnixNano(), "1", "remote_addr:1", "host", "b_addr", 1, 2, "v1"}
 	pi2 := &PeerInfo{beginningOfTime.UnixNano(), "2", "remote_addr:2", "host", "b_addr", 2, 3, "v1"}
 	pi3 := &PeerInfo{beginningOfTime.UnixNano(), "3", "remote_addr:3", "host", "b_addr", 3, 4, "v1"}
-	p1 := &Producer{pi1, false, beginningOfTime}
-	p2 := &Producer{pi2, false, beginningOfTime}
-	p3 := &Producer{pi3, false, beginningOfTime}
-	p4 := &Producer{pi1, false, beginningOfTime}
+	p1 := &Producer{peerInfo: pi1, tombstonedAt: beginningOfTime}
+	p2 := &Producer{peerInfo: pi2, tombstonedAt: beginningOfTime}
+	p3 := &Producer{peerInfo: pi3, tombstonedAt: beginningOfTime}
+	p4 := &Producer{peerInfo: pi1, tombstonedAt: beginningOfTime}
 
 	db := NewRegistrationDB()
 
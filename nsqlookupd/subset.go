@@ -0,0 +1,49 @@
+package nsqlookupd
+
+import (
+	"hash/fnv"
+	"sort"
+	"strconv"
+)
+
+// consumerSubset returns the (at most) n producers a consumer should
+// connect to, so that a large fleet of consumers spreads evenly across
+// producers instead of every consumer connecting to every producer
+//
+// producers are ranked by rendezvous hashing of the consumer ID and the
+// producer address, which keeps each consumer's subset stable as the
+// producer set changes. The top 2n candidates are then ordered by the
+// number of consumers they reported for the channel (see REGISTER), so
+// that load imbalances left over by the hashing are corrected.
+func consumerSubset(consumer string, producers Producers, consumers map[string]int64, n int) Producers {
+	if n <= 0 || len(producers) <= n {
+		return producers
+	}
+
+	type candidate struct {
+		producer *Producer
+		score    uint64
+		load     int64
+	}
+	candidates := make([]candidate, len(producers))
+	for i, p := range producers {
+		addr := p.peerInfo.BroadcastAddress + ":" + strconv.Itoa(p.peerInfo.TCPPort)
+		h := fnv.New64a()
+		h.Write([]byte(consumer))
+		h.Write([]byte{0})
+		h.Write([]byte(addr))
+		candidates[i] = candidate{p, h.Sum64(), consumers[p.peerInfo.id]}
+	}
+
+	sort.Slice(candidates, func(i, j int) bool { return candidates[i].score > candidates[j].score })
+	if len(candidates) > 2*n {
+		candidates = candidates[:2*n]
+	}
+	sort.SliceStable(candidates, func(i, j int) bool { return candidates[i].load < candidates[j].load })
+
+	subset := make(Producers, n)
+	for i := range subset {
+		subset[i] = candidates[i].producer
+	}
+	return subset
+}
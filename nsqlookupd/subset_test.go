@@ -0,0 +1,56 @@
+package nsqlookupd
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/nsqio/nsq/internal/test"
+)
+
+func TestConsumerSubset(t *testing.T) {
+	var producers Producers
+	for i := 0; i < 10; i++ {
+		producers = append(producers, &Producer{peerInfo: &PeerInfo{
+			id:               fmt.Sprintf("id%d", i),
+			BroadcastAddress: fmt.Sprintf("host%d", i),
+			TCPPort:          4150,
+		}})
+	}
+
+	subset := consumerSubset("consumer1", producers, nil, 3)
+	test.Equal(t, 3, len(subset))
+	test.Equal(t, subset, consumerSubset("consumer1", producers, nil, 3))
+
+	// removing a producer that isn't in the subset doesn't change it
+	var others Producers
+	for _, p := range producers {
+		if p != subset[0] && p != subset[1] && p != subset[2] {
+			others = append(others, p)
+		}
+	}
+	test.Equal(t, subset, consumerSubset("consumer1", append(Producers{subset[0], subset[1], subset[2]}, others[1:]...), nil, 3))
+
+	// the most loaded candidate is skipped
+	consumers := map[string]int64{subset[0].peerInfo.id: 100}
+	loaded := consumerSubset("consumer1", producers, consumers, 3)
+	test.Equal(t, 3, len(loaded))
+	for _, p := range loaded {
+		test.NotEqual(t, subset[0], p)
+	}
+
+	// consumers spread across producers
+	counts := make(map[*Producer]int)
+	for i := 0; i < 1000; i++ {
+		for _, p := range consumerSubset(fmt.Sprintf("consumer%d", i), producers, nil, 3) {
+			counts[p]++
+		}
+	}
+	test.Equal(t, 10, len(counts))
+	for _, count := range counts {
+		if count < 200 || count > 400 {
+			t.Fatalf("unbalanced subsets %v", counts)
+		}
+	}
+
+	test.Equal(t, producers, consumerSubset("consumer1", producers, nil, 0))
+}